@@ -0,0 +1,8 @@
+module github.com/cloudbees/cloud-bill-saas/common
+
+go 1.12
+
+require (
+	github.com/jefferyfry/funclog v0.0.0-20191010235000-f6a0246169e0
+	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
+)
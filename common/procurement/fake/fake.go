@@ -0,0 +1,547 @@
+//Package fake is an in-memory marketplace for running the signup flow without GCP. It serves the procurement API
+//and partner subscriptions from an httptest server, moves accounts and entitlements through their states as the real
+//marketplace does and records the Pub/Sub events each change would publish.
+package fake
+
+import (
+	"encoding/json"
+	"github.com/cloudbees/cloud-bill-saas/common/procurement"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Account and entitlement states
+const (
+	AccountActivationRequested = "ACCOUNT_ACTIVATION_REQUESTED"
+	AccountActive              = "ACCOUNT_ACTIVE"
+
+	EntitlementActivationRequested       = "ENTITLEMENT_ACTIVATION_REQUESTED"
+	EntitlementActive                    = "ENTITLEMENT_ACTIVE"
+	EntitlementPendingPlanChangeApproval = "ENTITLEMENT_PENDING_PLAN_CHANGE_APPROVAL"
+	EntitlementPendingCancellation       = "ENTITLEMENT_PENDING_CANCELLATION"
+	EntitlementCancelled                 = "ENTITLEMENT_CANCELLED"
+)
+
+//SignupApproval is the account approval the frontend grants after signup.
+const SignupApproval = "signup"
+
+//Event is a marketplace Pub/Sub message, in the JSON form the pubsub service receives.
+type Event struct {
+	EventId     string       `json:"eventId"`
+	EventType   string       `json:"eventType"`
+	Entitlement *EventEntity `json:"entitlement,omitempty"`
+	Account     *EventEntity `json:"account,omitempty"`
+}
+
+type EventEntity struct {
+	Id         string `json:"id"`
+	UpdateTime string `json:"updateTime"`
+}
+
+//Server is a fake marketplace for one partner. Its methods are safe for concurrent use with the requests it serves.
+type Server struct {
+	*httptest.Server
+	partnerId string
+
+	mutex        sync.Mutex
+	accounts     map[string]*procurement.Account
+	entitlements map[string]*procurement.Entitlement
+	events       []Event
+}
+
+//NewServer starts a fake marketplace for partnerId. Close it when done.
+func NewServer(partnerId string) *Server {
+	srv := &Server{
+		partnerId:    partnerId,
+		accounts:     map[string]*procurement.Account{},
+		entitlements: map[string]*procurement.Entitlement{},
+	}
+	srv.Server = httptest.NewServer(http.HandlerFunc(srv.serveHTTP))
+	return srv
+}
+
+//Client returns a procurement client for the server. The server URL is also the root url of both APIs for services
+//configured with it.
+func (srv *Server) Client() procurement.Client {
+	return procurement.NewClientWithHTTPClient(srv.URL, srv.URL, srv.partnerId, srv.Server.Client())
+}
+
+//Purchase creates the account, if it does not exist, and an entitlement for product and plan as a customer buying
+//the product does. Both wait for approval and an ENTITLEMENT_CREATION_REQUESTED event is recorded.
+func (srv *Server) Purchase(accountId string, entitlementId string, product string, plan string) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	now := timestamp()
+	if _, ok := srv.accounts[accountId]; !ok {
+		srv.accounts[accountId] = &procurement.Account{
+			Id:         accountId,
+			Name:       srv.accountName(accountId),
+			Provider:   srv.partnerId,
+			State:      AccountActivationRequested,
+			Approvals:  []procurement.Approval{{Name: SignupApproval, State: "PENDING", UpdateTime: now}},
+			CreateTime: now,
+			UpdateTime: now,
+		}
+	}
+	srv.entitlements[entitlementId] = &procurement.Entitlement{
+		Id:               entitlementId,
+		Name:             "providers/" + srv.partnerId + "/entitlements/" + entitlementId,
+		Account:          srv.accountName(accountId),
+		Provider:         srv.partnerId,
+		Product:          product,
+		Plan:             plan,
+		State:            EntitlementActivationRequested,
+		UsageReportingId: "usage-" + entitlementId,
+		CreateTime:       now,
+		UpdateTime:       now,
+	}
+	srv.entitlementEvent("ENTITLEMENT_CREATION_REQUESTED", entitlementId, now)
+}
+
+//RequestPlanChange starts a customer's change of an entitlement to plan and records an
+//ENTITLEMENT_PLAN_CHANGE_REQUESTED event. It returns false if the entitlement is not active.
+func (srv *Server) RequestPlanChange(entitlementId string, plan string) bool {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	entitlement, ok := srv.entitlements[entitlementId]
+	if !ok || entitlement.State != EntitlementActive {
+		return false
+	}
+	now := timestamp()
+	entitlement.NewPendingPlan = plan
+	entitlement.State = EntitlementPendingPlanChangeApproval
+	entitlement.UpdateTime = now
+	srv.entitlementEvent("ENTITLEMENT_PLAN_CHANGE_REQUESTED", entitlementId, now)
+	return true
+}
+
+//CancelPlanChange withdraws a customer's pending plan change and records an ENTITLEMENT_PLAN_CHANGE_CANCELLED event.
+//It returns false if the entitlement has no pending plan change.
+func (srv *Server) CancelPlanChange(entitlementId string) bool {
+	return srv.changeEntitlement(entitlementId, EntitlementPendingPlanChangeApproval, EntitlementActive, "ENTITLEMENT_PLAN_CHANGE_CANCELLED")
+}
+
+//RequestCancellation cancels an active entitlement at the end of its term and records an
+//ENTITLEMENT_PENDING_CANCELLATION event. It returns false if the entitlement is not active.
+func (srv *Server) RequestCancellation(entitlementId string) bool {
+	return srv.changeEntitlement(entitlementId, EntitlementActive, EntitlementPendingCancellation, "ENTITLEMENT_PENDING_CANCELLATION")
+}
+
+//RevertCancellation withdraws a pending cancellation and records an ENTITLEMENT_CANCELLATION_REVERTED event. It
+//returns false if the entitlement is not pending cancellation.
+func (srv *Server) RevertCancellation(entitlementId string) bool {
+	return srv.changeEntitlement(entitlementId, EntitlementPendingCancellation, EntitlementActive, "ENTITLEMENT_CANCELLATION_REVERTED")
+}
+
+//Renew starts a new term of an active entitlement and records an ENTITLEMENT_RENEWED event. It returns false if the
+//entitlement is not active.
+func (srv *Server) Renew(entitlementId string) bool {
+	return srv.changeEntitlement(entitlementId, EntitlementActive, EntitlementActive, "ENTITLEMENT_RENEWED")
+}
+
+//Cancel cancels an entitlement and records an ENTITLEMENT_CANCELLED event. It returns false if the entitlement does
+//not exist.
+func (srv *Server) Cancel(entitlementId string) bool {
+	return srv.changeEntitlement(entitlementId, "", EntitlementCancelled, "ENTITLEMENT_CANCELLED")
+}
+
+//DeleteEntitlement removes an entitlement and records an ENTITLEMENT_DELETED event. It returns false if the
+//entitlement does not exist.
+func (srv *Server) DeleteEntitlement(entitlementId string) bool {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if _, ok := srv.entitlements[entitlementId]; !ok {
+		return false
+	}
+	delete(srv.entitlements, entitlementId)
+	srv.entitlementEvent("ENTITLEMENT_DELETED", entitlementId, timestamp())
+	return true
+}
+
+//DeleteAccount removes an account and records an ACCOUNT_DELETED event. Its entitlements are kept, as they are in
+//the marketplace until they are deleted themselves. It returns false if the account does not exist.
+func (srv *Server) DeleteAccount(accountId string) bool {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if _, ok := srv.accounts[accountId]; !ok {
+		return false
+	}
+	delete(srv.accounts, accountId)
+	srv.events = append(srv.events, Event{
+		EventId:   srv.nextEventId(),
+		EventType: "ACCOUNT_DELETED",
+		Account:   &EventEntity{Id: accountId, UpdateTime: timestamp()},
+	})
+	return true
+}
+
+//changeEntitlement moves an entitlement from state, or from any state if from is empty, to state to and records an
+//event. A pending plan is cleared unless the entitlement stays pending plan change approval.
+func (srv *Server) changeEntitlement(entitlementId string, from string, to string, eventType string) bool {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	entitlement, ok := srv.entitlements[entitlementId]
+	if !ok || (from != "" && entitlement.State != from) {
+		return false
+	}
+	now := timestamp()
+	entitlement.State = to
+	if to != EntitlementPendingPlanChangeApproval {
+		entitlement.NewPendingPlan = ""
+	}
+	entitlement.UpdateTime = now
+	srv.entitlementEvent(eventType, entitlementId, now)
+	return true
+}
+
+//PutAccount adds or replaces an account without recording an event.
+func (srv *Server) PutAccount(account procurement.Account) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.accounts[account.Id] = &account
+}
+
+//PutEntitlement adds or replaces an entitlement without recording an event.
+func (srv *Server) PutEntitlement(entitlement procurement.Entitlement) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.entitlements[entitlement.Id] = &entitlement
+}
+
+//Account returns a copy of an account and whether it exists.
+func (srv *Server) Account(accountId string) (procurement.Account, bool) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if account, ok := srv.accounts[accountId]; ok {
+		return *account, true
+	}
+	return procurement.Account{}, false
+}
+
+//Entitlement returns a copy of an entitlement and whether it exists.
+func (srv *Server) Entitlement(entitlementId string) (procurement.Entitlement, bool) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if entitlement, ok := srv.entitlements[entitlementId]; ok {
+		return *entitlement, true
+	}
+	return procurement.Entitlement{}, false
+}
+
+//Events returns the events recorded so far, oldest first. Each event is JSON the pubsub service can replay.
+func (srv *Server) Events() []Event {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return append([]Event{}, srv.events...)
+}
+
+func (srv *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if strings.HasPrefix(path, procurement.SubscriptionPrefix) || path == "partnerSubscriptions" {
+		srv.serveSubscriptions(w, r, strings.TrimPrefix(strings.TrimPrefix(path, "partnerSubscriptions"), "/"))
+		return
+	}
+	providerPrefix := "providers/" + srv.partnerId + "/"
+	if !strings.HasPrefix(path, providerPrefix) {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "unknown resource "+r.URL.Path)
+		return
+	}
+	//resource names end in an optional :method, as in accounts/123:approve, and lists have no id, as in accounts
+	parts := strings.SplitN(strings.TrimPrefix(path, providerPrefix), "/", 2)
+	if len(parts) == 1 {
+		parts = append(parts, "")
+	}
+	id, method := parts[1], ""
+	if i := strings.Index(id, ":"); i >= 0 {
+		id, method = id[:i], id[i+1:]
+	}
+	switch parts[0] {
+	case "accounts":
+		srv.serveAccounts(w, r, id, method)
+	case "entitlements":
+		srv.serveEntitlements(w, r, id, method)
+	default:
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "unknown resource "+r.URL.Path)
+	}
+}
+
+func (srv *Server) serveAccounts(w http.ResponseWriter, r *http.Request, id string, method string) {
+	if id == "" && method == "" && r.Method == http.MethodGet {
+		ids, nextPageToken, ok := page(srv.accountIds(), r)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid page token")
+			return
+		}
+		accounts := []procurement.Account{}
+		for _, accountId := range ids {
+			accounts = append(accounts, *srv.accounts[accountId])
+		}
+		writeJSON(w, struct {
+			Accounts      []procurement.Account `json:"accounts"`
+			NextPageToken string                `json:"nextPageToken,omitempty"`
+		}{accounts, nextPageToken})
+		return
+	}
+	account, ok := srv.accounts[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "account "+id+" not found")
+		return
+	}
+	now := timestamp()
+	switch {
+	case method == "" && r.Method == http.MethodGet:
+		writeJSON(w, account)
+	case method == "approve" && r.Method == http.MethodPost:
+		body := struct {
+			ApprovalName string `json:"approvalName"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ApprovalName == "" {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "approvalName is required")
+			return
+		}
+		approved := false
+		for i := range account.Approvals {
+			if account.Approvals[i].Name == body.ApprovalName {
+				account.Approvals[i].State = "APPROVED"
+				account.Approvals[i].UpdateTime = now
+				approved = true
+			}
+		}
+		if !approved {
+			writeError(w, http.StatusBadRequest, "FAILED_PRECONDITION", "account "+id+" has no approval "+body.ApprovalName)
+			return
+		}
+		if account.State != AccountActive {
+			account.State = AccountActive
+			srv.events = append(srv.events, Event{
+				EventId:   srv.nextEventId(),
+				EventType: AccountActive,
+				Account:   &EventEntity{Id: id, UpdateTime: now},
+			})
+		}
+		account.UpdateTime = now
+		writeJSON(w, struct{}{})
+	case method == "reset" && r.Method == http.MethodPost:
+		for i := range account.Approvals {
+			account.Approvals[i].State = "PENDING"
+			account.Approvals[i].UpdateTime = now
+		}
+		account.State = AccountActivationRequested
+		account.UpdateTime = now
+		writeJSON(w, struct{}{})
+	default:
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", r.Method+" "+method+" is not supported for accounts")
+	}
+}
+
+func (srv *Server) serveEntitlements(w http.ResponseWriter, r *http.Request, id string, method string) {
+	if id == "" && method == "" && r.Method == http.MethodGet {
+		ids, nextPageToken, ok := page(srv.entitlementIds(), r)
+		if !ok {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid page token")
+			return
+		}
+		entitlements := []procurement.Entitlement{}
+		for _, entitlementId := range ids {
+			entitlements = append(entitlements, *srv.entitlements[entitlementId])
+		}
+		writeJSON(w, struct {
+			Entitlements  []procurement.Entitlement `json:"entitlements"`
+			NextPageToken string                    `json:"nextPageToken,omitempty"`
+		}{entitlements, nextPageToken})
+		return
+	}
+	entitlement, ok := srv.entitlements[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "entitlement "+id+" not found")
+		return
+	}
+	now := timestamp()
+	switch {
+	case method == "" && r.Method == http.MethodGet:
+		writeJSON(w, entitlement)
+	case method == "approve" && r.Method == http.MethodPost:
+		if entitlement.State != EntitlementActivationRequested {
+			writeError(w, http.StatusBadRequest, "FAILED_PRECONDITION", "entitlement "+id+" is "+entitlement.State)
+			return
+		}
+		entitlement.State = EntitlementActive
+		entitlement.UpdateTime = now
+		srv.entitlementEvent(EntitlementActive, id, now)
+		writeJSON(w, struct{}{})
+	case method == "approvePlanChange" && r.Method == http.MethodPost:
+		body := struct {
+			PendingPlanName string `json:"pendingPlanName"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid request body")
+			return
+		}
+		if entitlement.State != EntitlementPendingPlanChangeApproval || body.PendingPlanName != entitlement.NewPendingPlan {
+			writeError(w, http.StatusBadRequest, "FAILED_PRECONDITION", "entitlement "+id+" is "+entitlement.State+" with pending plan "+entitlement.NewPendingPlan)
+			return
+		}
+		entitlement.Plan = entitlement.NewPendingPlan
+		entitlement.NewPendingPlan = ""
+		entitlement.State = EntitlementActive
+		entitlement.UpdateTime = now
+		srv.entitlementEvent("ENTITLEMENT_PLAN_CHANGED", id, now)
+		writeJSON(w, struct{}{})
+	case method == "reject" && r.Method == http.MethodPost:
+		body := struct {
+			Reason string `json:"reason"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid request body")
+			return
+		}
+		if entitlement.State != EntitlementActivationRequested {
+			writeError(w, http.StatusBadRequest, "FAILED_PRECONDITION", "entitlement "+id+" is "+entitlement.State)
+			return
+		}
+		entitlement.State = EntitlementCancelled
+		entitlement.MessageToUser = body.Reason
+		entitlement.UpdateTime = now
+		srv.entitlementEvent("ENTITLEMENT_CANCELLED", id, now)
+		writeJSON(w, struct{}{})
+	case method == "rejectPlanChange" && r.Method == http.MethodPost:
+		body := struct {
+			PendingPlanName string `json:"pendingPlanName"`
+			Reason          string `json:"reason"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "invalid request body")
+			return
+		}
+		if entitlement.State != EntitlementPendingPlanChangeApproval || body.PendingPlanName != entitlement.NewPendingPlan {
+			writeError(w, http.StatusBadRequest, "FAILED_PRECONDITION", "entitlement "+id+" is "+entitlement.State+" with pending plan "+entitlement.NewPendingPlan)
+			return
+		}
+		entitlement.NewPendingPlan = ""
+		entitlement.State = EntitlementActive
+		entitlement.MessageToUser = body.Reason
+		entitlement.UpdateTime = now
+		srv.entitlementEvent("ENTITLEMENT_PLAN_CHANGE_CANCELLED", id, now)
+		writeJSON(w, struct{}{})
+	default:
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", r.Method+" "+method+" is not supported for entitlements")
+	}
+}
+
+//serveSubscriptions serves each entitlement as a partner subscription named after it.
+func (srv *Server) serveSubscriptions(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", r.Method+" is not supported for subscriptions")
+		return
+	}
+	if id != "" {
+		if entitlement, ok := srv.entitlements[id]; ok {
+			writeJSON(w, srv.subscription(entitlement))
+		} else {
+			writeError(w, http.StatusNotFound, "NOT_FOUND", "subscription "+id+" not found")
+		}
+		return
+	}
+	accountId := r.URL.Query().Get("externalAccountId")
+	subscriptions := procurement.PartnerSubscriptions{}
+	for _, entitlementId := range srv.entitlementIds() {
+		if entitlement := srv.entitlements[entitlementId]; entitlement.Account == srv.accountName(accountId) {
+			subscriptions.Subscriptions = append(subscriptions.Subscriptions, srv.subscription(entitlement))
+		}
+	}
+	writeJSON(w, subscriptions)
+}
+
+func (srv *Server) subscription(entitlement *procurement.Entitlement) procurement.Subscription {
+	return procurement.Subscription{
+		Name:              procurement.SubscriptionPrefix + entitlement.Id,
+		ExternalAccountId: strings.TrimPrefix(entitlement.Account, "providers/"+srv.partnerId+"/accounts/"),
+		Status:            strings.TrimPrefix(entitlement.State, "ENTITLEMENT_"),
+		SubscribedResources: []procurement.SubscribedResource{{
+			SubscriptionProvider: srv.partnerId,
+			Resource:             entitlement.Product,
+		}},
+		CreateTime: entitlement.CreateTime,
+		UpdateTime: entitlement.UpdateTime,
+	}
+}
+
+func (srv *Server) accountName(accountId string) string {
+	return "providers/" + srv.partnerId + "/accounts/" + accountId
+}
+
+func (srv *Server) entitlementEvent(eventType string, entitlementId string, now string) {
+	srv.events = append(srv.events, Event{
+		EventId:     srv.nextEventId(),
+		EventType:   eventType,
+		Entitlement: &EventEntity{Id: entitlementId, UpdateTime: now},
+	})
+}
+
+func (srv *Server) nextEventId() string {
+	return "fake-event-" + strconv.Itoa(len(srv.events)+1)
+}
+
+//accountIds and entitlementIds return ids in order so lists are stable.
+func (srv *Server) accountIds() []string {
+	ids := []string{}
+	for id := range srv.accounts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (srv *Server) entitlementIds() []string {
+	ids := []string{}
+	for id := range srv.entitlements {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func timestamp() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+//pageSize is the number of accounts or entitlements in each page of a list, small so clients have to page.
+const pageSize = 2
+
+//page returns the ids in the page of a list given by the pageToken parameter, which is the index of the first id, and
+//the token of the next page. It returns false if the token is invalid.
+func page(ids []string, r *http.Request) ([]string, string, bool) {
+	start := 0
+	if pageToken := r.URL.Query().Get("pageToken"); pageToken != "" {
+		var err error
+		if start, err = strconv.Atoi(pageToken); err != nil || start < 0 || start > len(ids) {
+			return nil, "", false
+		}
+	}
+	if start+pageSize >= len(ids) {
+		return ids[start:], "", true
+	}
+	return ids[start : start+pageSize], strconv.Itoa(start + pageSize), true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+//writeError writes an error in the format of the Google APIs.
+func writeError(w http.ResponseWriter, code int, status string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": message, "status": status},
+	})
+}
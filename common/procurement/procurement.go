@@ -0,0 +1,345 @@
+//Package procurement is a client for the Cloud Commerce Procurement API and the partner subscriptions of the Cloud
+//Billing API, which the marketplace uses for accounts and entitlements. It is shared by every service that calls the
+//marketplace.
+package procurement
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/jefferyfry/funclog"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"strings"
+)
+
+var (
+	LogI = funclog.NewInfoLogger("INFO: ")
+	LogE = funclog.NewErrorLogger("ERROR: ")
+)
+
+//Client calls the marketplace APIs. Account and entitlement ids are the last segment of their resource names.
+type Client interface {
+	GetAccount(ctx context.Context, accountId string) (*Account, error)
+	//ListAccounts returns every account of the partner.
+	ListAccounts(ctx context.Context) ([]Account, error)
+	//ApproveAccount approves the named approval, such as signup, of an account.
+	ApproveAccount(ctx context.Context, accountId string, approvalName string) error
+	//ResetAccount resets an account so the customer can sign up again.
+	ResetAccount(ctx context.Context, accountId string) error
+
+	GetEntitlement(ctx context.Context, entitlementId string) (*Entitlement, error)
+	//ListEntitlements returns every entitlement of the partner.
+	ListEntitlements(ctx context.Context) ([]Entitlement, error)
+	ApproveEntitlement(ctx context.Context, entitlementId string) error
+	//ApprovePlanChange approves the change of an entitlement to pendingPlanName, its NewPendingPlan.
+	ApprovePlanChange(ctx context.Context, entitlementId string, pendingPlanName string) error
+	//RejectEntitlement rejects an entitlement activation request, the reason is shown to the customer.
+	RejectEntitlement(ctx context.Context, entitlementId string, reason string) error
+	//RejectPlanChange rejects the change of an entitlement to pendingPlanName, the reason is shown to the customer.
+	RejectPlanChange(ctx context.Context, entitlementId string, pendingPlanName string, reason string) error
+
+	//ListSubscriptions returns the partner subscriptions of an account.
+	ListSubscriptions(ctx context.Context, accountId string) ([]Subscription, error)
+	//GetSubscription returns the partner subscription of an entitlement.
+	GetSubscription(ctx context.Context, entitlementId string) (*Subscription, error)
+
+	//Healthz checks that the procurement API can be reached with the client's credentials.
+	Healthz(ctx context.Context) error
+}
+
+//google account fields
+type Account struct {
+	Id  			string     	`json:"id"`
+	Name  			string     	`json:"name"`
+	UpdateTime   	string    	`json:"updateTime,omitempty"`
+	CreateTime      string    	`json:"createTime,omitempty"`
+	Provider     	string		`json:"provider,omitempty"`
+	State 	 		string      `json:"state,omitempty"`
+	Approvals    	[]Approval  `json:"approvals,omitempty"`
+}
+
+type Approval struct {
+	Name  			string     	`json:"name"`
+	State  			string     	`json:"state"`
+	Reason  		string     	`json:"reason"`
+	UpdateTime  	string     	`json:"updateTime"`
+}
+
+//google entitlement fields
+type Entitlement struct {
+	Id     				string	`json:"id"`
+	Name     			string	`json:"name"`
+	Account   			string	`json:"account"`
+	Provider    		string	`json:"provider"`
+	Product  			string	`json:"product"`
+	Plan     	  		string	`json:"plan"`
+	NewPendingPlan 	  	string	`json:"newPendingPlan"`
+	State    	  		string	`json:"state"`
+	UpdateTime    	  	string	`json:"updateTime"`
+	CreateTime    	  	string	`json:"createTime"`
+	UsageReportingId    string	`json:"usageReportingId"`
+	MessageToUser    	string	`json:"messageToUser"`
+}
+
+type PartnerSubscriptions struct {
+	Subscriptions 	[]Subscription   `json:"subscriptions,omitempty"`
+}
+
+type Subscription struct {
+	Name 				string     	`json:"name"`
+	ExternalAccountId 	string     	`json:"externalAccountId"`
+	Version				string     	`json:"version,omitempty"`
+	Status				string     	`json:"status"`
+	SubscribedResources	[]SubscribedResource     	`json:"subscribedResources"`
+	RequiredApprovals	string     	`json:"requiredApprovals,omitempty"`
+	StartDate			json.RawMessage     	`json:"startDate,omitempty"`
+	EndDate				json.RawMessage     	`json:"endDate,omitempty"`
+	CreateTime			string     	`json:"createTime,omitempty"`
+	UpdateTime			string     	`json:"updateTime,omitempty"`
+}
+
+type SubscribedResource struct {
+	SubscriptionProvider 	string     	`json:"subscriptionProvider"`
+	Resource 				string     	`json:"resource"`
+	Labels					json.RawMessage     	`json:"labels,omitempty"`
+}
+
+//SubscriptionPrefix is the prefix of partner subscription names, the rest is the entitlement id.
+const SubscriptionPrefix = "partnerSubscriptions/"
+
+//Error is an error response from the marketplace APIs.
+type Error struct {
+	//Request describes the failed request, e.g. "Entitlement approval".
+	Request    string
+	StatusCode int
+	Status     string
+}
+
+func (err *Error) Error() string {
+	return err.Request + " received error response: " + err.Status
+}
+
+//IsNotFound returns whether err is a not found response from the marketplace APIs.
+func IsNotFound(err error) bool {
+	apiErr, ok := err.(*Error)
+	return ok && apiErr.StatusCode == http.StatusNotFound
+}
+
+type client struct {
+	procurementUrl   string
+	subscriptionsUrl string
+	httpClient       *http.Client
+	transport        http.RoundTripper
+}
+
+//NewClient returns a client that authenticates with the Google application default credentials. procurementUrl is
+//the root url of the procurement API and subscriptionsUrl that of the Cloud Billing API, either may be empty if the
+//service does not use it.
+func NewClient(procurementUrl string, subscriptionsUrl string, partnerId string) Client {
+	return NewClientWithTransport(procurementUrl, subscriptionsUrl, partnerId, nil)
+}
+
+//NewClientWithTransport returns a client that authenticates with the Google application default credentials and sends
+//requests, including those for tokens, with transport, for example to retry them. A nil transport uses the default.
+func NewClientWithTransport(procurementUrl string, subscriptionsUrl string, partnerId string, transport http.RoundTripper) Client {
+	return &client{
+		procurementUrl:   strings.TrimSuffix(procurementUrl, "/") + "/providers/" + partnerId,
+		subscriptionsUrl: strings.TrimSuffix(subscriptionsUrl, "/"),
+		transport:        transport,
+	}
+}
+
+//NewClientWithHTTPClient returns a client that sends requests with httpClient, or with the Google application default
+//credentials if httpClient is nil.
+func NewClientWithHTTPClient(procurementUrl string, subscriptionsUrl string, partnerId string, httpClient *http.Client) Client {
+	return &client{
+		procurementUrl:   strings.TrimSuffix(procurementUrl, "/") + "/providers/" + partnerId,
+		subscriptionsUrl: strings.TrimSuffix(subscriptionsUrl, "/"),
+		httpClient:       httpClient,
+	}
+}
+
+func (c *client) GetAccount(ctx context.Context, accountId string) (*Account, error) {
+	account := Account{}
+	if err := c.do(ctx, "Get account", http.MethodGet, c.procurementUrl+"/accounts/"+accountId, nil, &account); err != nil {
+		return nil, err
+	}
+	account.Id = accountId
+	LogI.Printf("Commerce API: Account %s is status %s.", accountId, account.State)
+	return &account, nil
+}
+
+func (c *client) ListAccounts(ctx context.Context) ([]Account, error) {
+	accounts := []Account{}
+	pageToken := ""
+	for {
+		page := struct {
+			Accounts      []Account `json:"accounts"`
+			NextPageToken string    `json:"nextPageToken"`
+		}{}
+		if err := c.do(ctx, "List accounts", http.MethodGet, c.procurementUrl+"/accounts"+pageQuery(pageToken), nil, &page); err != nil {
+			return nil, err
+		}
+		for _, account := range page.Accounts {
+			account.Id = path.Base(account.Name)
+			accounts = append(accounts, account)
+		}
+		if page.NextPageToken == "" {
+			return accounts, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (c *client) ApproveAccount(ctx context.Context, accountId string, approvalName string) error {
+	approval := map[string]string{"approvalName": approvalName}
+	return c.do(ctx, "Account approval", http.MethodPost, c.procurementUrl+"/accounts/"+accountId+":approve", approval, nil)
+}
+
+func (c *client) ResetAccount(ctx context.Context, accountId string) error {
+	return c.do(ctx, "Account reset", http.MethodPost, c.procurementUrl+"/accounts/"+accountId+":reset", nil, nil)
+}
+
+func (c *client) GetEntitlement(ctx context.Context, entitlementId string) (*Entitlement, error) {
+	entitlement := Entitlement{}
+	if err := c.do(ctx, "Get entitlement", http.MethodGet, c.procurementUrl+"/entitlements/"+entitlementId, nil, &entitlement); err != nil {
+		return nil, err
+	}
+	entitlement.Id = entitlementId
+	LogI.Printf("Commerce API: Entitlement %s is status %s.", entitlementId, entitlement.State)
+	return &entitlement, nil
+}
+
+func (c *client) ListEntitlements(ctx context.Context) ([]Entitlement, error) {
+	entitlements := []Entitlement{}
+	pageToken := ""
+	for {
+		page := struct {
+			Entitlements  []Entitlement `json:"entitlements"`
+			NextPageToken string        `json:"nextPageToken"`
+		}{}
+		if err := c.do(ctx, "List entitlements", http.MethodGet, c.procurementUrl+"/entitlements"+pageQuery(pageToken), nil, &page); err != nil {
+			return nil, err
+		}
+		for _, entitlement := range page.Entitlements {
+			entitlement.Id = path.Base(entitlement.Name)
+			entitlements = append(entitlements, entitlement)
+		}
+		if page.NextPageToken == "" {
+			return entitlements, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (c *client) ApproveEntitlement(ctx context.Context, entitlementId string) error {
+	return c.do(ctx, "Entitlement approval", http.MethodPost, c.procurementUrl+"/entitlements/"+entitlementId+":approve", nil, nil)
+}
+
+func (c *client) ApprovePlanChange(ctx context.Context, entitlementId string, pendingPlanName string) error {
+	approval := map[string]string{"pendingPlanName": pendingPlanName}
+	return c.do(ctx, "Entitlement change approval", http.MethodPost, c.procurementUrl+"/entitlements/"+entitlementId+":approvePlanChange", approval, nil)
+}
+
+func (c *client) RejectEntitlement(ctx context.Context, entitlementId string, reason string) error {
+	rejection := map[string]string{"reason": reason}
+	return c.do(ctx, "Entitlement rejection", http.MethodPost, c.procurementUrl+"/entitlements/"+entitlementId+":reject", rejection, nil)
+}
+
+func (c *client) RejectPlanChange(ctx context.Context, entitlementId string, pendingPlanName string, reason string) error {
+	rejection := map[string]string{"pendingPlanName": pendingPlanName, "reason": reason}
+	return c.do(ctx, "Entitlement change rejection", http.MethodPost, c.procurementUrl+"/entitlements/"+entitlementId+":rejectPlanChange", rejection, nil)
+}
+
+func (c *client) ListSubscriptions(ctx context.Context, accountId string) ([]Subscription, error) {
+	partnerSubscriptions := PartnerSubscriptions{}
+	if err := c.do(ctx, "Getting subscription entitlements", http.MethodGet, c.subscriptionsUrl+"/partnerSubscriptions?externalAccountId="+accountId, nil, &partnerSubscriptions); err != nil {
+		return nil, err
+	}
+	return partnerSubscriptions.Subscriptions, nil
+}
+
+func (c *client) GetSubscription(ctx context.Context, entitlementId string) (*Subscription, error) {
+	subscription := Subscription{}
+	if err := c.do(ctx, "Getting subscription entitlement", http.MethodGet, c.subscriptionsUrl+"/"+SubscriptionPrefix+entitlementId, nil, &subscription); err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+func (c *client) Healthz(ctx context.Context) error {
+	return c.do(ctx, "Cloud Commerce API check", http.MethodGet, c.procurementUrl+"/accounts/", nil, nil)
+}
+
+//pageQuery returns the query string for the page of a list after the first, which has no page token.
+func pageQuery(pageToken string) string {
+	if pageToken == "" {
+		return ""
+	}
+	return "?pageToken=" + url.QueryEscape(pageToken)
+}
+
+//do sends a request with body, if not nil, as JSON and decodes the response into result, if not nil. Responses other
+//than 200 are returned as an *Error.
+func (c *client) do(ctx context.Context, request string, method string, url string, body interface{}, result interface{}) error {
+	httpClient := c.httpClient
+	if httpClient == nil {
+		var err error
+		clientCtx := ctx
+		if c.transport != nil {
+			clientCtx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: c.transport})
+		}
+		if httpClient, err = google.DefaultClient(clientCtx, "https://www.googleapis.com/auth/cloud-platform"); err != nil {
+			LogE.Printf("Failed to create oath2 client for the procurement API %#v \n", err)
+			return err
+		}
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			LogE.Printf("Error marshalling %s request %#v \n", request, err)
+			return err
+		}
+		reqBody = bytes.NewBuffer(bodyBytes)
+	}
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		LogE.Printf("Failed creating %s request %s %#v \n", request, url, err)
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req = req.WithContext(ctx)
+
+	LogI.Printf("%s: %s %s \n", request, method, url)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		LogE.Printf("Failed sending %s request %s %#v \n", request, url, err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		LogE.Println(request+" received error response: ", resp.StatusCode)
+		responseDump, _ := httputil.DumpResponse(resp, true)
+		LogE.Println(string(responseDump))
+		return &Error{request, resp.StatusCode, resp.Status}
+	}
+	LogI.Printf("%s %s %s", request, url, resp.Status)
+
+	if result != nil {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			LogE.Printf("Error decoding %s response %s %#v \n", request, url, err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+//Package retry retries HTTP requests to other services that failed with a transient error. It is shared by every
+//service that calls the marketplace or the subscription service.
+package retry
+
+import (
+	"context"
+	"errors"
+	"github.com/jefferyfry/funclog"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//budgetReserve is how many retries the budget starts with and can save up, so a burst of failures after a quiet
+//period is still retried.
+const budgetReserve = 10
+
+var (
+	LogI = funclog.NewInfoLogger("INFO: ")
+	LogE = funclog.NewErrorLogger("ERROR: ")
+)
+
+//Policy configures how HTTP requests are retried.
+type Policy struct {
+	//MaxAttempts is the number of attempts per request including the first, 1 disables retries
+	MaxAttempts int
+	//InitialBackoff is the longest wait before the first retry, it doubles for each retry after it up to MaxBackoff
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	//AttemptTimeout is the deadline of each attempt, 0 for none
+	AttemptTimeout time.Duration
+	//Budget is the number of retries allowed per request on average, 0.2 allows one retry for every five requests
+	Budget float64
+}
+
+//ParsePolicy returns the policy for configuration values, such as "4", "100ms", "5s", "10s" and "0.2".
+func ParsePolicy(maxAttempts string, initialBackoff string, maxBackoff string, attemptTimeout string, budget string) (Policy, error) {
+	policy := Policy{}
+	var err error
+	if policy.MaxAttempts, err = strconv.Atoi(maxAttempts); err != nil || policy.MaxAttempts < 1 {
+		return policy, errors.New("retry max attempts " + maxAttempts + " is not a positive number")
+	}
+	if policy.InitialBackoff, err = time.ParseDuration(initialBackoff); err != nil || policy.InitialBackoff < 0 {
+		return policy, errors.New("retry initial backoff " + initialBackoff + " is not a valid duration")
+	}
+	if policy.MaxBackoff, err = time.ParseDuration(maxBackoff); err != nil || policy.MaxBackoff < policy.InitialBackoff {
+		return policy, errors.New("retry max backoff " + maxBackoff + " is not a valid duration of at least the initial backoff")
+	}
+	if policy.AttemptTimeout, err = time.ParseDuration(attemptTimeout); err != nil || policy.AttemptTimeout < 0 {
+		return policy, errors.New("retry attempt timeout " + attemptTimeout + " is not a valid duration")
+	}
+	if policy.Budget, err = strconv.ParseFloat(budget, 64); err != nil || policy.Budget < 0 {
+		return policy, errors.New("retry budget " + budget + " is not a number of at least 0")
+	}
+	return policy, nil
+}
+
+//Transport is an http.RoundTripper that retries requests that failed with a transient error, waiting a random backoff
+//between attempts. Retries are limited by a budget shared by every request sent with the transport, so a service that
+//is down is not sent several times the usual load.
+type Transport struct {
+	Base   http.RoundTripper
+	Policy Policy
+
+	mutex   sync.Mutex
+	retries float64
+}
+
+//NewTransport returns a transport that sends requests with base, or http.DefaultTransport if base is nil.
+func NewTransport(base http.RoundTripper, policy Policy) *Transport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &Transport{Base: base, Policy: policy, retries: budgetReserve}
+}
+
+//NewClient returns an http.Client that retries requests with policy.
+func NewClient(policy Policy) *http.Client {
+	return &http.Client{Transport: NewTransport(nil, policy)}
+}
+
+//Retryable returns whether a response with statusCode is worth retrying. The service was overloaded or unavailable, so
+//the request was most likely not processed. A 500 is only retried for methods that are safe to repeat.
+func Retryable(method string, statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusInternalServerError:
+		return idempotent(method)
+	}
+	return false
+}
+
+//retryableError returns whether a request that failed with err is worth retrying. A request that is not safe to repeat
+//is only retried if the connection could not be made, otherwise it may have been processed.
+func retryableError(method string, err error) bool {
+	if idempotent(method) {
+		return true
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+//Backoff returns the wait before retry number retry, counting from 0. It is chosen at random up to InitialBackoff
+//doubled for each earlier retry, capped at MaxBackoff, so clients that failed together do not retry together.
+func (policy Policy) Backoff(retry int) time.Duration {
+	backoff := policy.InitialBackoff
+	for i := 0; i < retry && backoff < policy.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > policy.MaxBackoff {
+		backoff = policy.MaxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(backoff) + 1))
+}
+
+//RoundTrip sends req until it succeeds, fails with an error that is not transient, runs out of attempts or the budget
+//runs out of retries. The last response or error is returned. A request with a body is retried only if the body can be
+//read again, as it can for requests made with http.NewRequest from a buffer.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.deposit()
+	maxAttempts := t.Policy.MaxAttempts
+	if req.Body != nil && req.GetBody == nil {
+		maxAttempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		attemptReq, cancel, err := t.attemptRequest(req, attempt)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := t.Base.RoundTrip(attemptReq)
+
+		var retryAfter time.Duration
+		if err != nil {
+			cancel()
+			if req.Context().Err() != nil || !retryableError(req.Method, err) {
+				return nil, err
+			}
+		} else if !Retryable(req.Method, resp.StatusCode) {
+			resp.Body = &cancelBody{resp.Body, cancel}
+			return resp, nil
+		} else {
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		}
+
+		if attempt >= maxAttempts || !t.withdraw() {
+			if err != nil {
+				return nil, err
+			}
+			resp.Body = &cancelBody{resp.Body, cancel}
+			return resp, nil
+		}
+		if resp != nil {
+			//drain the body so the connection is reused
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			cancel()
+		}
+
+		backoff := t.Policy.Backoff(attempt - 1)
+		if retryAfter > backoff {
+			backoff = retryAfter
+			if backoff > t.Policy.MaxBackoff {
+				backoff = t.Policy.MaxBackoff
+			}
+		}
+		if err != nil {
+			LogI.Printf("Retrying %s %s in %s after attempt %d failed: %v \n", req.Method, req.URL, backoff, attempt, err)
+		} else {
+			LogI.Printf("Retrying %s %s in %s after attempt %d received %s \n", req.Method, req.URL, backoff, attempt, resp.Status)
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+	}
+}
+
+//attemptRequest returns a copy of req for an attempt with the attempt deadline and, after the first attempt, a new
+//copy of the body. The returned function releases the deadline.
+func (t *Transport) attemptRequest(req *http.Request, attempt int) (*http.Request, context.CancelFunc, error) {
+	ctx, cancel := req.Context(), context.CancelFunc(func() {})
+	if t.Policy.AttemptTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.Policy.AttemptTimeout)
+	}
+	attemptReq := req.WithContext(ctx)
+	if attempt > 1 && req.Body != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, nil, err
+		}
+		attemptReq.Body = body
+	}
+	return attemptReq, cancel, nil
+}
+
+//deposit adds a request's share of retries to the budget.
+func (t *Transport) deposit() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.retries += t.Policy.Budget
+	if t.retries > budgetReserve {
+		t.retries = budgetReserve
+	}
+}
+
+//withdraw takes a retry from the budget and returns false if there is none left.
+func (t *Transport) withdraw() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.retries < 1 {
+		LogE.Println("Retry budget exhausted, not retrying.")
+		return false
+	}
+	t.retries--
+	return true
+}
+
+//parseRetryAfter returns the wait in a Retry-After header given in seconds, or 0.
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
+}
+
+//cancelBody releases the deadline of the attempt that returned a response once its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
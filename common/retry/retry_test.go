@@ -0,0 +1,258 @@
+package retry
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+//failingServer fails the first failures requests with status and the given headers, then responds 200.
+type failingServer struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	requests int
+}
+
+func newFailingServer(failures int, status int, header http.Header) *failingServer {
+	srv := &failingServer{}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		srv.mutex.Lock()
+		srv.requests++
+		request := srv.requests
+		srv.mutex.Unlock()
+		if request <= failures {
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+			w.WriteHeader(status)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	return srv
+}
+
+func (srv *failingServer) Requests() int {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.requests
+}
+
+func testPolicy() Policy {
+	return Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond, Budget: 1}
+}
+
+func send(t *testing.T, client *http.Client, method string, url string) int {
+	req, err := http.NewRequest(method, url, bytes.NewBufferString("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, url, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		status       int
+		wantStatus   int
+		wantRequests int
+	}{
+		{"GET 503 then 200", http.MethodGet, http.StatusServiceUnavailable, http.StatusOK, 2},
+		{"POST 503 then 200", http.MethodPost, http.StatusServiceUnavailable, http.StatusOK, 2},
+		{"GET 429 then 200", http.MethodGet, http.StatusTooManyRequests, http.StatusOK, 2},
+		{"PUT 500 then 200", http.MethodPut, http.StatusInternalServerError, http.StatusOK, 2},
+		{"POST 500 not retried", http.MethodPost, http.StatusInternalServerError, http.StatusInternalServerError, 1},
+		{"GET 404 not retried", http.MethodGet, http.StatusNotFound, http.StatusNotFound, 1},
+		{"PUT 412 not retried", http.MethodPut, http.StatusPreconditionFailed, http.StatusPreconditionFailed, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := newFailingServer(1, test.status, nil)
+			defer srv.Close()
+
+			status := send(t, NewClient(testPolicy()), test.method, srv.URL)
+			if status != test.wantStatus {
+				t.Errorf("status = %d, want %d", status, test.wantStatus)
+			}
+			if srv.Requests() != test.wantRequests {
+				t.Errorf("requests = %d, want %d", srv.Requests(), test.wantRequests)
+			}
+		})
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	srv := newFailingServer(10, http.StatusServiceUnavailable, nil)
+	defer srv.Close()
+
+	if status := send(t, NewClient(testPolicy()), http.MethodGet, srv.URL); status != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want the last response %d", status, http.StatusServiceUnavailable)
+	}
+	if srv.Requests() != 3 {
+		t.Errorf("requests = %d, want 3", srv.Requests())
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		retryAfter string
+		maxBackoff time.Duration
+		minWait    time.Duration
+		maxWait    time.Duration
+	}{
+		{"honored", "1", 5 * time.Second, time.Second, 3 * time.Second},
+		{"capped at max backoff", "120", 50 * time.Millisecond, 50 * time.Millisecond, time.Second},
+		{"ignored if not seconds", "Wed, 21 Oct 2015 07:28:00 GMT", 10 * time.Millisecond, 0, time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := newFailingServer(1, http.StatusServiceUnavailable, http.Header{"Retry-After": {test.retryAfter}})
+			defer srv.Close()
+			policy := testPolicy()
+			policy.MaxBackoff = test.maxBackoff
+
+			start := time.Now()
+			status := send(t, NewClient(policy), http.MethodGet, srv.URL)
+			wait := time.Since(start)
+			if status != http.StatusOK || srv.Requests() != 2 {
+				t.Fatalf("status = %d after %d requests, want 200 after 2", status, srv.Requests())
+			}
+			if wait < test.minWait || wait > test.maxWait {
+				t.Errorf("retried after %s, want between %s and %s", wait, test.minWait, test.maxWait)
+			}
+		})
+	}
+}
+
+func TestBudgetExhausted(t *testing.T) {
+	srv := newFailingServer(1000, http.StatusServiceUnavailable, nil)
+	defer srv.Close()
+	policy := testPolicy()
+	policy.Budget = 0
+	client := NewClient(policy)
+
+	//the reserve of 10 retries allows 2 retries for each of the first 5 requests, then none are left
+	for i := 0; i < 7; i++ {
+		send(t, client, http.MethodGet, srv.URL)
+	}
+	if want := 5*3 + 2; srv.Requests() != want {
+		t.Errorf("requests = %d, want %d", srv.Requests(), want)
+	}
+}
+
+func TestBudgetRefilled(t *testing.T) {
+	srv := newFailingServer(1000, http.StatusServiceUnavailable, nil)
+	defer srv.Close()
+	policy := testPolicy()
+	policy.Budget = 0.5
+	client := NewClient(policy)
+
+	//each request deposits half a retry, so once the reserve is spent every other request is retried once
+	for i := 0; i < 20; i++ {
+		send(t, client, http.MethodGet, srv.URL)
+	}
+	if srv.Requests() >= 20*3 || srv.Requests() <= 20 {
+		t.Errorf("requests = %d, want fewer than every retry and more than none", srv.Requests())
+	}
+}
+
+func TestAttemptTimeout(t *testing.T) {
+	var mutex sync.Mutex
+	requests := 0
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests++
+		request := requests
+		mutex.Unlock()
+		if request == 1 {
+			//hang until the attempt times out
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	defer close(release)
+	policy := testPolicy()
+	policy.AttemptTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	status := send(t, NewClient(policy), http.MethodGet, srv.URL)
+	if status != http.StatusOK {
+		t.Errorf("status = %d, want 200", status)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if requests != 2 {
+		t.Errorf("requests = %d, want 2", requests)
+	}
+	if wait := time.Since(start); wait > 2*time.Second {
+		t.Errorf("took %s, the first attempt was not timed out", wait)
+	}
+}
+
+func TestPostNotRetriedAfterTimeout(t *testing.T) {
+	var mutex sync.Mutex
+	requests := 0
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		requests++
+		mutex.Unlock()
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+	policy := testPolicy()
+	policy.AttemptTimeout = 50 * time.Millisecond
+
+	//the request may have been processed, so it is not sent again
+	req, _ := http.NewRequest(http.MethodPost, srv.URL, bytes.NewBufferString("{}"))
+	if _, err := NewClient(policy).Do(req); err == nil {
+		t.Error("POST succeeded, want the attempt timeout error")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if requests != 1 {
+		t.Errorf("requests = %d, want 1", requests)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		values  []string
+		wantErr bool
+	}{
+		{[]string{"4", "100ms", "5s", "10s", "0.2"}, false},
+		{[]string{"1", "0s", "0s", "0s", "0"}, false},
+		{[]string{"0", "100ms", "5s", "10s", "0.2"}, true},
+		{[]string{"4", "ten", "5s", "10s", "0.2"}, true},
+		{[]string{"4", "5s", "100ms", "10s", "0.2"}, true},
+		{[]string{"4", "100ms", "5s", "-1s", "0.2"}, true},
+		{[]string{"4", "100ms", "5s", "10s", "-1"}, true},
+	}
+	for _, test := range tests {
+		_, err := ParsePolicy(test.values[0], test.values[1], test.values[2], test.values[3], test.values[4])
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParsePolicy(%q) error = %v, want error %t", test.values, err, test.wantErr)
+		}
+	}
+}
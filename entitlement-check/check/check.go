@@ -3,18 +3,25 @@ package check
 import (
 	"bytes"
 	"encoding/json"
+	"context"
 	"errors"
+	"github.com/cloudbees/cloud-bill-saas/common/procurement"
 	"github.com/jefferyfry/funclog"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
 	subscriptionServiceBaseUrl string
-	googleSubscriptionsBaseUrl string
+	//subscriptionServiceClient sends every request to the subscription service
+	subscriptionServiceClient = http.DefaultClient
+	procurementClient procurement.Client
+	//runSource identifies this run in the history of the entitlements it updates
+	runSource string
 
 	LogI = funclog.NewInfoLogger("INFO: ")
 	LogE = funclog.NewErrorLogger("ERROR: ")
@@ -24,6 +31,12 @@ type EntitlementCheckHandler struct {
 	Products    			string
 }
 
+//EntitlementsPage is one page of entitlements from the subscription service.
+type EntitlementsPage struct {
+	Entitlements  []Entitlement `json:"entitlements"`
+	NextPageToken string        `json:"nextPageToken"`
+}
+
 type Entitlement struct {
 	Id     				string	`json:"id"`
 	Name     			string	`json:"name"`
@@ -37,36 +50,23 @@ type Entitlement struct {
 	CreateTime    	  	string	`json:"createTime"`
 	UsageReportingId    string	`json:"usageReportingId"`
 	MessageToUser    	string	`json:"messageToUser"`
+	Version    			int64	`json:"version"`
 }
 
-type Subscription struct {
-	Name 				string     	`json:"name"`
-	ExternalAccountId 	string     	`json:"externalAccountId"`
-	Version				string     	`json:"version,omitempty"`
-	Status				string     	`json:"status"`
-	SubscribedResources	[]SubscribedResource     	`json:"subscribedResources"`
-	RequiredApprovals	string     	`json:"requiredApprovals,omitempty"`
-	StartDate			json.RawMessage     	`json:"startDate,omitempty"`
-	EndDate				json.RawMessage     	`json:"endDate,omitempty"`
-	CreateTime			string     	`json:"createTime,omitempty"`
-	UpdateTime			string     	`json:"updateTime,omitempty"`
-}
-
-type SubscribedResource struct {
-	SubscriptionProvider 	string     	`json:"subscriptionProvider"`
-	Resource 				string     	`json:"resource"`
-	Labels					json.RawMessage     	`json:"labels,omitempty"`
-}
-
-func GetEntitlementCheckHandler(products string, subscriptionServiceUrl string, googleSubscriptionsUrl string) *EntitlementCheckHandler {
+//GetEntitlementCheckHandler returns a handler that sends requests to the subscription service with httpClient.
+func GetEntitlementCheckHandler(products string, subscriptionServiceUrl string, httpClient *http.Client, procurementApiClient procurement.Client) *EntitlementCheckHandler {
 	subscriptionServiceBaseUrl = subscriptionServiceUrl
-	googleSubscriptionsBaseUrl = googleSubscriptionsUrl
+	subscriptionServiceClient = httpClient
+	procurementClient = procurementApiClient
 	return &EntitlementCheckHandler{
 		products,
 	}
 }
 
-func (hdlr *EntitlementCheckHandler) Run() error {
+//Run checks the active entitlements of each product against the marketplace. When ctx is done it stops before the next
+//entitlement and returns ctx.Err(), an entitlement that was being updated is finished first.
+func (hdlr *EntitlementCheckHandler) Run(ctx context.Context) error {
+	runSource = "entitlement-check run " + time.Now().UTC().Format(time.RFC3339)
 	//query subscription service for entitlements
 	products := strings.Split(hdlr.Products, ",")
 
@@ -74,18 +74,25 @@ func (hdlr *EntitlementCheckHandler) Run() error {
 		LogI.Printf("Checking entitlements for product %s", product)
 		if entitlements, err := getActiveEntitlementsForProduct(product); err == nil {
 			for _, entitlement := range entitlements {
+				if ctx.Err() != nil {
+					LogI.Printf("Stopping entitlement check before entitlement %s \n", entitlement.Id)
+					return ctx.Err()
+				}
 				LogI.Printf("Checking entitlement %s", entitlement.Id)
 				if entitlementStatus, err := getProdEntitlementStatus(entitlement.Id); err == nil {
 					status := "ENTITLEMENT_"+entitlementStatus
 					if status != entitlement.State {
 						entitlement.State = status
-						saveEntitlementToDb(&entitlement)
-						LogI.Printf("Updated entitlement %s with status %s", entitlement.Id, entitlement.State)
+						if err := saveEntitlementToDb(&entitlement); err != nil {
+							LogE.Printf("Failed to update entitlement %s with status %s %#v \n", entitlement.Id, entitlement.State, err)
+						} else {
+							LogI.Printf("Updated entitlement %s with status %s", entitlement.Id, entitlement.State)
+						}
 					} else {
 						LogI.Printf("Entitlement %s status with status %s is unchanged.", entitlement.Id, status)
 					}
 				} else {
-					LogE.Printf("Failed to get entitlement status %s %#v \n",googleSubscriptionsBaseUrl, err)
+					LogE.Printf("Failed to get entitlement status %s %#v \n",entitlement.Id, err)
 				}
 			}
 		} else {
@@ -97,64 +104,59 @@ func (hdlr *EntitlementCheckHandler) Run() error {
 	return nil
 }
 
+//getActiveEntitlementsForProduct walks every page of active entitlements for the product.
 func getActiveEntitlementsForProduct(product string) ([]Entitlement, error) {
-	subscriptionServiceUrl := subscriptionServiceBaseUrl + "/entitlements?filters=state%3DENTITLEMENT_ACTIVE%2Cproduct%3D"+product
-
-	LogI.Printf("Getting entitlements: %s \n", subscriptionServiceUrl)
-	resp, err := http.Get(subscriptionServiceUrl)
-	if err != nil {
-		LogE.Printf("Failed to get entitlements %s %#v \n",subscriptionServiceUrl, err)
-		return nil,err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode == 404 {
-		LogI.Printf("No active entitlements for %s found.",product)
-	} else if resp.StatusCode != 200 {
-		LogE.Println("Get entitlement received error response: ",resp.StatusCode)
-		responseDump, _ := httputil.DumpResponse(resp, true)
-		LogE.Println(string(responseDump))
-		return nil,errors.New(resp.Status)
-	} else {
-		LogI.Printf("Got entitlements %s %s",subscriptionServiceUrl,resp.Status)
-	}
+	entitlementsUrl := subscriptionServiceBaseUrl + "/entitlements?filters=state%3DENTITLEMENT_ACTIVE%2Cproduct%3D"+url.QueryEscape(product)
 
 	entitlements := make([]Entitlement,0)
-	if err = json.NewDecoder(resp.Body).Decode(&entitlements); err != nil {
-		LogE.Printf("Error decoding entitlements %s %#v %#v \n", subscriptionServiceUrl, resp.Body, err)
-		return nil,err
-	}
+	pageToken := ""
+	for {
+		subscriptionServiceUrl := entitlementsUrl
+		if pageToken != "" {
+			subscriptionServiceUrl += "&cursor=" + url.QueryEscape(pageToken)
+		}
+		LogI.Printf("Getting entitlements: %s \n", subscriptionServiceUrl)
+		resp, err := subscriptionServiceClient.Get(subscriptionServiceUrl)
+		if err != nil {
+			LogE.Printf("Failed to get entitlements %s %#v \n",subscriptionServiceUrl, err)
+			return nil,err
+		}
+		if resp.StatusCode == 404 {
+			resp.Body.Close()
+			LogI.Printf("No active entitlements for %s found.",product)
+			return entitlements,nil
+		} else if resp.StatusCode != 200 {
+			LogE.Println("Get entitlement received error response: ",resp.StatusCode)
+			responseDump, _ := httputil.DumpResponse(resp, true)
+			LogE.Println(string(responseDump))
+			resp.Body.Close()
+			return nil,errors.New(resp.Status)
+		} else {
+			LogI.Printf("Got entitlements %s %s",subscriptionServiceUrl,resp.Status)
+		}
 
-	return entitlements,nil
+		page := EntitlementsPage{}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			LogE.Printf("Error decoding entitlements %s %#v \n", subscriptionServiceUrl, err)
+			return nil,err
+		}
+		entitlements = append(entitlements, page.Entitlements...)
+
+		if page.NextPageToken == "" {
+			return entitlements,nil
+		}
+		pageToken = page.NextPageToken
+	}
 }
 
 func getProdEntitlementStatus(entitlementId string) (string, error) {
-	subscriptionsUrl := googleSubscriptionsBaseUrl+"/partnerSubscriptions/"+entitlementId
-	if client, clientErr := google.DefaultClient(oauth2.NoContext, "https://www.googleapis.com/auth/cloud-platform"); clientErr != nil {
-		LogE.Printf("Failed to create oath2 client for the procurement API %#v \n", clientErr)
-		return "", clientErr
-	} else {
-		LogI.Printf("Getting subscription entitlement : %s \n", subscriptionsUrl)
-		if subResp, err := client.Get(subscriptionsUrl); nil != err {
-			LogE.Printf("Failed subscription entitlement request %s %#v \n", subscriptionsUrl, err)
-			return "", err
-		} else {
-			defer subResp.Body.Close()
-			if subResp.StatusCode != 200 {
-				LogE.Println("Getting subscription entitlement received error response: ", subResp.StatusCode)
-				responseDump, _ := httputil.DumpResponse(subResp, true)
-				LogE.Println(string(responseDump))
-				return "",errors.New("Getting subscription entitlement received error response: " + subResp.Status)
-			}
-			subscription := Subscription{}
-			if err = json.NewDecoder(subResp.Body).Decode(&subscription); err != nil {
-				LogE.Printf("Error decoding subscription %s %#v %#v \n", subscriptionsUrl, subResp.Body, err)
-				responseDump, _ := httputil.DumpResponse(subResp, true)
-				LogE.Println(string(responseDump))
-				return "",err
-			}
-			return subscription.Status, nil
-		}
+	subscription, err := procurementClient.GetSubscription(context.Background(), entitlementId)
+	if err != nil {
+		return "", err
 	}
+	return subscription.Status, nil
 }
 
 func saveEntitlementToDb(entitlement *Entitlement) error {
@@ -169,13 +171,19 @@ func saveEntitlementToDb(entitlement *Entitlement) error {
 		LogE.Printf("Failed creating entitlement update request %s %#v \n",subscriptionServiceBaseUrl, err)
 		return err
 	}
-	entitlementResp, err := http.DefaultClient.Do(entitlementReq)
+	//only update the entitlement if nothing else has changed it since it was read
+	entitlementReq.Header.Set("X-Cloud-Bill-Source", runSource)
+	entitlementReq.Header.Set("If-Match", strconv.Quote(strconv.FormatInt(entitlement.Version, 10)))
+	entitlementResp, err := subscriptionServiceClient.Do(entitlementReq)
 	if err != nil {
 		LogE.Printf("Failed sending entitlement update request %s %#v \n",subscriptionServiceBaseUrl, err)
 		return err
 	}
 	defer entitlementResp.Body.Close()
-	if entitlementResp.StatusCode != 204 {
+	if entitlementResp.StatusCode == http.StatusPreconditionFailed {
+		LogI.Printf("Entitlement %s changed since it was read, it will be checked again on the next run.", entitlement.Id)
+		return errors.New(entitlementResp.Status)
+	} else if entitlementResp.StatusCode != 204 {
 		LogE.Println("Update entitlement received error response: ",entitlementResp.StatusCode)
 		responseDump, _ := httputil.DumpResponse(entitlementResp, true)
 		LogE.Println(string(responseDump))
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"flag"
+	"github.com/cloudbees/cloud-bill-saas/common/retry"
 	"github.com/jefferyfry/funclog"
 	"os"
 	"strings"
@@ -15,6 +16,11 @@ var (
 	SubscriptionServiceUrl = "https://subscription-service.cloudbees-jenkins-support.svc.cluster.local"
 	GoogleSubscriptionsUrl = "https://cloudbilling.googleapis.com/v1"
 	SentryDsn		= ""
+	RetryMaxAttempts		= "4"
+	RetryInitialBackoff		= "100ms"
+	RetryMaxBackoff			= "5s"
+	RetryAttemptTimeout		= "10s"
+	RetryBudget				= "0.2"
 
 	LogI = funclog.NewInfoLogger("INFO: ")
 	LogE = funclog.NewErrorLogger("ERROR: ")
@@ -26,6 +32,11 @@ type ServiceConfig struct {
 	SubscriptionServiceUrl 	string `json:"subscriptionServiceUrl"`
 	GoogleSubscriptionsUrl 	string `json:"googleSubscriptionsUrl"`
 	SentryDsn		string	`json:"sentryDsn"`
+	RetryMaxAttempts		string	`json:"retryMaxAttempts"`
+	RetryInitialBackoff		string	`json:"retryInitialBackoff"`
+	RetryMaxBackoff			string	`json:"retryMaxBackoff"`
+	RetryAttemptTimeout		string	`json:"retryAttemptTimeout"`
+	RetryBudget				string	`json:"retryBudget"`
 }
 
 func GetConfiguration() (ServiceConfig, error) {
@@ -35,6 +46,11 @@ func GetConfiguration() (ServiceConfig, error) {
 		SubscriptionServiceUrl,
 		GoogleSubscriptionsUrl,
 		SentryDsn,
+		RetryMaxAttempts,
+		RetryInitialBackoff,
+		RetryMaxBackoff,
+		RetryAttemptTimeout,
+		RetryBudget,
 	}
 
 	if dir, err := os.Getwd(); err != nil {
@@ -51,6 +67,11 @@ func GetConfiguration() (ServiceConfig, error) {
 	subscriptionServiceUrl := flag.String("subscriptionServiceUrl", "", "set the subscription service url")
 	googleSubscriptionsUrl := flag.String("googleSubscriptionsUrl", "", "set the Google subscription url")
 	sentryDsn := flag.String("sentryDsn", "", "set the Sentry DSN")
+	retryMaxAttempts := flag.String("retryMaxAttempts", "", "set how many times a request to another service is attempted (ex. 4)")
+	retryInitialBackoff := flag.String("retryInitialBackoff", "", "set the longest wait before the first retry, doubled for each retry (ex. 100ms)")
+	retryMaxBackoff := flag.String("retryMaxBackoff", "", "set the longest wait between retries (ex. 5s)")
+	retryAttemptTimeout := flag.String("retryAttemptTimeout", "", "set the deadline of each attempt of a request to another service (ex. 10s)")
+	retryBudget := flag.String("retryBudget", "", "set how many retries are allowed per request on average (ex. 0.2)")
 	flag.Parse()
 
 	//try environment variables if necessary
@@ -76,6 +97,21 @@ func GetConfiguration() (ServiceConfig, error) {
 	if *sentryDsn == "" {
 		*sentryDsn = os.Getenv("CLOUD_BILL_ENTITLEMENT_CHECK_SENTRY_DSN")
 	}
+	if *retryMaxAttempts == "" {
+		*retryMaxAttempts = os.Getenv("CLOUD_BILL_ENTITLEMENT_CHECK_RETRY_MAX_ATTEMPTS")
+	}
+	if *retryInitialBackoff == "" {
+		*retryInitialBackoff = os.Getenv("CLOUD_BILL_ENTITLEMENT_CHECK_RETRY_INITIAL_BACKOFF")
+	}
+	if *retryMaxBackoff == "" {
+		*retryMaxBackoff = os.Getenv("CLOUD_BILL_ENTITLEMENT_CHECK_RETRY_MAX_BACKOFF")
+	}
+	if *retryAttemptTimeout == "" {
+		*retryAttemptTimeout = os.Getenv("CLOUD_BILL_ENTITLEMENT_CHECK_RETRY_ATTEMPT_TIMEOUT")
+	}
+	if *retryBudget == "" {
+		*retryBudget = os.Getenv("CLOUD_BILL_ENTITLEMENT_CHECK_RETRY_BUDGET")
+	}
 
 	if *configFile == "" {
 		//try other flags
@@ -84,6 +120,21 @@ func GetConfiguration() (ServiceConfig, error) {
 		conf.SubscriptionServiceUrl = *subscriptionServiceUrl
 		conf.GoogleSubscriptionsUrl = *googleSubscriptionsUrl
 		conf.SentryDsn = *sentryDsn
+		if *retryMaxAttempts != "" {
+			conf.RetryMaxAttempts = *retryMaxAttempts
+		}
+		if *retryInitialBackoff != "" {
+			conf.RetryInitialBackoff = *retryInitialBackoff
+		}
+		if *retryMaxBackoff != "" {
+			conf.RetryMaxBackoff = *retryMaxBackoff
+		}
+		if *retryAttemptTimeout != "" {
+			conf.RetryAttemptTimeout = *retryAttemptTimeout
+		}
+		if *retryBudget != "" {
+			conf.RetryBudget = *retryBudget
+		}
 	} else {
 		if file, err := os.Open(*configFile); err != nil {
 			LogE.Printf("Error reading confile file %s %s", *configFile, err)
@@ -128,6 +179,11 @@ func GetConfiguration() (ServiceConfig, error) {
 		LogE.Println("SentryDsn was not set. Will run without Sentry.")
 	}
 
+	if _, err := retry.ParsePolicy(conf.RetryMaxAttempts, conf.RetryInitialBackoff, conf.RetryMaxBackoff, conf.RetryAttemptTimeout, conf.RetryBudget); err != nil {
+		LogE.Printf("Retry configuration is not valid: %v \n", err)
+		valid = false
+	}
+
 	if gAppCredPath,gAppCredExists := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS"); !gAppCredExists {
 		LogE.Println("GOOGLE_APPLICATION_CREDENTIALS was not set. ")
 		valid = false
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"github.com/cloudbees/cloud-bill-saas/common/procurement"
+	"github.com/cloudbees/cloud-bill-saas/common/retry"
 	"github.com/cloudbees/cloud-bill-saas/entitlement-check/check"
 	"github.com/cloudbees/cloud-bill-saas/entitlement-check/config"
 	"github.com/getsentry/sentry-go"
 	"github.com/jefferyfry/funclog"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -38,9 +44,24 @@ func main() {
 	}
 
 	//start service
-	entitlementCheck := check.GetEntitlementCheckHandler(config.Products,config.SubscriptionServiceUrl,config.GoogleSubscriptionsUrl)
+	//the check only reads partner subscriptions, it does not call the procurement API
+	//retry transient failures of the partner subscriptions API and the subscription service
+	retryPolicy, _ := retry.ParsePolicy(config.RetryMaxAttempts,config.RetryInitialBackoff,config.RetryMaxBackoff,config.RetryAttemptTimeout,config.RetryBudget)
+	httpClient := retry.NewClient(retryPolicy)
+	procurementClient := procurement.NewClientWithTransport("", config.GoogleSubscriptionsUrl, "", httpClient.Transport)
+	entitlementCheck := check.GetEntitlementCheckHandler(config.Products,config.SubscriptionServiceUrl,httpClient,procurementClient)
 
-	if err := entitlementCheck.Run(); err != nil {
+	//stop between entitlements if the job is terminated
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		LogI.Printf("Received %s, stopping... \n", sig)
+		cancel()
+	}()
+
+	if err := entitlementCheck.Run(ctx); err != nil {
 		LogE.Printf("Entitlement Check Job encountered err %s",err)
 	} else {
 		LogI.Println("Entitlement Check Job completed successfully.")
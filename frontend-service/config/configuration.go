@@ -4,9 +4,11 @@ import (
 	"encoding/json"
 	"errors"
 	"flag"
+	"github.com/cloudbees/cloud-bill-saas/common/retry"
 	"github.com/jefferyfry/funclog"
 	"os"
 	"strings"
+	"time"
 )
 
 var (
@@ -26,6 +28,12 @@ var (
 	TestMode							= "false"
 	SentryDsn							= ""
 	GcpProjectId				        = "cloud-billing-saas"
+	ShutdownTimeout						= "30s"
+	RetryMaxAttempts					= "4"
+	RetryInitialBackoff					= "100ms"
+	RetryMaxBackoff						= "5s"
+	RetryAttemptTimeout					= "10s"
+	RetryBudget							= "0.2"
 	
 	LogI = funclog.NewInfoLogger("INFO: ")
 	LogE = funclog.NewErrorLogger("ERROR: ")
@@ -48,6 +56,12 @@ type ServiceConfig struct {
 	TestMode    					string	`json:"testMode"`
 	SentryDsn						string	`json:"sentryDsn"`
 	GcpProjectId    				string	`json:"gcpProjectId"`
+	ShutdownTimeout					string	`json:"shutdownTimeout"`
+	RetryMaxAttempts				string	`json:"retryMaxAttempts"`
+	RetryInitialBackoff				string	`json:"retryInitialBackoff"`
+	RetryMaxBackoff					string	`json:"retryMaxBackoff"`
+	RetryAttemptTimeout				string	`json:"retryAttemptTimeout"`
+	RetryBudget						string	`json:"retryBudget"`
 }
 
 func GetConfiguration() (ServiceConfig, error) {
@@ -68,6 +82,12 @@ func GetConfiguration() (ServiceConfig, error) {
 		TestMode,
 		SentryDsn,
 		GcpProjectId,
+		ShutdownTimeout,
+		RetryMaxAttempts,
+		RetryInitialBackoff,
+		RetryMaxBackoff,
+		RetryAttemptTimeout,
+		RetryBudget,
 	}
 
 	if dir, err := os.Getwd(); err != nil {
@@ -95,6 +115,12 @@ func GetConfiguration() (ServiceConfig, error) {
 	testMode := flag.String("testMode", "", "set whether this runs in test mode")
 	sentryDsn := flag.String("sentryDsn", "", "set the Sentry DSN")
 	gcpProjectId := flag.String("gcpProjectId", "", "set the GCP Project Id")
+	shutdownTimeout := flag.String("shutdownTimeout", "", "set how long in-flight requests may take to finish on shutdown (ex. 30s)")
+	retryMaxAttempts := flag.String("retryMaxAttempts", "", "set how many times a request to another service is attempted (ex. 4)")
+	retryInitialBackoff := flag.String("retryInitialBackoff", "", "set the longest wait before the first retry, doubled for each retry (ex. 100ms)")
+	retryMaxBackoff := flag.String("retryMaxBackoff", "", "set the longest wait between retries (ex. 5s)")
+	retryAttemptTimeout := flag.String("retryAttemptTimeout", "", "set the deadline of each attempt of a request to another service (ex. 10s)")
+	retryBudget := flag.String("retryBudget", "", "set how many retries are allowed per request on average (ex. 0.2)")
 	flag.Parse()
 
 	//try environment variables if necessary
@@ -149,6 +175,24 @@ func GetConfiguration() (ServiceConfig, error) {
 	if *sentryDsn == "" {
 		*sentryDsn = os.Getenv("CLOUD_BILL_FRONTEND_SENTRY_DSN")
 	}
+	if *shutdownTimeout == "" {
+		*shutdownTimeout = os.Getenv("CLOUD_BILL_FRONTEND_SHUTDOWN_TIMEOUT")
+	}
+	if *retryMaxAttempts == "" {
+		*retryMaxAttempts = os.Getenv("CLOUD_BILL_FRONTEND_RETRY_MAX_ATTEMPTS")
+	}
+	if *retryInitialBackoff == "" {
+		*retryInitialBackoff = os.Getenv("CLOUD_BILL_FRONTEND_RETRY_INITIAL_BACKOFF")
+	}
+	if *retryMaxBackoff == "" {
+		*retryMaxBackoff = os.Getenv("CLOUD_BILL_FRONTEND_RETRY_MAX_BACKOFF")
+	}
+	if *retryAttemptTimeout == "" {
+		*retryAttemptTimeout = os.Getenv("CLOUD_BILL_FRONTEND_RETRY_ATTEMPT_TIMEOUT")
+	}
+	if *retryBudget == "" {
+		*retryBudget = os.Getenv("CLOUD_BILL_FRONTEND_RETRY_BUDGET")
+	}
 
 	if *configFile == "" {
 		//try other flags
@@ -168,6 +212,24 @@ func GetConfiguration() (ServiceConfig, error) {
 		conf.TestMode = *testMode
 		conf.SentryDsn = *sentryDsn
 		conf.GcpProjectId = *gcpProjectId
+		if *shutdownTimeout != "" {
+			conf.ShutdownTimeout = *shutdownTimeout
+		}
+		if *retryMaxAttempts != "" {
+			conf.RetryMaxAttempts = *retryMaxAttempts
+		}
+		if *retryInitialBackoff != "" {
+			conf.RetryInitialBackoff = *retryInitialBackoff
+		}
+		if *retryMaxBackoff != "" {
+			conf.RetryMaxBackoff = *retryMaxBackoff
+		}
+		if *retryAttemptTimeout != "" {
+			conf.RetryAttemptTimeout = *retryAttemptTimeout
+		}
+		if *retryBudget != "" {
+			conf.RetryBudget = *retryBudget
+		}
 	} else {
 		if file, err := os.Open(*configFile); err != nil {
 			LogE.Printf("Error reading confile file %s %s", *configFile, err)
@@ -267,6 +329,16 @@ func GetConfiguration() (ServiceConfig, error) {
 		valid = false
 	}
 
+	if timeout, err := time.ParseDuration(conf.ShutdownTimeout); err != nil || timeout < 0 {
+		LogE.Printf("ShutdownTimeout %s is not a valid duration. \n", conf.ShutdownTimeout)
+		valid = false
+	}
+
+	if _, err := retry.ParsePolicy(conf.RetryMaxAttempts, conf.RetryInitialBackoff, conf.RetryMaxBackoff, conf.RetryAttemptTimeout, conf.RetryBudget); err != nil {
+		LogE.Printf("Retry configuration is not valid: %v \n", err)
+		valid = false
+	}
+
 	if gAppCredPath,gAppCredExists := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS"); !gAppCredExists {
 		LogE.Println("GOOGLE_APPLICATION_CREDENTIALS was not set. ")
 		valid = false
@@ -3,6 +3,7 @@ module github.com/cloudbees/cloud-bill-saas/frontend-service
 go 1.12
 
 require (
+	github.com/cloudbees/cloud-bill-saas/common v0.0.0
 	github.com/coreos/go-oidc v2.1.0+incompatible
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
 	github.com/getsentry/sentry-go v0.3.0
@@ -16,3 +17,5 @@ require (
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
 	gopkg.in/square/go-jose.v2 v2.3.1 // indirect
 )
+
+replace github.com/cloudbees/cloud-bill-saas/common => ../common
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"github.com/cloudbees/cloud-bill-saas/common/procurement"
+	"github.com/cloudbees/cloud-bill-saas/common/retry"
 	"github.com/cloudbees/cloud-bill-saas/frontend-service/config"
 	"github.com/cloudbees/cloud-bill-saas/frontend-service/web"
 	"github.com/getsentry/sentry-go"
 	"github.com/jefferyfry/funclog"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -36,6 +42,30 @@ func main() {
 		sentry.Flush(time.Second * 5)
 	}
 
+	//retry transient failures of the marketplace APIs and the subscription service
+	retryPolicy, _ := retry.ParsePolicy(config.RetryMaxAttempts,config.RetryInitialBackoff,config.RetryMaxBackoff,config.RetryAttemptTimeout,config.RetryBudget)
+	httpClient := retry.NewClient(retryPolicy)
+	procurementClient := procurement.NewClientWithTransport(config.CloudCommerceProcurementUrl, config.GoogleSubscriptionsUrl, config.PartnerId, httpClient.Transport)
+
+	shutdownTimeout, _ := time.ParseDuration(config.ShutdownTimeout)
+
 	//start web service
-	LogE.Fatal(web.SetUpService(config.FrontendServiceEndpoint,config.HealthCheckEndpoint,config.SubscriptionServiceUrl,config.GoogleSubscriptionsUrl,config.ClientId,config.ClientSecret,config.CallbackUrl,config.Issuer,config.SessionKey,config.CloudCommerceProcurementUrl,config.PartnerId,config.FinishUrl,config.FinishUrlTitle,config.TestMode))
+	if err := web.SetUpService(shutdownContext(),shutdownTimeout,config.FrontendServiceEndpoint,config.HealthCheckEndpoint,config.SubscriptionServiceUrl,httpClient,config.GoogleSubscriptionsUrl,config.ClientId,config.ClientSecret,config.CallbackUrl,config.Issuer,config.SessionKey,procurementClient,config.PartnerId,config.FinishUrl,config.FinishUrlTitle,config.TestMode); err != nil {
+		LogE.Fatal(err)
+	}
+	LogI.Println("Cloud Bill SaaS Frontend Service stopped.")
+}
+
+//shutdownContext returns a context that is cancelled when the service receives SIGTERM, as on a Kubernetes rollout, or
+//an interrupt.
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		LogI.Printf("Received %s, shutting down... \n", sig)
+		cancel()
+	}()
+	return ctx
 }
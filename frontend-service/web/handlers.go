@@ -5,9 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"net/http/httputil"
 	"regexp"
 	"strings"
 	"time"
@@ -15,6 +12,7 @@ import (
 	"context"
 	"encoding/base64"
 	"errors"
+	"github.com/cloudbees/cloud-bill-saas/common/procurement"
 	"github.com/cloudbees/cloud-bill-saas/frontend-service/auth"
 	"github.com/coreos/go-oidc"
 	"github.com/dgrijalva/jwt-go"
@@ -31,8 +29,9 @@ var (
 	Store *sessions.CookieStore
 
 	subscriptionServiceBaseUrl string
-	googleSubscriptionsBaseUrl string
-	cloudCommerceProcurementBaseUrl string
+	//subscriptionServiceClient sends the signup requests to the subscription service
+	subscriptionServiceClient = http.DefaultClient
+	procurementClient procurement.Client
 
 	LogI = funclog.NewInfoLogger("INFO: ")
 	LogE = funclog.NewErrorLogger("ERROR: ")
@@ -45,7 +44,7 @@ type SubscriptionFrontendHandler struct {
 	ClientSecret string
 	CallbackUrl string
 	Issuer string
-	CloudCommerceProcurementUrl string
+	ProcurementClient procurement.Client
 	PartnerId string
 	FinishUrl string
 	FinishUrlTitle string
@@ -80,39 +79,16 @@ type Contact struct {
 	Timezone		string     	`json:"timezone,omitempty"`
 }
 
-type PartnerSubscriptions struct {
-	Subscriptions 	[]Subscription   `json:"subscriptions,omitempty"`
-}
-
-type Subscription struct {
-	Name 				string     	`json:"name"`
-	ExternalAccountId 	string     	`json:"externalAccountId"`
-	Version				string     	`json:"version,omitempty"`
-	Status				string     	`json:"status"`
-	SubscribedResources	[]SubscribedResource     	`json:"subscribedResources"`
-	RequiredApprovals	string     	`json:"requiredApprovals,omitempty"`
-	StartDate			json.RawMessage     	`json:"startDate,omitempty"`
-	EndDate				json.RawMessage     	`json:"endDate,omitempty"`
-	CreateTime			string     	`json:"createTime,omitempty"`
-	UpdateTime			string     	`json:"updateTime,omitempty"`
-}
-
-type SubscribedResource struct {
-	SubscriptionProvider 	string     	`json:"subscriptionProvider"`
-	Resource 				string     	`json:"resource"`
-	Labels					json.RawMessage     	`json:"labels,omitempty"`
-}
-
 type Finish struct {
 	FinishUrl 		string `json:"finishUrl"`
 	FinishUrlTitle 	string `json:"finishUrlTitle"`
 }
 
-func GetSubscriptionFrontendHandler(subscriptionServiceUrl string,googleSubscriptionsUrl string,clientId string, clientSecret string, callbackUrl string, issuer string, sessionKey string, cloudCommerceProcurementUrl string, partnerId string, finishUrl string, finishUrlTitle string) *SubscriptionFrontendHandler {
+func GetSubscriptionFrontendHandler(subscriptionServiceUrl string,httpClient *http.Client,googleSubscriptionsUrl string,clientId string, clientSecret string, callbackUrl string, issuer string, sessionKey string, procurementApiClient procurement.Client, partnerId string, finishUrl string, finishUrlTitle string) *SubscriptionFrontendHandler {
 	Store = sessions.NewCookieStore([]byte(sessionKey))
 	subscriptionServiceBaseUrl = subscriptionServiceUrl
-	googleSubscriptionsBaseUrl = googleSubscriptionsUrl
-	cloudCommerceProcurementBaseUrl = cloudCommerceProcurementUrl
+	subscriptionServiceClient = httpClient
+	procurementClient = procurementApiClient
 	Store.Options = &sessions.Options{
 		Path:     "/",
 		MaxAge:   86400 * 7,
@@ -125,7 +101,7 @@ func GetSubscriptionFrontendHandler(subscriptionServiceUrl string,googleSubscrip
 		clientSecret,
 		callbackUrl,
 		issuer,
-		cloudCommerceProcurementUrl,
+		procurementApiClient,
 		partnerId,
 		finishUrl,
 		finishUrlTitle,
@@ -262,7 +238,7 @@ func (hdlr *SubscriptionFrontendHandler) ResetSaas(w http.ResponseWriter, r *htt
 		return
 	}
 
-	if err := postAccountReset(hdlr.PartnerId, acct[0], w); err != nil {
+	if err := postAccountReset(acct[0]); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	} else {
 		fmt.Fprintf(w,"Account %s has been reset.",acct[0])
@@ -458,7 +434,7 @@ func (hdlr *SubscriptionFrontendHandler) FinishSaas(w http.ResponseWriter, r *ht
 	if !createContact(contact, w) {
 		http.Error(w, "Failed to store contact info", http.StatusInternalServerError)
 	} else {
-		postAccountApproval(hdlr.PartnerId, contact.AccountId, w)
+		postAccountApproval(contact.AccountId)
 
 		if tmpl, err := template.ParseFiles("templates/finish.html"); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -540,18 +516,11 @@ func (hdlr *SubscriptionFrontendHandler) Healthz(w http.ResponseWriter, r *http.
 	subscriptionServiceUrl := hdlr.SubscriptionServiceUrl+"/healthz"
 	if subResp, err := http.Get(subscriptionServiceUrl); err == nil {
 		if subResp.StatusCode == http.StatusOK {
-			procurementUrl := hdlr.CloudCommerceProcurementUrl +  "/providers/" +  hdlr.PartnerId + "/accounts/"
-
-			if client, clientErr := google.DefaultClient(oauth2.NoContext,"https://www.googleapis.com/auth/cloud-platform"); clientErr != nil {
-				LogE.Printf("Healthz failed. Failed to create oath2 client for the procurement API %#v \n", clientErr)
-				w.WriteHeader(http.StatusInternalServerError)
+			if err := hdlr.ProcurementClient.Healthz(r.Context()); err != nil {
+				LogE.Printf("Healthz failed. Cloud Commerce API check failed: %#v \n", err)
+				http.Error(w,err.Error(),http.StatusInternalServerError)
 			} else {
-				if procResp, err := client.Get(procurementUrl); nil != err {
-					LogE.Printf("Healthz failed. Cloud Commerce API check failed: %s %#v \n", procurementUrl, err)
-					http.Error(w,err.Error(),procResp.StatusCode)
-				} else {
-					w.WriteHeader(procResp.StatusCode)
-				}
+				w.WriteHeader(http.StatusOK)
 			}
 		}
 	} else {
@@ -560,6 +529,9 @@ func (hdlr *SubscriptionFrontendHandler) Healthz(w http.ResponseWriter, r *http.
 	}
 }
 
+//signupSource identifies signups in the history of the accounts and entitlements they create.
+const signupSource = "frontend-service signup"
+
 func createProduct(entitlementId string,prod string, accountId string, w http.ResponseWriter) bool {
 	loc, _ := time.LoadLocation("UTC")
 	now := time.Now().In(loc).Format(time.RFC3339)
@@ -580,10 +552,11 @@ func createProduct(entitlementId string,prod string, accountId string, w http.Re
 	} else {
 		if prodReq, err := http.NewRequest(http.MethodPut, subscriptionServiceBaseUrl+"/entitlements", bytes.NewBuffer(productBytes)); nil != err {
 			w.WriteHeader(500)
-			fmt.Fprint(w, `{"error": "error with creating product upsert request %s"}`, err)
+			fmt.Fprintf(w, `{"error": "error with creating product upsert request %s"}`, err)
 			return false
 		} else {
-			if prodResp, err := http.DefaultClient.Do(prodReq); nil != err {
+			prodReq.Header.Set("X-Cloud-Bill-Source", signupSource)
+			if prodResp, err := subscriptionServiceClient.Do(prodReq); nil != err {
 				w.WriteHeader(prodResp.StatusCode)
 				fmt.Fprintf(w, `{"error": "error received from subscription service %s"}`, err)
 				return false
@@ -603,10 +576,11 @@ func createContact(contact Contact, w http.ResponseWriter) bool {
 	} else {
 		if contactReq, err := http.NewRequest(http.MethodPut, subscriptionServiceBaseUrl+"/contacts", bytes.NewBuffer(contactBytes)); nil != err {
 			w.WriteHeader(500)
-			fmt.Fprint(w, `{"error": "error with creating contact upsert request %s"}`, err)
+			fmt.Fprintf(w, `{"error": "error with creating contact upsert request %s"}`, err)
 			return false
 		} else {
-			if contactResp, err := http.DefaultClient.Do(contactReq); nil != err {
+			contactReq.Header.Set("X-Cloud-Bill-Source", signupSource)
+			if contactResp, err := subscriptionServiceClient.Do(contactReq); nil != err {
 				w.WriteHeader(contactResp.StatusCode)
 				fmt.Fprintf(w, `{"error": "error received from subscription service %s"}`, err)
 				return false
@@ -626,10 +600,11 @@ func createAccount(account Account, w http.ResponseWriter) bool {
 	} else {
 		if accountReq, err := http.NewRequest(http.MethodPut, subscriptionServiceBaseUrl+"/accounts", bytes.NewBuffer(accountBytes)); nil != err {
 			w.WriteHeader(500)
-			fmt.Fprint(w, `{"error": "error with creating account upsert request %s"}`, err)
+			fmt.Fprintf(w, `{"error": "error with creating account upsert request %s"}`, err)
 			return false
 		} else {
-			if accountResp, err := http.DefaultClient.Do(accountReq); nil != err {
+			accountReq.Header.Set("X-Cloud-Bill-Source", signupSource)
+			if accountResp, err := subscriptionServiceClient.Do(accountReq); nil != err {
 				w.WriteHeader(accountResp.StatusCode)
 				fmt.Fprintf(w, `{"error": "error received from subscription service %s"}`, err)
 				return false
@@ -641,131 +616,34 @@ func createAccount(account Account, w http.ResponseWriter) bool {
 	}
 }
 
-func postAccountApproval(partnerId string,accountName string, w http.ResponseWriter) error {
-	procurementUrl := cloudCommerceProcurementBaseUrl +  "/providers/" +  partnerId + "/accounts/" + accountName + ":approve"
-	jsonApproval := []byte(`
-			{
-				"approvalName": "signup"
-			}`)
-	if client, clientErr := google.DefaultClient(oauth2.NoContext,"https://www.googleapis.com/auth/cloud-platform"); clientErr != nil {
-		LogE.Printf("Failed to create oath2 client for the procurement API %#v \n", clientErr)
-		return clientErr
-	} else {
-		LogI.Printf("Sending account approval: %s \n", procurementUrl)
-		if procResp, err := client.Post(procurementUrl, "", bytes.NewBuffer(jsonApproval)); nil != err {
-			LogE.Printf("Failed sending entitlement approval request %s %#v \n", procurementUrl, err)
-			return err
-		} else {
-			defer procResp.Body.Close()
-			if procResp.StatusCode != 200 {
-				LogE.Println("Account approval received error response: ", procResp.StatusCode)
-				responseDump, _ := httputil.DumpResponse(procResp, true)
-				LogE.Println(string(responseDump))
-				return errors.New("Account approval received error response: " + procResp.Status)
-			} else {
-				LogI.Printf("%s %s", procurementUrl, procResp.Status)
-			}
-			return nil
-		}
-	}
+func postAccountApproval(accountName string) error {
+	return procurementClient.ApproveAccount(context.Background(), accountName, "signup")
 }
 
-func postAccountReset(partnerId string,accountName string,w http.ResponseWriter) error {
-	procurementUrl := cloudCommerceProcurementBaseUrl +  "/providers/" +  partnerId + "/accounts/" + accountName + ":reset"
-	if client, clientErr := google.DefaultClient(oauth2.NoContext,"https://www.googleapis.com/auth/cloud-platform"); clientErr != nil {
-		LogE.Printf("Failed to create oath2 client for the procurement API %#v \n", clientErr)
-		return clientErr
-	} else {
-		LogI.Printf("Sending account reset: %s \n", procurementUrl)
-		if procResp, err := client.Post(procurementUrl, "", nil); nil != err {
-			LogE.Printf("Failed sending account reset request %s %#v \n", procurementUrl, err)
-			return err
-		} else {
-			defer procResp.Body.Close()
-			if procResp.StatusCode != 200 {
-				LogE.Println("Account reset received error response: ", procResp.StatusCode)
-				responseDump, _ := httputil.DumpResponse(procResp, true)
-				LogE.Println(string(responseDump))
-				return errors.New("Account reset received error response: " + procResp.Status)
-			}
-			return nil
-		}
-	}
+func postAccountReset(accountName string) error {
+	return procurementClient.ResetAccount(context.Background(), accountName)
 }
 
+//isProdAccountValid returns whether the account has a partner subscription to prod.
 func isProdAccountValid(accountId string, prod string) (bool, error) {
-	subscriptionsUrl := googleSubscriptionsBaseUrl+"/partnerSubscriptions?externalAccountId="+accountId
-	if client, clientErr := google.DefaultClient(oauth2.NoContext, "https://www.googleapis.com/auth/cloud-platform"); clientErr != nil {
-		LogE.Printf("Failed to create oath2 client for the procurement API %#v \n", clientErr)
-		return false, clientErr
-	} else {
-		LogI.Printf("Validating account : %s \n", subscriptionsUrl)
-		if subResp, err := client.Get(subscriptionsUrl); nil != err {
-			LogE.Printf("Failed validating account request %s %#v \n", subscriptionsUrl, err)
-			return false, err
-		} else {
-			defer subResp.Body.Close()
-			if subResp.StatusCode != 200 {
-				LogE.Println("Account check received error response: ", subResp.StatusCode)
-				responseDump, _ := httputil.DumpResponse(subResp, true)
-				LogE.Println(string(responseDump))
-				return false,errors.New("Account check received error response: " + subResp.Status)
-			}
-			responseDump, _ := httputil.DumpResponse(subResp, true)
-			responseString := string(responseDump)
-			if strings.Contains(responseString,prod) {
-				return true, nil
-			} else {
-				return false, nil
-			}
-		}
-	}
+	entitlementId, err := getProdEntitlementId(accountId, prod)
+	return entitlementId != "", err
 }
 
+//getProdEntitlementId returns the id of the entitlement for the account's partner subscription to prod, or an empty
+//string if it has none.
 func getProdEntitlementId(accountId string, prod string) (string, error) {
-	subscriptionsUrl := googleSubscriptionsBaseUrl+"/partnerSubscriptions?externalAccountId="+accountId
-	if client, clientErr := google.DefaultClient(oauth2.NoContext, "https://www.googleapis.com/auth/cloud-platform"); clientErr != nil {
-		LogE.Printf("Failed to create oath2 client for the procurement API %#v \n", clientErr)
-		return "", clientErr
-	} else {
-		LogI.Printf("Getting subscription entitlements : %s \n", subscriptionsUrl)
-		if subResp, err := client.Get(subscriptionsUrl); nil != err {
-			LogE.Printf("Failed subscription entitlements request %s %#v \n", subscriptionsUrl, err)
-			return "", err
-		} else {
-			defer subResp.Body.Close()
-			if subResp.StatusCode != 200 {
-				LogE.Println("Getting subscription entitlements received error response: ", subResp.StatusCode)
-				responseDump, _ := httputil.DumpResponse(subResp, true)
-				LogE.Println(string(responseDump))
-				return "",errors.New("Getting subscription entitlements received error response: " + subResp.Status)
-			}
-			partnerSubscriptions := PartnerSubscriptions{}
-			if err = json.NewDecoder(subResp.Body).Decode(&partnerSubscriptions); err != nil {
-				LogE.Printf("Error decoding subscriptions %s %#v %#v \n", subscriptionsUrl, subResp.Body, err)
-				responseDump, _ := httputil.DumpResponse(subResp, true)
-				LogE.Println(string(responseDump))
-				return "",err
-			}
-
-			for _, subscription := range partnerSubscriptions.Subscriptions {
-				if len(subscription.SubscribedResources) > 0 {
-					for _, resource := range subscription.SubscribedResources {
-						if resource.Resource == prod {
-							LogI.Printf("Subscription name is '%s'",subscription.Name)
-							entitlementId := strings.TrimPrefix(subscription.Name,"partnerSubscriptions/")
-							return entitlementId,nil
-						}
-					}
-				}
+	subscriptions, err := procurementClient.ListSubscriptions(context.Background(), accountId)
+	if err != nil {
+		return "", err
+	}
+	for _, subscription := range subscriptions {
+		for _, resource := range subscription.SubscribedResources {
+			if resource.Resource == prod {
+				LogI.Printf("Subscription name is '%s'",subscription.Name)
+				return strings.TrimPrefix(subscription.Name,procurement.SubscriptionPrefix),nil
 			}
 		}
 	}
 	return "", nil
 }
-
-
-
-
-
-
@@ -1,18 +1,23 @@
 package web
 
 import (
+	"context"
+	"github.com/cloudbees/cloud-bill-saas/common/procurement"
 	"github.com/gorilla/mux"
 	"net/http"
 	"strconv"
+	"time"
 )
 
-//SetUpService sets up the subscription service.
-func SetUpService(webServiceEndpoint string,healthCheckEndpoint string,subscriptionServiceUrl string,googleSubscriptionsUrl string,clientId string, clientSecret string, callbackUrl string, issuer string, sessionKey string, cloudCommerceProcurementUrl string, partnerId string, finishUrl string, finishUrlTitle string, testMode string) error {
-	handler := GetSubscriptionFrontendHandler(subscriptionServiceUrl,googleSubscriptionsUrl,clientId, clientSecret, callbackUrl, issuer, sessionKey, cloudCommerceProcurementUrl, partnerId, finishUrl, finishUrlTitle)
+//SetUpService sets up the frontend service and serves it until ctx is done. Requests in flight then have up to
+//shutdownTimeout to finish.
+func SetUpService(ctx context.Context, shutdownTimeout time.Duration, webServiceEndpoint string,healthCheckEndpoint string,subscriptionServiceUrl string,subscriptionServiceClient *http.Client,googleSubscriptionsUrl string,clientId string, clientSecret string, callbackUrl string, issuer string, sessionKey string, procurementClient procurement.Client, partnerId string, finishUrl string, finishUrlTitle string, testMode string) error {
+	handler := GetSubscriptionFrontendHandler(subscriptionServiceUrl,subscriptionServiceClient,googleSubscriptionsUrl,clientId, clientSecret, callbackUrl, issuer, sessionKey, procurementClient, partnerId, finishUrl, finishUrlTitle)
 
 	healthCheck := mux.NewRouter()
 	healthCheck.Methods(http.MethodGet).Path("/healthz").HandlerFunc(handler.Healthz)
-	go http.ListenAndServe(":"+healthCheckEndpoint, healthCheck)
+	healthCheckServer := &http.Server{Addr: ":"+healthCheckEndpoint, Handler: healthCheck}
+	go healthCheckServer.ListenAndServe()
 
 	webService := mux.NewRouter()
 	if testModeBool,err := strconv.ParseBool(testMode); err==nil && testModeBool {
@@ -32,5 +37,31 @@ func SetUpService(webServiceEndpoint string,healthCheckEndpoint string,subscript
 		http.Redirect(w, r, "https://www.cloudbees.com", http.StatusFound)
 	})
 
-	return http.ListenAndServe(":"+webServiceEndpoint, webService)
+	webServiceServer := &http.Server{Addr: ":"+webServiceEndpoint, Handler: webService}
+	return serve(ctx, shutdownTimeout, webServiceServer, healthCheckServer)
+}
+
+//serve runs server until ctx is done, then shuts it down and the other servers after it, waiting up to shutdownTimeout
+//for their requests in flight. The health check keeps answering until the service has drained.
+func serve(ctx context.Context, shutdownTimeout time.Duration, server *http.Server, others ...*http.Server) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	LogI.Printf("Shutting down, waiting up to %s for requests in flight \n", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	for _, other := range others {
+		if otherErr := other.Shutdown(shutdownCtx); err == nil {
+			err = otherErr
+		}
+	}
+	return err
 }
\ No newline at end of file
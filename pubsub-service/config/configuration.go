@@ -4,9 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"flag"
+	"github.com/cloudbees/cloud-bill-saas/common/retry"
 	"github.com/jefferyfry/funclog"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -17,6 +20,17 @@ var (
 	PartnerId							= "000"
 	GcpProjectId				        = "cloud-billing-saas"
 	SentryDsn							= ""
+	MaxDeliveryAttempts					= "5"
+	MaxOutstandingMessages				= "10"
+	NumGoroutines						= "1"
+	ShutdownTimeout						= "30s"
+	PushKeysUrl							= "https://www.googleapis.com/oauth2/v3/certs"
+	AdminEndpoint						= "8098"
+	RetryMaxAttempts					= "4"
+	RetryInitialBackoff					= "100ms"
+	RetryMaxBackoff						= "5s"
+	RetryAttemptTimeout					= "10s"
+	RetryBudget							= "0.2"
 
 	LogI = funclog.NewInfoLogger("INFO: ")
 	LogE = funclog.NewErrorLogger("ERROR: ")
@@ -30,6 +44,23 @@ type ServiceConfig struct {
 	PartnerId    					string	`json:"partnerId"`
 	GcpProjectId    				string	`json:"gcpProjectId"`
 	SentryDsn						string	`json:"sentryDsn"`
+	MaxDeliveryAttempts				string	`json:"maxDeliveryAttempts"`
+	ReplayFile						string	`json:"replayFile"`
+	ReplayDryRun					bool	`json:"replayDryRun"`
+	ApprovalPolicyFile				string	`json:"approvalPolicyFile"`
+	MaxOutstandingMessages			string	`json:"maxOutstandingMessages"`
+	NumGoroutines					string	`json:"numGoroutines"`
+	ShutdownTimeout					string	`json:"shutdownTimeout"`
+	PushMode						bool	`json:"pushMode"`
+	PushAudience					string	`json:"pushAudience"`
+	PushServiceAccount				string	`json:"pushServiceAccount"`
+	PushKeysUrl						string	`json:"pushKeysUrl"`
+	AdminEndpoint					string	`json:"adminEndpoint"`
+	RetryMaxAttempts				string	`json:"retryMaxAttempts"`
+	RetryInitialBackoff				string	`json:"retryInitialBackoff"`
+	RetryMaxBackoff					string	`json:"retryMaxBackoff"`
+	RetryAttemptTimeout				string	`json:"retryAttemptTimeout"`
+	RetryBudget						string	`json:"retryBudget"`
 }
 
 func GetConfiguration() (ServiceConfig, error) {
@@ -41,6 +72,23 @@ func GetConfiguration() (ServiceConfig, error) {
 		PartnerId,
 		GcpProjectId,
 		SentryDsn,
+		MaxDeliveryAttempts,
+		"",
+		false,
+		"",
+		MaxOutstandingMessages,
+		NumGoroutines,
+		ShutdownTimeout,
+		false,
+		"",
+		"",
+		PushKeysUrl,
+		AdminEndpoint,
+		RetryMaxAttempts,
+		RetryInitialBackoff,
+		RetryMaxBackoff,
+		RetryAttemptTimeout,
+		RetryBudget,
 	}
 
 	if dir, err := os.Getwd(); err != nil {
@@ -59,6 +107,23 @@ func GetConfiguration() (ServiceConfig, error) {
 	partnerId := flag.String("partnerId", "", "set the CloudBees Partner Id")
 	gcpProjectId := flag.String("gcpProjectId", "", "set the GCP Project Id")
 	sentryDsn := flag.String("sentryDsn", "", "set the Sentry DSN")
+	maxDeliveryAttempts := flag.String("maxDeliveryAttempts", "", "set how many times a marketplace event is processed before it is dead lettered")
+	replayFile := flag.String("replayFile", "", "replay the PubSubMsg JSON lines in this file and exit instead of listening")
+	replayDryRun := flag.String("replayDryRun", "", "set to true to replay without writing anything")
+	approvalPolicyFile := flag.String("approvalPolicyFile", "", "set the path to the entitlement approval policy json file")
+	maxOutstandingMessages := flag.String("maxOutstandingMessages", "", "set how many marketplace messages are processed at once")
+	numGoroutines := flag.String("numGoroutines", "", "set how many goroutines pull marketplace messages")
+	shutdownTimeout := flag.String("shutdownTimeout", "", "set how long outstanding messages may take to finish on shutdown (ex. 30s)")
+	pushMode := flag.String("pushMode", "", "set to true to receive messages from a push subscription instead of pulling them")
+	pushAudience := flag.String("pushAudience", "", "set the audience of the OIDC token on push requests")
+	pushServiceAccount := flag.String("pushServiceAccount", "", "set the service account email push requests must be signed by")
+	pushKeysUrl := flag.String("pushKeysUrl", "", "set the url of the keys that sign the OIDC token on push requests")
+	adminEndpoint := flag.String("adminEndpoint", "", "set the port of the replay and dead letter endpoints in push mode")
+	retryMaxAttempts := flag.String("retryMaxAttempts", "", "set how many times a request to another service is attempted (ex. 4)")
+	retryInitialBackoff := flag.String("retryInitialBackoff", "", "set the longest wait before the first retry, doubled for each retry (ex. 100ms)")
+	retryMaxBackoff := flag.String("retryMaxBackoff", "", "set the longest wait between retries (ex. 5s)")
+	retryAttemptTimeout := flag.String("retryAttemptTimeout", "", "set the deadline of each attempt of a request to another service (ex. 10s)")
+	retryBudget := flag.String("retryBudget", "", "set how many retries are allowed per request on average (ex. 0.2)")
 	flag.Parse()
 
 	//try environment variables if necessary
@@ -86,6 +151,57 @@ func GetConfiguration() (ServiceConfig, error) {
 	if *sentryDsn == "" {
 		*sentryDsn = os.Getenv("CLOUD_BILL_PUBSUB_SENTRY_DSN")
 	}
+	if *maxDeliveryAttempts == "" {
+		*maxDeliveryAttempts = os.Getenv("CLOUD_BILL_PUBSUB_MAX_DELIVERY_ATTEMPTS")
+	}
+	if *replayFile == "" {
+		*replayFile = os.Getenv("CLOUD_BILL_PUBSUB_REPLAY_FILE")
+	}
+	if *replayDryRun == "" {
+		*replayDryRun = os.Getenv("CLOUD_BILL_PUBSUB_REPLAY_DRY_RUN")
+	}
+	if *approvalPolicyFile == "" {
+		*approvalPolicyFile = os.Getenv("CLOUD_BILL_PUBSUB_APPROVAL_POLICY_FILE")
+	}
+	if *maxOutstandingMessages == "" {
+		*maxOutstandingMessages = os.Getenv("CLOUD_BILL_PUBSUB_MAX_OUTSTANDING_MESSAGES")
+	}
+	if *numGoroutines == "" {
+		*numGoroutines = os.Getenv("CLOUD_BILL_PUBSUB_NUM_GOROUTINES")
+	}
+	if *shutdownTimeout == "" {
+		*shutdownTimeout = os.Getenv("CLOUD_BILL_PUBSUB_SHUTDOWN_TIMEOUT")
+	}
+	if *pushMode == "" {
+		*pushMode = os.Getenv("CLOUD_BILL_PUBSUB_PUSH_MODE")
+	}
+	if *pushAudience == "" {
+		*pushAudience = os.Getenv("CLOUD_BILL_PUBSUB_PUSH_AUDIENCE")
+	}
+	if *pushServiceAccount == "" {
+		*pushServiceAccount = os.Getenv("CLOUD_BILL_PUBSUB_PUSH_SERVICE_ACCOUNT")
+	}
+	if *pushKeysUrl == "" {
+		*pushKeysUrl = os.Getenv("CLOUD_BILL_PUBSUB_PUSH_KEYS_URL")
+	}
+	if *adminEndpoint == "" {
+		*adminEndpoint = os.Getenv("CLOUD_BILL_PUBSUB_ADMIN_ENDPOINT")
+	}
+	if *retryMaxAttempts == "" {
+		*retryMaxAttempts = os.Getenv("CLOUD_BILL_PUBSUB_RETRY_MAX_ATTEMPTS")
+	}
+	if *retryInitialBackoff == "" {
+		*retryInitialBackoff = os.Getenv("CLOUD_BILL_PUBSUB_RETRY_INITIAL_BACKOFF")
+	}
+	if *retryMaxBackoff == "" {
+		*retryMaxBackoff = os.Getenv("CLOUD_BILL_PUBSUB_RETRY_MAX_BACKOFF")
+	}
+	if *retryAttemptTimeout == "" {
+		*retryAttemptTimeout = os.Getenv("CLOUD_BILL_PUBSUB_RETRY_ATTEMPT_TIMEOUT")
+	}
+	if *retryBudget == "" {
+		*retryBudget = os.Getenv("CLOUD_BILL_PUBSUB_RETRY_BUDGET")
+	}
 
 	if *configFile == "" {
 		//try other flags
@@ -96,6 +212,59 @@ func GetConfiguration() (ServiceConfig, error) {
 		conf.PartnerId = *partnerId
 		conf.GcpProjectId = *gcpProjectId
 		conf.SentryDsn = *sentryDsn
+		if *maxDeliveryAttempts != "" {
+			conf.MaxDeliveryAttempts = *maxDeliveryAttempts
+		}
+		conf.ReplayFile = *replayFile
+		if *replayDryRun != "" {
+			if dryRun, err := strconv.ParseBool(*replayDryRun); err != nil {
+				LogE.Printf("ReplayDryRun %s must be true or false. \n", *replayDryRun)
+				return conf, err
+			} else {
+				conf.ReplayDryRun = dryRun
+			}
+		}
+		conf.ApprovalPolicyFile = *approvalPolicyFile
+		if *maxOutstandingMessages != "" {
+			conf.MaxOutstandingMessages = *maxOutstandingMessages
+		}
+		if *numGoroutines != "" {
+			conf.NumGoroutines = *numGoroutines
+		}
+		if *shutdownTimeout != "" {
+			conf.ShutdownTimeout = *shutdownTimeout
+		}
+		if *pushMode != "" {
+			if push, err := strconv.ParseBool(*pushMode); err != nil {
+				LogE.Printf("PushMode %s must be true or false. \n", *pushMode)
+				return conf, err
+			} else {
+				conf.PushMode = push
+			}
+		}
+		conf.PushAudience = *pushAudience
+		conf.PushServiceAccount = *pushServiceAccount
+		if *pushKeysUrl != "" {
+			conf.PushKeysUrl = *pushKeysUrl
+		}
+		if *adminEndpoint != "" {
+			conf.AdminEndpoint = *adminEndpoint
+		}
+		if *retryMaxAttempts != "" {
+			conf.RetryMaxAttempts = *retryMaxAttempts
+		}
+		if *retryInitialBackoff != "" {
+			conf.RetryInitialBackoff = *retryInitialBackoff
+		}
+		if *retryMaxBackoff != "" {
+			conf.RetryMaxBackoff = *retryMaxBackoff
+		}
+		if *retryAttemptTimeout != "" {
+			conf.RetryAttemptTimeout = *retryAttemptTimeout
+		}
+		if *retryBudget != "" {
+			conf.RetryBudget = *retryBudget
+		}
 	} else {
 		if file, err := os.Open(*configFile); err != nil {
 			LogE.Printf("Error reading confile file %s %s", *configFile, err)
@@ -148,9 +317,61 @@ func GetConfiguration() (ServiceConfig, error) {
 		LogE.Println("SentryDsn was not set. Will run without Sentry.")
 	}
 
-	if gAppCredPath,gAppCredExists := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS"); !gAppCredExists {
-		LogE.Println("GOOGLE_APPLICATION_CREDENTIALS was not set. ")
+	if attempts, err := strconv.Atoi(conf.MaxDeliveryAttempts); err != nil || attempts < 1 {
+		LogE.Printf("MaxDeliveryAttempts %s is not a positive number. \n", conf.MaxDeliveryAttempts)
+		valid = false
+	}
+
+	if messages, err := strconv.Atoi(conf.MaxOutstandingMessages); err != nil || messages < 1 {
+		LogE.Printf("MaxOutstandingMessages %s is not a positive number. \n", conf.MaxOutstandingMessages)
+		valid = false
+	}
+
+	if goroutines, err := strconv.Atoi(conf.NumGoroutines); err != nil || goroutines < 1 {
+		LogE.Printf("NumGoroutines %s is not a positive number. \n", conf.NumGoroutines)
 		valid = false
+	}
+
+	if timeout, err := time.ParseDuration(conf.ShutdownTimeout); err != nil || timeout < 0 {
+		LogE.Printf("ShutdownTimeout %s is not a valid duration. \n", conf.ShutdownTimeout)
+		valid = false
+	}
+
+	if conf.ApprovalPolicyFile == "" {
+		LogI.Println("ApprovalPolicyFile was not set. Every entitlement request will be approved.")
+	}
+
+	if conf.PushMode {
+		if conf.PushAudience == "" {
+			LogE.Println("PushAudience was not set. It is required in push mode.")
+			valid = false
+		}
+		if conf.PushKeysUrl == "" {
+			LogE.Println("PushKeysUrl was not set. It is required in push mode.")
+			valid = false
+		}
+		if conf.PushServiceAccount == "" {
+			LogE.Println("PushServiceAccount was not set. Push requests signed by any Google service account will be accepted.")
+		}
+		if conf.AdminEndpoint == "" || conf.AdminEndpoint == conf.HealthCheckEndpoint {
+			LogE.Println("AdminEndpoint must be set to a port other than the HealthCheckEndpoint in push mode.")
+			valid = false
+		}
+	}
+
+	if _, err := retry.ParsePolicy(conf.RetryMaxAttempts, conf.RetryInitialBackoff, conf.RetryMaxBackoff, conf.RetryAttemptTimeout, conf.RetryBudget); err != nil {
+		LogE.Printf("Retry configuration is not valid: %v \n", err)
+		valid = false
+	}
+
+	if gAppCredPath,gAppCredExists := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS"); !gAppCredExists {
+		if conf.PushMode {
+			//Cloud Run provides credentials from the metadata server
+			LogE.Println("GOOGLE_APPLICATION_CREDENTIALS was not set. Using the default credentials of the environment. ")
+		} else {
+			LogE.Println("GOOGLE_APPLICATION_CREDENTIALS was not set. ")
+			valid = false
+		}
 	} else {
 		if _, gAppCredPathErr := os.Stat(gAppCredPath); os.IsNotExist(gAppCredPathErr) {
 			LogE.Println("GOOGLE_APPLICATION_CREDENTIALS file does not exist: ", gAppCredPath)
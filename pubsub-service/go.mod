@@ -3,9 +3,15 @@ module github.com/cloudbees/cloud-bill-saas/pubsub-service
 go 1.12
 
 require (
+	github.com/cloudbees/cloud-bill-saas/common v0.0.0
 	cloud.google.com/go/pubsub v1.0.1
+	github.com/coreos/go-oidc v2.1.0+incompatible
 	github.com/getsentry/sentry-go v0.3.0
 	github.com/gorilla/mux v1.7.3
 	github.com/jefferyfry/funclog v0.0.0-20191010235000-f6a0246169e0
+	github.com/pquerna/cachecontrol v0.0.0-20180517163645-1555304b9b35 // indirect
 	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
+	gopkg.in/square/go-jose.v2 v2.3.1
 )
+
+replace github.com/cloudbees/cloud-bill-saas/common => ../common
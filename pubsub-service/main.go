@@ -1,11 +1,20 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"github.com/cloudbees/cloud-bill-saas/common/procurement"
+	"github.com/cloudbees/cloud-bill-saas/common/retry"
 	"github.com/cloudbees/cloud-bill-saas/pubsub-service/config"
 	"github.com/cloudbees/cloud-bill-saas/pubsub-service/mpevents"
+	"github.com/cloudbees/cloud-bill-saas/pubsub-service/policy"
 	"github.com/cloudbees/cloud-bill-saas/pubsub-service/web"
 	"github.com/getsentry/sentry-go"
 	"github.com/jefferyfry/funclog"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 )
 
@@ -36,12 +45,104 @@ func main() {
 		sentry.Flush(time.Second * 5)
 	}
 
+	maxDeliveryAttempts, _ := strconv.ParseInt(config.MaxDeliveryAttempts, 10, 64)
+	maxOutstandingMessages, _ := strconv.Atoi(config.MaxOutstandingMessages)
+	numGoroutines, _ := strconv.Atoi(config.NumGoroutines)
+	shutdownTimeout, _ := time.ParseDuration(config.ShutdownTimeout)
+	approvalPolicy := policy.ApproveAll
+	if config.ApprovalPolicyFile != "" {
+		if approvalPolicy, err = policy.Load(config.ApprovalPolicyFile); err != nil {
+			LogE.Fatalf("Invalid approval policy: %v", err)
+		}
+		LogI.Printf("Using approval policy %s \n", config.ApprovalPolicyFile)
+	}
+
+	//retry transient failures of the procurement API and the subscription service
+	retryPolicy, _ := retry.ParsePolicy(config.RetryMaxAttempts,config.RetryInitialBackoff,config.RetryMaxBackoff,config.RetryAttemptTimeout,config.RetryBudget)
+	httpClient := retry.NewClient(retryPolicy)
+	procurementClient := procurement.NewClientWithTransport(config.CloudCommerceProcurementUrl, "", config.PartnerId, httpClient.Transport)
+	pubSubListener := mpevents.GetPubSubListener(config.PubSubSubscription,config.SubscriptionServiceUrl,httpClient,procurementClient,approvalPolicy,config.GcpProjectId,maxDeliveryAttempts,maxOutstandingMessages,numGoroutines)
+
+	ctx := shutdownContext()
+
+	//replay events from a file instead of listening
+	if config.ReplayFile != "" {
+		os.Exit(replayFile(ctx, config.ReplayFile, config.ReplayDryRun))
+	}
+
+	//receive pushed messages on the web service instead of listening
+	if config.PushMode {
+		LogI.Printf("Receiving messages pushed to /api/v1/push on port %s \n", config.HealthCheckEndpoint)
+		LogI.Printf("Serving replay and dead letters on port %s \n", config.AdminEndpoint)
+		pushVerifier := web.NewPushVerifier(config.PushAudience,config.PushServiceAccount,config.PushKeysUrl)
+		if err := web.SetUpService(ctx,config.HealthCheckEndpoint,config.AdminEndpoint,config.PubSubSubscription,config.SubscriptionServiceUrl,httpClient,procurementClient,config.GcpProjectId,shutdownTimeout,pushVerifier); err != nil {
+			LogE.Fatal(err)
+		}
+		LogI.Println("Cloud Bill SaaS PubSub Service stopped.")
+		return
+	}
+
 	//start the web service
-	go web.SetUpService(config.HealthCheckEndpoint,config.PubSubSubscription,config.SubscriptionServiceUrl,config.CloudCommerceProcurementUrl,config.PartnerId,config.GcpProjectId)
+	go web.SetUpService(ctx,config.HealthCheckEndpoint,config.AdminEndpoint,config.PubSubSubscription,config.SubscriptionServiceUrl,httpClient,procurementClient,config.GcpProjectId,shutdownTimeout,nil)
 
 	//start the pub sub listener
-	pubSubListener := mpevents.GetPubSubListener(config.PubSubSubscription,config.SubscriptionServiceUrl,config.CloudCommerceProcurementUrl,config.PartnerId,config.GcpProjectId)
-	LogE.Fatal(pubSubListener.Listen())
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- pubSubListener.Listen(ctx)
+	}()
+	select {
+	case err = <-listenErr:
+	case <-ctx.Done():
+		LogI.Printf("Waiting up to %s for outstanding messages \n", shutdownTimeout)
+		select {
+		case err = <-listenErr:
+		case <-time.After(shutdownTimeout):
+			LogE.Printf("Messages were still processing after %s, they will be redelivered. \n", shutdownTimeout)
+		}
+	}
+	if err != nil {
+		LogE.Fatal(err)
+	}
+	LogI.Println("Cloud Bill SaaS PubSub Service stopped.")
+}
+
+//shutdownContext returns a context that is cancelled when the service receives SIGTERM, as on a Kubernetes rollout, or
+//an interrupt.
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		LogI.Printf("Received %s, shutting down... \n", sig)
+		cancel()
+	}()
+	return ctx
 }
 
+//replayFile replays the PubSubMsg JSON lines in a file, writes the results to stdout as JSON and returns the exit
+//status, which is 1 if any event failed.
+func replayFile(ctx context.Context, path string, dryRun bool) int {
+	file, err := os.Open(path)
+	if err != nil {
+		LogE.Printf("Error opening replay file %s: %v", path, err)
+		return 1
+	}
+	defer file.Close()
 
+	LogI.Printf("Replaying events from %s, dry run %t \n", path, dryRun)
+	results, err := mpevents.Replay(ctx, file, dryRun)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(results)
+	if err != nil {
+		LogE.Printf("Error reading replay file %s: %v", path, err)
+		return 1
+	}
+	for _, result := range results {
+		if result.Outcome == mpevents.EventFailed {
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,285 @@
+package mpevents
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/cloudbees/cloud-bill-saas/pubsub-service/policy"
+	"net/http"
+	"net/http/httputil"
+	"path/filepath"
+	"time"
+)
+
+//PendingApproval is an entitlement creation or plan change request the approval policy held for manual review, stored
+//with the subscription service by entitlement id.
+type PendingApproval struct {
+	Id          string `json:"id"`
+	Account     string `json:"account"`
+	Request     string `json:"request"`
+	Product     string `json:"product"`
+	Plan        string `json:"plan"`
+	PendingPlan string `json:"pendingPlan,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+	EventId     string `json:"eventId,omitempty"`
+	CreateTime  string `json:"createTime"`
+}
+
+//States of the approval attempts recorded on an entitlement with the subscription service. An attempt is FAILED when
+//the procurement API call failed, the event is then nacked so the attempt is repeated when it is redelivered.
+const (
+	approvalApproved = "APPROVED"
+	approvalRejected = "REJECTED"
+	approvalPending  = "PENDING"
+	approvalFailed   = "FAILED"
+)
+
+//approver identifies the pubsub service as the approver of the attempts it records.
+const approver = "pubsub-service"
+
+//EntitlementApproval is an attempt to approve, reject or hold an entitlement creation or plan change, appended to the
+//approvals of the entitlement in the subscription service.
+type EntitlementApproval struct {
+	Name       string `json:"name"`
+	State      string `json:"state"`
+	Reason     string `json:"reason"`
+	UpdateTime string `json:"updateTime"`
+	Approver   string `json:"approver,omitempty"`
+}
+
+//decideEntitlementCreation approves, rejects or holds the activation of an entitlement as the approval policy decides.
+//There is nothing to decide if the entitlement is no longer waiting for approval, e.g. it was approved in the Partner
+//Portal.
+func decideEntitlementCreation(ctx context.Context, entitlement *Entitlement, eventId string, run *eventRun) error {
+	entitlementId := entitlement.Id
+	if entitlement.State != "ENTITLEMENT_ACTIVATION_REQUESTED" {
+		LogI.Printf("Entitlement %s is %s with no activation to approve. \n", entitlementId, entitlement.State)
+		return nil
+	}
+	decision, reason := approvalPolicy.Decide(policy.Request{
+		Type:      policy.EntitlementCreation,
+		Product:   entitlement.Product,
+		Plan:      entitlement.Plan,
+		AccountId: filepath.Base(entitlement.Account),
+	})
+	LogI.Printf("Approval policy: %s entitlement %s. %s \n", decision, entitlementId, reason)
+
+	var state string
+	var err error
+	switch decision {
+	case policy.Reject:
+		state = approvalRejected
+		err = run.do("reject entitlement "+entitlementId, func() error {
+			return procurementClient.RejectEntitlement(ctx, entitlementId, reason)
+		})
+	case policy.Hold:
+		if held, err := alreadyHeld(ctx, entitlementId, policy.EntitlementCreation, entitlement.Plan, ""); err != nil || held {
+			return err
+		}
+		state = approvalPending
+		err = run.do("hold entitlement "+entitlementId, func() error {
+			return savePendingApprovalToDb(ctx, &PendingApproval{
+				Id:      entitlementId,
+				Account: filepath.Base(entitlement.Account),
+				Request: policy.EntitlementCreation,
+				Product: entitlement.Product,
+				Plan:    entitlement.Plan,
+				Reason:  reason,
+				EventId: eventId,
+			})
+		})
+	default:
+		state = approvalApproved
+		err = run.do("approve entitlement "+entitlementId, func() error {
+			return procurementClient.ApproveEntitlement(ctx, entitlementId)
+		})
+	}
+	return recordApproval(ctx, entitlementId, policy.EntitlementCreation, state, reason, err, run)
+}
+
+//decidePlanChange approves, rejects or holds the change of an entitlement to its pending plan as the approval policy
+//decides. There is nothing to decide if the customer cancelled the change before the request was handled.
+func decidePlanChange(ctx context.Context, entitlementId string, eventId string, run *eventRun) error {
+	entitlement, err := procurementClient.GetEntitlement(ctx, entitlementId)
+	if err != nil {
+		LogE.Printf("Unable to determine entitlement to approve from procurement API %#v \n", err)
+		return err
+	}
+	if entitlement.State != "ENTITLEMENT_PENDING_PLAN_CHANGE_APPROVAL" || entitlement.NewPendingPlan == "" {
+		LogI.Printf("Entitlement %s is %s with no plan change to approve. \n", entitlementId, entitlement.State)
+		return nil
+	}
+
+	pendingPlan := entitlement.NewPendingPlan
+	decision, reason := approvalPolicy.Decide(policy.Request{
+		Type:      policy.PlanChange,
+		Product:   entitlement.Product,
+		Plan:      pendingPlan,
+		AccountId: filepath.Base(entitlement.Account),
+	})
+	LogI.Printf("Approval policy: %s plan change of entitlement %s to %s. %s \n", decision, entitlementId, pendingPlan, reason)
+
+	var state string
+	switch decision {
+	case policy.Reject:
+		state = approvalRejected
+		err = run.do("reject plan change of entitlement "+entitlementId, func() error {
+			return procurementClient.RejectPlanChange(ctx, entitlementId, pendingPlan, reason)
+		})
+	case policy.Hold:
+		if held, err := alreadyHeld(ctx, entitlementId, policy.PlanChange, entitlement.Plan, pendingPlan); err != nil || held {
+			return err
+		}
+		state = approvalPending
+		err = run.do("hold plan change of entitlement "+entitlementId, func() error {
+			return savePendingApprovalToDb(ctx, &PendingApproval{
+				Id:          entitlementId,
+				Account:     filepath.Base(entitlement.Account),
+				Request:     policy.PlanChange,
+				Product:     entitlement.Product,
+				Plan:        entitlement.Plan,
+				PendingPlan: pendingPlan,
+				Reason:      reason,
+				EventId:     eventId,
+			})
+		})
+	default:
+		state = approvalApproved
+		err = run.do("approve plan change of entitlement "+entitlementId, func() error {
+			return procurementClient.ApprovePlanChange(ctx, entitlementId, pendingPlan)
+		})
+	}
+	return recordApproval(ctx, entitlementId, policy.PlanChange, state, reason, err, run)
+}
+
+//alreadyHeld returns whether the same request for the same plans is already held for the entitlement, as it is when
+//the event is redelivered or the account becomes active again. It is then not held and recorded again.
+func alreadyHeld(ctx context.Context, entitlementId string, request string, plan string, pendingPlan string) (bool, error) {
+	pendingApproval, err := getPendingApprovalFromDb(ctx, entitlementId)
+	if err != nil {
+		LogE.Printf("Unable to check for a pending approval of entitlement %s due to error %#v \n", entitlementId, err)
+		return false, err
+	}
+	if pendingApproval != nil && pendingApproval.Request == request && pendingApproval.Plan == plan &&
+		pendingApproval.PendingPlan == pendingPlan {
+		LogI.Printf("%s of entitlement %s is already held since %s. \n", request, entitlementId, pendingApproval.CreateTime)
+		return true, nil
+	}
+	return false, nil
+}
+
+//recordApproval records the attempt to decide request on an entitlement and returns err, the error of the attempt. A
+//failed attempt is recorded with the error as its reason. Failing to record the attempt does not fail the event, the
+//approval itself is what matters.
+func recordApproval(ctx context.Context, entitlementId string, request string, state string, reason string, err error, run *eventRun) error {
+	if err != nil {
+		LogE.Printf("Unable to decide %s of entitlement %s due to error %#v \n", request, entitlementId, err)
+		state, reason = approvalFailed, err.Error()
+	}
+	approval := &EntitlementApproval{
+		Name:       request,
+		State:      state,
+		Reason:     reason,
+		UpdateTime: time.Now().UTC().Format(time.RFC3339Nano),
+		Approver:   approver,
+	}
+	if recordErr := run.do("record "+state+" "+request+" approval of entitlement "+entitlementId, func() error {
+		return saveApprovalToDb(ctx, entitlementId, approval, run.source)
+	}); recordErr != nil {
+		LogE.Printf("Unable to record approval of entitlement %s due to error %#v \n", entitlementId, recordErr)
+	}
+	return err
+}
+
+func saveApprovalToDb(ctx context.Context, entitlementId string, approval *EntitlementApproval, source string) error {
+	approvalBytes, err := json.Marshal(approval)
+	if err != nil {
+		LogE.Printf("Error marshalling approval %#v \n", err)
+		return err
+	}
+	url := subscriptionServiceBaseUrl + "/entitlements/" + entitlementId + "/approvals"
+	approvalReq, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(approvalBytes))
+	if nil != err {
+		LogE.Printf("Failed creating approval request %s %#v \n", subscriptionServiceBaseUrl, err)
+		return err
+	}
+	approvalReq.Header.Set("X-Cloud-Bill-Source", source)
+	approvalReq = approvalReq.WithContext(ctx)
+	approvalResp, err := subscriptionServiceClient.Do(approvalReq)
+	if err != nil {
+		LogE.Printf("Failed sending approval request %s %#v \n", subscriptionServiceBaseUrl, err)
+		return err
+	}
+	defer approvalResp.Body.Close()
+	if approvalResp.StatusCode != 204 {
+		LogE.Println("Record approval received error response: ", approvalResp.StatusCode)
+		responseDump, _ := httputil.DumpResponse(approvalResp, true)
+		LogE.Println(string(responseDump))
+		return errors.New(approvalResp.Status)
+	}
+	LogI.Printf("Recorded %s approval %s of entitlement %s", approval.State, approval.Name, entitlementId)
+	return nil
+}
+
+func savePendingApprovalToDb(ctx context.Context, approval *PendingApproval) error {
+	if approval.CreateTime == "" {
+		approval.CreateTime = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	approvalBytes, err := json.Marshal(approval)
+	if err != nil {
+		LogE.Printf("Error marshalling pending approval %#v \n", err)
+		return err
+	}
+	url := subscriptionServiceBaseUrl + "/pendingapprovals"
+	approvalReq, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(approvalBytes))
+	if nil != err {
+		LogE.Printf("Failed creating pending approval update request %s %#v \n", subscriptionServiceBaseUrl, err)
+		return err
+	}
+	approvalReq = approvalReq.WithContext(ctx)
+	approvalResp, err := subscriptionServiceClient.Do(approvalReq)
+	if err != nil {
+		LogE.Printf("Failed sending pending approval update request %s %#v \n", subscriptionServiceBaseUrl, err)
+		return err
+	}
+	defer approvalResp.Body.Close()
+	if approvalResp.StatusCode != 204 {
+		LogE.Println("Update pending approval received error response: ", approvalResp.StatusCode)
+		responseDump, _ := httputil.DumpResponse(approvalResp, true)
+		LogE.Println(string(responseDump))
+		return errors.New(approvalResp.Status)
+	}
+	LogI.Printf("Saved pending approval %s %s", approval.Id, approval.Request)
+	return nil
+}
+
+//getPendingApprovalFromDb returns the pending approval of an entitlement, or nil if none is held.
+func getPendingApprovalFromDb(ctx context.Context, entitlementId string) (*PendingApproval, error) {
+	url := subscriptionServiceBaseUrl + "/pendingapprovals/" + entitlementId
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		LogE.Printf("Failed creating pending approval request %s %#v \n", url, err)
+		return nil, err
+	}
+	resp, err := subscriptionServiceClient.Do(req.WithContext(ctx))
+	if err != nil {
+		LogE.Printf("Failed to get pending approval %s %#v \n", url, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != 200 {
+		LogE.Println("Get pending approval received error response: ", resp.StatusCode)
+		responseDump, _ := httputil.DumpResponse(resp, true)
+		LogE.Println(string(responseDump))
+		return nil, errors.New(resp.Status)
+	}
+	pendingApproval := PendingApproval{}
+	if err := json.NewDecoder(resp.Body).Decode(&pendingApproval); err != nil {
+		LogE.Printf("Failed decoding pending approval %s %#v \n", url, err)
+		return nil, err
+	}
+	return &pendingApproval, nil
+}
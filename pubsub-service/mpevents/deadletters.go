@@ -0,0 +1,153 @@
+package mpevents
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"time"
+)
+
+//DeadLetter is a marketplace message that failed too many times, or could not be decoded, stored with the subscription
+//service until it is replayed.
+type DeadLetter struct {
+	Id         string `json:"id"`
+	EventId    string `json:"eventId,omitempty"`
+	EventType  string `json:"eventType,omitempty"`
+	Data       string `json:"data"`
+	Error      string `json:"error"`
+	Attempts   int64  `json:"attempts"`
+	CreateTime string `json:"createTime"`
+}
+
+//ErrDeadLetterNotFound is returned when replaying a dead letter that does not exist.
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+//ReplayDeadLetter processes a dead lettered message again. On success the dead letter is removed and the event is
+//recorded as succeeded, otherwise the dead letter is updated with the new error, which is returned.
+func ReplayDeadLetter(ctx context.Context, deadLetterId string) (*Event, error) {
+	deadLetter, err := getDeadLetterFromDb(ctx, deadLetterId)
+	if err != nil {
+		return nil, err
+	} else if deadLetter == nil {
+		return nil, ErrDeadLetterNotFound
+	}
+
+	LogI.Printf("Replaying dead letter %s \n", deadLetterId)
+	pubSubMsg := PubSubMsg{}
+	processErr := json.Unmarshal([]byte(deadLetter.Data), &pubSubMsg)
+	if processErr == nil && pubSubMsg.EventId == "" {
+		processErr = errors.New("message has no event ID")
+	}
+	if processErr == nil {
+		unlock := eventLocks.lock(orderingKey(pubSubMsg))
+		processErr = processPubSubMsg(ctx, pubSubMsg, newEventRun(pubSubMsg, false))
+		unlock()
+	}
+	deadLetter.Attempts++
+	if processErr != nil {
+		deadLetter.Error = processErr.Error()
+		if err := saveDeadLetterToDb(ctx, deadLetter); err != nil {
+			LogE.Printf("Unable to update dead letter %s due to error %#v \n", deadLetterId, err)
+		}
+		return nil, processErr
+	}
+
+	event := newEvent(pubSubMsg)
+	event.Attempts = deadLetter.Attempts
+	if err := saveEventToDb(ctx, &event); err != nil {
+		LogE.Printf("Unable to record the outcome of event %s due to error %#v \n", event.Id, err)
+	}
+	if err := deleteDeadLetterFromDb(ctx, deadLetterId); err != nil {
+		return &event, err
+	}
+	LogI.Printf("Replayed dead letter %s \n", deadLetterId)
+	return &event, nil
+}
+
+//getDeadLetterFromDb returns a dead letter, or nil if there is no dead letter with the id.
+func getDeadLetterFromDb(ctx context.Context, deadLetterId string) (*DeadLetter, error) {
+	url := subscriptionServiceBaseUrl + "/deadletters/" + deadLetterId
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		LogE.Printf("Failed creating dead letter request %s %#v \n", url, err)
+		return nil, err
+	}
+	resp, err := subscriptionServiceClient.Do(req.WithContext(ctx))
+	if err != nil {
+		LogE.Printf("Failed to get dead letter %s %#v \n", url, err)
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != 200 {
+		LogE.Println("Get dead letter received error response: ", resp.StatusCode)
+		responseDump, _ := httputil.DumpResponse(resp, true)
+		LogE.Println(string(responseDump))
+		return nil, errors.New(resp.Status)
+	}
+	deadLetter := DeadLetter{}
+	if err := json.NewDecoder(resp.Body).Decode(&deadLetter); err != nil {
+		LogE.Printf("Failed decoding dead letter %s %#v \n", url, err)
+		return nil, err
+	}
+	return &deadLetter, nil
+}
+
+func saveDeadLetterToDb(ctx context.Context, deadLetter *DeadLetter) error {
+	if deadLetter.CreateTime == "" {
+		deadLetter.CreateTime = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	deadLetterBytes, err := json.Marshal(deadLetter)
+	if err != nil {
+		LogE.Printf("Error marshalling dead letter %#v \n", err)
+		return err
+	}
+	url := subscriptionServiceBaseUrl + "/deadletters"
+	deadLetterReq, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(deadLetterBytes))
+	if nil != err {
+		LogE.Printf("Failed creating dead letter update request %s %#v \n", subscriptionServiceBaseUrl, err)
+		return err
+	}
+	deadLetterReq = deadLetterReq.WithContext(ctx)
+	deadLetterResp, err := subscriptionServiceClient.Do(deadLetterReq)
+	if err != nil {
+		LogE.Printf("Failed sending dead letter update request %s %#v \n", subscriptionServiceBaseUrl, err)
+		return err
+	}
+	defer deadLetterResp.Body.Close()
+	if deadLetterResp.StatusCode != 204 {
+		LogE.Println("Update dead letter received error response: ", deadLetterResp.StatusCode)
+		responseDump, _ := httputil.DumpResponse(deadLetterResp, true)
+		LogE.Println(string(responseDump))
+		return errors.New(deadLetterResp.Status)
+	}
+	LogI.Printf("Saved dead letter %s", deadLetter.Id)
+	return nil
+}
+
+func deleteDeadLetterFromDb(ctx context.Context, deadLetterId string) error {
+	url := subscriptionServiceBaseUrl + "/deadletters/" + deadLetterId
+	deadLetterReq, err := http.NewRequest(http.MethodDelete, url, nil)
+	if nil != err {
+		LogE.Printf("Failed creating dead letter delete request %s %#v \n", subscriptionServiceBaseUrl, err)
+		return err
+	}
+	deadLetterReq = deadLetterReq.WithContext(ctx)
+	deadLetterResp, err := subscriptionServiceClient.Do(deadLetterReq)
+	if err != nil {
+		LogE.Printf("Failed sending dead letter delete request %s %#v \n", subscriptionServiceBaseUrl, err)
+		return err
+	}
+	defer deadLetterResp.Body.Close()
+	if deadLetterResp.StatusCode != 204 {
+		LogE.Println("Delete dead letter received error response: ", deadLetterResp.StatusCode)
+		responseDump, _ := httputil.DumpResponse(deadLetterResp, true)
+		LogE.Println(string(responseDump))
+		return errors.New(deadLetterResp.Status)
+	}
+	return nil
+}
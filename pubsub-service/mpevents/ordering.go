@@ -0,0 +1,60 @@
+package mpevents
+
+import (
+	"sync"
+)
+
+//eventLocks serializes the processing of events for the same entitlement or account, so for example a PLAN_CHANGED
+//event waits while ENTITLEMENT_ACTIVE is still syncing the entitlement. Events for different keys run in parallel. The
+//locks are held by this replica only. An account event takes the lock of each entitlement it decides while holding the
+//account lock, entitlement events never take an account lock, so the two cannot wait on each other.
+var eventLocks = keyLocks{locks: make(map[string]*keyLock)}
+
+type keyLocks struct {
+	mutex sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	//holders counts the goroutines holding or waiting for the lock, it is removed from the map at zero
+	holders int
+}
+
+//orderingKey returns the entitlement or account a message is about, or "" if it is about neither.
+func orderingKey(pubSubMsg PubSubMsg) string {
+	if pubSubMsg.Entitlement.Id != "" {
+		return "entitlement/" + pubSubMsg.Entitlement.Id
+	}
+	if pubSubMsg.Account.Id != "" {
+		return "account/" + pubSubMsg.Account.Id
+	}
+	return ""
+}
+
+//lock waits until no other event for key is processing and returns the function that releases it. An empty key is not
+//locked.
+func (kl *keyLocks) lock(key string) func() {
+	if key == "" {
+		return func() {}
+	}
+	kl.mutex.Lock()
+	lock, ok := kl.locks[key]
+	if !ok {
+		lock = &keyLock{}
+		kl.locks[key] = lock
+	}
+	lock.holders++
+	kl.mutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		kl.mutex.Lock()
+		lock.holders--
+		if lock.holders == 0 {
+			delete(kl.locks, key)
+		}
+		kl.mutex.Unlock()
+	}
+}
@@ -6,19 +6,21 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"github.com/cloudbees/cloud-bill-saas/common/procurement"
+	"github.com/cloudbees/cloud-bill-saas/pubsub-service/policy"
 	"github.com/jefferyfry/funclog"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"path/filepath"
+	"time"
 )
 
 type PubSubMsg struct {
 	EventId     	string	`json:"eventId"`
 	EventType   	string	`json:"eventType"`
-	Entitlement		EntitlementMeta `json:entitlement,omitempty`
-	Account			AccountMeta `json:account,omitempty`
+	Entitlement		EntitlementMeta `json:"entitlement,omitempty"`
+	Account			AccountMeta `json:"account,omitempty"`
 }
 
 type EntitlementMeta struct {
@@ -31,68 +33,93 @@ type AccountMeta struct {
 	UpdateTime   	string    	`json:"updateTime"`
 }
 
-type Account struct {
-	Id  			string     	`json:"id"`
-	Name  			string     	`json:"name"`
-	UpdateTime   	string    	`json:"updateTime,omitempty"`
-	CreateTime      string    	`json:"createTime,omitempty"`
-	Provider     	string		`json:"provider,omitempty"`
-	State 	 		string      `json:"state,omitempty"`
-	Approvals    	[]Approval  `json:"approvals,omitempty"`
-}
+//Account, Approval and Entitlement are the procurement API resources, which are saved as is to the subscription
+//service.
+type Account = procurement.Account
+type Approval = procurement.Approval
+type Entitlement = procurement.Entitlement
 
-type Approval struct {
-	Name  			string     	`json:"name"`
-	State  			string     	`json:"state"`
-	Reason  		string     	`json:"reason"`
-	UpdateTime  	string     	`json:"updateTime"`
+//EntitlementsPage is one page of entitlements from the subscription service.
+type EntitlementsPage struct {
+	Entitlements  []Entitlement `json:"entitlements"`
+	NextPageToken string        `json:"nextPageToken"`
 }
 
-type Entitlement struct {
+//Event is the outcome of a marketplace event recorded with the subscription service.
+type Event struct {
 	Id     				string	`json:"id"`
-	Name     			string	`json:"name"`
-	Account   			string	`json:"account"`
-	Provider    		string	`json:"provider"`
-	Product  			string	`json:"product"`
-	Plan     	  		string	`json:"plan"`
-	NewPendingPlan 	  	string	`json:"newPendingPlan"`
-	State    	  		string	`json:"state"`
-	UpdateTime    	  	string	`json:"updateTime"`
-	CreateTime    	  	string	`json:"createTime"`
-	UsageReportingId    string	`json:"usageReportingId"`
-	MessageToUser    	string	`json:"messageToUser"`
+	EventType     		string	`json:"eventType"`
+	EntityId     		string	`json:"entityId,omitempty"`
+	Outcome     		string	`json:"outcome"`
+	Attempts     		int64	`json:"attempts"`
+	Error     			string	`json:"error,omitempty"`
+	ProcessedTime     	string	`json:"processedTime"`
+}
+
+//Event outcomes
+const (
+	EventSucceeded    = "SUCCEEDED"
+	EventFailed       = "FAILED"
+	EventDeadLettered = "DEAD_LETTERED"
+
+	//EventSkipped is not recorded, it is returned for events that were already handled
+	EventSkipped = "SKIPPED"
+)
+
+//AccountDeletion is the subscription service summary of a cascading account delete.
+type AccountDeletion struct {
+	AccountId		string		`json:"accountId"`
+	Account			bool		`json:"account"`
+	Contact			bool		`json:"contact"`
+	Entitlements	[]string	`json:"entitlements"`
 }
 
 type PubSubListener struct {
 	PubSubSubscription    			string
 	SubscriptionServiceUrl 			string
-	CloudCommerceProcurementUrl    	string
-	PartnerId    					string
+	ProcurementClient    			procurement.Client
+	ApprovalPolicy    				*policy.Policy
 	GcpProjectId                    string
+	MaxOutstandingMessages			int
+	NumGoroutines					int
 }
 
 var (
-	cloudCommerceProcurementBaseUrl string
+	procurementClient procurement.Client
+	approvalPolicy *policy.Policy
 	subscriptionServiceBaseUrl string
+	//subscriptionServiceClient sends every request to the subscription service
+	subscriptionServiceClient = http.DefaultClient
+	maxDeliveryAttempts int64
 
 	LogI = funclog.NewInfoLogger("INFO: ")
 	LogE = funclog.NewErrorLogger("ERROR: ")
 )
 
-func GetPubSubListener(pubSubSubscription string, subscriptionServiceUrl string, cloudCommerceProcurementUrl string, partnerId string, gcpProjectId string) *PubSubListener {
-	cloudCommerceProcurementBaseUrl = cloudCommerceProcurementUrl + "/providers/" + partnerId
+//GetPubSubListener returns a listener that decides entitlement requests with entitlementPolicy, policy.ApproveAll
+//approves every request. maxOutstandingMessages bounds how many messages are processed at once and numGoroutines is
+//the number of goroutines pulling messages, the Pub/Sub client defaults are used for values below 1. Requests to the
+//subscription service are sent with httpClient.
+func GetPubSubListener(pubSubSubscription string, subscriptionServiceUrl string, httpClient *http.Client, procurementApiClient procurement.Client, entitlementPolicy *policy.Policy, gcpProjectId string, maxAttempts int64, maxOutstandingMessages int, numGoroutines int) *PubSubListener {
+	procurementClient = procurementApiClient
+	approvalPolicy = entitlementPolicy
 	subscriptionServiceBaseUrl = subscriptionServiceUrl
+	subscriptionServiceClient = httpClient
+	maxDeliveryAttempts = maxAttempts
 	return &PubSubListener{
 		pubSubSubscription,
 		subscriptionServiceUrl,
-		cloudCommerceProcurementUrl,
-		partnerId,
+		procurementApiClient,
+		entitlementPolicy,
 		gcpProjectId,
+		maxOutstandingMessages,
+		numGoroutines,
 	}
 }
 
-func (lstnr *PubSubListener) Listen() error {
-	ctx := context.Background()
+//Listen processes marketplace messages until ctx is done. Receive then stops pulling, messages that have not started
+//processing are nacked so they are redelivered, and Listen returns once the messages in flight are acked or nacked.
+func (lstnr *PubSubListener) Listen(ctx context.Context) error {
 	client, err := pubsub.NewClient(ctx, lstnr.GcpProjectId)
 	if err != nil {
 		LogE.Fatalf("Error creating pubsub client %s: %#v", lstnr.PubSubSubscription, err)
@@ -106,45 +133,180 @@ func (lstnr *PubSubListener) Listen() error {
 		LogE.Fatalf("Error checking for subscription: %#v", errSub)
 	}
 
-	LogI.Printf("Begin receiving messages from subscription %s \n", subscription.String())
+	subscription.ReceiveSettings.MaxOutstandingMessages = lstnr.MaxOutstandingMessages
+	subscription.ReceiveSettings.NumGoroutines = lstnr.NumGoroutines
+
+	LogI.Printf("Begin receiving messages from subscription %s, at most %d outstanding with %d goroutines \n",
+		subscription.String(), lstnr.MaxOutstandingMessages, lstnr.NumGoroutines)
 	errRcv := subscription.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
-		pubSubMsg := PubSubMsg{}
-		if err := json.Unmarshal(msg.Data, &pubSubMsg); err != nil {
-			LogE.Printf("could not decode message data: %#v \n", msg)
+		if ctx.Err() != nil {
 			msg.Nack()
+			LogI.Printf("Message %s nacked, shutting down.", msg.ID)
 			return
 		}
-
-		LogI.Printf("Received msg %#v", pubSubMsg)
-		if processPubSubMsg(pubSubMsg) {
+		if HandleMessage(ctx, msg.ID, msg.Data) {
 			msg.Ack()
-			LogI.Printf("Message %s acked.",pubSubMsg.EventId)
+			LogI.Printf("Message %s acked.", msg.ID)
 		} else {
 			msg.Nack()
-			LogI.Printf("Message %s nacked.",pubSubMsg.EventId)
+			LogI.Printf("Message %s nacked.", msg.ID)
 		}
 	})
 	if errRcv != nil {
 		return errRcv
 	}
+	LogI.Printf("Stopped receiving messages from subscription %s \n", subscription.String())
 	return nil
 }
 
-func processPubSubMsg(pubSubMsg PubSubMsg) bool {
+//HandleMessage decodes and processes the data of a Pub/Sub message, pulled or pushed, and returns whether the message
+//should be acked. Data that is not a PubSubMsg is dead lettered right away since redelivering it will not help. The
+//procurement API and subscription service calls made for the message are cancelled with ctx.
+func HandleMessage(ctx context.Context, messageId string, data []byte) bool {
+	pubSubMsg := PubSubMsg{}
+	if err := json.Unmarshal(data, &pubSubMsg); err != nil || pubSubMsg.EventId == "" {
+		LogE.Printf("could not decode message %s data: %s \n", messageId, data)
+		deadLetter := DeadLetter{
+			Id: "message-" + messageId,
+			Data: string(data),
+			Error: "could not decode message data",
+			Attempts: 1,
+		}
+		if err != nil {
+			deadLetter.Error += ": " + err.Error()
+		}
+		if err := saveDeadLetterToDb(ctx, &deadLetter); err != nil {
+			LogE.Printf("Unable to dead letter message %s due to error %#v \n", messageId, err)
+			return false
+		}
+		return true
+	}
+
+	LogI.Printf("Received msg %#v", pubSubMsg)
+	outcome, _ := handlePubSubMsg(ctx, pubSubMsg, data, newEventRun(pubSubMsg, false))
+	return outcome != EventFailed
+}
+
+//handlePubSubMsg processes a message unless an earlier delivery of the same event succeeded or was dead lettered, and
+//records the outcome with the subscription service so redeliveries are skipped. A message that has failed
+//maxDeliveryAttempts times is sent to the dead letters. It returns the outcome of this delivery, or EventSkipped, and
+//the processing error. The message should be acked unless the outcome is EventFailed. A dry run records nothing.
+//Messages for the same entitlement or account are handled one at a time.
+func handlePubSubMsg(ctx context.Context, pubSubMsg PubSubMsg, data []byte, run *eventRun) (string, error) {
+	unlock := eventLocks.lock(orderingKey(pubSubMsg))
+	defer unlock()
+
+	previous, err := getEventFromDb(ctx, pubSubMsg.EventId)
+	if err != nil {
+		LogE.Printf("Unable to check whether event %s was already processed due to error %#v \n", pubSubMsg.EventId, err)
+		return EventFailed, err
+	} else if previous != nil && (previous.Outcome == EventSucceeded || previous.Outcome == EventDeadLettered) {
+		LogI.Printf("Event %s was already %s at %s. Skipping. \n", pubSubMsg.EventId, previous.Outcome, previous.ProcessedTime)
+		return EventSkipped, nil
+	}
+
+	event := newEvent(pubSubMsg)
+	if previous != nil {
+		event.Attempts = previous.Attempts
+	}
+	event.Attempts++
+	processErr := processPubSubMsg(ctx, pubSubMsg, run)
+	if run.dryRun {
+		if processErr != nil {
+			return EventFailed, processErr
+		}
+		return EventSucceeded, nil
+	}
+	if processErr != nil {
+		event.Outcome = EventFailed
+		event.Error = processErr.Error()
+		if event.Attempts >= maxDeliveryAttempts {
+			deadLetter := DeadLetter{
+				Id: pubSubMsg.EventId,
+				EventId: pubSubMsg.EventId,
+				EventType: pubSubMsg.EventType,
+				Data: string(data),
+				Error: event.Error,
+				Attempts: event.Attempts,
+			}
+			if err := saveDeadLetterToDb(ctx, &deadLetter); err != nil {
+				LogE.Printf("Unable to dead letter event %s due to error %#v \n", pubSubMsg.EventId, err)
+			} else {
+				LogE.Printf("Event %s failed %d times and was dead lettered: %s \n", pubSubMsg.EventId, event.Attempts, event.Error)
+				event.Outcome = EventDeadLettered
+			}
+		}
+	}
+	if err := saveEventToDb(ctx, &event); err != nil {
+		LogE.Printf("Unable to record the outcome of event %s due to error %#v \n", pubSubMsg.EventId, err)
+	}
+	return event.Outcome, processErr
+}
+
+//newEvent returns the succeeded outcome of processing a message.
+func newEvent(pubSubMsg PubSubMsg) Event {
+	event := Event{
+		Id: pubSubMsg.EventId,
+		EventType: pubSubMsg.EventType,
+		EntityId: pubSubMsg.Entitlement.Id,
+		Outcome: EventSucceeded,
+		ProcessedTime: time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if event.EntityId == "" {
+		event.EntityId = pubSubMsg.Account.Id
+	}
+	return event
+}
+
+//eventRun is one run of processing an event. It carries the source recorded with the subscription service and
+//collects the writes processing made, or would have made in a dry run.
+type eventRun struct {
+	source  string
+	dryRun  bool
+	actions []string
+}
+
+func newEventRun(pubSubMsg PubSubMsg, dryRun bool) *eventRun {
+	return &eventRun{
+		source: "pubsub-service event " + pubSubMsg.EventId,
+		dryRun: dryRun,
+	}
+}
+
+//do records an action and runs write unless this is a dry run.
+func (run *eventRun) do(action string, write func() error) error {
+	run.actions = append(run.actions, action)
+	if run.dryRun {
+		LogI.Printf("Dry run. Skipping %s. \n", action)
+		return nil
+	}
+	return write()
+}
+
+func processPubSubMsg(ctx context.Context, pubSubMsg PubSubMsg, run *eventRun) error {
 	switch pubSubMsg.EventType {
 	case "ACCOUNT_ACTIVE":
 		LogI.Printf("PubSub event: Account %s ACCOUNT_ACTIVE. \n", pubSubMsg.Account.Id)
-		if _,err := syncAccount(pubSubMsg.Account.Id); err != nil {
+		if _,err := syncAccount(ctx, pubSubMsg.Account.Id, run); err != nil {
 			LogE.Printf("Unable to update account %#v due to error %#v \n", pubSubMsg.Entitlement, err)
-			return false
+			return err
 		} else {
-			if entitlements, err := getUnapprovedEntitlementsFromDb(pubSubMsg.Account.Id); err != nil {
+			if entitlements, err := getUnapprovedEntitlementsFromDb(ctx, pubSubMsg.Account.Id); err != nil {
 				LogE.Printf("Unable to check for unapproved entitlements %#v due to error %#v \n", pubSubMsg.Entitlement, err)
-				return false
+				return err
 			} else if entitlements!=nil && len(entitlements) > 0 {
-				LogI.Printf("Approving entitlements for account %s. \n", pubSubMsg.Account.Id)
-				for _, ent := range entitlements {
-					postEntitlementApprovalToCommerceApi(ent.Id)
+				LogI.Printf("Deciding unapproved entitlements for account %s. \n", pubSubMsg.Account.Id)
+				//decide every entitlement before nacking so one failure does not hold up the others, the ones already
+				//decided are skipped when the event is redelivered
+				var decideErr error
+				for i := range entitlements {
+					if err := decideUnapprovedEntitlement(ctx, entitlements[i].Id, pubSubMsg.EventId, run); err != nil && decideErr == nil {
+						decideErr = err
+					}
+				}
+				if decideErr != nil {
+					LogE.Printf("Unable to decide unapproved entitlements of account %s due to error %#v \n", pubSubMsg.Account.Id, decideErr)
+					return decideErr
 				}
 			} else {
 				LogI.Printf("No unapproved entitlments were found for account %s",pubSubMsg.Account.Id)
@@ -152,213 +314,153 @@ func processPubSubMsg(pubSubMsg PubSubMsg) bool {
 		}
 	case "ENTITLEMENT_CREATION_REQUESTED":
 		LogI.Printf("PubSub event: Entitlement %s ENTITLEMENT_CREATION_REQUESTED. \n", pubSubMsg.Entitlement.Id)
-		if entitlement,err := syncEntitlement(pubSubMsg.Entitlement.Id); err == nil {
-			if accountExists, acctErr := accountExistsInDb(entitlement.Account); acctErr != nil {
+		if entitlement,err := syncEntitlement(ctx, pubSubMsg.Entitlement.Id, run); err == nil {
+			if accountExists, acctErr := accountExistsInDb(ctx, entitlement.Account); acctErr != nil {
 				LogE.Printf("Unable to determine if account %#v exists due to error %#v \n", entitlement.Account, acctErr)
-				return false
+				return acctErr
 			} else if accountExists {
 				LogI.Printf("Account %s exists. \n", entitlement.Account)
-				postEntitlementApprovalToCommerceApi(pubSubMsg.Entitlement.Id);
+				if err := decideEntitlementCreation(ctx, entitlement, pubSubMsg.EventId, run); err != nil {
+					return err
+				}
 			} else {
 				LogI.Printf("Account %s does not exist. \n", entitlement.Account)
 			}
 		} else {
 			LogE.Printf("Unable to sync entitlement and approve entitlement %#v due to error %#v \n", pubSubMsg.Entitlement, err)
-			return false
-		}
-	case "ENTITLEMENT_ACTIVE":
-		LogI.Printf("PubSub event: Entitlement %s ENTITLEMENT_ACTIVE. \n", pubSubMsg.Entitlement.Id)
-		if _,err := syncEntitlement(pubSubMsg.Entitlement.Id); err != nil {
-			LogE.Printf("Unable to update entitlement plan %#v due to error %#v \n", pubSubMsg.Entitlement, err)
-			return false
+			return err
 		}
 	case "ENTITLEMENT_PLAN_CHANGE_REQUESTED":
 		LogI.Printf("PubSub event: Entitlement %s ENTITLEMENT_PLAN_CHANGE_REQUESTED. \n", pubSubMsg.Entitlement.Id)
-		if err := postEntitlementChangeApprovalToCommerceApi(pubSubMsg.Entitlement.Id); err == nil {
-			if _,err := syncEntitlement(pubSubMsg.Entitlement.Id); err != nil {
+		if err := decidePlanChange(ctx, pubSubMsg.Entitlement.Id, pubSubMsg.EventId, run); err == nil {
+			if _,err := syncEntitlement(ctx, pubSubMsg.Entitlement.Id, run); err != nil {
 				LogE.Printf("Unable to update entitlement plan %#v due to error %#v \n", pubSubMsg.Entitlement, err)
-				return false
+				return err
 			}
 		} else {
-			LogE.Printf("Unable to approve entitlement plan change %#v due to error %#v \n", pubSubMsg.Entitlement, err)
-			return false
+			LogE.Printf("Unable to decide entitlement plan change %#v due to error %#v \n", pubSubMsg.Entitlement, err)
+			return err
 		}
-	case "ENTITLEMENT_PLAN_CHANGED":
-		LogI.Printf("PubSub event: Entitlement %s ENTITLEMENT_PLAN_CHANGED. \n", pubSubMsg.Entitlement.Id)
-		if _,err := syncEntitlement(pubSubMsg.Entitlement.Id); err != nil {
-			LogE.Printf("Unable to update entitlement plan %#v due to error %#v \n", pubSubMsg.Entitlement, err)
-			return false
-		}
-	case "ENTITLEMENT_PENDING_CANCELLATION":
-		LogE.Printf("PubSub event: Entitlement %s ENTITLEMENT_PENDING_CANCELLATION. \n", pubSubMsg.Entitlement.Id)
-	case "ENTITLEMENT_CANCELLED":
-		LogI.Printf("PubSub event: Entitlement %s ENTITLEMENT_CANCELLED. \n", pubSubMsg.Entitlement.Id)
-		if _,err := syncEntitlement(pubSubMsg.Entitlement.Id); err != nil {
-			LogE.Printf("Unable to update entitlement plan %#v due to error %#v \n", pubSubMsg.Entitlement, err)
-			return false
+	case "ENTITLEMENT_OFFER_ACCEPTED", "ENTITLEMENT_ACTIVE", "ENTITLEMENT_RENEWED", "ENTITLEMENT_OFFER_ENDED",
+		"ENTITLEMENT_PLAN_CHANGED", "ENTITLEMENT_PLAN_CHANGE_CANCELLED", "ENTITLEMENT_PENDING_CANCELLATION",
+		"ENTITLEMENT_CANCELLATION_REVERTED", "ENTITLEMENT_CANCELLING", "ENTITLEMENT_CANCELLED":
+		//the procurement API has the new state, plan or pending plan of the entitlement
+		LogI.Printf("PubSub event: Entitlement %s %s. \n", pubSubMsg.Entitlement.Id, pubSubMsg.EventType)
+		if _,err := syncEntitlement(ctx, pubSubMsg.Entitlement.Id, run); err != nil {
+			LogE.Printf("Unable to update entitlement %#v due to error %#v \n", pubSubMsg.Entitlement, err)
+			return err
 		}
 	case "ENTITLEMENT_DELETED":
 		LogI.Printf("PubSub event: Entitlement %s ENTITLEMENT_DELETED. \n", pubSubMsg.Entitlement.Id)
-		if err := deleteEntitlementFromDb(pubSubMsg.Entitlement.Id); err != nil {
+		if err := run.do("delete entitlement "+pubSubMsg.Entitlement.Id, func() error {
+			return deleteEntitlementFromDb(ctx, pubSubMsg.Entitlement.Id, run.source)
+		}); err != nil {
 			LogE.Printf("Unable to delete entitlement %#v due to error %#v \n", pubSubMsg.Entitlement, err)
-			return false
+			return err
 		}
+	case "ACCOUNT_CREATION_REQUESTED":
+		//deprecated by the marketplace, the account is created by the frontend signup and approved after it
+		LogI.Printf("PubSub event: Account %s ACCOUNT_CREATION_REQUESTED. Waiting for signup. \n", pubSubMsg.Account.Id)
 	case "ACCOUNT_DELETED":
 		LogI.Printf("PubSub event: Account %s ACCOUNT_DELETED. \n", pubSubMsg.Account.Id)
-		if err := deleteAccountFromDb(pubSubMsg.Account.Id); err != nil {
+		if err := run.do("delete account "+pubSubMsg.Account.Id, func() error {
+			return deleteAccountFromDb(ctx, pubSubMsg.Account.Id, run.source)
+		}); err != nil {
 			LogE.Printf("Unable to delete account %#v due to error %#v \n", pubSubMsg.Entitlement, err)
-			return false
+			return err
 		}
 	case "TEST":
 		LogI.Printf("Test message %s was received \n", pubSubMsg.EventId)
 	default:
 		LogE.Printf("Unknown pubsub event type %#v \n", pubSubMsg)
 	}
-	return true
-}
-
-func postEntitlementApprovalToCommerceApi(entitlementId string) error {
-	procurementUrl := cloudCommerceProcurementBaseUrl + "/entitlements/" + entitlementId + ":approve"
-
-	client, clientErr := google.DefaultClient(oauth2.NoContext,"https://www.googleapis.com/auth/cloud-platform")
-
-	if clientErr != nil {
-		LogE.Printf("Failed to create oath2 client for the procurement API %#v \n", clientErr)
-		return clientErr
-	}
-
-	LogI.Printf("Sending entitlement approval: %s \n", procurementUrl)
-	procResp, err := client.Post(procurementUrl,"",nil)
-	if nil != err {
-		LogE.Printf("Failed sending entitlement approval request %s %#v \n",procurementUrl, err)
-		return err
-	}
-	defer procResp.Body.Close()
-	if procResp.StatusCode != 200 {
-		LogE.Println("Entitlement approval received error response: ",procResp.StatusCode)
-		responseDump, _ := httputil.DumpResponse(procResp, true)
-		LogE.Println(string(responseDump))
-		return errors.New("Entitlement approval received error response: "+procResp.Status)
-	} else {
-		LogI.Printf("Sent entitlement approval %s %s",procurementUrl,procResp.Status)
-	}
 	return nil
 }
 
-func postEntitlementChangeApprovalToCommerceApi(entitlementId string) error {
-	entitlement := Entitlement{}
-	if err := getEntitlementFromCommerceApi(entitlementId,&entitlement); err != nil {
-		LogE.Printf("Unable to determine entitlement to approve from procurement API %#v \n", err)
-	}
-	jsonApproval := []byte(`{
-				"pendingPlanName": "`+entitlement.NewPendingPlan+`"
-			}`)
-	procurementUrl := cloudCommerceProcurementBaseUrl + "/entitlements/" + entitlementId + ":approvePlanChange"
+//decideUnapprovedEntitlement syncs and decides an entitlement of an account that became active. It holds the lock of
+//the entitlement, so an ENTITLEMENT_CREATION_REQUESTED event for it is not decided at the same time.
+func decideUnapprovedEntitlement(ctx context.Context, entitlementId string, eventId string, run *eventRun) error {
+	unlock := eventLocks.lock("entitlement/" + entitlementId)
+	defer unlock()
 
-	client, clientErr := google.DefaultClient(oauth2.NoContext,"https://www.googleapis.com/auth/cloud-platform")
-
-	if clientErr != nil {
-		LogE.Printf("Failed to create oath2 client for the procurement API %#v \n", clientErr)
-		return clientErr
-	}
-
-	LogI.Printf("Sending entitlement change approval: %s %s \n", procurementUrl, jsonApproval)
-	procResp, err := client.Post(procurementUrl,"",bytes.NewBuffer(jsonApproval))
-	if nil != err {
-		LogE.Printf("Failed sending entitlement change approval request %s %#v \n",procurementUrl, err)
+	entitlement, err := syncEntitlement(ctx, entitlementId, run)
+	if err != nil {
 		return err
 	}
-	defer procResp.Body.Close()
-	if procResp.StatusCode != 200 {
-		LogE.Println("Entitlement change approval received error response: ",procResp.StatusCode)
-		responseDump, _ := httputil.DumpResponse(procResp, true)
-		LogE.Println(string(responseDump))
-		return errors.New("Entitlement approval received error response: "+procResp.Status)
-	} else {
-		LogI.Printf("Sent entitlement change approval %s %s",procurementUrl,procResp.Status)
-	}
-	return nil
+	return decideEntitlementCreation(ctx, entitlement, eventId, run)
 }
 
-func syncEntitlement(entitlementId string) (*Entitlement,error) {
-	entitlement := Entitlement{}
-	if err := getEntitlementFromCommerceApi(entitlementId, &entitlement); err == nil {
+func syncEntitlement(ctx context.Context, entitlementId string, run *eventRun) (*Entitlement,error) {
+	entitlement, err := procurementClient.GetEntitlement(ctx, entitlementId)
+	if err == nil {
 		entitlement.Account = filepath.Base(entitlement.Account)
-		if err := saveEntitlementToDb(&entitlement); err != nil {
+		if err := run.do("save entitlement "+entitlementId, func() error {
+			return saveEntitlementToDb(ctx, entitlement, run.source)
+		}); err != nil {
 			LogE.Printf("Unable to update entitlement %#v due to error %#v \n", entitlement, err)
+			return nil, err
 		}
 	} else {
-		LogE.Printf("Unable to retrieve entitlement %s due to error %#v \n", entitlement, err)
+		LogE.Printf("Unable to retrieve entitlement %s due to error %#v \n", entitlementId, err)
 		return nil, err
 	}
-	return &entitlement,nil
+	return entitlement,nil
 }
 
-func getEntitlementFromCommerceApi(entitlementId string,entitlement *Entitlement) error {
-	procurementUrl := cloudCommerceProcurementBaseUrl + "/entitlements/" + entitlementId
-
-	client, clientErr := google.DefaultClient(oauth2.NoContext,"https://www.googleapis.com/auth/cloud-platform")
-
-	if clientErr != nil {
-		LogE.Printf("Failed to create oath2 client for the procurement API %#v \n", clientErr)
-		return clientErr
-	}
-
-	LogI.Printf("Getting entitlement: %s \n", procurementUrl)
-	resp, err := client.Get(procurementUrl)
-	if err != nil {
-		LogE.Printf("Failed to get entitlement %s %#v \n",procurementUrl, err)
-		return err
-	}
-	if resp.StatusCode != 200 {
-		LogE.Println("Get entitlement received error response: ",resp.StatusCode)
-		responseDump, _ := httputil.DumpResponse(resp, true)
-		LogE.Println(string(responseDump))
-		return errors.New(resp.Status)
-	} else {
-		LogI.Printf("Got entitlement %s %s",procurementUrl,resp.Status)
-	}
-	defer resp.Body.Close()
+//getUnapprovedEntitlementsFromDb walks every page of the account's entitlements that are waiting for approval.
+func getUnapprovedEntitlementsFromDb(ctx context.Context, accountId string) ([]Entitlement, error) {
+	entitlementsUrl := subscriptionServiceBaseUrl + "/accounts/"+accountId+"/entitlements?filters=state%3DENTITLEMENT_ACTIVATION_REQUESTED"
 
-	if err = json.NewDecoder(resp.Body).Decode(&entitlement); err != nil {
-		LogE.Printf("Error decoding entitlement %s %#v %#v \n", procurementUrl, resp.Body, err)
-		return err
-	}
-	entitlement.Id = entitlementId
-	LogI.Printf("Commerce API: Entitlement %s is status %s.",entitlementId, entitlement.State)
-
-	return nil
-}
-
-func getUnapprovedEntitlementsFromDb(accountId string) ([]Entitlement, error) {
-	procurementUrl := subscriptionServiceBaseUrl + "/accounts/"+accountId+"/entitlements?filter?state=ENTITLEMENT_CREATION_REQUESTED"
+	entitlements := make([]Entitlement,0)
+	pageToken := ""
+	for {
+		procurementUrl := entitlementsUrl
+		if pageToken != "" {
+			procurementUrl += "&cursor=" + url.QueryEscape(pageToken)
+		}
+		LogI.Printf("Getting unapproved entitlements: %s \n", procurementUrl)
+		req, err := http.NewRequest(http.MethodGet, procurementUrl, nil)
+		if err != nil {
+			LogE.Printf("Failed creating entitlements request %s %#v \n", procurementUrl, err)
+			return nil,err
+		}
+		resp, err := subscriptionServiceClient.Do(req.WithContext(ctx))
+		if err != nil {
+			LogE.Printf("Failed to get entitlement %s %#v \n",procurementUrl, err)
+			return nil,err
+		}
+		if resp.StatusCode == 404 {
+			resp.Body.Close()
+			LogI.Printf("No unapproved entitlements found %s",procurementUrl)
+			return entitlements,nil
+		} else if resp.StatusCode != 200 {
+			LogE.Println("Get entitlement received error response: ",resp.StatusCode)
+			responseDump, _ := httputil.DumpResponse(resp, true)
+			LogE.Println(string(responseDump))
+			resp.Body.Close()
+			return nil,errors.New(resp.Status)
+		} else {
+			LogI.Printf("Got entitlements %s %s",procurementUrl,resp.Status)
+		}
 
-	LogI.Printf("Getting unapproved entitlements: %s \n", procurementUrl)
-	resp, err := http.Get(procurementUrl)
-	if err != nil {
-		LogE.Printf("Failed to get entitlement %s %#v \n",procurementUrl, err)
-		return nil,err
-	}
-	if resp.StatusCode != 200 {
-		LogE.Println("Get entitlement received error response: ",resp.StatusCode)
-		responseDump, _ := httputil.DumpResponse(resp, true)
-		LogE.Println(string(responseDump))
-		return nil,errors.New(resp.Status)
-	} else {
-		LogI.Printf("Got entitlements %s %s",procurementUrl,resp.Status)
-	}
-	defer resp.Body.Close()
+		page := EntitlementsPage{}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			LogE.Printf("Error decoding entitlements %s %#v \n", procurementUrl, err)
+			return nil,err
+		}
+		entitlements = append(entitlements, page.Entitlements...)
 
-	entitlements := make([]Entitlement,0)
-	if err = json.NewDecoder(resp.Body).Decode(&entitlements); err != nil {
-		LogE.Printf("Error decoding entitlements %s %#v %#v \n", procurementUrl, resp.Body, err)
-		return nil,err
+		if page.NextPageToken == "" {
+			return entitlements,nil
+		}
+		pageToken = page.NextPageToken
 	}
-
-	return entitlements,nil
 }
 
-func saveEntitlementToDb(entitlement *Entitlement) error {
+//saveEntitlementToDb upserts the entitlement, source is recorded as the caller in the entitlement history.
+func saveEntitlementToDb(ctx context.Context, entitlement *Entitlement, source string) error {
 	entitlementBytes, err := json.Marshal(entitlement)
 	if err != nil {
 		LogE.Printf("Error marshalling entitlement %#v \n", err)
@@ -370,11 +472,14 @@ func saveEntitlementToDb(entitlement *Entitlement) error {
 		LogE.Printf("Failed creating entitlement update request %s %#v \n",subscriptionServiceBaseUrl, err)
 		return err
 	}
-	entitlementResp, err := http.DefaultClient.Do(entitlementReq)
+	entitlementReq.Header.Set("X-Cloud-Bill-Source", source)
+	entitlementReq = entitlementReq.WithContext(ctx)
+	entitlementResp, err := subscriptionServiceClient.Do(entitlementReq)
 	if err != nil {
 		LogE.Printf("Failed sending entitlement update request %s %#v \n",subscriptionServiceBaseUrl, err)
 		return err
 	}
+	defer entitlementResp.Body.Close()
 	if entitlementResp.StatusCode != 204 {
 		LogE.Println("Update entitlement received error response: ",entitlementResp.StatusCode)
 		responseDump, _ := httputil.DumpResponse(entitlementResp, true)
@@ -383,22 +488,25 @@ func saveEntitlementToDb(entitlement *Entitlement) error {
 	} else {
 		LogI.Printf("Updated entitlement %s %s",url,entitlementResp.Status)
 	}
-	defer entitlementResp.Body.Close()
 	return nil
 }
 
-func deleteEntitlementFromDb(entitlementId string) error {
+//deleteEntitlementFromDb deletes the entitlement, source is recorded as the caller in the entitlement history.
+func deleteEntitlementFromDb(ctx context.Context, entitlementId string, source string) error {
 	url := subscriptionServiceBaseUrl+"/entitlements/"+entitlementId
 	entitlementReq, err := http.NewRequest(http.MethodDelete, url,nil)
 	if nil != err {
 		LogE.Printf("Failed creating entitlement delete request %s %#v \n",subscriptionServiceBaseUrl, err)
 		return err
 	}
-	entitlementResp, err := http.DefaultClient.Do(entitlementReq)
+	entitlementReq.Header.Set("X-Cloud-Bill-Source", source)
+	entitlementReq = entitlementReq.WithContext(ctx)
+	entitlementResp, err := subscriptionServiceClient.Do(entitlementReq)
 	if err != nil {
 		LogE.Printf("Failed sending entitlement delete request %s %#v \n",subscriptionServiceBaseUrl, err)
 		return err
 	}
+	defer entitlementResp.Body.Close()
 	if entitlementResp.StatusCode != 204 {
 		LogE.Println("Delete entitlement received error response: ",entitlementResp.StatusCode)
 		responseDump, _ := httputil.DumpResponse(entitlementResp, true)
@@ -407,77 +515,116 @@ func deleteEntitlementFromDb(entitlementId string) error {
 	} else {
 		LogI.Printf("Deleted entitlement %s %s",url,entitlementResp.Status)
 	}
-	defer entitlementResp.Body.Close()
 	return nil
 }
 
-func syncAccount(accountId string) (*Account, error) {
-	account := Account{}
-	if err := getAccountFromCommerceApi(accountId, &account); err == nil {
-		err := saveAccountToDb(&account)
+func syncAccount(ctx context.Context, accountId string, run *eventRun) (*Account, error) {
+	account, err := procurementClient.GetAccount(ctx, accountId)
+	if err == nil {
+		err := run.do("save account "+accountId, func() error {
+			return saveAccountToDb(ctx, account, run.source)
+		})
 		if err != nil {
 			LogE.Printf("Unable to update account %#v due to error %#v \n", account, err)
+			return nil, err
 		}
 	} else {
 		LogE.Printf("Unable to retrieve account %s due to error %#v \n", accountId, err)
 		return nil,err
 	}
-	return &account,nil
+	return account,nil
 }
 
-func accountExistsInDb(accountId string) (bool, error){
-	subscriptionServiceUrl := subscriptionServiceBaseUrl+"/accounts/"+accountId
-
-	resp, err := http.Get(subscriptionServiceUrl)
+//getEventFromDb returns the recorded outcome of an event, or nil if it has not been handled before.
+func getEventFromDb(ctx context.Context, eventId string) (*Event, error) {
+	url := subscriptionServiceBaseUrl+"/events/"+eventId
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		LogE.Printf("Failed to get account %s %#v \n",subscriptionServiceUrl, err)
-		return false, err
+		LogE.Printf("Failed creating event request %s %#v \n", url, err)
+		return nil, err
 	}
-	LogI.Printf("Getting account: %s %s \n", subscriptionServiceUrl, resp.Status)
-	if resp.StatusCode == 200 {
-		return true, nil
-	} else {
-		return false, nil
+	resp, err := subscriptionServiceClient.Do(req.WithContext(ctx))
+	if err != nil {
+		LogE.Printf("Failed to get event %s %#v \n", url, err)
+		return nil, err
 	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != 200 {
+		LogE.Println("Get event received error response: ", resp.StatusCode)
+		responseDump, _ := httputil.DumpResponse(resp, true)
+		LogE.Println(string(responseDump))
+		return nil, errors.New(resp.Status)
+	}
+	event := Event{}
+	if err := json.NewDecoder(resp.Body).Decode(&event); err != nil {
+		LogE.Printf("Failed decoding event %s %#v \n", url, err)
+		return nil, err
+	}
+	return &event, nil
 }
 
-func getAccountFromCommerceApi(accountId string,account *Account) error {
-	procurementUrl := cloudCommerceProcurementBaseUrl + "/accounts/" + accountId
-	client, clientErr := google.DefaultClient(oauth2.NoContext,"https://www.googleapis.com/auth/cloud-platform")
-
-	if clientErr != nil {
-		LogE.Printf("Failed to create oath2 client for the procurement API %#v \n", clientErr)
-		return clientErr
+func saveEventToDb(ctx context.Context, event *Event) error {
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		LogE.Printf("Error marshalling event %#v \n", err)
+		return err
 	}
-
-	LogI.Printf("Getting account: %s \n", procurementUrl)
-	resp, err := client.Get(procurementUrl)
+	url := subscriptionServiceBaseUrl+"/events"
+	eventReq, err := http.NewRequest(http.MethodPut, url, bytes.NewBuffer(eventBytes))
+	if nil != err {
+		LogE.Printf("Failed creating event update request %s %#v \n", subscriptionServiceBaseUrl, err)
+		return err
+	}
+	eventReq = eventReq.WithContext(ctx)
+	eventResp, err := subscriptionServiceClient.Do(eventReq)
 	if err != nil {
-		LogE.Printf("Failed to get account %s %#v \n",procurementUrl, err)
+		LogE.Printf("Failed sending event update request %s %#v \n", subscriptionServiceBaseUrl, err)
 		return err
 	}
-
-	if resp.StatusCode != 200 {
-		LogE.Println("Get account received error response: ",resp.StatusCode)
-		responseDump, _ := httputil.DumpResponse(resp, true)
+	defer eventResp.Body.Close()
+	if eventResp.StatusCode != 204 {
+		LogE.Println("Update event received error response: ", eventResp.StatusCode)
+		responseDump, _ := httputil.DumpResponse(eventResp, true)
 		LogE.Println(string(responseDump))
-		return errors.New(resp.Status)
-	} else {
-		LogI.Printf("Got account %s %s",procurementUrl,resp.Status)
+		return errors.New(eventResp.Status)
 	}
+	LogI.Printf("Saved event %s %s", event.Id, event.Outcome)
+	return nil
+}
 
-	defer resp.Body.Close()
+//accountExistsInDb returns whether the account is in the subscription service. Responses other than 200 and 404 are
+//errors so the event is retried.
+func accountExistsInDb(ctx context.Context, accountId string) (bool, error){
+	subscriptionServiceUrl := subscriptionServiceBaseUrl+"/accounts/"+accountId
 
-	if errJson := json.NewDecoder(resp.Body).Decode(&account); errJson != nil {
-		LogE.Printf("Failed to decode account %s %#v %#v \n", procurementUrl, resp.Body, err)
-		return errJson
+	req, err := http.NewRequest(http.MethodGet, subscriptionServiceUrl, nil)
+	if err != nil {
+		LogE.Printf("Failed creating account request %s %#v \n", subscriptionServiceUrl, err)
+		return false, err
+	}
+	resp, err := subscriptionServiceClient.Do(req.WithContext(ctx))
+	if err != nil {
+		LogE.Printf("Failed to get account %s %#v \n",subscriptionServiceUrl, err)
+		return false, err
+	}
+	defer resp.Body.Close()
+	LogI.Printf("Getting account: %s %s \n", subscriptionServiceUrl, resp.Status)
+	if resp.StatusCode == http.StatusOK {
+		return true, nil
+	} else if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	} else {
+		LogE.Println("Get account received error response: ", resp.StatusCode)
+		responseDump, _ := httputil.DumpResponse(resp, true)
+		LogE.Println(string(responseDump))
+		return false, errors.New(resp.Status)
 	}
-	account.Id = accountId
-	LogI.Printf("Commerce API: Account %s is status %s.",accountId, account.State)
-	return nil
 }
 
-func saveAccountToDb(account *Account) error {
+//saveAccountToDb upserts the account, source is recorded as the caller in the account history.
+func saveAccountToDb(ctx context.Context, account *Account, source string) error {
 	accountBytes, err := json.Marshal(account)
 	if err != nil {
 		LogE.Printf("Error marshalling account %#v \n", err)
@@ -489,11 +636,14 @@ func saveAccountToDb(account *Account) error {
 		LogE.Printf("Failed creating account update request %s %#v \n",subscriptionServiceBaseUrl, err)
 		return err
 	}
-	accountResp, err := http.DefaultClient.Do(accountReq)
+	accountReq.Header.Set("X-Cloud-Bill-Source", source)
+	accountReq = accountReq.WithContext(ctx)
+	accountResp, err := subscriptionServiceClient.Do(accountReq)
 	if err != nil {
 		LogE.Printf("Failed sending account update request %s %#v \n",subscriptionServiceBaseUrl, err)
 		return err
 	}
+	defer accountResp.Body.Close()
 	if accountResp.StatusCode != 204 {
 		LogE.Println("Update account received error response: ",accountResp.StatusCode)
 		responseDump, _ := httputil.DumpResponse(accountResp, true)
@@ -502,31 +652,38 @@ func saveAccountToDb(account *Account) error {
 	} else {
 		LogI.Printf("Saved account %s %s",url,accountResp.Status)
 	}
-	defer accountResp.Body.Close()
 
 	return nil
 }
 
-func deleteAccountFromDb(accountId string) error {
-	url := subscriptionServiceBaseUrl+"/accounts/"+accountId
+//deleteAccountFromDb deletes the account along with its contact and entitlements.
+func deleteAccountFromDb(ctx context.Context, accountId string, source string) error {
+	url := subscriptionServiceBaseUrl+"/accounts/"+accountId+"?cascade=true"
 	accountReq, err := http.NewRequest(http.MethodDelete, url,nil)
 	if nil != err {
 		LogE.Printf("Failed creating account delete request %s %#v \n",subscriptionServiceBaseUrl, err)
 		return err
 	}
-	accountResp, err := http.DefaultClient.Do(accountReq)
+	accountReq.Header.Set("X-Cloud-Bill-Source", source)
+	accountReq = accountReq.WithContext(ctx)
+	accountResp, err := subscriptionServiceClient.Do(accountReq)
 	if err != nil {
 		LogE.Printf("Failed sending account delete request %s %#v \n",subscriptionServiceBaseUrl, err)
 		return err
 	}
-	if accountResp.StatusCode != 204 {
-		LogE.Println("Delete entitlement received error response: ",accountResp.StatusCode)
+	defer accountResp.Body.Close()
+	if accountResp.StatusCode != 200 {
+		LogE.Println("Delete account received error response: ",accountResp.StatusCode)
 		responseDump, _ := httputil.DumpResponse(accountResp, true)
 		LogE.Println(string(responseDump))
 		return errors.New(accountResp.Status)
-	} else {
-		LogI.Printf("Deleted entitlement %s %s",url,accountResp.Status)
 	}
-	defer accountResp.Body.Close()
+	deletion := AccountDeletion{}
+	if err := json.NewDecoder(accountResp.Body).Decode(&deletion); err != nil {
+		LogE.Printf("Failed decoding account delete response %s %#v \n", url, err)
+		return err
+	}
+	LogI.Printf("Deleted account %s: account %t, contact %t, entitlements %v \n", accountId, deletion.Account,
+		deletion.Contact, deletion.Entitlements)
 	return nil
 }
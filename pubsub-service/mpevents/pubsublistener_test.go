@@ -0,0 +1,644 @@
+package mpevents
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cloudbees/cloud-bill-saas/common/procurement/fake"
+	"github.com/cloudbees/cloud-bill-saas/pubsub-service/policy"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testPartnerId     = "test-partner"
+	testAccountId     = "A-1"
+	testEntitlementId = "E-1"
+)
+
+//subscriptionService is an in-memory subscription service with the endpoints the pubsub service calls. It records the
+//X-Cloud-Bill-Source of each write.
+type subscriptionService struct {
+	*httptest.Server
+
+	mutex        sync.Mutex
+	accounts     map[string]Account
+	entitlements map[string]Entitlement
+	approvals    map[string][]EntitlementApproval
+	pending      map[string]PendingApproval
+	events       map[string]Event
+	deadLetters  map[string]DeadLetter
+	sources      []string
+}
+
+func newSubscriptionService() *subscriptionService {
+	ss := &subscriptionService{
+		accounts:     map[string]Account{},
+		entitlements: map[string]Entitlement{},
+		approvals:    map[string][]EntitlementApproval{},
+		pending:      map[string]PendingApproval{},
+		events:       map[string]Event{},
+		deadLetters:  map[string]DeadLetter{},
+	}
+	ss.Server = httptest.NewServer(http.HandlerFunc(ss.serveHTTP))
+	return ss
+}
+
+func (ss *subscriptionService) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if source := r.Header.Get("X-Cloud-Bill-Source"); source != "" {
+		ss.sources = append(ss.sources, source)
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	id := ""
+	if len(parts) > 1 {
+		id = parts[1]
+	}
+	route := r.Method + " " + parts[0]
+	if len(parts) > 2 {
+		route += "/" + parts[2]
+	}
+	switch route {
+	case "PUT accounts":
+		account := Account{}
+		ss.decode(w, r, &account, func() { ss.accounts[account.Id] = account })
+	case "GET accounts":
+		account, ok := ss.accounts[id]
+		ss.respond(w, account, ok)
+	case "DELETE accounts":
+		if _, ok := ss.accounts[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(ss.accounts, id)
+		deletion := AccountDeletion{AccountId: id, Account: true, Entitlements: []string{}}
+		for entitlementId, entitlement := range ss.entitlements {
+			if entitlement.Account == id {
+				delete(ss.entitlements, entitlementId)
+				deletion.Entitlements = append(deletion.Entitlements, entitlementId)
+			}
+		}
+		ss.respond(w, deletion, true)
+	case "GET accounts/entitlements":
+		state := strings.TrimPrefix(r.URL.Query().Get("filters"), "state=")
+		page := EntitlementsPage{Entitlements: []Entitlement{}}
+		for _, entitlement := range ss.entitlements {
+			if entitlement.Account == id && entitlement.State == state {
+				page.Entitlements = append(page.Entitlements, entitlement)
+			}
+		}
+		ss.respond(w, page, true)
+	case "PUT entitlements":
+		entitlement := Entitlement{}
+		ss.decode(w, r, &entitlement, func() { ss.entitlements[entitlement.Id] = entitlement })
+	case "DELETE entitlements":
+		if _, ok := ss.entitlements[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(ss.entitlements, id)
+		w.WriteHeader(http.StatusNoContent)
+	case "POST entitlements/approvals":
+		if _, ok := ss.entitlements[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		approval := EntitlementApproval{}
+		ss.decode(w, r, &approval, func() { ss.approvals[id] = append(ss.approvals[id], approval) })
+	case "PUT pendingapprovals":
+		approval := PendingApproval{}
+		ss.decode(w, r, &approval, func() { ss.pending[approval.Id] = approval })
+	case "GET pendingapprovals":
+		approval, ok := ss.pending[id]
+		ss.respond(w, approval, ok)
+	case "PUT events":
+		event := Event{}
+		ss.decode(w, r, &event, func() { ss.events[event.Id] = event })
+	case "GET events":
+		event, ok := ss.events[id]
+		ss.respond(w, event, ok)
+	case "PUT deadletters":
+		deadLetter := DeadLetter{}
+		ss.decode(w, r, &deadLetter, func() { ss.deadLetters[deadLetter.Id] = deadLetter })
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusNotImplemented)
+	}
+}
+
+//decode reads the request body into v and, if it is valid, stores it and responds 204.
+func (ss *subscriptionService) decode(w http.ResponseWriter, r *http.Request, v interface{}, store func()) {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	store()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ss *subscriptionService) respond(w http.ResponseWriter, v interface{}, ok bool) {
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+func (ss *subscriptionService) approvalStates(entitlementId string) []string {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	var states []string
+	for _, approval := range ss.approvals[entitlementId] {
+		states = append(states, approval.Name+" "+approval.State)
+	}
+	return states
+}
+
+//setUp points the listener at a fake marketplace and subscription service and returns the function that closes them.
+func setUp(approvals *policy.Policy) (*fake.Server, *subscriptionService, func()) {
+	mp := fake.NewServer(testPartnerId)
+	ss := newSubscriptionService()
+	procurementClient = mp.Client()
+	approvalPolicy = approvals
+	subscriptionServiceBaseUrl = ss.URL
+	subscriptionServiceClient = ss.Client()
+	maxDeliveryAttempts = 5
+	return mp, ss, func() {
+		ss.Close()
+		mp.Close()
+	}
+}
+
+//purchase creates the test account and entitlement in the marketplace, waiting for approval, and optionally moves
+//the entitlement to state.
+func purchase(mp *fake.Server, state string) {
+	mp.Purchase(testAccountId, testEntitlementId, "test-product", "basic")
+	if state != "" {
+		entitlement, _ := mp.Entitlement(testEntitlementId)
+		entitlement.State = state
+		mp.PutEntitlement(entitlement)
+	}
+}
+
+//storeEntitlement stores the marketplace entitlement, and its account if withAccount, as the pubsub service synced
+//them earlier.
+func storeEntitlement(mp *fake.Server, ss *subscriptionService, withAccount bool) {
+	entitlement, _ := mp.Entitlement(testEntitlementId)
+	entitlement.Account = testAccountId
+	ss.entitlements[testEntitlementId] = entitlement
+	if withAccount {
+		account, _ := mp.Account(testAccountId)
+		ss.accounts[testAccountId] = account
+	}
+}
+
+func holdAll(request string) *policy.Policy {
+	return &policy.Policy{Default: policy.Approve, Rules: []policy.Rule{{Requests: []string{request}, Decision: policy.Hold}}}
+}
+
+func TestProcessPubSubMsg(t *testing.T) {
+	//syncs returns the setup of an event after which the entitlement is saved in the state the marketplace moved it to
+	syncs := func(state string) func(mp *fake.Server, ss *subscriptionService) {
+		return func(mp *fake.Server, ss *subscriptionService) {
+			purchase(mp, fake.EntitlementActive)
+			storeEntitlement(mp, ss, true)
+			entitlement, _ := mp.Entitlement(testEntitlementId)
+			entitlement.State = state
+			mp.PutEntitlement(entitlement)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		eventType string
+		account   bool
+		policy    *policy.Policy
+		setup     func(mp *fake.Server, ss *subscriptionService)
+		wantErr   bool
+		//wantState is the state of the stored entitlement, or "" if it is not stored
+		wantState       string
+		wantPendingPlan string
+		wantAccount     bool
+		wantApprovals   []string
+		wantHeld        string
+		//wantMarketplaceState is the state of the entitlement in the marketplace after the event
+		wantMarketplaceState string
+	}{
+		{
+			name:      "account creation requested waits for signup",
+			eventType: "ACCOUNT_CREATION_REQUESTED",
+			account:   true,
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				purchase(mp, "")
+			},
+			wantMarketplaceState: fake.EntitlementActivationRequested,
+		},
+		{
+			name:      "account active approves waiting entitlements",
+			eventType: "ACCOUNT_ACTIVE",
+			account:   true,
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				purchase(mp, "")
+				storeEntitlement(mp, ss, false)
+			},
+			wantState:            fake.EntitlementActivationRequested,
+			wantAccount:          true,
+			wantApprovals:        []string{"ENTITLEMENT_CREATION APPROVED"},
+			wantMarketplaceState: fake.EntitlementActive,
+		},
+		{
+			name:      "account active holds waiting entitlements",
+			eventType: "ACCOUNT_ACTIVE",
+			account:   true,
+			policy:    holdAll(policy.EntitlementCreation),
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				purchase(mp, "")
+				storeEntitlement(mp, ss, false)
+			},
+			wantState:            fake.EntitlementActivationRequested,
+			wantAccount:          true,
+			wantApprovals:        []string{"ENTITLEMENT_CREATION PENDING"},
+			wantHeld:             policy.EntitlementCreation,
+			wantMarketplaceState: fake.EntitlementActivationRequested,
+		},
+		{
+			name:      "account deleted deletes its entitlements",
+			eventType: "ACCOUNT_DELETED",
+			account:   true,
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				purchase(mp, fake.EntitlementActive)
+				storeEntitlement(mp, ss, true)
+				mp.DeleteAccount(testAccountId)
+			},
+			wantMarketplaceState: fake.EntitlementActive,
+		},
+		{
+			name:      "account deleted that is not stored fails",
+			eventType: "ACCOUNT_DELETED",
+			account:   true,
+			setup:     func(mp *fake.Server, ss *subscriptionService) {},
+			wantErr:   true,
+		},
+		{
+			name:      "creation requested after signup is approved",
+			eventType: "ENTITLEMENT_CREATION_REQUESTED",
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				purchase(mp, "")
+				account, _ := mp.Account(testAccountId)
+				ss.accounts[testAccountId] = account
+			},
+			wantState:            fake.EntitlementActivationRequested,
+			wantAccount:          true,
+			wantApprovals:        []string{"ENTITLEMENT_CREATION APPROVED"},
+			wantMarketplaceState: fake.EntitlementActive,
+		},
+		{
+			name:      "creation requested after signup is rejected",
+			eventType: "ENTITLEMENT_CREATION_REQUESTED",
+			policy:    &policy.Policy{Default: policy.Reject},
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				purchase(mp, "")
+				account, _ := mp.Account(testAccountId)
+				ss.accounts[testAccountId] = account
+			},
+			wantState:            fake.EntitlementActivationRequested,
+			wantAccount:          true,
+			wantApprovals:        []string{"ENTITLEMENT_CREATION REJECTED"},
+			wantMarketplaceState: fake.EntitlementCancelled,
+		},
+		{
+			name:      "creation requested that is already held is not held again",
+			eventType: "ENTITLEMENT_CREATION_REQUESTED",
+			policy:    holdAll(policy.EntitlementCreation),
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				purchase(mp, "")
+				account, _ := mp.Account(testAccountId)
+				ss.accounts[testAccountId] = account
+				ss.pending[testEntitlementId] = PendingApproval{Id: testEntitlementId, Request: policy.EntitlementCreation, Plan: "basic"}
+			},
+			wantState:            fake.EntitlementActivationRequested,
+			wantAccount:          true,
+			wantHeld:             policy.EntitlementCreation,
+			wantMarketplaceState: fake.EntitlementActivationRequested,
+		},
+		{
+			name:      "creation requested before signup waits",
+			eventType: "ENTITLEMENT_CREATION_REQUESTED",
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				purchase(mp, "")
+			},
+			wantState:            fake.EntitlementActivationRequested,
+			wantMarketplaceState: fake.EntitlementActivationRequested,
+		},
+		{
+			name:      "creation requested for an unknown entitlement fails",
+			eventType: "ENTITLEMENT_CREATION_REQUESTED",
+			setup:     func(mp *fake.Server, ss *subscriptionService) {},
+			wantErr:   true,
+		},
+		{
+			name:      "plan change requested is approved",
+			eventType: "ENTITLEMENT_PLAN_CHANGE_REQUESTED",
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				purchase(mp, fake.EntitlementActive)
+				storeEntitlement(mp, ss, true)
+				mp.RequestPlanChange(testEntitlementId, "pro")
+			},
+			wantState:            fake.EntitlementActive,
+			wantAccount:          true,
+			wantApprovals:        []string{"PLAN_CHANGE APPROVED"},
+			wantMarketplaceState: fake.EntitlementActive,
+		},
+		{
+			name:      "plan change requested is held",
+			eventType: "ENTITLEMENT_PLAN_CHANGE_REQUESTED",
+			policy:    holdAll(policy.PlanChange),
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				purchase(mp, fake.EntitlementActive)
+				storeEntitlement(mp, ss, true)
+				mp.RequestPlanChange(testEntitlementId, "pro")
+			},
+			wantState:            fake.EntitlementPendingPlanChangeApproval,
+			wantPendingPlan:      "pro",
+			wantAccount:          true,
+			wantApprovals:        []string{"PLAN_CHANGE PENDING"},
+			wantHeld:             policy.PlanChange,
+			wantMarketplaceState: fake.EntitlementPendingPlanChangeApproval,
+		},
+		{
+			name:      "plan change requested that was cancelled is not decided",
+			eventType: "ENTITLEMENT_PLAN_CHANGE_REQUESTED",
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				purchase(mp, fake.EntitlementActive)
+				storeEntitlement(mp, ss, true)
+				mp.RequestPlanChange(testEntitlementId, "pro")
+				mp.CancelPlanChange(testEntitlementId)
+			},
+			wantState:            fake.EntitlementActive,
+			wantAccount:          true,
+			wantMarketplaceState: fake.EntitlementActive,
+		},
+		{
+			name:                 "offer accepted",
+			eventType:            "ENTITLEMENT_OFFER_ACCEPTED",
+			setup:                syncs(fake.EntitlementActivationRequested),
+			wantState:            fake.EntitlementActivationRequested,
+			wantAccount:          true,
+			wantMarketplaceState: fake.EntitlementActivationRequested,
+		},
+		{
+			name:                 "active",
+			eventType:            "ENTITLEMENT_ACTIVE",
+			setup:                syncs(fake.EntitlementActive),
+			wantState:            fake.EntitlementActive,
+			wantAccount:          true,
+			wantMarketplaceState: fake.EntitlementActive,
+		},
+		{
+			name:                 "renewed",
+			eventType:            "ENTITLEMENT_RENEWED",
+			setup:                syncs(fake.EntitlementActive),
+			wantState:            fake.EntitlementActive,
+			wantAccount:          true,
+			wantMarketplaceState: fake.EntitlementActive,
+		},
+		{
+			name:                 "offer ended",
+			eventType:            "ENTITLEMENT_OFFER_ENDED",
+			setup:                syncs(fake.EntitlementCancelled),
+			wantState:            fake.EntitlementCancelled,
+			wantAccount:          true,
+			wantMarketplaceState: fake.EntitlementCancelled,
+		},
+		{
+			name:                 "plan changed",
+			eventType:            "ENTITLEMENT_PLAN_CHANGED",
+			setup:                syncs(fake.EntitlementActive),
+			wantState:            fake.EntitlementActive,
+			wantAccount:          true,
+			wantMarketplaceState: fake.EntitlementActive,
+		},
+		{
+			name:                 "plan change cancelled",
+			eventType:            "ENTITLEMENT_PLAN_CHANGE_CANCELLED",
+			setup:                syncs(fake.EntitlementActive),
+			wantState:            fake.EntitlementActive,
+			wantAccount:          true,
+			wantMarketplaceState: fake.EntitlementActive,
+		},
+		{
+			name:                 "pending cancellation",
+			eventType:            "ENTITLEMENT_PENDING_CANCELLATION",
+			setup:                syncs(fake.EntitlementPendingCancellation),
+			wantState:            fake.EntitlementPendingCancellation,
+			wantAccount:          true,
+			wantMarketplaceState: fake.EntitlementPendingCancellation,
+		},
+		{
+			name:                 "cancellation reverted",
+			eventType:            "ENTITLEMENT_CANCELLATION_REVERTED",
+			setup:                syncs(fake.EntitlementActive),
+			wantState:            fake.EntitlementActive,
+			wantAccount:          true,
+			wantMarketplaceState: fake.EntitlementActive,
+		},
+		{
+			name:                 "cancelling",
+			eventType:            "ENTITLEMENT_CANCELLING",
+			setup:                syncs("ENTITLEMENT_CANCELLING"),
+			wantState:            "ENTITLEMENT_CANCELLING",
+			wantAccount:          true,
+			wantMarketplaceState: "ENTITLEMENT_CANCELLING",
+		},
+		{
+			name:                 "cancelled",
+			eventType:            "ENTITLEMENT_CANCELLED",
+			setup:                syncs(fake.EntitlementCancelled),
+			wantState:            fake.EntitlementCancelled,
+			wantAccount:          true,
+			wantMarketplaceState: fake.EntitlementCancelled,
+		},
+		{
+			name:      "sync of an unknown entitlement fails",
+			eventType: "ENTITLEMENT_ACTIVE",
+			setup:     func(mp *fake.Server, ss *subscriptionService) {},
+			wantErr:   true,
+		},
+		{
+			name:      "entitlement deleted",
+			eventType: "ENTITLEMENT_DELETED",
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				purchase(mp, fake.EntitlementCancelled)
+				storeEntitlement(mp, ss, true)
+				mp.DeleteEntitlement(testEntitlementId)
+			},
+			wantAccount: true,
+		},
+		{
+			name:      "entitlement deleted that is not stored fails",
+			eventType: "ENTITLEMENT_DELETED",
+			setup:     func(mp *fake.Server, ss *subscriptionService) {},
+			wantErr:   true,
+		},
+		{
+			name:      "test message",
+			eventType: "TEST",
+			setup:     func(mp *fake.Server, ss *subscriptionService) {},
+		},
+		{
+			name:      "unknown event type is ignored",
+			eventType: "ENTITLEMENT_UNKNOWN",
+			setup:     func(mp *fake.Server, ss *subscriptionService) {},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			approvals := test.policy
+			if approvals == nil {
+				approvals = policy.ApproveAll
+			}
+			mp, ss, tearDown := setUp(approvals)
+			defer tearDown()
+			test.setup(mp, ss)
+
+			pubSubMsg := PubSubMsg{EventId: "event-1", EventType: test.eventType}
+			if test.account {
+				pubSubMsg.Account.Id = testAccountId
+			} else {
+				pubSubMsg.Entitlement.Id = testEntitlementId
+			}
+			run := newEventRun(pubSubMsg, false)
+			err := processPubSubMsg(context.Background(), pubSubMsg, run)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("processPubSubMsg() error = %v, want error %t", err, test.wantErr)
+			}
+
+			ss.mutex.Lock()
+			entitlement, stored := ss.entitlements[testEntitlementId]
+			_, accountStored := ss.accounts[testAccountId]
+			pending, held := ss.pending[testEntitlementId]
+			sources := ss.sources
+			ss.mutex.Unlock()
+			if test.wantState == "" && stored {
+				t.Errorf("entitlement is stored as %s, want none", entitlement.State)
+			} else if test.wantState != "" && (entitlement.State != test.wantState || entitlement.NewPendingPlan != test.wantPendingPlan) {
+				t.Errorf("stored entitlement is %s with pending plan %q, want %s with %q", entitlement.State,
+					entitlement.NewPendingPlan, test.wantState, test.wantPendingPlan)
+			}
+			if stored && entitlement.Account != testAccountId {
+				t.Errorf("stored entitlement account = %s, want the account id %s", entitlement.Account, testAccountId)
+			}
+			if accountStored != test.wantAccount {
+				t.Errorf("account stored = %t, want %t", accountStored, test.wantAccount)
+			}
+			if approvals := ss.approvalStates(testEntitlementId); !reflect.DeepEqual(approvals, test.wantApprovals) {
+				t.Errorf("approvals = %v, want %v", approvals, test.wantApprovals)
+			}
+			if test.wantHeld == "" && held {
+				t.Errorf("%s is held, want nothing held", pending.Request)
+			} else if test.wantHeld != "" && pending.Request != test.wantHeld {
+				t.Errorf("held request = %q, want %s", pending.Request, test.wantHeld)
+			}
+			if test.wantMarketplaceState != "" {
+				if mpEntitlement, _ := mp.Entitlement(testEntitlementId); mpEntitlement.State != test.wantMarketplaceState {
+					t.Errorf("marketplace entitlement is %s, want %s", mpEntitlement.State, test.wantMarketplaceState)
+				}
+			}
+			for _, source := range sources {
+				if source != run.source {
+					t.Errorf("write source = %q, want %q", source, run.source)
+				}
+			}
+		})
+	}
+}
+
+func TestProcessPubSubMsgDryRun(t *testing.T) {
+	mp, ss, tearDown := setUp(policy.ApproveAll)
+	defer tearDown()
+	purchase(mp, "")
+	account, _ := mp.Account(testAccountId)
+	ss.accounts[testAccountId] = account
+
+	pubSubMsg := PubSubMsg{EventId: "event-1", EventType: "ENTITLEMENT_CREATION_REQUESTED", Entitlement: EntitlementMeta{Id: testEntitlementId}}
+	run := newEventRun(pubSubMsg, true)
+	if err := processPubSubMsg(context.Background(), pubSubMsg, run); err != nil {
+		t.Fatal(err)
+	}
+	wantActions := []string{
+		"save entitlement " + testEntitlementId,
+		"approve entitlement " + testEntitlementId,
+		"record APPROVED ENTITLEMENT_CREATION approval of entitlement " + testEntitlementId,
+	}
+	if !reflect.DeepEqual(run.actions, wantActions) {
+		t.Errorf("actions = %q, want %q", run.actions, wantActions)
+	}
+	if _, stored := ss.entitlements[testEntitlementId]; stored {
+		t.Error("dry run stored the entitlement")
+	}
+	if mpEntitlement, _ := mp.Entitlement(testEntitlementId); mpEntitlement.State != fake.EntitlementActivationRequested {
+		t.Errorf("dry run changed the marketplace entitlement to %s", mpEntitlement.State)
+	}
+}
+
+func TestHandlePubSubMsgSkipsHandledEvents(t *testing.T) {
+	mp, ss, tearDown := setUp(policy.ApproveAll)
+	defer tearDown()
+	purchase(mp, fake.EntitlementActive)
+
+	pubSubMsg := PubSubMsg{EventId: "event-1", EventType: "ENTITLEMENT_ACTIVE", Entitlement: EntitlementMeta{Id: testEntitlementId}}
+	data, _ := json.Marshal(pubSubMsg)
+	for _, wantOutcome := range []string{EventSucceeded, EventSkipped} {
+		outcome, err := handlePubSubMsg(context.Background(), pubSubMsg, data, newEventRun(pubSubMsg, false))
+		if err != nil || outcome != wantOutcome {
+			t.Errorf("handlePubSubMsg() = %s, %v, want %s", outcome, err, wantOutcome)
+		}
+	}
+	if event := ss.events["event-1"]; event.Outcome != EventSucceeded || event.Attempts != 1 {
+		t.Errorf("recorded event = %s after %d attempts, want %s after 1", event.Outcome, event.Attempts, EventSucceeded)
+	}
+}
+
+func TestHandlePubSubMsgDeadLetters(t *testing.T) {
+	_, ss, tearDown := setUp(policy.ApproveAll)
+	defer tearDown()
+	maxDeliveryAttempts = 2
+
+	//the entitlement is not in the marketplace so every delivery fails
+	pubSubMsg := PubSubMsg{EventId: "event-1", EventType: "ENTITLEMENT_ACTIVE", Entitlement: EntitlementMeta{Id: testEntitlementId}}
+	data, _ := json.Marshal(pubSubMsg)
+	for _, wantOutcome := range []string{EventFailed, EventDeadLettered, EventSkipped} {
+		outcome, _ := handlePubSubMsg(context.Background(), pubSubMsg, data, newEventRun(pubSubMsg, false))
+		if outcome != wantOutcome {
+			t.Errorf("handlePubSubMsg() = %s, want %s", outcome, wantOutcome)
+		}
+	}
+	if deadLetter, ok := ss.deadLetters["event-1"]; !ok || deadLetter.Attempts != 2 || deadLetter.Data != string(data) {
+		t.Errorf("dead letter = %+v, want the message data after 2 attempts", deadLetter)
+	}
+}
+
+func TestHandleMessageCancelled(t *testing.T) {
+	mp, ss, tearDown := setUp(policy.ApproveAll)
+	defer tearDown()
+	purchase(mp, fake.EntitlementActive)
+
+	//no subscription service call is sent once the message context is done, so nothing is recorded
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	data, _ := json.Marshal(PubSubMsg{EventId: "event-1", EventType: "ENTITLEMENT_ACTIVE", Entitlement: EntitlementMeta{Id: testEntitlementId}})
+	if HandleMessage(ctx, "message-1", data) {
+		t.Error("HandleMessage() acked the message, want it redelivered")
+	}
+	if HandleMessage(ctx, "message-2", []byte("not json")) {
+		t.Error("HandleMessage() acked undecodable data it could not dead letter, want it redelivered")
+	}
+	if len(ss.events) != 0 || len(ss.entitlements) != 0 || len(ss.deadLetters) != 0 || len(ss.sources) != 0 {
+		t.Errorf("subscription service changed after the context was cancelled: %d events, %d entitlements, %d dead letters",
+			len(ss.events), len(ss.entitlements), len(ss.deadLetters))
+	}
+}
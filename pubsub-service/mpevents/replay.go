@@ -0,0 +1,68 @@
+package mpevents
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+)
+
+//maxReplayLineSize is the longest PubSubMsg JSON line Replay reads.
+const maxReplayLineSize = 1024 * 1024
+
+//ReplayResult is the outcome of replaying one line of PubSubMsg JSON.
+type ReplayResult struct {
+	Line      int      `json:"line"`
+	EventId   string   `json:"eventId,omitempty"`
+	EventType string   `json:"eventType,omitempty"`
+	Outcome   string   `json:"outcome"`
+	Error     string   `json:"error,omitempty"`
+	Actions   []string `json:"actions,omitempty"`
+}
+
+//Replay reads PubSubMsg JSON lines and runs each, in order, through the same processing as messages from the
+//subscription, including skipping events that were already handled. A dry run only reads from the procurement API and
+//the subscription service, it reports the writes it would have made as actions and records nothing. Blank lines are
+//ignored. A line that is not a valid message is reported as failed and the replay continues with the next line.
+func Replay(ctx context.Context, reader io.Reader, dryRun bool) ([]ReplayResult, error) {
+	results := []ReplayResult{}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), maxReplayLineSize)
+	for line := 1; scanner.Scan(); line++ {
+		data := scanner.Bytes()
+		if strings.TrimSpace(string(data)) == "" {
+			continue
+		}
+		result := ReplayResult{Line: line}
+
+		pubSubMsg := PubSubMsg{}
+		if err := json.Unmarshal(data, &pubSubMsg); err != nil {
+			result.Outcome = EventFailed
+			result.Error = "could not decode message data: " + err.Error()
+		} else if pubSubMsg.EventId == "" {
+			result.Outcome = EventFailed
+			result.Error = "message has no event ID"
+		} else {
+			LogI.Printf("Replaying line %d event %s %s \n", line, pubSubMsg.EventId, pubSubMsg.EventType)
+			run := newEventRun(pubSubMsg, dryRun)
+			outcome, err := handlePubSubMsg(ctx, pubSubMsg, data, run)
+			result.EventId = pubSubMsg.EventId
+			result.EventType = pubSubMsg.EventType
+			result.Outcome = outcome
+			result.Actions = run.actions
+			if err != nil {
+				result.Error = err.Error()
+			}
+		}
+		results = append(results, result)
+	}
+	if err := scanner.Err(); err != nil {
+		if err == bufio.ErrTooLong {
+			return results, errors.New("a line is longer than the maximum message size")
+		}
+		return results, err
+	}
+	return results, nil
+}
@@ -0,0 +1,144 @@
+//Package policy decides whether marketplace entitlement requests are approved, rejected or held for manual review.
+//A policy is a list of rules loaded from a JSON file, for example
+//
+//	{
+//	  "default": "APPROVE",
+//	  "rules": [
+//	    {"requests": ["PLAN_CHANGE"], "plans": ["enterprise"], "decision": "HOLD", "reason": "Enterprise needs sales review"},
+//	    {"accounts": ["E-1234"], "decision": "REJECT", "reason": "Account is blocked"}
+//	  ]
+//	}
+//
+//The first rule that matches a request decides it, and the default decides requests no rule matches.
+package policy
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+//Decisions
+const (
+	Approve = "APPROVE"
+	Reject  = "REJECT"
+	Hold    = "HOLD"
+)
+
+//Requests a policy decides
+const (
+	EntitlementCreation = "ENTITLEMENT_CREATION"
+	PlanChange          = "PLAN_CHANGE"
+)
+
+//Reasons given for rejected and held requests whose rule has no reason
+const (
+	DefaultRejectReason = "The request was not approved."
+	DefaultHoldReason   = "The request is waiting for manual review."
+)
+
+//Request is an entitlement creation or plan change request. Plan is the requested plan, the pending plan of a plan
+//change.
+type Request struct {
+	Type      string
+	Product   string
+	Plan      string
+	AccountId string
+}
+
+//Rule matches requests whose type, product, plan and account are in its lists. An empty list matches anything.
+type Rule struct {
+	Requests []string `json:"requests,omitempty"`
+	Products []string `json:"products,omitempty"`
+	Plans    []string `json:"plans,omitempty"`
+	Accounts []string `json:"accounts,omitempty"`
+	Decision string   `json:"decision"`
+	//Reason is sent to the Procurement API with rejections and stored with held requests.
+	Reason string `json:"reason,omitempty"`
+}
+
+type Policy struct {
+	Default string `json:"default"`
+	Rules   []Rule `json:"rules"`
+}
+
+//ApproveAll is the policy used when no policy file is configured, it approves every request like the service always did.
+var ApproveAll = &Policy{Default: Approve}
+
+//Load reads and validates the policy in the JSON file at path.
+func Load(path string) (*Policy, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	policy := Policy{}
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, errors.New("Invalid approval policy " + path + ": " + err.Error())
+	}
+	if policy.Default == "" {
+		policy.Default = Approve
+	}
+	if err := policy.validate(); err != nil {
+		return nil, errors.New("Invalid approval policy " + path + ": " + err.Error())
+	}
+	return &policy, nil
+}
+
+func (policy *Policy) validate() error {
+	if !validDecision(policy.Default) {
+		return errors.New("default must be " + Approve + ", " + Reject + " or " + Hold)
+	}
+	for _, rule := range policy.Rules {
+		if !validDecision(rule.Decision) {
+			return errors.New("rule decision must be " + Approve + ", " + Reject + " or " + Hold)
+		}
+		for _, request := range rule.Requests {
+			if request != EntitlementCreation && request != PlanChange {
+				return errors.New("rule request " + request + " must be " + EntitlementCreation + " or " + PlanChange)
+			}
+		}
+	}
+	return nil
+}
+
+func validDecision(decision string) bool {
+	return decision == Approve || decision == Reject || decision == Hold
+}
+
+//Decide returns the decision for request and, unless it is approved, the reason.
+func (policy *Policy) Decide(request Request) (string, string) {
+	decision, reason := policy.Default, ""
+	for _, rule := range policy.Rules {
+		if matches(rule.Requests, request.Type) && matches(rule.Products, request.Product) &&
+			matches(rule.Plans, request.Plan) && matches(rule.Accounts, request.AccountId) {
+			decision, reason = rule.Decision, rule.Reason
+			break
+		}
+	}
+	switch {
+	case decision == Approve:
+		reason = ""
+	case reason != "":
+	case decision == Reject:
+		reason = DefaultRejectReason
+	case decision == Hold:
+		reason = DefaultHoldReason
+	}
+	return decision, reason
+}
+
+func matches(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package policy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestDecide(t *testing.T) {
+	rules := &Policy{
+		Default: Approve,
+		Rules: []Rule{
+			{Accounts: []string{"blocked"}, Decision: Reject, Reason: "Account is blocked"},
+			{Requests: []string{PlanChange}, Plans: []string{"enterprise"}, Decision: Hold, Reason: "Enterprise needs sales review"},
+			{Products: []string{"beta"}, Decision: Hold},
+			{Products: []string{"retired"}, Decision: Reject},
+			{Products: []string{"beta", "retired"}, Decision: Approve, Reason: "never given"},
+		},
+	}
+	tests := []struct {
+		name         string
+		policy       *Policy
+		request      Request
+		wantDecision string
+		wantReason   string
+	}{
+		{"no rule matches", rules, Request{EntitlementCreation, "product-a", "basic", "A-1"}, Approve, ""},
+		{"first rule wins", rules, Request{PlanChange, "beta", "enterprise", "blocked"}, Reject, "Account is blocked"},
+		{"every list must match", rules, Request{EntitlementCreation, "product-a", "enterprise", "A-1"}, Approve, ""},
+		{"rule reason", rules, Request{PlanChange, "product-a", "enterprise", "A-1"}, Hold, "Enterprise needs sales review"},
+		{"empty lists match anything", rules, Request{PlanChange, "beta", "basic", "A-1"}, Hold, DefaultHoldReason},
+		{"default reject reason", rules, Request{EntitlementCreation, "retired", "basic", "A-1"}, Reject, DefaultRejectReason},
+		{"default decision reason", &Policy{Default: Hold}, Request{EntitlementCreation, "product-a", "basic", "A-1"}, Hold, DefaultHoldReason},
+		{"approvals have no reason", &Policy{Default: Reject, Rules: []Rule{{Decision: Approve, Reason: "ignored"}}}, Request{PlanChange, "product-a", "basic", "A-1"}, Approve, ""},
+		{"approve all", ApproveAll, Request{PlanChange, "product-a", "enterprise", "blocked"}, Approve, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decision, reason := test.policy.Decide(test.request)
+			if decision != test.wantDecision || reason != test.wantReason {
+				t.Errorf("Decide(%+v) = %s, %q, want %s, %q", test.request, decision, reason, test.wantDecision, test.wantReason)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		json    string
+		want    *Policy
+		wantErr bool
+	}{
+		{
+			name: "rules",
+			json: `{"default": "HOLD", "rules": [{"requests": ["PLAN_CHANGE"], "plans": ["enterprise"], "decision": "REJECT", "reason": "No"}]}`,
+			want: &Policy{Default: Hold, Rules: []Rule{{Requests: []string{PlanChange}, Plans: []string{"enterprise"}, Decision: Reject, Reason: "No"}}},
+		},
+		{
+			name: "default approves",
+			json: `{"rules": []}`,
+			want: &Policy{Default: Approve, Rules: []Rule{}},
+		},
+		{
+			name:    "unknown default",
+			json:    `{"default": "MAYBE"}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown rule decision",
+			json:    `{"rules": [{"products": ["a"], "decision": "approve"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "missing rule decision",
+			json:    `{"rules": [{"products": ["a"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown request type",
+			json:    `{"rules": [{"requests": ["ENTITLEMENT_CANCELLATION"], "decision": "HOLD"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			json:    `{"rules": [{"product": ["a"], "decision": "HOLD"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid json",
+			json:    `{"rules": [`,
+			wantErr: true,
+		},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, "policy"+strconv.Itoa(i)+".json")
+			if err := ioutil.WriteFile(path, []byte(test.json), 0600); err != nil {
+				t.Fatal(err)
+			}
+			policy, err := Load(path)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("Load() = %+v, want an error", policy)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			if !reflect.DeepEqual(policy, test.want) {
+				t.Errorf("Load() = %+v, want %+v", policy, test.want)
+			}
+		})
+	}
+
+	if _, err := Load(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("Load() of a missing file succeeded, want an error")
+	}
+}
@@ -0,0 +1,51 @@
+package web
+
+import (
+	"encoding/json"
+	"github.com/cloudbees/cloud-bill-saas/pubsub-service/mpevents"
+	"github.com/gorilla/mux"
+	"io"
+	"net/http"
+)
+
+//GetDeadLetters lists the dead letters stored with the subscription service. The filters, order, limit and cursor
+//query parameters are passed through.
+func (hdlr *PubSubServiceHandler) GetDeadLetters(w http.ResponseWriter, r *http.Request) {
+	url := hdlr.SubscriptionServiceUrl + "/deadletters"
+	if r.URL.RawQuery != "" {
+		url += "?" + r.URL.RawQuery
+	}
+	resp, err := hdlr.SubscriptionServiceClient.Get(url)
+	if err != nil {
+		LogE.Printf("Failed to get dead letters %s %#v \n", url, err)
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+//ReplayDeadLetter processes a dead letter again and returns the recorded event on success.
+func (hdlr *PubSubServiceHandler) ReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	deadLetterId := mux.Vars(r)["deadLetterId"]
+
+	event, err := mpevents.ReplayDeadLetter(r.Context(), deadLetterId)
+	if err == mpevents.ErrDeadLetterNotFound {
+		writeError(w, http.StatusNotFound, err.Error())
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "Error occured while replaying dead letter: "+err.Error())
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(event)
+	}
+}
+
+//writeError writes a JSON error response like the subscription service does.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,30 @@
+package web
+
+import (
+	"encoding/json"
+	"github.com/cloudbees/cloud-bill-saas/pubsub-service/mpevents"
+	"net/http"
+	"strconv"
+)
+
+//ReplayEvents runs PubSubMsg JSON lines in the request body through the same processing as messages from the
+//subscription and returns the result of each line. With dryRun=true nothing is written.
+func (hdlr *PubSubServiceHandler) ReplayEvents(w http.ResponseWriter, r *http.Request) {
+	dryRun := false
+	if value := r.URL.Query().Get("dryRun"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			writeError(w, http.StatusBadRequest, "dryRun must be true or false")
+			return
+		}
+	}
+
+	results, err := mpevents.Replay(r.Context(), r.Body, dryRun)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error occured while reading events: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(results)
+}
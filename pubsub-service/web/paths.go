@@ -1,16 +1,64 @@
 package web
 
 import (
+	"context"
+	"github.com/cloudbees/cloud-bill-saas/common/procurement"
 	"github.com/gorilla/mux"
 	"net/http"
+	"time"
 )
 
-//SetUpService sets up the subscription service.
-func SetUpService(healthCheckEndpoint string, pubSubSubscription string, subscriptionServiceUrl string, cloudCommerceProcurementUrl string, partnerId string, gcpProjectId string) error {
-	handler := GetPubSubServiceHandler(pubSubSubscription, subscriptionServiceUrl, cloudCommerceProcurementUrl, partnerId, gcpProjectId)
+//SetUpService sets up the subscription service and serves it until ctx is done. Requests in flight then have up to
+//shutdownTimeout to finish. Messages are accepted from a push subscription only if pushVerifier is not nil. The push
+//endpoint is public, so the replay and dead letter endpoints, which are not authenticated, are then served on
+//adminEndpoint instead of the health check port.
+func SetUpService(ctx context.Context, healthCheckEndpoint string, adminEndpoint string, pubSubSubscription string, subscriptionServiceUrl string, subscriptionServiceClient *http.Client, procurementClient procurement.Client, gcpProjectId string, shutdownTimeout time.Duration, pushVerifier *PushVerifier) error {
+	handler := GetPubSubServiceHandler(pubSubSubscription, subscriptionServiceUrl, subscriptionServiceClient, procurementClient, gcpProjectId, pushVerifier)
 	r := mux.NewRouter()
 
 	r.Methods(http.MethodGet).Path("/healthz").HandlerFunc(handler.Healthz)
+	servers := []*http.Server{{Addr: ":"+healthCheckEndpoint, Handler: r}}
 
-	return http.ListenAndServe(":"+healthCheckEndpoint, r)
-}
\ No newline at end of file
+	//push subscription
+	if pushVerifier != nil {
+		r.Methods(http.MethodPost).Path("/api/v1/push").HandlerFunc(handler.PushMessage)
+
+		admin := mux.NewRouter()
+		setUpAdminRoutes(admin, handler)
+		servers = append(servers, &http.Server{Addr: ":"+adminEndpoint, Handler: admin})
+	} else {
+		setUpAdminRoutes(r, handler)
+	}
+
+	serveErr := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			serveErr <- server.ListenAndServe()
+		}(server)
+	}
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var shutdownErr error
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil && shutdownErr == nil {
+			shutdownErr = err
+		}
+	}
+	return shutdownErr
+}
+
+//setUpAdminRoutes adds the endpoints that replay events and dead letters.
+func setUpAdminRoutes(r *mux.Router, handler *PubSubServiceHandler) {
+	//replay
+	r.Methods(http.MethodPost).Path("/api/v1/events").HandlerFunc(handler.ReplayEvents)
+
+	//dead letters
+	r.Methods(http.MethodGet).Path("/api/v1/deadletters").HandlerFunc(handler.GetDeadLetters)
+	r.Methods(http.MethodPost).Path("/api/v1/deadletters/{deadLetterId}/replay").HandlerFunc(handler.ReplayDeadLetter)
+}
@@ -0,0 +1,90 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/cloudbees/cloud-bill-saas/pubsub-service/mpevents"
+	"github.com/coreos/go-oidc"
+	"net/http"
+	"strings"
+)
+
+//googleIssuer is the issuer of the OIDC tokens Pub/Sub signs push requests with.
+const googleIssuer = "https://accounts.google.com"
+
+//PushEnvelope is the body of a Pub/Sub push request. Data is base64 encoded in the JSON.
+type PushEnvelope struct {
+	Message struct {
+		Data        []byte            `json:"data"`
+		MessageId   string            `json:"messageId"`
+		Attributes  map[string]string `json:"attributes"`
+		PublishTime string            `json:"publishTime"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+//PushVerifier checks the OIDC token on push requests. The token must be signed by a key from keysUrl, issued by Google
+//for audience and, if serviceAccount is set, for that service account.
+type PushVerifier struct {
+	verifier       *oidc.IDTokenVerifier
+	serviceAccount string
+}
+
+func NewPushVerifier(audience string, serviceAccount string, keysUrl string) *PushVerifier {
+	keySet := oidc.NewRemoteKeySet(context.Background(), keysUrl)
+	return &PushVerifier{
+		oidc.NewVerifier(googleIssuer, keySet, &oidc.Config{ClientID: audience}),
+		serviceAccount,
+	}
+}
+
+//Verify returns an error unless the request has a valid bearer token.
+func (pv *PushVerifier) Verify(r *http.Request) error {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return errors.New("missing bearer token")
+	}
+	token, err := pv.verifier.Verify(r.Context(), strings.TrimPrefix(authorization, "Bearer "))
+	if err != nil {
+		return err
+	}
+	if pv.serviceAccount == "" {
+		return nil
+	}
+	claims := struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}{}
+	if err := token.Claims(&claims); err != nil {
+		return err
+	}
+	if claims.Email != pv.serviceAccount || !claims.EmailVerified {
+		return errors.New("token is not for service account " + pv.serviceAccount)
+	}
+	return nil
+}
+
+//PushMessage processes a message from a push subscription the same way as a pulled message. It returns 204 to ack
+//the message and 500 to nack it so Pub/Sub redelivers it.
+func (hdlr *PubSubServiceHandler) PushMessage(w http.ResponseWriter, r *http.Request) {
+	if err := hdlr.PushVerifier.Verify(r); err != nil {
+		LogE.Printf("Rejected push request: %v \n", err)
+		writeError(w, http.StatusUnauthorized, "invalid push token: "+err.Error())
+		return
+	}
+
+	envelope := PushEnvelope{}
+	if err := json.NewDecoder(r.Body).Decode(&envelope); err != nil {
+		writeError(w, http.StatusBadRequest, "Error occured while reading push request: "+err.Error())
+		return
+	}
+
+	if mpevents.HandleMessage(r.Context(), envelope.Message.MessageId, envelope.Message.Data) {
+		LogI.Printf("Message %s acked.", envelope.Message.MessageId)
+		w.WriteHeader(http.StatusNoContent)
+	} else {
+		LogI.Printf("Message %s nacked.", envelope.Message.MessageId)
+		writeError(w, http.StatusInternalServerError, "message "+envelope.Message.MessageId+" was not processed")
+	}
+}
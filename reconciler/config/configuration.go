@@ -0,0 +1,237 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"github.com/cloudbees/cloud-bill-saas/common/retry"
+	"github.com/jefferyfry/funclog"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	GcpProjectId				= "cloud-billing-saas"
+	SubscriptionServiceUrl		= "https://subscription-service.cloudbees-jenkins-support.svc.cluster.local"
+	CloudCommerceProcurementUrl	= "https://cloudcommerceprocurement.googleapis.com/"
+	PartnerId					= ""
+	SentryDsn					= ""
+	RetryMaxAttempts			= "4"
+	RetryInitialBackoff			= "100ms"
+	RetryMaxBackoff				= "5s"
+	RetryAttemptTimeout			= "10s"
+	RetryBudget					= "0.2"
+
+	LogI = funclog.NewInfoLogger("INFO: ")
+	LogE = funclog.NewErrorLogger("ERROR: ")
+)
+
+type ServiceConfig struct {
+	GcpProjectId				string	`json:"gcpProjectId"`
+	SubscriptionServiceUrl		string	`json:"subscriptionServiceUrl"`
+	CloudCommerceProcurementUrl	string	`json:"cloudCommerceProcurementUrl"`
+	PartnerId					string	`json:"partnerId"`
+	SentryDsn					string	`json:"sentryDsn"`
+	ExcludeProducts				string	`json:"excludeProducts"`
+	DryRun						bool	`json:"dryRun"`
+	ReportFile					string	`json:"reportFile"`
+	RetryMaxAttempts			string	`json:"retryMaxAttempts"`
+	RetryInitialBackoff			string	`json:"retryInitialBackoff"`
+	RetryMaxBackoff				string	`json:"retryMaxBackoff"`
+	RetryAttemptTimeout			string	`json:"retryAttemptTimeout"`
+	RetryBudget					string	`json:"retryBudget"`
+}
+
+func GetConfiguration() (ServiceConfig, error) {
+	conf := ServiceConfig {
+		GcpProjectId,
+		SubscriptionServiceUrl,
+		CloudCommerceProcurementUrl,
+		PartnerId,
+		SentryDsn,
+		"",
+		false,
+		"",
+		RetryMaxAttempts,
+		RetryInitialBackoff,
+		RetryMaxBackoff,
+		RetryAttemptTimeout,
+		RetryBudget,
+	}
+
+	if dir, err := os.Getwd(); err != nil {
+		LogE.Println("Unable to determine working directory.")
+		return conf, err
+	} else {
+		LogI.Printf("Running service with working directory %s \n", dir)
+	}
+
+	//parse commandline arguments
+	configFile := flag.String("configFile", "", "set the path to the configuration json file")
+	gcpProjectId := flag.String("gcpProjectId", "", "set the GCP Project Id")
+	subscriptionServiceUrl := flag.String("subscriptionServiceUrl", "", "set the subscription service url")
+	cloudCommerceProcurementUrl := flag.String("cloudCommerceProcurementUrl", "", "set root url for the cloud commerce procurement API")
+	partnerId := flag.String("partnerId", "", "set the CloudBees Partner Id")
+	sentryDsn := flag.String("sentryDsn", "", "set the Sentry DSN")
+	excludeProducts := flag.String("excludeProducts", "", "a comma separated list of products not to reconcile, such as the VM products of the entitlement check")
+	dryRun := flag.String("dryRun", "", "set to true to report the differences without fixing them")
+	reportFile := flag.String("reportFile", "", "set the path of the JSON diff report, the report is written to stdout if not set")
+	retryMaxAttempts := flag.String("retryMaxAttempts", "", "set how many times a request to another service is attempted (ex. 4)")
+	retryInitialBackoff := flag.String("retryInitialBackoff", "", "set the longest wait before the first retry, doubled for each retry (ex. 100ms)")
+	retryMaxBackoff := flag.String("retryMaxBackoff", "", "set the longest wait between retries (ex. 5s)")
+	retryAttemptTimeout := flag.String("retryAttemptTimeout", "", "set the deadline of each attempt of a request to another service (ex. 10s)")
+	retryBudget := flag.String("retryBudget", "", "set how many retries are allowed per request on average (ex. 0.2)")
+	flag.Parse()
+
+	//try environment variables if necessary
+	if *configFile == "" {
+		*configFile = os.Getenv("CLOUD_BILL_RECONCILER_CONFIG_FILE")
+	}
+	if *gcpProjectId == "" {
+		*gcpProjectId = os.Getenv("CLOUD_BILL_RECONCILER_GCP_PROJECT_ID")
+	}
+	if *subscriptionServiceUrl == "" {
+		*subscriptionServiceUrl = os.Getenv("CLOUD_BILL_RECONCILER_SUBSCRIPTION_SERVICE_URL")
+	}
+	if *cloudCommerceProcurementUrl == "" {
+		*cloudCommerceProcurementUrl = os.Getenv("CLOUD_BILL_RECONCILER_CLOUD_COMMERCE_PROCUREMENT_URL")
+	}
+	if *partnerId == "" {
+		*partnerId = os.Getenv("CLOUD_BILL_RECONCILER_PARTNER_ID")
+	}
+	if *sentryDsn == "" {
+		*sentryDsn = os.Getenv("CLOUD_BILL_RECONCILER_SENTRY_DSN")
+	}
+	if *excludeProducts == "" {
+		*excludeProducts = os.Getenv("CLOUD_BILL_RECONCILER_EXCLUDE_PRODUCTS")
+	}
+	if *dryRun == "" {
+		*dryRun = os.Getenv("CLOUD_BILL_RECONCILER_DRY_RUN")
+	}
+	if *reportFile == "" {
+		*reportFile = os.Getenv("CLOUD_BILL_RECONCILER_REPORT_FILE")
+	}
+	if *retryMaxAttempts == "" {
+		*retryMaxAttempts = os.Getenv("CLOUD_BILL_RECONCILER_RETRY_MAX_ATTEMPTS")
+	}
+	if *retryInitialBackoff == "" {
+		*retryInitialBackoff = os.Getenv("CLOUD_BILL_RECONCILER_RETRY_INITIAL_BACKOFF")
+	}
+	if *retryMaxBackoff == "" {
+		*retryMaxBackoff = os.Getenv("CLOUD_BILL_RECONCILER_RETRY_MAX_BACKOFF")
+	}
+	if *retryAttemptTimeout == "" {
+		*retryAttemptTimeout = os.Getenv("CLOUD_BILL_RECONCILER_RETRY_ATTEMPT_TIMEOUT")
+	}
+	if *retryBudget == "" {
+		*retryBudget = os.Getenv("CLOUD_BILL_RECONCILER_RETRY_BUDGET")
+	}
+
+	if *configFile == "" {
+		//try other flags
+		conf.GcpProjectId = *gcpProjectId
+		if *subscriptionServiceUrl != "" {
+			conf.SubscriptionServiceUrl = *subscriptionServiceUrl
+		}
+		if *cloudCommerceProcurementUrl != "" {
+			conf.CloudCommerceProcurementUrl = *cloudCommerceProcurementUrl
+		}
+		conf.PartnerId = *partnerId
+		conf.SentryDsn = *sentryDsn
+		conf.ExcludeProducts = *excludeProducts
+		if *dryRun != "" {
+			if dry, err := strconv.ParseBool(*dryRun); err != nil {
+				LogE.Printf("DryRun %s must be true or false. \n", *dryRun)
+				return conf, err
+			} else {
+				conf.DryRun = dry
+			}
+		}
+		conf.ReportFile = *reportFile
+		if *retryMaxAttempts != "" {
+			conf.RetryMaxAttempts = *retryMaxAttempts
+		}
+		if *retryInitialBackoff != "" {
+			conf.RetryInitialBackoff = *retryInitialBackoff
+		}
+		if *retryMaxBackoff != "" {
+			conf.RetryMaxBackoff = *retryMaxBackoff
+		}
+		if *retryAttemptTimeout != "" {
+			conf.RetryAttemptTimeout = *retryAttemptTimeout
+		}
+		if *retryBudget != "" {
+			conf.RetryBudget = *retryBudget
+		}
+	} else {
+		if file, err := os.Open(*configFile); err != nil {
+			LogE.Printf("Error reading confile file %s %s", *configFile, err)
+			return conf, err
+		} else {
+			if err = json.NewDecoder(file).Decode(&conf); err != nil {
+				return conf, errors.New("Configuration file not found.")
+			}
+			LogI.Printf("Using confile file %s \n", *configFile)
+		}
+	}
+
+	valid := true
+
+	if conf.GcpProjectId == "" {
+		LogE.Println("GcpProjectId was not set.")
+		valid = false
+	}
+
+	if conf.SubscriptionServiceUrl == "" {
+		LogE.Println("SubscriptionServiceUrl was not set.")
+		valid = false
+	} else {
+		conf.SubscriptionServiceUrl = strings.TrimSuffix(conf.SubscriptionServiceUrl,"/")
+	}
+
+	if conf.CloudCommerceProcurementUrl == "" {
+		LogE.Println("CloudCommerceProcurementUrl was not set.")
+		valid = false
+	}
+
+	if conf.PartnerId == "" {
+		LogE.Println("PartnerId was not set.")
+		valid = false
+	}
+
+	if conf.SentryDsn == "" {
+		LogE.Println("SentryDsn was not set. Will run without Sentry.")
+	}
+
+	if conf.ExcludeProducts != "" {
+		LogI.Printf("Not reconciling entitlements for products: %s \n", conf.ExcludeProducts)
+	}
+
+	if conf.DryRun {
+		LogI.Println("DryRun is true. Differences will be reported but not fixed.")
+	}
+
+	if _, err := retry.ParsePolicy(conf.RetryMaxAttempts, conf.RetryInitialBackoff, conf.RetryMaxBackoff, conf.RetryAttemptTimeout, conf.RetryBudget); err != nil {
+		LogE.Printf("Retry configuration is not valid: %v \n", err)
+		valid = false
+	}
+
+	if gAppCredPath,gAppCredExists := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS"); !gAppCredExists {
+		LogE.Println("GOOGLE_APPLICATION_CREDENTIALS was not set. ")
+		valid = false
+	} else {
+		if _, gAppCredPathErr := os.Stat(gAppCredPath); os.IsNotExist(gAppCredPathErr) {
+			LogE.Println("GOOGLE_APPLICATION_CREDENTIALS file does not exist: ", gAppCredPath)
+			valid = false
+		} else {
+			LogI.Println("Using GOOGLE_APPLICATION_CREDENTIALS file: ", gAppCredPath)
+		}
+	}
+
+	if !valid {
+		return conf, errors.New("Reconciler configuration is not valid!")
+	} else {
+		return conf, nil
+	}
+}
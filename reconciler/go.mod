@@ -0,0 +1,12 @@
+module github.com/cloudbees/cloud-bill-saas/reconciler
+
+go 1.12
+
+require (
+	github.com/cloudbees/cloud-bill-saas/common v0.0.0
+	github.com/getsentry/sentry-go v0.3.0
+	github.com/jefferyfry/funclog v0.0.0-20191010235000-f6a0246169e0
+	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
+)
+
+replace github.com/cloudbees/cloud-bill-saas/common => ../common
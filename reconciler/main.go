@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cloudbees/cloud-bill-saas/common/procurement"
+	"github.com/cloudbees/cloud-bill-saas/common/retry"
+	"github.com/cloudbees/cloud-bill-saas/reconciler/config"
+	"github.com/cloudbees/cloud-bill-saas/reconciler/reconcile"
+	"github.com/getsentry/sentry-go"
+	"github.com/jefferyfry/funclog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	LogI = funclog.NewInfoLogger("INFO: ")
+	LogE = funclog.NewErrorLogger("ERROR: ")
+)
+
+func main() {
+	LogI.Println("Starting Cloud Bill SaaS Reconciler Job...")
+	config, err := config.GetConfiguration()
+
+	if err != nil {
+		LogE.Fatalf("Invalid configuration: %#v", err)
+	}
+
+	//wait for istio
+	time.Sleep(10 * time.Second)
+
+	if config.SentryDsn != "" {
+		sentry.Init(sentry.ClientOptions{
+			Dsn: config.SentryDsn,
+			Environment: config.GcpProjectId,
+			ServerName: "reconciler",
+		})
+
+		sentry.CaptureMessage("Sentry initialized for Cloud Bill SaaS Reconciler Job.")
+		// Since sentry emits events in the background we need to make sure
+		// they are sent before we shut down
+		sentry.Flush(time.Second * 5)
+	}
+
+	//retry transient failures of the procurement API and the subscription service
+	retryPolicy, _ := retry.ParsePolicy(config.RetryMaxAttempts,config.RetryInitialBackoff,config.RetryMaxBackoff,config.RetryAttemptTimeout,config.RetryBudget)
+	httpClient := retry.NewClient(retryPolicy)
+	procurementClient := procurement.NewClientWithTransport(config.CloudCommerceProcurementUrl, "", config.PartnerId, httpClient.Transport)
+	reconciler := reconcile.GetReconciler(config.SubscriptionServiceUrl,httpClient,procurementClient,config.PartnerId,config.ExcludeProducts,config.DryRun)
+
+	//stop between fixes if the job is terminated
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		LogI.Printf("Received %s, stopping... \n", sig)
+		cancel()
+	}()
+
+	report, err := reconciler.Run(ctx)
+	if writeErr := writeReport(config.ReportFile, report); writeErr != nil {
+		LogE.Printf("Error writing report %s: %v", config.ReportFile, writeErr)
+		os.Exit(1)
+	}
+	if err != nil {
+		LogE.Printf("Reconciler Job encountered err %s",err)
+		os.Exit(1)
+	} else if report.Summary.Failed > 0 {
+		LogE.Printf("Reconciler Job failed to fix %d differences.",report.Summary.Failed)
+		os.Exit(1)
+	}
+	LogI.Println("Reconciler Job completed successfully.")
+}
+
+//writeReport writes the report as JSON to path, or to stdout if path is empty.
+func writeReport(path string, report *reconcile.Report) error {
+	out := os.Stdout
+	if path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+		LogI.Printf("Writing report to %s \n", path)
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(report)
+}
@@ -0,0 +1,540 @@
+package reconcile
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/cloudbees/cloud-bill-saas/common/procurement"
+	"github.com/jefferyfry/funclog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Kinds of records compared
+const (
+	AccountKind     = "account"
+	EntitlementKind = "entitlement"
+)
+
+//Types of differences
+const (
+	//Missing records are in the procurement API but not in the subscription database, or deleted from it
+	Missing = "MISSING"
+	//Stale records are in both but the subscription database has old values
+	Stale = "STALE"
+	//Orphaned records are in the subscription database but not in the procurement API
+	Orphaned = "ORPHANED"
+)
+
+//Actions that fix a difference
+const (
+	ActionCreate  = "create"
+	ActionRestore = "restore"
+	ActionUpdate  = "update"
+	ActionDelete  = "delete"
+)
+
+//listPageSize is the page size of the subscription service lists, the most it returns.
+const listPageSize = "1000"
+
+var (
+	subscriptionServiceBaseUrl string
+	//subscriptionServiceClient sends every request to the subscription service
+	subscriptionServiceClient = http.DefaultClient
+	procurementClient procurement.Client
+	//runSource identifies this run in the history of the accounts and entitlements it changes
+	runSource string
+
+	LogI = funclog.NewInfoLogger("INFO: ")
+	LogE = funclog.NewErrorLogger("ERROR: ")
+)
+
+//Report is the machine readable result of a run.
+type Report struct {
+	StartTime   string       `json:"startTime"`
+	EndTime     string       `json:"endTime"`
+	DryRun      bool         `json:"dryRun"`
+	Summary     Summary      `json:"summary"`
+	Differences []Difference `json:"differences"`
+	//Error is set if the run stopped before every difference was found or fixed
+	Error       string       `json:"error,omitempty"`
+}
+
+//Summary counts the records compared, the differences found and the fixes.
+type Summary struct {
+	Accounts     int `json:"accounts"`
+	Entitlements int `json:"entitlements"`
+	Missing      int `json:"missing"`
+	Stale        int `json:"stale"`
+	Orphaned     int `json:"orphaned"`
+	Fixed        int `json:"fixed"`
+	Failed       int `json:"failed"`
+}
+
+//Difference is an account or entitlement that differs between the procurement API and the subscription database.
+type Difference struct {
+	Kind   string        `json:"kind"`
+	Id     string        `json:"id"`
+	Type   string        `json:"type"`
+	Fields []FieldChange `json:"fields,omitempty"`
+	Action string        `json:"action"`
+	Fixed  bool          `json:"fixed"`
+	Error  string        `json:"error,omitempty"`
+
+	account     *Account
+	entitlement *Entitlement
+}
+
+//FieldChange is a field of a stale record with its value in each source.
+type FieldChange struct {
+	Field        string `json:"field"`
+	Procurement  string `json:"procurement"`
+	Subscription string `json:"subscription"`
+}
+
+//AccountsPage is one page of accounts from the subscription service.
+type AccountsPage struct {
+	Accounts      []Account `json:"accounts"`
+	NextPageToken string    `json:"nextPageToken"`
+}
+
+//EntitlementsPage is one page of entitlements from the subscription service.
+type EntitlementsPage struct {
+	Entitlements  []Entitlement `json:"entitlements"`
+	NextPageToken string        `json:"nextPageToken"`
+}
+
+type Account struct {
+	Id  			string     	`json:"id"`
+	Name  			string     	`json:"name"`
+	UpdateTime   	string    	`json:"updateTime,omitempty"`
+	CreateTime      string    	`json:"createTime,omitempty"`
+	Provider     	string		`json:"provider,omitempty"`
+	State 	 		string      `json:"state,omitempty"`
+	Approvals    	[]procurement.Approval  `json:"approvals,omitempty"`
+	Version    	  	int64		`json:"version"`
+	DeletedTime   	string    	`json:"deletedTime,omitempty"`
+}
+
+//Entitlement has no approvals so the ones recorded by the subscription service are kept when it is upserted.
+type Entitlement struct {
+	Id     				string	`json:"id"`
+	Name     			string	`json:"name"`
+	Account   			string	`json:"account"`
+	Provider    		string	`json:"provider"`
+	Product  			string	`json:"product"`
+	Plan     	  		string	`json:"plan"`
+	NewPendingPlan 	  	string	`json:"newPendingPlan"`
+	State    	  		string	`json:"state"`
+	UpdateTime    	  	string	`json:"updateTime"`
+	CreateTime    	  	string	`json:"createTime"`
+	UsageReportingId    string	`json:"usageReportingId"`
+	MessageToUser    	string	`json:"messageToUser"`
+	Version    			int64	`json:"version"`
+	DeletedTime    	  	string	`json:"deletedTime,omitempty"`
+}
+
+type Reconciler struct {
+	PartnerId       string
+	ExcludeProducts map[string]bool
+	DryRun          bool
+}
+
+//GetReconciler returns a reconciler that sends requests to the subscription service with httpClient. Entitlements for
+//the comma separated excludeProducts are not reconciled.
+func GetReconciler(subscriptionServiceUrl string, httpClient *http.Client, procurementApiClient procurement.Client, partnerId string, excludeProducts string, dryRun bool) *Reconciler {
+	subscriptionServiceBaseUrl = subscriptionServiceUrl
+	subscriptionServiceClient = httpClient
+	procurementClient = procurementApiClient
+	excluded := map[string]bool{}
+	for _, product := range strings.Split(excludeProducts, ",") {
+		if product = strings.TrimSpace(product); product != "" {
+			excluded[product] = true
+		}
+	}
+	return &Reconciler{
+		partnerId,
+		excluded,
+		dryRun,
+	}
+}
+
+//Run diffs the accounts and entitlements of the partner in the procurement API against the subscription database and,
+//unless this is a dry run, fixes the differences. The report is returned even if the run fails. When ctx is done it
+//stops before the next fix and returns ctx.Err().
+func (rec *Reconciler) Run(ctx context.Context) (*Report, error) {
+	start := time.Now().UTC()
+	runSource = "reconciler run " + start.Format(time.RFC3339)
+	report := &Report{StartTime: start.Format(time.RFC3339), DryRun: rec.DryRun, Differences: []Difference{}}
+	err := rec.run(ctx, report)
+	report.EndTime = time.Now().UTC().Format(time.RFC3339)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	return report, err
+}
+
+func (rec *Reconciler) run(ctx context.Context, report *Report) error {
+	procurementAccounts, err := procurementClient.ListAccounts(ctx)
+	if err != nil {
+		LogE.Printf("Failed to list procurement accounts %#v \n", err)
+		return err
+	}
+	procurementEntitlements, err := procurementClient.ListEntitlements(ctx)
+	if err != nil {
+		LogE.Printf("Failed to list procurement entitlements %#v \n", err)
+		return err
+	}
+	accounts := []Account{}
+	if err := listFromDb("/accounts", func(decoder *json.Decoder) (string, error) {
+		page := AccountsPage{}
+		err := decoder.Decode(&page)
+		accounts = append(accounts, page.Accounts...)
+		return page.NextPageToken, err
+	}); err != nil {
+		return err
+	}
+	entitlements := []Entitlement{}
+	if err := listFromDb("/entitlements", func(decoder *json.Decoder) (string, error) {
+		page := EntitlementsPage{}
+		err := decoder.Decode(&page)
+		entitlements = append(entitlements, page.Entitlements...)
+		return page.NextPageToken, err
+	}); err != nil {
+		return err
+	}
+	LogI.Printf("Comparing %d accounts and %d entitlements from the procurement API with %d accounts and %d entitlements from the subscription service \n",
+		len(procurementAccounts), len(procurementEntitlements), len(accounts), len(entitlements))
+
+	//accounts first so entitlements are not fixed for accounts that are missing
+	differences := append(rec.diffAccounts(procurementAccounts, accounts, report),
+		rec.diffEntitlements(procurementEntitlements, entitlements, report)...)
+	for _, difference := range differences {
+		switch difference.Type {
+		case Missing:
+			report.Summary.Missing++
+		case Stale:
+			report.Summary.Stale++
+		case Orphaned:
+			report.Summary.Orphaned++
+		}
+	}
+	LogI.Printf("Found %d missing, %d stale and %d orphaned records \n", report.Summary.Missing, report.Summary.Stale, report.Summary.Orphaned)
+
+	for i := range differences {
+		difference := &differences[i]
+		if !rec.DryRun {
+			if ctx.Err() != nil {
+				LogI.Printf("Stopping reconciliation before %s %s \n", difference.Kind, difference.Id)
+				report.Differences = append(report.Differences, differences[i:]...)
+				return ctx.Err()
+			}
+			if err := fix(ctx, difference); err != nil {
+				LogE.Printf("Failed to %s %s %s %#v \n", difference.Action, difference.Kind, difference.Id, err)
+				difference.Error = err.Error()
+				report.Summary.Failed++
+			} else {
+				LogI.Printf("Fixed %s %s %s with %s \n", difference.Type, difference.Kind, difference.Id, difference.Action)
+				difference.Fixed = true
+				report.Summary.Fixed++
+			}
+		}
+		report.Differences = append(report.Differences, *difference)
+	}
+	return nil
+}
+
+func (rec *Reconciler) diffAccounts(procurementAccounts []procurement.Account, accounts []Account, report *Report) []Difference {
+	differences := []Difference{}
+	stored := map[string]Account{}
+	for _, account := range accounts {
+		stored[account.Id] = account
+	}
+	listed := map[string]bool{}
+	for _, procurementAccount := range procurementAccounts {
+		listed[procurementAccount.Id] = true
+		report.Summary.Accounts++
+		account, ok := stored[procurementAccount.Id]
+		synced := syncedAccount(&procurementAccount, account.Version)
+		difference := Difference{Kind: AccountKind, Id: procurementAccount.Id, account: synced}
+		switch {
+		case !ok:
+			difference.Type, difference.Action = Missing, ActionCreate
+		case account.DeletedTime != "":
+			difference.Type, difference.Action = Missing, ActionRestore
+		default:
+			difference.Fields = accountChanges(synced, &account)
+			if len(difference.Fields) == 0 {
+				continue
+			}
+			difference.Type, difference.Action = Stale, ActionUpdate
+		}
+		differences = append(differences, difference)
+	}
+	for _, account := range accounts {
+		if !listed[account.Id] && account.DeletedTime == "" && rec.ownedBy(account.Provider) {
+			differences = append(differences, Difference{Kind: AccountKind, Id: account.Id, Type: Orphaned, Action: ActionDelete})
+		}
+	}
+	return differences
+}
+
+func (rec *Reconciler) diffEntitlements(procurementEntitlements []procurement.Entitlement, entitlements []Entitlement, report *Report) []Difference {
+	differences := []Difference{}
+	stored := map[string]Entitlement{}
+	for _, entitlement := range entitlements {
+		stored[entitlement.Id] = entitlement
+	}
+	listed := map[string]bool{}
+	for _, procurementEntitlement := range procurementEntitlements {
+		listed[procurementEntitlement.Id] = true
+		if rec.ExcludeProducts[procurementEntitlement.Product] {
+			continue
+		}
+		report.Summary.Entitlements++
+		entitlement, ok := stored[procurementEntitlement.Id]
+		synced := syncedEntitlement(&procurementEntitlement, entitlement.Version)
+		difference := Difference{Kind: EntitlementKind, Id: procurementEntitlement.Id, entitlement: synced}
+		switch {
+		case !ok:
+			difference.Type, difference.Action = Missing, ActionCreate
+		case entitlement.DeletedTime != "":
+			difference.Type, difference.Action = Missing, ActionRestore
+		default:
+			difference.Fields = entitlementChanges(synced, &entitlement)
+			if len(difference.Fields) == 0 {
+				continue
+			}
+			difference.Type, difference.Action = Stale, ActionUpdate
+		}
+		differences = append(differences, difference)
+	}
+	for _, entitlement := range entitlements {
+		if !listed[entitlement.Id] && entitlement.DeletedTime == "" && rec.ownedBy(entitlement.Provider) &&
+			!rec.ExcludeProducts[entitlement.Product] {
+			differences = append(differences, Difference{Kind: EntitlementKind, Id: entitlement.Id, Type: Orphaned, Action: ActionDelete})
+		}
+	}
+	return differences
+}
+
+//ownedBy returns whether a stored record with provider belongs to the partner. Records of another partner sharing the
+//database are never orphans of this one.
+func (rec *Reconciler) ownedBy(provider string) bool {
+	return provider == "" || provider == rec.PartnerId
+}
+
+//syncedAccount returns an account from the procurement API as the pubsub service stores it.
+func syncedAccount(account *procurement.Account, version int64) *Account {
+	return &Account{
+		Id:         account.Id,
+		Name:       account.Name,
+		UpdateTime: account.UpdateTime,
+		CreateTime: account.CreateTime,
+		Provider:   account.Provider,
+		State:      account.State,
+		Approvals:  account.Approvals,
+		Version:    version,
+	}
+}
+
+//syncedEntitlement returns an entitlement from the procurement API as the pubsub service stores it, with the account
+//id instead of the account resource name.
+func syncedEntitlement(entitlement *procurement.Entitlement, version int64) *Entitlement {
+	return &Entitlement{
+		Id:               entitlement.Id,
+		Name:             entitlement.Name,
+		Account:          path.Base(entitlement.Account),
+		Provider:         entitlement.Provider,
+		Product:          entitlement.Product,
+		Plan:             entitlement.Plan,
+		NewPendingPlan:   entitlement.NewPendingPlan,
+		State:            entitlement.State,
+		UpdateTime:       entitlement.UpdateTime,
+		CreateTime:       entitlement.CreateTime,
+		UsageReportingId: entitlement.UsageReportingId,
+		MessageToUser:    entitlement.MessageToUser,
+		Version:          version,
+	}
+}
+
+//accountChanges returns the fields of an account that differ, update and create times are not compared.
+func accountChanges(procurementAccount *Account, account *Account) []FieldChange {
+	changes := []FieldChange{}
+	changes = appendChange(changes, "name", procurementAccount.Name, account.Name)
+	changes = appendChange(changes, "provider", procurementAccount.Provider, account.Provider)
+	changes = appendChange(changes, "state", procurementAccount.State, account.State)
+	changes = appendChange(changes, "approvals", approvalsValue(procurementAccount.Approvals), approvalsValue(account.Approvals))
+	return changes
+}
+
+//entitlementChanges returns the fields of an entitlement that differ, update and create times are not compared.
+func entitlementChanges(procurementEntitlement *Entitlement, entitlement *Entitlement) []FieldChange {
+	changes := []FieldChange{}
+	changes = appendChange(changes, "name", procurementEntitlement.Name, entitlement.Name)
+	changes = appendChange(changes, "account", procurementEntitlement.Account, entitlement.Account)
+	changes = appendChange(changes, "provider", procurementEntitlement.Provider, entitlement.Provider)
+	changes = appendChange(changes, "product", procurementEntitlement.Product, entitlement.Product)
+	changes = appendChange(changes, "plan", procurementEntitlement.Plan, entitlement.Plan)
+	changes = appendChange(changes, "newPendingPlan", procurementEntitlement.NewPendingPlan, entitlement.NewPendingPlan)
+	changes = appendChange(changes, "state", procurementEntitlement.State, entitlement.State)
+	changes = appendChange(changes, "usageReportingId", procurementEntitlement.UsageReportingId, entitlement.UsageReportingId)
+	changes = appendChange(changes, "messageToUser", procurementEntitlement.MessageToUser, entitlement.MessageToUser)
+	return changes
+}
+
+func appendChange(changes []FieldChange, field string, procurementValue string, value string) []FieldChange {
+	if procurementValue == value {
+		return changes
+	}
+	return append(changes, FieldChange{field, procurementValue, value})
+}
+
+//approvalsValue returns account approvals as name=state pairs in name order.
+func approvalsValue(approvals []procurement.Approval) string {
+	values := []string{}
+	for _, approval := range approvals {
+		values = append(values, approval.Name+"="+approval.State)
+	}
+	sort.Strings(values)
+	return strings.Join(values, ",")
+}
+
+//fix makes the subscription database match the procurement API for a difference. An orphan is only deleted once the
+//procurement API confirms it does not exist, it may have been created after the list was read.
+func fix(ctx context.Context, difference *Difference) error {
+	resource := "/accounts/"
+	if difference.Kind == EntitlementKind {
+		resource = "/entitlements/"
+	}
+	switch difference.Action {
+	case ActionDelete:
+		var err error
+		if difference.Kind == AccountKind {
+			_, err = procurementClient.GetAccount(ctx, difference.Id)
+		} else {
+			_, err = procurementClient.GetEntitlement(ctx, difference.Id)
+		}
+		if err == nil {
+			return errors.New(difference.Kind + " exists in the procurement API, it was not deleted")
+		} else if !procurement.IsNotFound(err) {
+			return err
+		}
+		return sendToDb(ctx, http.MethodDelete, resource+difference.Id, nil, "")
+	case ActionRestore:
+		if err := sendToDb(ctx, http.MethodPost, "/admin"+resource+difference.Id+"/restore", nil, ""); err != nil {
+			return err
+		}
+		//restoring changes the version
+		return upsertToDb(ctx, difference, "")
+	case ActionUpdate:
+		//only update the record if nothing else has changed it since it was read
+		return upsertToDb(ctx, difference, strconv.Quote(strconv.FormatInt(difference.version(), 10)))
+	default:
+		return upsertToDb(ctx, difference, "")
+	}
+}
+
+func (difference *Difference) version() int64 {
+	if difference.account != nil {
+		return difference.account.Version
+	}
+	return difference.entitlement.Version
+}
+
+func upsertToDb(ctx context.Context, difference *Difference, ifMatch string) error {
+	if difference.account != nil {
+		return sendToDb(ctx, http.MethodPut, "/accounts", difference.account, ifMatch)
+	}
+	return sendToDb(ctx, http.MethodPut, "/entitlements", difference.entitlement, ifMatch)
+}
+
+//sendToDb sends a request with body, if not nil, as JSON to the subscription service and expects 204.
+func sendToDb(ctx context.Context, method string, resource string, body interface{}, ifMatch string) error {
+	var reqBody *bytes.Buffer
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			LogE.Printf("Error marshalling %s %#v \n", resource, err)
+			return err
+		}
+		reqBody = bytes.NewBuffer(bodyBytes)
+	} else {
+		reqBody = &bytes.Buffer{}
+	}
+	url := subscriptionServiceBaseUrl + resource
+	req, err := http.NewRequest(method, url, reqBody)
+	if err != nil {
+		LogE.Printf("Failed creating request %s %s %#v \n", method, url, err)
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("X-Cloud-Bill-Source", runSource)
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	resp, err := subscriptionServiceClient.Do(req)
+	if err != nil {
+		LogE.Printf("Failed sending request %s %s %#v \n", method, url, err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		LogI.Printf("%s changed since it was read, it will be reconciled again on the next run.", resource)
+		return errors.New(resp.Status)
+	} else if resp.StatusCode != 204 {
+		LogE.Printf("%s %s received error response: %d \n", method, url, resp.StatusCode)
+		responseDump, _ := httputil.DumpResponse(resp, true)
+		LogE.Println(string(responseDump))
+		return errors.New(resp.Status)
+	}
+	LogI.Printf("%s %s %s", method, url, resp.Status)
+	return nil
+}
+
+//listFromDb walks every page of a subscription service list, including deleted records, decoding each with decode,
+//which returns the next page token.
+func listFromDb(resource string, decode func(decoder *json.Decoder) (string, error)) error {
+	listUrl := subscriptionServiceBaseUrl + resource + "?includeDeleted=true&limit=" + listPageSize
+	pageToken := ""
+	for {
+		subscriptionServiceUrl := listUrl
+		if pageToken != "" {
+			subscriptionServiceUrl += "&cursor=" + url.QueryEscape(pageToken)
+		}
+		LogI.Printf("Getting %s: %s \n", resource, subscriptionServiceUrl)
+		resp, err := subscriptionServiceClient.Get(subscriptionServiceUrl)
+		if err != nil {
+			LogE.Printf("Failed to get %s %#v \n", subscriptionServiceUrl, err)
+			return err
+		}
+		if resp.StatusCode == 404 {
+			resp.Body.Close()
+			LogI.Printf("No %s found.", resource)
+			return nil
+		} else if resp.StatusCode != 200 {
+			LogE.Printf("Get %s received error response: %d \n", resource, resp.StatusCode)
+			responseDump, _ := httputil.DumpResponse(resp, true)
+			LogE.Println(string(responseDump))
+			resp.Body.Close()
+			return errors.New(resp.Status)
+		}
+
+		pageToken, err = decode(json.NewDecoder(resp.Body))
+		resp.Body.Close()
+		if err != nil {
+			LogE.Printf("Error decoding %s %#v \n", subscriptionServiceUrl, err)
+			return err
+		}
+		if pageToken == "" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package reconcile
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cloudbees/cloud-bill-saas/common/procurement/fake"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testPartnerId       = "test-partner"
+	otherPartnerId      = "other-partner"
+	testExcludedProduct = "excluded-product"
+)
+
+//subscriptionService is an in-memory subscription service with the endpoints the reconciler calls. Writes are
+//checked against If-Match as the subscription service does, and recorded as "METHOD path".
+type subscriptionService struct {
+	*httptest.Server
+
+	mutex        sync.Mutex
+	accounts     map[string]Account
+	entitlements map[string]Entitlement
+	writes       []string
+	//beforeWrite, if set, is called before each write, as if another writer changed the database first
+	beforeWrite func(ss *subscriptionService)
+}
+
+func newSubscriptionService() *subscriptionService {
+	ss := &subscriptionService{
+		accounts:     map[string]Account{},
+		entitlements: map[string]Entitlement{},
+	}
+	ss.Server = httptest.NewServer(http.HandlerFunc(ss.serveHTTP))
+	return ss
+}
+
+func (ss *subscriptionService) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if r.Method != http.MethodGet {
+		ss.writes = append(ss.writes, r.Method+" "+r.URL.Path)
+		if ss.beforeWrite != nil {
+			ss.beforeWrite(ss)
+		}
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/accounts":
+		page := AccountsPage{Accounts: []Account{}}
+		for _, id := range sortedKeys(ss.accounts) {
+			page.Accounts = append(page.Accounts, ss.accounts[id])
+		}
+		json.NewEncoder(w).Encode(page)
+	case r.Method == http.MethodGet && r.URL.Path == "/entitlements":
+		page := EntitlementsPage{Entitlements: []Entitlement{}}
+		for _, id := range sortedKeys(ss.entitlements) {
+			page.Entitlements = append(page.Entitlements, ss.entitlements[id])
+		}
+		json.NewEncoder(w).Encode(page)
+	case r.Method == http.MethodPut && r.URL.Path == "/accounts":
+		account := Account{}
+		json.NewDecoder(r.Body).Decode(&account)
+		current, ok := ss.accounts[account.Id]
+		if !ss.ifMatch(w, r, current.Version, ok) {
+			return
+		}
+		account.Version = current.Version + 1
+		account.DeletedTime = current.DeletedTime
+		ss.accounts[account.Id] = account
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.URL.Path == "/entitlements":
+		entitlement := Entitlement{}
+		json.NewDecoder(r.Body).Decode(&entitlement)
+		current, ok := ss.entitlements[entitlement.Id]
+		if !ss.ifMatch(w, r, current.Version, ok) {
+			return
+		}
+		entitlement.Version = current.Version + 1
+		entitlement.DeletedTime = current.DeletedTime
+		ss.entitlements[entitlement.Id] = entitlement
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && len(parts) == 2 && parts[0] == "accounts":
+		account, ok := ss.accounts[parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		account.DeletedTime, account.Version = "2019-10-01T00:00:00Z", account.Version+1
+		ss.accounts[account.Id] = account
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete && len(parts) == 2 && parts[0] == "entitlements":
+		entitlement, ok := ss.entitlements[parts[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		entitlement.DeletedTime, entitlement.Version = "2019-10-01T00:00:00Z", entitlement.Version+1
+		ss.entitlements[entitlement.Id] = entitlement
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && len(parts) == 4 && parts[0] == "admin" && parts[1] == "accounts" && parts[3] == "restore":
+		account, ok := ss.accounts[parts[2]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		account.DeletedTime, account.Version = "", account.Version+1
+		ss.accounts[account.Id] = account
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPost && len(parts) == 4 && parts[0] == "admin" && parts[1] == "entitlements" && parts[3] == "restore":
+		entitlement, ok := ss.entitlements[parts[2]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		entitlement.DeletedTime, entitlement.Version = "", entitlement.Version+1
+		ss.entitlements[entitlement.Id] = entitlement
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+r.URL.String(), http.StatusNotImplemented)
+	}
+}
+
+//ifMatch responds 412 and returns false if the request has an If-Match that is not the current version.
+func (ss *subscriptionService) ifMatch(w http.ResponseWriter, r *http.Request, version int64, exists bool) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" || (exists && ifMatch == strconv.Quote(strconv.FormatInt(version, 10))) {
+		return true
+	}
+	w.WriteHeader(http.StatusPreconditionFailed)
+	return false
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//storeAccount stores a marketplace account as the pubsub service synced it.
+func storeAccount(mp *fake.Server, ss *subscriptionService, accountId string) {
+	account, _ := mp.Account(accountId)
+	ss.accounts[accountId] = *syncedAccount(&account, 1)
+}
+
+//storeEntitlement stores a marketplace entitlement as the pubsub service synced it.
+func storeEntitlement(mp *fake.Server, ss *subscriptionService, entitlementId string) {
+	entitlement, _ := mp.Entitlement(entitlementId)
+	ss.entitlements[entitlementId] = *syncedEntitlement(&entitlement, 1)
+}
+
+//differenceSummary returns a difference as "kind id type action", followed by "fixed" or its error.
+func differenceSummary(difference Difference) string {
+	summary := difference.Kind + " " + difference.Id + " " + difference.Type + " " + difference.Action
+	if difference.Fixed {
+		return summary + " fixed"
+	}
+	if difference.Error != "" {
+		return summary + " " + difference.Error
+	}
+	return summary
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name            string
+		dryRun          bool
+		setup           func(mp *fake.Server, ss *subscriptionService)
+		wantDifferences []string
+		wantWrites      []string
+		check           func(t *testing.T, mp *fake.Server, ss *subscriptionService, report *Report)
+	}{
+		{
+			name:  "in sync",
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				mp.Purchase("A-1", "E-1", "product-a", "basic")
+				storeAccount(mp, ss, "A-1")
+				storeEntitlement(mp, ss, "E-1")
+			},
+		},
+		{
+			name:  "missing",
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				mp.Purchase("A-1", "E-1", "product-a", "basic")
+			},
+			wantDifferences: []string{
+				"account A-1 MISSING create fixed",
+				"entitlement E-1 MISSING create fixed",
+			},
+			wantWrites: []string{"PUT /accounts", "PUT /entitlements"},
+			check: func(t *testing.T, mp *fake.Server, ss *subscriptionService, report *Report) {
+				procurementEntitlement, _ := mp.Entitlement("E-1")
+				if entitlement := ss.entitlements["E-1"]; !reflect.DeepEqual(entitlement, *syncedEntitlement(&procurementEntitlement, 1)) {
+					t.Errorf("stored entitlement = %+v, want the procurement entitlement", entitlement)
+				}
+			},
+		},
+		{
+			name:  "deleted then restore",
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				mp.Purchase("A-1", "E-1", "product-a", "basic")
+				storeAccount(mp, ss, "A-1")
+				storeEntitlement(mp, ss, "E-1")
+				entitlement := ss.entitlements["E-1"]
+				entitlement.DeletedTime = "2019-10-01T00:00:00Z"
+				ss.entitlements["E-1"] = entitlement
+			},
+			wantDifferences: []string{"entitlement E-1 MISSING restore fixed"},
+			wantWrites:      []string{"POST /admin/entitlements/E-1/restore", "PUT /entitlements"},
+			check: func(t *testing.T, mp *fake.Server, ss *subscriptionService, report *Report) {
+				if entitlement := ss.entitlements["E-1"]; entitlement.DeletedTime != "" || entitlement.Version != 3 {
+					t.Errorf("entitlement deleted at %q with version %d, want restored with version 3", entitlement.DeletedTime, entitlement.Version)
+				}
+			},
+		},
+		{
+			name:  "stale",
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				mp.Purchase("A-1", "E-1", "product-a", "basic")
+				storeAccount(mp, ss, "A-1")
+				storeEntitlement(mp, ss, "E-1")
+				entitlement := ss.entitlements["E-1"]
+				entitlement.Plan = "old"
+				ss.entitlements["E-1"] = entitlement
+			},
+			wantDifferences: []string{"entitlement E-1 STALE update fixed"},
+			wantWrites:      []string{"PUT /entitlements"},
+			check: func(t *testing.T, mp *fake.Server, ss *subscriptionService, report *Report) {
+				want := []FieldChange{{"plan", "basic", "old"}}
+				if fields := report.Differences[0].Fields; !reflect.DeepEqual(fields, want) {
+					t.Errorf("fields = %+v, want %+v", fields, want)
+				}
+				if plan := ss.entitlements["E-1"].Plan; plan != "basic" {
+					t.Errorf("plan = %s, want basic", plan)
+				}
+			},
+		},
+		{
+			name:  "stale changed since it was read",
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				mp.Purchase("A-1", "E-1", "product-a", "basic")
+				storeAccount(mp, ss, "A-1")
+				storeEntitlement(mp, ss, "E-1")
+				entitlement := ss.entitlements["E-1"]
+				entitlement.Plan = "old"
+				ss.entitlements["E-1"] = entitlement
+				ss.beforeWrite = func(ss *subscriptionService) {
+					entitlement := ss.entitlements["E-1"]
+					entitlement.Plan, entitlement.Version = "premium", entitlement.Version+1
+					ss.entitlements["E-1"] = entitlement
+				}
+			},
+			wantDifferences: []string{"entitlement E-1 STALE update 412 Precondition Failed"},
+			wantWrites:      []string{"PUT /entitlements"},
+			check: func(t *testing.T, mp *fake.Server, ss *subscriptionService, report *Report) {
+				if plan := ss.entitlements["E-1"].Plan; plan != "premium" {
+					t.Errorf("plan = %s, want the change made since it was read", plan)
+				}
+				if report.Summary.Failed != 1 {
+					t.Errorf("failed = %d, want 1", report.Summary.Failed)
+				}
+			},
+		},
+		{
+			name:  "orphans",
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				ss.accounts["A-1"] = Account{Id: "A-1", Provider: testPartnerId, Version: 1}
+				ss.entitlements["E-1"] = Entitlement{Id: "E-1", Account: "A-1", Provider: testPartnerId, Product: "product-a", Version: 1}
+				ss.entitlements["E-2"] = Entitlement{Id: "E-2", Account: "A-1", Product: "product-a", Version: 1, DeletedTime: "2019-10-01T00:00:00Z"}
+				ss.accounts["A-2"] = Account{Id: "A-2", Provider: otherPartnerId, Version: 1}
+				ss.entitlements["E-3"] = Entitlement{Id: "E-3", Account: "A-2", Provider: otherPartnerId, Product: "product-a", Version: 1}
+			},
+			wantDifferences: []string{
+				"account A-1 ORPHANED delete fixed",
+				"entitlement E-1 ORPHANED delete fixed",
+			},
+			wantWrites: []string{"DELETE /accounts/A-1", "DELETE /entitlements/E-1"},
+			check: func(t *testing.T, mp *fake.Server, ss *subscriptionService, report *Report) {
+				if ss.accounts["A-2"].DeletedTime != "" || ss.entitlements["E-3"].DeletedTime != "" {
+					t.Error("records of another provider were deleted")
+				}
+			},
+		},
+		{
+			name:  "excluded products",
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				mp.Purchase("A-1", "E-1", testExcludedProduct, "basic")
+				storeAccount(mp, ss, "A-1")
+				ss.entitlements["E-2"] = Entitlement{Id: "E-2", Account: "A-1", Provider: testPartnerId, Product: testExcludedProduct, Version: 1}
+			},
+			check: func(t *testing.T, mp *fake.Server, ss *subscriptionService, report *Report) {
+				if report.Summary.Entitlements != 0 {
+					t.Errorf("entitlements = %d, want excluded products not compared", report.Summary.Entitlements)
+				}
+			},
+		},
+		{
+			name:   "dry run",
+			dryRun: true,
+			setup: func(mp *fake.Server, ss *subscriptionService) {
+				mp.Purchase("A-1", "E-1", "product-a", "basic")
+				mp.Purchase("A-1", "E-2", "product-a", "basic")
+				storeAccount(mp, ss, "A-1")
+				storeEntitlement(mp, ss, "E-2")
+				entitlement := ss.entitlements["E-2"]
+				entitlement.Plan = "old"
+				ss.entitlements["E-2"] = entitlement
+				ss.entitlements["E-3"] = Entitlement{Id: "E-3", Account: "A-1", Provider: testPartnerId, Product: "product-a", Version: 1}
+			},
+			wantDifferences: []string{
+				"entitlement E-1 MISSING create",
+				"entitlement E-2 STALE update",
+				"entitlement E-3 ORPHANED delete",
+			},
+			check: func(t *testing.T, mp *fake.Server, ss *subscriptionService, report *Report) {
+				want := Summary{Accounts: 1, Entitlements: 2, Missing: 1, Stale: 1, Orphaned: 1}
+				if report.Summary != want {
+					t.Errorf("summary = %+v, want %+v", report.Summary, want)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mp := fake.NewServer(testPartnerId)
+			defer mp.Close()
+			ss := newSubscriptionService()
+			defer ss.Close()
+			test.setup(mp, ss)
+
+			rec := GetReconciler(ss.URL, ss.Client(), mp.Client(), testPartnerId, testExcludedProduct+", ", test.dryRun)
+			report, err := rec.Run(context.Background())
+			if err != nil {
+				t.Fatalf("Run() error = %v", err)
+			}
+
+			differences := []string{}
+			for _, difference := range report.Differences {
+				differences = append(differences, differenceSummary(difference))
+			}
+			if test.wantDifferences == nil {
+				test.wantDifferences = []string{}
+			}
+			if !reflect.DeepEqual(differences, test.wantDifferences) {
+				t.Errorf("differences = %q, want %q", differences, test.wantDifferences)
+			}
+			if !reflect.DeepEqual(ss.writes, test.wantWrites) {
+				t.Errorf("writes = %q, want %q", ss.writes, test.wantWrites)
+			}
+			if test.check != nil {
+				test.check(t, mp, ss, report)
+			}
+		})
+	}
+}
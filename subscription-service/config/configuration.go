@@ -6,6 +6,7 @@ import (
 	"flag"
 	"github.com/jefferyfry/funclog"
 	"os"
+	"time"
 )
 
 var (
@@ -13,6 +14,16 @@ var (
 	HealthCheckEndpoint 				= "8095"
 	GcpProjectId				        = "cloud-bill-saas"
 	SentryDsn							= ""
+	DatabaseType						= "datastoredb"
+	DatabaseUrl							= ""
+	RequestTimeout						= "30s"
+	DeletedRetention					= "720h"
+	CloudCommerceProcurementUrl       	= "https://cloudcommerceprocurement.googleapis.com/"
+	PartnerId							= ""
+	ShutdownTimeout						= "30s"
+	ServiceControlUrl					= "https://servicecontrol.googleapis.com/"
+	UsageServiceDomain					= ""
+	UsageReportInterval					= "1h"
 
 	LogI = funclog.NewInfoLogger("INFO: ")
 	LogE = funclog.NewErrorLogger("ERROR: ")
@@ -23,6 +34,16 @@ type ServiceConfig struct {
 	HealthCheckEndpoint string `json:"healthCheckEndpoint"`
 	GcpProjectId    				string	`json:"gcpProjectId"`
 	SentryDsn						string	`json:"sentryDsn"`
+	DatabaseType					string	`json:"databaseType"`
+	DatabaseUrl						string	`json:"databaseUrl"`
+	RequestTimeout					string	`json:"requestTimeout"`
+	DeletedRetention				string	`json:"deletedRetention"`
+	CloudCommerceProcurementUrl    	string	`json:"cloudCommerceProcurementUrl"`
+	PartnerId    					string	`json:"partnerId"`
+	ShutdownTimeout					string	`json:"shutdownTimeout"`
+	ServiceControlUrl				string	`json:"serviceControlUrl"`
+	UsageServiceDomain				string	`json:"usageServiceDomain"`
+	UsageReportInterval				string	`json:"usageReportInterval"`
 }
 
 func GetConfiguration() (ServiceConfig, error) {
@@ -31,6 +52,16 @@ func GetConfiguration() (ServiceConfig, error) {
 		HealthCheckEndpoint,
 		GcpProjectId,
 		SentryDsn,
+		DatabaseType,
+		DatabaseUrl,
+		RequestTimeout,
+		DeletedRetention,
+		CloudCommerceProcurementUrl,
+		PartnerId,
+		ShutdownTimeout,
+		ServiceControlUrl,
+		UsageServiceDomain,
+		UsageReportInterval,
 	}
 
 	if dir, err := os.Getwd(); err != nil {
@@ -46,6 +77,16 @@ func GetConfiguration() (ServiceConfig, error) {
 	healthCheckEndpoint := flag.String("healthCheckEndpoint", "", "set the value of the health check endpoint port")
 	gcpProjectId := flag.String("gcpProjectId", "", "set the GCP Project Id")
 	sentryDsn := flag.String("sentryDsn", "", "set the Sentry DSN")
+	databaseType := flag.String("databaseType", "", "set the database type (datastoredb, postgresdb or memorydb)")
+	databaseUrl := flag.String("databaseUrl", "", "set the database connection url for postgresdb")
+	requestTimeout := flag.String("requestTimeout", "", "set the deadline for each request to the database (ex. 30s)")
+	deletedRetention := flag.String("deletedRetention", "", "set how long deleted accounts and entitlements are kept before they are purged, 0 keeps them forever (ex. 720h)")
+	cloudCommerceProcurementUrl := flag.String("cloudCommerceProcurementUrl", "", "set root url for the cloud commerce procurement API")
+	partnerId := flag.String("partnerId", "", "set the CloudBees Partner Id, required to approve or reject pending approvals")
+	shutdownTimeout := flag.String("shutdownTimeout", "", "set how long in-flight requests may take to finish on shutdown (ex. 30s)")
+	serviceControlUrl := flag.String("serviceControlUrl", "", "set root url for the Service Control API that usage is reported to")
+	usageServiceDomain := flag.String("usageServiceDomain", "", "set the domain of the product services usage is reported to, default endpoints.<gcpProjectId>.cloud.goog")
+	usageReportInterval := flag.String("usageReportInterval", "", "set how often usage is reported to Service Control, 0 does not report usage (ex. 1h)")
 	flag.Parse()
 
 	//try environment variables if necessary
@@ -66,6 +107,46 @@ func GetConfiguration() (ServiceConfig, error) {
 		*sentryDsn = os.Getenv("CLOUD_BILL_SUBSCRIPTION_SENTRY_DSN")
 	}
 
+	if *databaseType == "" {
+		*databaseType = os.Getenv("CLOUD_BILL_SUBSCRIPTION_DATABASE_TYPE")
+	}
+
+	if *databaseUrl == "" {
+		*databaseUrl = os.Getenv("CLOUD_BILL_SUBSCRIPTION_DATABASE_URL")
+	}
+
+	if *requestTimeout == "" {
+		*requestTimeout = os.Getenv("CLOUD_BILL_SUBSCRIPTION_REQUEST_TIMEOUT")
+	}
+
+	if *deletedRetention == "" {
+		*deletedRetention = os.Getenv("CLOUD_BILL_SUBSCRIPTION_DELETED_RETENTION")
+	}
+
+	if *cloudCommerceProcurementUrl == "" {
+		*cloudCommerceProcurementUrl = os.Getenv("CLOUD_BILL_SUBSCRIPTION_CLOUD_COMMERCE_PROCUREMENT_URL")
+	}
+
+	if *partnerId == "" {
+		*partnerId = os.Getenv("CLOUD_BILL_SUBSCRIPTION_PARTNER_ID")
+	}
+
+	if *shutdownTimeout == "" {
+		*shutdownTimeout = os.Getenv("CLOUD_BILL_SUBSCRIPTION_SHUTDOWN_TIMEOUT")
+	}
+
+	if *serviceControlUrl == "" {
+		*serviceControlUrl = os.Getenv("CLOUD_BILL_SUBSCRIPTION_SERVICE_CONTROL_URL")
+	}
+
+	if *usageServiceDomain == "" {
+		*usageServiceDomain = os.Getenv("CLOUD_BILL_SUBSCRIPTION_USAGE_SERVICE_DOMAIN")
+	}
+
+	if *usageReportInterval == "" {
+		*usageReportInterval = os.Getenv("CLOUD_BILL_SUBSCRIPTION_USAGE_REPORT_INTERVAL")
+	}
+
 
 	if *configFile == "" {
 		//try other flags
@@ -73,6 +154,30 @@ func GetConfiguration() (ServiceConfig, error) {
 		conf.HealthCheckEndpoint = *healthCheckEndpoint
 		conf.GcpProjectId = *gcpProjectId
 		conf.SentryDsn = *sentryDsn
+		if *databaseType != "" {
+			conf.DatabaseType = *databaseType
+		}
+		conf.DatabaseUrl = *databaseUrl
+		if *requestTimeout != "" {
+			conf.RequestTimeout = *requestTimeout
+		}
+		if *deletedRetention != "" {
+			conf.DeletedRetention = *deletedRetention
+		}
+		if *cloudCommerceProcurementUrl != "" {
+			conf.CloudCommerceProcurementUrl = *cloudCommerceProcurementUrl
+		}
+		conf.PartnerId = *partnerId
+		if *shutdownTimeout != "" {
+			conf.ShutdownTimeout = *shutdownTimeout
+		}
+		if *serviceControlUrl != "" {
+			conf.ServiceControlUrl = *serviceControlUrl
+		}
+		conf.UsageServiceDomain = *usageServiceDomain
+		if *usageReportInterval != "" {
+			conf.UsageReportInterval = *usageReportInterval
+		}
 	} else {
 		if file, err := os.Open(*configFile); err != nil {
 			LogE.Printf("Error reading confile file %s %s", *configFile, err)
@@ -105,6 +210,52 @@ func GetConfiguration() (ServiceConfig, error) {
 		LogE.Println("SentryDsn was not set. Will run without Sentry.")
 	}
 
+	if conf.DatabaseType == "" {
+		LogE.Println("DatabaseType was not set.")
+		valid = false
+	} else if conf.DatabaseType == "postgresdb" && conf.DatabaseUrl == "" {
+		LogE.Println("DatabaseUrl was not set. It is required for postgresdb.")
+		valid = false
+	}
+
+	if _, err := time.ParseDuration(conf.RequestTimeout); err != nil {
+		LogE.Printf("RequestTimeout %s is not a valid duration. \n", conf.RequestTimeout)
+		valid = false
+	}
+
+	if retention, err := time.ParseDuration(conf.DeletedRetention); err != nil || retention < 0 {
+		LogE.Printf("DeletedRetention %s is not a valid duration. \n", conf.DeletedRetention)
+		valid = false
+	} else if retention == 0 {
+		LogI.Println("DeletedRetention is 0. Deleted accounts and entitlements will not be purged.")
+	}
+
+	if timeout, err := time.ParseDuration(conf.ShutdownTimeout); err != nil || timeout < 0 {
+		LogE.Printf("ShutdownTimeout %s is not a valid duration. \n", conf.ShutdownTimeout)
+		valid = false
+	}
+
+	if conf.PartnerId == "" {
+		LogE.Println("PartnerId was not set. Pending approvals cannot be approved or rejected.")
+	} else if conf.CloudCommerceProcurementUrl == "" {
+		LogE.Println("CloudCommerceProcurementUrl was not set.")
+		valid = false
+	}
+
+	if interval, err := time.ParseDuration(conf.UsageReportInterval); err != nil || interval < 0 {
+		LogE.Printf("UsageReportInterval %s is not a valid duration. \n", conf.UsageReportInterval)
+		valid = false
+	} else if interval == 0 {
+		LogI.Println("UsageReportInterval is 0. Usage will be recorded but not reported to Service Control.")
+	} else if conf.ServiceControlUrl == "" {
+		LogE.Println("ServiceControlUrl was not set.")
+		valid = false
+	}
+
+	if conf.UsageServiceDomain == "" {
+		conf.UsageServiceDomain = "endpoints." + conf.GcpProjectId + ".cloud.goog"
+	}
+
 	if credPath,envExists := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS"); !envExists {
 		LogE.Println("GOOGLE_APPLICATION_CREDENTIALS was not set. This is fine with an emulator but will fail in production. ")
 	} else {
@@ -7,17 +7,28 @@ import (
 	"github.com/cloudbees/cloud-bill-saas/subscription-service/persistence"
 	"github.com/jefferyfry/funclog"
 	"google.golang.org/api/iterator"
-	"strings"
+	"reflect"
+	"time"
 )
 
 const (
 	ACCOUNT        = "Account"
 	CONTACT    		= "Contact"
 	ENTITLEMENT    = "Entitlement"
+	HISTORY        = "History"
+	EVENT          = "Event"
+	DEAD_LETTER    = "DeadLetter"
+	PENDING_APPROVAL = "PendingApproval"
+	USAGE_RECORD   = "UsageRecord"
+	USAGE_REPORT   = "UsageReport"
+
+	//maxBatchSize is the most keys datastore accepts in one call, and the most mutations in one transaction
+	maxBatchSize = 500
 )
 
 type DatastoreClient struct {
 	ProjectId string
+	client *datastore.Client
 }
 
 var (
@@ -25,325 +36,618 @@ var (
 	LogE = funclog.NewErrorLogger("ERROR: ")
 )
 
-func NewDatastore(projectId string) (persistence.DatabaseHandler) {
+//NewDatastore creates a single datastore client that is shared by all operations. Call Close when done.
+func NewDatastore(projectId string) (persistence.DatabaseHandler, error) {
+	client, err := datastore.NewClient(context.Background(), projectId)
+	if err != nil {
+		LogE.Printf("Failed to create datastore client: %v", err)
+		return nil, err
+	}
 	return &DatastoreClient{
 		projectId,
-	}
+		client,
+	}, nil
 }
 
-func (datastoreClient *DatastoreClient) UpsertAccount(account *persistence.Account) error {
-	ctx := context.Background()
+func (datastoreClient *DatastoreClient) Close() error {
+	return datastoreClient.client.Close()
+}
 
-	if client, err := datastore.NewClient(ctx, datastoreClient.ProjectId); err != nil {
-		LogE.Printf("Failed to create datastore client: %v", err)
-		return err
-	} else {
-		kind := ACCOUNT
-		id := account.Id
-		key := datastore.NameKey(kind, id, nil)
-		_,ptErr := client.Put(ctx, key, account)
-		return ptErr
-	}
+func (datastoreClient *DatastoreClient) UpsertAccount(ctx context.Context, account *persistence.Account, ifVersion int64) error {
+	kind := ACCOUNT
+	id := account.Id
+	key := datastore.NameKey(kind, id, nil)
+	return datastoreClient.putVersioned(ctx, key, account, &account.Version, ifVersion)
 }
 
-func (datastoreClient *DatastoreClient) DeleteAccount(accountId string) error {
-	ctx := context.Background()
+func (datastoreClient *DatastoreClient) DeleteAccount(ctx context.Context, accountId string) error {
+	kind := ACCOUNT
+	key := datastore.NameKey(kind, accountId, nil)
+	return datastoreClient.setDeletedTime(ctx, key, &persistence.Account{}, persistence.FormatDeletedTime(time.Now()))
+}
 
-	if client, err := datastore.NewClient(ctx, datastoreClient.ProjectId); err != nil {
-		LogE.Printf("Failed to create datastore client: %v", err)
-		return err
-	} else {
-		kind := ACCOUNT
-		key := datastore.NameKey(kind, accountId, nil)
-		return client.Delete(ctx, key)
+//DeleteAccountCascade makes every change in one transaction, so an account with more entitlements than fit in
+//maxBatchSize mutations is not deleted and an error is returned.
+func (datastoreClient *DatastoreClient) DeleteAccountCascade(ctx context.Context, accountId string) (*persistence.AccountDeletion, error) {
+	//datastore only allows ancestor queries in a transaction so the entitlements are found first
+	q := datastore.NewQuery(ENTITLEMENT).Filter("account =", accountId).KeysOnly()
+	entitlementKeys, err := datastoreClient.client.GetAll(ctx, q, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCascadeSize(len(entitlementKeys)); err != nil {
+		return nil, err
+	}
+
+	deletion := persistence.AccountDeletion{}
+	deletedTime := persistence.FormatDeletedTime(time.Now())
+	_, err = datastoreClient.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		deletion = persistence.AccountDeletion{AccountId: accountId, Entitlements: []string{}}
+		accountKey := datastore.NameKey(ACCOUNT, accountId, nil)
+		deleted, err := setDeletedTimeInTx(ctx, tx, accountKey, &persistence.Account{}, deletedTime)
+		if err != nil {
+			return err
+		}
+		deletion.Account = deleted
+
+		contactKey := datastore.NameKey(CONTACT, accountId, nil)
+		if err := tx.Get(contactKey, &persistence.Contact{}); err == nil {
+			if err := tx.Delete(contactKey); err != nil {
+				return err
+			}
+			deletion.Contact = true
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		for _, entitlementKey := range entitlementKeys {
+			deleted, err := setDeletedTimeInTx(ctx, tx, entitlementKey, &persistence.Entitlement{}, deletedTime)
+			if err != nil {
+				return err
+			}
+			if deleted {
+				deletion.Entitlements = append(deletion.Entitlements, entitlementKey.Name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, toPersistenceError(err)
 	}
+	return &deletion, nil
 }
 
-func (datastoreClient *DatastoreClient) GetAccount(accountId string) (*persistence.Account, error){
-	ctx := context.Background()
+//checkCascadeSize returns an error if deleting an account with entitlementCount entitlements needs more than
+//maxBatchSize mutations. The account and each entitlement are written with a history entry, and the contact is deleted.
+func checkCascadeSize(entitlementCount int) error {
+	if mutations := 2 + 1 + 2*entitlementCount; mutations > maxBatchSize {
+		return errors.New("account has too many entitlements to delete in one transaction")
+	}
+	return nil
+}
 
-	if client, err := datastore.NewClient(ctx, datastoreClient.ProjectId); err != nil {
-		LogE.Printf("Failed to create datastore client: %v", err)
-		return nil,err
-	} else {
-		kind := ACCOUNT
-		key := datastore.NameKey(kind, accountId, nil)
-		account := persistence.Account{}
-		gtErr := client.Get(ctx,key, &account)
-		return &account, gtErr
+func (datastoreClient *DatastoreClient) RestoreAccount(ctx context.Context, accountId string) error {
+	kind := ACCOUNT
+	key := datastore.NameKey(kind, accountId, nil)
+	return datastoreClient.setDeletedTime(ctx, key, &persistence.Account{}, "")
+}
+
+func (datastoreClient *DatastoreClient) GetAccount(ctx context.Context, accountId string) (*persistence.Account, error){
+	kind := ACCOUNT
+	key := datastore.NameKey(kind, accountId, nil)
+	account := persistence.Account{}
+	if err := datastoreClient.client.Get(ctx, key, &account); err != nil {
+		return nil, toPersistenceError(err)
 	}
+	return &account, nil
 }
 
-func (datastoreClient *DatastoreClient) UpsertContact(contact *persistence.Contact) error {
-	ctx := context.Background()
+func (datastoreClient *DatastoreClient) UpsertContact(ctx context.Context, contact *persistence.Contact, ifVersion int64) error {
+	kind := CONTACT
+	id := contact.AccountId
+	key := datastore.NameKey(kind, id, nil)
+	return datastoreClient.putVersioned(ctx, key, contact, &contact.Version, ifVersion)
+}
 
-	if client, err := datastore.NewClient(ctx, datastoreClient.ProjectId); err != nil {
-		LogE.Printf("Failed to create datastore client: %v", err)
-		return err
-	} else {
-		kind := CONTACT
-		id := contact.AccountId
-		key := datastore.NameKey(kind, id, nil)
-		_, ptErr := client.Put(ctx, key, contact)
-		return ptErr
+func (datastoreClient *DatastoreClient) DeleteContact(ctx context.Context, accountId string) error {
+	kind := CONTACT
+	key := datastore.NameKey(kind, accountId, nil)
+	return datastoreClient.client.Delete(ctx, key)
+}
+
+func (datastoreClient *DatastoreClient) GetContact(ctx context.Context, accountId string) (*persistence.Contact, error){
+	kind := CONTACT
+	key := datastore.NameKey(kind, accountId, nil)
+	contact := persistence.Contact{}
+	if err := datastoreClient.client.Get(ctx, key, &contact); err != nil {
+		return nil, toPersistenceError(err)
 	}
+	return &contact, nil
 }
 
-func (datastoreClient *DatastoreClient) DeleteContact(accountId string) error {
-	ctx := context.Background()
+func (datastoreClient *DatastoreClient) UpsertEvent(ctx context.Context, event *persistence.Event) error {
+	kind := EVENT
+	key := datastore.NameKey(kind, event.Id, nil)
+	_, err := datastoreClient.client.Put(ctx, key, event)
+	return err
+}
 
-	if client, err := datastore.NewClient(ctx, datastoreClient.ProjectId); err != nil {
-		LogE.Printf("Failed to create datastore client: %v", err)
-		return err
-	} else {
-		kind := CONTACT
-		key := datastore.NameKey(kind, accountId, nil)
-		return client.Delete(ctx, key)
+func (datastoreClient *DatastoreClient) GetEvent(ctx context.Context, eventId string) (*persistence.Event, error){
+	kind := EVENT
+	key := datastore.NameKey(kind, eventId, nil)
+	event := persistence.Event{}
+	if err := datastoreClient.client.Get(ctx, key, &event); err != nil {
+		return nil, toPersistenceError(err)
 	}
+	return &event, nil
 }
 
-func (datastoreClient *DatastoreClient) GetContact(accountId string) (*persistence.Contact, error){
-	ctx := context.Background()
+func (datastoreClient *DatastoreClient) UpsertDeadLetter(ctx context.Context, deadLetter *persistence.DeadLetter) error {
+	kind := DEAD_LETTER
+	key := datastore.NameKey(kind, deadLetter.Id, nil)
+	_, err := datastoreClient.client.Put(ctx, key, deadLetter)
+	return err
+}
 
-	if client, err := datastore.NewClient(ctx, datastoreClient.ProjectId); err != nil {
-		LogE.Printf("Failed to create datastore client: %v", err)
-		return nil,err
-	} else {
-		kind := CONTACT
-		key := datastore.NameKey(kind, accountId, nil)
-		contact := persistence.Contact{}
-		gtErr := client.Get(ctx, key, &contact)
-		return &contact, gtErr
+func (datastoreClient *DatastoreClient) DeleteDeadLetter(ctx context.Context, deadLetterId string) error {
+	kind := DEAD_LETTER
+	key := datastore.NameKey(kind, deadLetterId, nil)
+	return datastoreClient.client.Delete(ctx, key)
+}
+
+func (datastoreClient *DatastoreClient) GetDeadLetter(ctx context.Context, deadLetterId string) (*persistence.DeadLetter, error){
+	kind := DEAD_LETTER
+	key := datastore.NameKey(kind, deadLetterId, nil)
+	deadLetter := persistence.DeadLetter{}
+	if err := datastoreClient.client.Get(ctx, key, &deadLetter); err != nil {
+		return nil, toPersistenceError(err)
 	}
+	return &deadLetter, nil
 }
 
-func (datastoreClient *DatastoreClient) UpsertEntitlement(entitlement *persistence.Entitlement) error {
-	ctx := context.Background()
+func (datastoreClient *DatastoreClient) UpsertEntitlement(ctx context.Context, entitlement *persistence.Entitlement, ifVersion int64) error {
+	kind := ENTITLEMENT
+	id := entitlement.Id
+	key := datastore.NameKey(kind, id, nil)
+	return datastoreClient.putVersioned(ctx, key, entitlement, &entitlement.Version, ifVersion)
+}
 
-	if client, err := datastore.NewClient(ctx, datastoreClient.ProjectId); err != nil {
-		LogE.Printf("Failed to create datastore client: %v", err)
-		return err
-	} else {
-		kind := ENTITLEMENT
-		id := entitlement.Id
-		key := datastore.NameKey(kind, id, nil)
-		_, ptErr := client.Put(ctx, key, entitlement)
-		return ptErr
+func (datastoreClient *DatastoreClient) DeleteEntitlement(ctx context.Context, entitlementId string) error {
+	kind := ENTITLEMENT
+	key := datastore.NameKey(kind, entitlementId, nil)
+	return datastoreClient.setDeletedTime(ctx, key, &persistence.Entitlement{}, persistence.FormatDeletedTime(time.Now()))
+}
+
+func (datastoreClient *DatastoreClient) RestoreEntitlement(ctx context.Context, entitlementId string) error {
+	kind := ENTITLEMENT
+	key := datastore.NameKey(kind, entitlementId, nil)
+	return datastoreClient.setDeletedTime(ctx, key, &persistence.Entitlement{}, "")
+}
+
+func (datastoreClient *DatastoreClient) GetEntitlement(ctx context.Context, entitlementId string) (*persistence.Entitlement, error){
+	kind := ENTITLEMENT
+	key := datastore.NameKey(kind, entitlementId, nil)
+	entitlement := persistence.Entitlement{}
+	if err := datastoreClient.client.Get(ctx, key, &entitlement); err != nil {
+		return nil, toPersistenceError(err)
 	}
+	return &entitlement, nil
 }
 
-func (datastoreClient *DatastoreClient) DeleteEntitlement(entitlementId string) error {
-	ctx := context.Background()
+func (datastoreClient *DatastoreClient) QueryEntitlements(ctx context.Context, query persistence.Query) ([]persistence.Entitlement, string, error){
+	var entitlements []persistence.Entitlement
+	nextCursor, err := datastoreClient.runPage(ctx, datastore.NewQuery(ENTITLEMENT), query, &entitlements)
+	if err != nil {
+		return nil, "", err
+	}
+	return entitlements, nextCursor, nil
+}
 
-	if client, err := datastore.NewClient(ctx, datastoreClient.ProjectId); err != nil {
-		LogE.Printf("Failed to create datastore client: %v", err)
-		return err
-	} else {
-		kind := ENTITLEMENT
-		key := datastore.NameKey(kind, entitlementId, nil)
-		return client.Delete(ctx, key)
+func (datastoreClient *DatastoreClient) QueryAccountEntitlements(ctx context.Context, accountId string, query persistence.Query) ([]persistence.Entitlement, string, error){
+	if accountId == "" {
+		return nil, "", errors.New("Must specify account name.")
 	}
+	query.Filters = append([]persistence.Filter{{Property: "account", Operator: "=", Value: accountId}}, query.Filters...)
+	return datastoreClient.QueryEntitlements(ctx, query)
 }
 
-func (datastoreClient *DatastoreClient) GetEntitlement(entitlementId string) (*persistence.Entitlement, error){
-	ctx := context.Background()
+func (datastoreClient *DatastoreClient) QueryAccounts(ctx context.Context, query persistence.Query) ([]persistence.Account, string, error){
+	var accounts []persistence.Account
+	nextCursor, err := datastoreClient.runPage(ctx, datastore.NewQuery(ACCOUNT), query, &accounts)
+	if err != nil {
+		return nil, "", err
+	}
+	return accounts, nextCursor, nil
+}
 
-	if client, err := datastore.NewClient(ctx, datastoreClient.ProjectId); err != nil {
-		LogE.Printf("Failed to create datastore client: %v", err)
-		return nil,err
-	} else {
-		kind := ENTITLEMENT
-		key := datastore.NameKey(kind, entitlementId, nil)
-		entitlement := persistence.Entitlement{}
-		gtErr := client.Get(ctx, key, &entitlement)
-		return &entitlement, gtErr
+func (datastoreClient *DatastoreClient) QueryContacts(ctx context.Context, query persistence.Query) ([]persistence.Contact, string, error){
+	var contacts []persistence.Contact
+	nextCursor, err := datastoreClient.runPage(ctx, datastore.NewQuery(CONTACT), query, &contacts)
+	if err != nil {
+		return nil, "", err
 	}
+	return contacts, nextCursor, nil
 }
 
-func (datastoreClient *DatastoreClient) QueryEntitlements(filters []string, order string) ([]persistence.Entitlement, error){
-	ctx := context.Background()
+func (datastoreClient *DatastoreClient) UpsertPendingApproval(ctx context.Context, approval *persistence.PendingApproval) error {
+	kind := PENDING_APPROVAL
+	key := datastore.NameKey(kind, approval.Id, nil)
+	_, err := datastoreClient.client.Put(ctx, key, approval)
+	return err
+}
 
-	if client, err := datastore.NewClient(ctx, datastoreClient.ProjectId); err != nil {
-		LogE.Printf("Failed to create datastore client: %v", err)
-		return nil,err
-	} else {
-		q := datastore.NewQuery(ENTITLEMENT)
-		if order != "" {
-			q = q.Order(order)
-		}
+func (datastoreClient *DatastoreClient) DeletePendingApproval(ctx context.Context, entitlementId string) error {
+	kind := PENDING_APPROVAL
+	key := datastore.NameKey(kind, entitlementId, nil)
+	return datastoreClient.client.Delete(ctx, key)
+}
 
-		if filters != nil && len(filters)>0 {
-			for _, s := range filters {
-				if filter := strings.SplitAfter(s, "="); len(filter) > 0 {
-					filterStr := filter[0]
-					value := filter[1]
-					q = q.Filter(filterStr, value)
-				}
-			}
-		}
+func (datastoreClient *DatastoreClient) GetPendingApproval(ctx context.Context, entitlementId string) (*persistence.PendingApproval, error){
+	kind := PENDING_APPROVAL
+	key := datastore.NameKey(kind, entitlementId, nil)
+	approval := persistence.PendingApproval{}
+	if err := datastoreClient.client.Get(ctx, key, &approval); err != nil {
+		return nil, toPersistenceError(err)
+	}
+	return &approval, nil
+}
 
-		t := client.Run(ctx, q)
-		var entitlements []persistence.Entitlement
-		for {
-			entitlement := persistence.Entitlement{}
-			_, err := t.Next(&entitlement)
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				return nil, err
-			}
-			entitlements = append(entitlements, entitlement)
+func (datastoreClient *DatastoreClient) CreateUsageRecord(ctx context.Context, record *persistence.UsageRecord) error {
+	kind := USAGE_RECORD
+	key := datastore.NameKey(kind, record.Id, nil)
+	_, err := datastoreClient.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(key, &persistence.UsageRecord{}); err == nil {
+			return persistence.ErrConflict
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
 		}
-		return entitlements, nil
-	}
+		_, err := tx.Put(key, record)
+		return err
+	})
+	return toPersistenceError(err)
 }
 
-func (datastoreClient *DatastoreClient) QueryAccountEntitlements(accountId string,filters []string, order string) ([]persistence.Entitlement, error){
-	if accountId == "" {
-		return nil,errors.New("Must specify account name.")
+func (datastoreClient *DatastoreClient) GetUsageRecord(ctx context.Context, recordId string) (*persistence.UsageRecord, error){
+	kind := USAGE_RECORD
+	key := datastore.NameKey(kind, recordId, nil)
+	record := persistence.UsageRecord{}
+	if err := datastoreClient.client.Get(ctx, key, &record); err != nil {
+		return nil, toPersistenceError(err)
 	}
-	ctx := context.Background()
+	return &record, nil
+}
 
-	if client, err := datastore.NewClient(ctx, datastoreClient.ProjectId); err != nil {
-		LogE.Printf("Failed to create datastore client: %v", err)
-		return nil,err
-	} else {
-		q := datastore.NewQuery(ENTITLEMENT)
-		q.Filter("Account=",accountId)
-		if order != "" {
-			q = q.Order(order)
+//CreateUsageReport writes the report and its records in one transaction, so a report cannot have more than
+//maxBatchSize-1 records.
+func (datastoreClient *DatastoreClient) CreateUsageReport(ctx context.Context, report *persistence.UsageReport) error {
+	if len(report.RecordIds) >= maxBatchSize {
+		return errors.New("usage report has too many records")
+	}
+	reportKey := datastore.NameKey(USAGE_REPORT, report.Id, nil)
+	recordKeys := make([]*datastore.Key, len(report.RecordIds))
+	for i, recordId := range report.RecordIds {
+		recordKeys[i] = datastore.NameKey(USAGE_RECORD, recordId, nil)
+	}
+	_, err := datastoreClient.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		if err := tx.Get(reportKey, &persistence.UsageReport{}); err == nil {
+			return persistence.ErrConflict
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
 		}
-
-		if filters != nil && len(filters)>0 {
-			for _, s := range filters {
-				if filter := strings.SplitAfter(s, "="); len(filter) > 0 {
-					filterStr := filter[0]
-					value := filter[1]
-					q = q.Filter(filterStr, value)
+		records := make([]persistence.UsageRecord, len(recordKeys))
+		if err := tx.GetMulti(recordKeys, records); err != nil {
+			if multiErr, ok := err.(datastore.MultiError); ok {
+				for _, recordErr := range multiErr {
+					if recordErr == datastore.ErrNoSuchEntity {
+						return persistence.ErrConflict
+					}
 				}
 			}
+			return err
 		}
-
-		t := client.Run(ctx, q)
-		var entitlements []persistence.Entitlement
-		for {
-			entitlement := persistence.Entitlement{}
-			_, err := t.Next(&entitlement)
-			if err == iterator.Done {
-				break
+		for i := range records {
+			if records[i].ReportId != "" {
+				return persistence.ErrConflict
 			}
-			if err != nil {
-				return nil, err
-			}
-			entitlements = append(entitlements, entitlement)
+			records[i].ReportId = report.Id
+		}
+		if _, err := tx.PutMulti(recordKeys, records); err != nil {
+			return err
 		}
-		return entitlements, nil
+		_, err := tx.Put(reportKey, report)
+		return err
+	})
+	return toPersistenceError(err)
+}
+
+func (datastoreClient *DatastoreClient) UpsertUsageReport(ctx context.Context, report *persistence.UsageReport) error {
+	kind := USAGE_REPORT
+	key := datastore.NameKey(kind, report.Id, nil)
+	_, err := datastoreClient.client.Put(ctx, key, report)
+	return err
+}
+
+func (datastoreClient *DatastoreClient) GetUsageReport(ctx context.Context, reportId string) (*persistence.UsageReport, error){
+	kind := USAGE_REPORT
+	key := datastore.NameKey(kind, reportId, nil)
+	report := persistence.UsageReport{}
+	if err := datastoreClient.client.Get(ctx, key, &report); err != nil {
+		return nil, toPersistenceError(err)
 	}
+	return &report, nil
 }
 
-func (datastoreClient *DatastoreClient) QueryAccounts(filters []string, order string) ([]persistence.Account, error){
-	ctx := context.Background()
+func (datastoreClient *DatastoreClient) QueryEvents(ctx context.Context, query persistence.Query) ([]persistence.Event, string, error){
+	var events []persistence.Event
+	nextCursor, err := datastoreClient.runPage(ctx, datastore.NewQuery(EVENT), query, &events)
+	if err != nil {
+		return nil, "", err
+	}
+	return events, nextCursor, nil
+}
 
-	if client, err := datastore.NewClient(ctx, datastoreClient.ProjectId); err != nil {
-		LogE.Printf("Failed to create datastore client: %v", err)
-		return nil,err
-	} else {
-		q := datastore.NewQuery(ACCOUNT)
-		if order != "" {
-			q = q.Order(order)
-		}
+func (datastoreClient *DatastoreClient) QueryDeadLetters(ctx context.Context, query persistence.Query) ([]persistence.DeadLetter, string, error){
+	var deadLetters []persistence.DeadLetter
+	nextCursor, err := datastoreClient.runPage(ctx, datastore.NewQuery(DEAD_LETTER), query, &deadLetters)
+	if err != nil {
+		return nil, "", err
+	}
+	return deadLetters, nextCursor, nil
+}
 
-		if filters != nil && len(filters)>0 {
-			for _, s := range filters {
-				if filter := strings.SplitAfter(s, "="); len(filter) > 0 {
-					filterStr := filter[0]
-					value := filter[1]
-					q = q.Filter(filterStr, value)
-				}
-			}
-		}
+func (datastoreClient *DatastoreClient) QueryPendingApprovals(ctx context.Context, query persistence.Query) ([]persistence.PendingApproval, string, error){
+	var approvals []persistence.PendingApproval
+	nextCursor, err := datastoreClient.runPage(ctx, datastore.NewQuery(PENDING_APPROVAL), query, &approvals)
+	if err != nil {
+		return nil, "", err
+	}
+	return approvals, nextCursor, nil
+}
 
-		t := client.Run(ctx, q)
-		var accounts []persistence.Account
-		for {
-			account := persistence.Account{}
-			_, err := t.Next(&account)
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				return nil, err
-			}
-			accounts = append(accounts, account)
-		}
-		return accounts, nil
+func (datastoreClient *DatastoreClient) QueryUsageRecords(ctx context.Context, query persistence.Query) ([]persistence.UsageRecord, string, error){
+	var records []persistence.UsageRecord
+	nextCursor, err := datastoreClient.runPage(ctx, datastore.NewQuery(USAGE_RECORD), query, &records)
+	if err != nil {
+		return nil, "", err
 	}
+	return records, nextCursor, nil
 }
 
-func (datastoreClient *DatastoreClient) QueryContacts(filters []string, order string) ([]persistence.Contact, error){
-	ctx := context.Background()
+func (datastoreClient *DatastoreClient) QueryUsageReports(ctx context.Context, query persistence.Query) ([]persistence.UsageReport, string, error){
+	var reports []persistence.UsageReport
+	nextCursor, err := datastoreClient.runPage(ctx, datastore.NewQuery(USAGE_REPORT), query, &reports)
+	if err != nil {
+		return nil, "", err
+	}
+	return reports, nextCursor, nil
+}
 
-	if client, err := datastore.NewClient(ctx, datastoreClient.ProjectId); err != nil {
-		LogE.Printf("Failed to create datastore client: %v", err)
-		return nil,err
-	} else {
-		q := datastore.NewQuery(CONTACT)
-		if order != "" {
-			q = q.Order(order)
-		}
+func (datastoreClient *DatastoreClient) QueryHistory(ctx context.Context, entityKind string, entityId string, query persistence.Query) ([]persistence.HistoryEntry, string, error){
+	query.Filters = append([]persistence.Filter{
+		{Property: "entityKind", Operator: "=", Value: entityKind},
+		{Property: "entityId", Operator: "=", Value: entityId},
+	}, query.Filters...)
+	var history []persistence.HistoryEntry
+	nextCursor, err := datastoreClient.runPage(ctx, datastore.NewQuery(HISTORY), query, &history)
+	if err != nil {
+		return nil, "", err
+	}
+	return history, nextCursor, nil
+}
 
-		if filters != nil && len(filters)>0 {
-			for _, s := range filters {
-				if filter := strings.SplitAfter(s, "="); len(filter) > 0 {
-					filterStr := filter[0]
-					value := filter[1]
-					q = q.Filter(filterStr, value)
+func (datastoreClient *DatastoreClient) PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error){
+	before := persistence.FormatDeletedTime(deletedBefore)
+	purged := 0
+	for _, kind := range []string{ACCOUNT, ENTITLEMENT} {
+		q := datastore.NewQuery(kind).Filter("deletedTime>", "").Filter("deletedTime<", before).KeysOnly()
+		keys, err := datastoreClient.client.GetAll(ctx, q, nil)
+		if err != nil {
+			return purged, err
+		}
+		for start := 0; start < len(keys); start += maxBatchSize {
+			end := start + maxBatchSize
+			if end > len(keys) {
+				end = len(keys)
+			}
+			if err := datastoreClient.client.DeleteMulti(ctx, keys[start:end]); err != nil {
+				return purged, err
+			}
+			if kind == ACCOUNT {
+				//remove the signup contact along with the account
+				contactKeys := make([]*datastore.Key, 0, end-start)
+				for _, key := range keys[start:end] {
+					contactKeys = append(contactKeys, datastore.NameKey(CONTACT, key.Name, nil))
+				}
+				if err := datastoreClient.client.DeleteMulti(ctx, contactKeys); err != nil {
+					return purged, err
 				}
 			}
+			purged += end - start
 		}
+	}
+	return purged, nil
+}
 
-		t := client.Run(ctx, q)
-		var contacts []persistence.Contact
-		for {
-			contact := persistence.Contact{}
-			_, err := t.Next(&contact)
-			if err == iterator.Done {
-				break
-			}
-			if err != nil {
-				return nil, err
-			}
-			contacts = append(contacts, contact)
+func (datastoreClient *DatastoreClient) Healthz(ctx context.Context) error{
+	q := datastore.NewQuery(ACCOUNT).Limit(1)
+
+	t := datastoreClient.client.Run(ctx, q)
+	for {
+		account := persistence.Account{}
+		_, err := t.Next(&account)
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
 		}
-		return contacts, nil
 	}
 }
 
-func (datastoreClient *DatastoreClient) Healthz() error{
-	ctx := context.Background()
+//toPersistenceError maps datastore errors to the persistence errors.
+func toPersistenceError(err error) error {
+	switch err {
+	case datastore.ErrNoSuchEntity:
+		return persistence.ErrNotFound
+	case datastore.ErrConcurrentTransaction:
+		return persistence.ErrConflict
+	}
+	return err
+}
 
-	if client, err := datastore.NewClient(ctx, datastoreClient.ProjectId); err != nil {
-		LogE.Printf("Failed to create datastore client: %v", err)
-		return err
-	} else {
-		q := datastore.NewQuery(ACCOUNT).Limit(1)
+//putVersioned writes the entity in a transaction that checks ifVersion against the stored version and increments it,
+//so a writer working from a stale read cannot overwrite a newer entity. A history entry for the change is written in
+//the same transaction. Datastore retries the transaction on contention and returns ErrConcurrentTransaction if it
+//keeps failing.
+func (datastoreClient *DatastoreClient) putVersioned(ctx context.Context, key *datastore.Key, entity interface{}, version *int64, ifVersion int64) error {
+	previousVersion, newVersion := *version, int64(0)
+	_, err := datastoreClient.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		current := reflect.New(reflect.TypeOf(entity).Elem())
+		exists := true
+		if err := tx.Get(key, current.Interface()); err == datastore.ErrNoSuchEntity {
+			exists = false
+		} else if err != nil {
+			return err
+		}
+		currentVersion := current.Elem().FieldByName("Version").Int()
+		if err := persistence.CheckVersion(exists, currentVersion, ifVersion); err != nil {
+			return err
+		}
 
-		t := client.Run(ctx, q)
-		for {
-			account := persistence.Account{}
-			_, err := t.Next(&account)
-			if err == iterator.Done {
-				return nil
-			}
-			if err != nil {
+		newVersion = currentVersion + 1
+		*version = newVersion
+		//only delete and restore change the deleted time
+		if deletedTime := reflect.ValueOf(entity).Elem().FieldByName("DeletedTime"); deletedTime.IsValid() {
+			deletedTime.Set(current.Elem().FieldByName("DeletedTime"))
+		}
+		if entitlement, ok := entity.(*persistence.Entitlement); ok {
+			persistence.KeepApprovals(current.Interface().(*persistence.Entitlement), entitlement)
+		}
+		if _, err := tx.Put(key, entity); err != nil {
+			return err
+		}
+		if entry := persistence.NewHistoryEntry(ctx, current.Interface(), entity, newVersion); entry != nil {
+			if _, err := tx.Put(datastore.NameKey(HISTORY, entry.Id, nil), entry); err != nil {
 				return err
 			}
 		}
 		return nil
+	})
+	if err != nil {
+		*version = previousVersion
+		return toPersistenceError(err)
 	}
+	*version = newVersion
+	return nil
 }
 
+//setDeletedTime soft deletes an account or entitlement, or restores it when deletedTime is empty, in a transaction that
+//increments its version and records the change in its history. Deleting a missing entity does nothing.
+func (datastoreClient *DatastoreClient) setDeletedTime(ctx context.Context, key *datastore.Key, entity interface{}, deletedTime string) error {
+	_, err := datastoreClient.client.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		_, err := setDeletedTimeInTx(ctx, tx, key, entity, deletedTime)
+		return err
+	})
+	return toPersistenceError(err)
+}
 
+//setDeletedTimeInTx is setDeletedTime within a caller's transaction. It returns whether the entity was changed.
+func setDeletedTimeInTx(ctx context.Context, tx *datastore.Transaction, key *datastore.Key, entity interface{}, deletedTime string) (bool, error) {
+	if err := tx.Get(key, entity); err == datastore.ErrNoSuchEntity && deletedTime != "" {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if persistence.IsDeleted(entity) == (deletedTime != "") {
+		return false, nil
+	}
 
+	entityValue := reflect.ValueOf(entity).Elem()
+	current := reflect.New(entityValue.Type())
+	current.Elem().Set(entityValue)
+	entityValue.FieldByName("DeletedTime").SetString(deletedTime)
+	version := entityValue.FieldByName("Version")
+	version.SetInt(version.Int() + 1)
+	if _, err := tx.Put(key, entity); err != nil {
+		return false, err
+	}
+	if entry := persistence.NewHistoryEntry(ctx, current.Interface(), entity, version.Int()); entry != nil {
+		if _, err := tx.Put(datastore.NameKey(HISTORY, entry.Id, nil), entry); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+//runPage applies the query filters, order and cursor and loads up to the limit of entities into entitiesPtr, a
+//pointer to a slice of entities. The returned cursor is empty when there are no more results. Datastore has no != or
+//IN filters, and cannot select entities without a deletedTime, so those filters are applied to the loaded entities.
+//With a limit, entities are read in batches of one more than the limit until the page is full or there are no more,
+//so skipped entities never load the whole kind at once.
+func (datastoreClient *DatastoreClient) runPage(ctx context.Context, q *datastore.Query, query persistence.Query, entitiesPtr interface{}) (string, error) {
+	if query.Order != "" {
+		q = q.Order(query.Order)
+	}
+	var postFilters []persistence.Filter
+	for _, filter := range query.Filters {
+		switch filter.Operator {
+		case "!=", "IN":
+			postFilters = append(postFilters, filter)
+		default:
+			q = q.Filter(filter.Property+filter.Operator, filter.Value)
+		}
+	}
+	if query.Cursor != "" {
+		cursor, err := datastore.DecodeCursor(query.Cursor)
+		if err != nil {
+			return "", persistence.ErrInvalidCursor
+		}
+		q = q.Start(cursor)
+	}
+	batchSize := 0
+	if query.Limit > 0 {
+		//fetch one more than the limit to find out if there is a next page
+		batchSize = query.Limit + 1
+		q = q.Limit(batchSize)
+	}
 
+	entities := reflect.ValueOf(entitiesPtr).Elem()
+	var cursor datastore.Cursor
+	for {
+		t := datastoreClient.client.Run(ctx, q)
+		fetched := 0
+		for {
+			entity := reflect.New(entities.Type().Elem())
+			if _, err := t.Next(entity.Interface()); err == iterator.Done {
+				break
+			} else if err != nil {
+				return "", err
+			}
+			fetched++
+			if !persistence.MatchFilters(entity.Interface(), postFilters) ||
+				!query.IncludeDeleted && persistence.IsDeleted(entity.Interface()) {
+				continue
+			}
+			if query.Limit > 0 && entities.Len() == query.Limit {
+				//there is at least one more entity so return the cursor after the last one on this page
+				return cursor.String(), nil
+			}
+			entities.Set(reflect.Append(entities, entity.Elem()))
+			if query.Limit > 0 && entities.Len() == query.Limit {
+				var err error
+				if cursor, err = t.Cursor(); err != nil {
+					return "", err
+				}
+			}
+		}
+		if batchSize == 0 || fetched < batchSize {
+			return "", nil
+		}
+		//the batch had entities that were filtered out here, continue with the next one
+		batchEnd, err := t.Cursor()
+		if err != nil {
+			return "", err
+		}
+		q = q.Start(batchEnd)
+	}
+}
@@ -0,0 +1,146 @@
+package datastoreclient
+
+import (
+	"cloud.google.com/go/datastore"
+	"context"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/memoryclient"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/persistence"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCheckCascadeSize(t *testing.T) {
+	tests := []struct {
+		entitlements int
+		wantErr      bool
+	}{
+		{0, false},
+		{(maxBatchSize - 3) / 2, false},
+		{(maxBatchSize-3)/2 + 1, true},
+		{maxBatchSize, true},
+	}
+	for _, test := range tests {
+		if err := checkCascadeSize(test.entitlements); (err != nil) != test.wantErr {
+			t.Errorf("checkCascadeSize(%d) = %v, want error %t", test.entitlements, err, test.wantErr)
+		}
+	}
+}
+
+//The datastore benchmarks run against the datastore emulator and are skipped unless DATASTORE_EMULATOR_HOST is set:
+//
+//	gcloud beta emulators datastore start --no-store-on-disk
+//	DATASTORE_EMULATOR_HOST=localhost:8081 go test -run NONE -bench . -cpu 1,8,32 ./datastoreclient
+//
+//Each operation is run with the shared client, with a client dialed for each call as before the client was shared,
+//and with the memory backend as a baseline.
+
+const benchProjectId = "cloud-bill-bench"
+
+const benchAccountId = "bench-account"
+
+//emulatorClient returns a client for the emulator or skips the benchmark.
+func emulatorClient(b *testing.B) persistence.DatabaseHandler {
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		b.Skip("DATASTORE_EMULATOR_HOST is not set")
+	}
+	db, err := NewDatastore(benchProjectId)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return db
+}
+
+//benchmarkBackends runs op in parallel on each backend after setup. i is unique for each call of op.
+func benchmarkBackends(b *testing.B, setup func(ctx context.Context, db persistence.DatabaseHandler) error, op func(ctx context.Context, db persistence.DatabaseHandler, i int64) error) {
+	ctx := context.Background()
+	b.Run("memory", func(b *testing.B) {
+		db := memoryclient.NewMemory()
+		defer db.Close()
+		runParallel(b, ctx, db, setup, func(i int64) error {
+			return op(ctx, db, i)
+		})
+	})
+	b.Run("datastore shared client", func(b *testing.B) {
+		db := emulatorClient(b)
+		defer db.Close()
+		runParallel(b, ctx, db, setup, func(i int64) error {
+			return op(ctx, db, i)
+		})
+	})
+	b.Run("datastore client per call", func(b *testing.B) {
+		db := emulatorClient(b)
+		defer db.Close()
+		runParallel(b, ctx, db, setup, func(i int64) error {
+			client, err := datastore.NewClient(ctx, benchProjectId)
+			if err != nil {
+				return err
+			}
+			defer client.Close()
+			return op(ctx, &DatastoreClient{benchProjectId, client}, i)
+		})
+	})
+}
+
+func runParallel(b *testing.B, ctx context.Context, db persistence.DatabaseHandler, setup func(ctx context.Context, db persistence.DatabaseHandler) error, op func(i int64) error) {
+	if setup != nil {
+		if err := setup(ctx, db); err != nil {
+			b.Fatal(err)
+		}
+	}
+	var calls int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := op(atomic.AddInt64(&calls, 1)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func benchEntitlement(id string) *persistence.Entitlement {
+	return &persistence.Entitlement{
+		Id:       id,
+		Account:  benchAccountId,
+		Provider: "bench-provider",
+		Product:  "bench-product",
+		Plan:     "bench-plan",
+		State:    "ENTITLEMENT_ACTIVE",
+	}
+}
+
+//seedEntitlements stores count entitlements of the bench account.
+func seedEntitlements(count int) func(ctx context.Context, db persistence.DatabaseHandler) error {
+	return func(ctx context.Context, db persistence.DatabaseHandler) error {
+		for i := 0; i < count; i++ {
+			if err := db.UpsertEntitlement(ctx, benchEntitlement("bench-entitlement-"+strconv.Itoa(i)), persistence.NoVersion); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func BenchmarkGetEntitlement(b *testing.B) {
+	benchmarkBackends(b, seedEntitlements(1), func(ctx context.Context, db persistence.DatabaseHandler, i int64) error {
+		_, err := db.GetEntitlement(ctx, "bench-entitlement-0")
+		return err
+	})
+}
+
+func BenchmarkUpsertEntitlement(b *testing.B) {
+	benchmarkBackends(b, nil, func(ctx context.Context, db persistence.DatabaseHandler, i int64) error {
+		return db.UpsertEntitlement(ctx, benchEntitlement("bench-upsert-"+strconv.FormatInt(i, 10)), persistence.NoVersion)
+	})
+}
+
+func BenchmarkQueryAccountEntitlements(b *testing.B) {
+	benchmarkBackends(b, seedEntitlements(150), func(ctx context.Context, db persistence.DatabaseHandler, i int64) error {
+		_, _, err := db.QueryAccountEntitlements(ctx, benchAccountId, persistence.Query{Limit: 100})
+		return err
+	})
+}
@@ -1,20 +1,31 @@
 package dbinterface
 
 import (
+	"errors"
 	"github.com/cloudbees/cloud-bill-saas/subscription-service/datastoreclient"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/memoryclient"
 	"github.com/cloudbees/cloud-bill-saas/subscription-service/persistence"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/postgresclient"
 )
 
 type DBTYPE string
 
 const (
 	DATASTOREDB DBTYPE = "datastoredb"
+	MEMORYDB DBTYPE = "memorydb"
+	POSTGRESDB DBTYPE = "postgresdb"
 )
 
-func NewPersistenceLayer(options DBTYPE, connection string) persistence.DatabaseHandler {
+//NewPersistenceLayer creates the database handler. The connection is the GCP project ID for datastoredb and the
+//connection url for postgresdb. It is ignored for memorydb.
+func NewPersistenceLayer(options DBTYPE, connection string) (persistence.DatabaseHandler, error) {
 	switch options {
 		case DATASTOREDB:
 			return datastoreclient.NewDatastore(connection)
+		case MEMORYDB:
+			return memoryclient.NewMemory(), nil
+		case POSTGRESDB:
+			return postgresclient.NewPostgres(connection)
 	}
-	return nil
+	return nil, errors.New("Unsupported database type: "+string(options))
 }
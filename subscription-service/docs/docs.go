@@ -1,13 +1,12 @@
 // GENERATED BY THE COMMAND ABOVE; DO NOT EDIT
 // This file was generated by swaggo/swag at
-// 2019-10-09 10:22:28.331151 -0700 PDT m=+0.188952079
+// 2026-10-18 05:15:59.300445423 +0000 UTC m=+0.062244431
 
 package docs
 
 import (
 	"bytes"
 	"encoding/json"
-	"strings"
 
 	"github.com/alecthomas/template"
 	"github.com/swaggo/swag"
@@ -28,8 +27,8 @@ var doc = `{
         "license": {},
         "version": "{{.Version}}"
     },
-    "host": "{{.Host}}",
-    "basePath": "{{.BasePath}}",
+    "host": "localhost:8085",
+    "basePath": "/api/v1",
     "paths": {
         "/accounts": {
             "get": {
@@ -45,7 +44,7 @@ var doc = `{
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "optional comma separated list of filter",
+                        "description": "optional filter expression, e.g. state IN (ENTITLEMENT_ACTIVE, ENTITLEMENT_PENDING_CANCELLATION) AND updateTime \u003e= 2019-10-01",
                         "name": "filters",
                         "in": "query"
                     },
@@ -54,22 +53,53 @@ var doc = `{
                         "description": "optional order",
                         "name": "order",
                         "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "optional page size, default 100 and at most 1000",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional nextPageToken from the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "optional, also list deleted accounts",
+                        "name": "includeDeleted",
+                        "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/persistence.Account"
-                            }
+                            "type": "object",
+                            "$ref": "#/definitions/web.AccountsPage"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filters, order, limit, cursor or includeDeleted",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "No accounts found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     },
                     "500": {
                         "description": "Error",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     }
                 }
@@ -94,6 +124,12 @@ var doc = `{
                             "type": "object",
                             "$ref": "#/definitions/persistence.Account"
                         }
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional ETag from a previous get, the upsert fails with 412 if the account has changed since",
+                        "name": "If-Match",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -101,12 +137,33 @@ var doc = `{
                         "description": "Upserted",
                         "schema": {
                             "type": "string"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "New account version"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request body",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "412": {
+                        "description": "Account version does not match If-Match",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     },
                     "500": {
                         "description": "Error",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     }
                 }
@@ -130,31 +187,53 @@ var doc = `{
                         "name": "accountId",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "optional, also return the account if it was deleted",
+                        "name": "includeDeleted",
+                        "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
+                            "type": "object",
                             "$ref": "#/definitions/persistence.Account"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Account version for If-Match"
+                            }
                         }
                     },
                     "400": {
-                        "description": "Missing account ID in path",
+                        "description": "Missing account ID in path or invalid includeDeleted",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Account not found or deleted",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     }
                 }
             },
             "delete": {
-                "description": "Delete an account",
+                "description": "Soft deletes an account, it is hidden from gets and lists until restored or purged after the retention period.\nWith cascade=true the account's entitlements are also soft deleted and its contact removed in one\ntransaction, and a summary of the changes is returned.",
                 "consumes": [
                     "application/json"
                 ],
@@ -170,9 +249,22 @@ var doc = `{
                         "name": "accountId",
                         "in": "path",
                         "required": true
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "optional, also delete the account's contact and entitlements",
+                        "name": "cascade",
+                        "in": "query"
                     }
                 ],
                 "responses": {
+                    "200": {
+                        "description": "Deleted with cascade",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.AccountDeletion"
+                        }
+                    },
                     "204": {
                         "description": "Deleted",
                         "schema": {
@@ -180,15 +272,17 @@ var doc = `{
                         }
                     },
                     "400": {
-                        "description": "Missing account ID in path",
+                        "description": "Missing account ID in path or invalid cascade",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     },
                     "500": {
                         "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     }
                 }
@@ -215,7 +309,7 @@ var doc = `{
                     },
                     {
                         "type": "string",
-                        "description": "optional comma separated list of filter",
+                        "description": "optional filter expression, e.g. state IN (ENTITLEMENT_ACTIVE, ENTITLEMENT_PENDING_CANCELLATION) AND updateTime \u003e= 2019-10-01",
                         "name": "filters",
                         "in": "query"
                     },
@@ -224,42 +318,80 @@ var doc = `{
                         "description": "optional order",
                         "name": "order",
                         "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "optional page size, default 100 and at most 1000",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional nextPageToken from the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "optional, also list deleted entitlements",
+                        "name": "includeDeleted",
+                        "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/persistence.Entitlement"
-                            }
+                            "type": "object",
+                            "$ref": "#/definitions/web.EntitlementsPage"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filters, order, limit, cursor or includeDeleted",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "No entitlements found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     },
                     "500": {
                         "description": "Error",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     }
                 }
             }
         },
-        "/contacts": {
+        "/accounts/{accountId}/history": {
             "get": {
-                "description": "Gets an array of contacts",
+                "description": "Gets the state and approval changes of an account, oldest first",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "GetContacts",
-                "operationId": "cloud-bill-saas-subscription-service-get-contacts",
+                "summary": "GetAccountHistory",
+                "operationId": "cloud-bill-saas-subscription-service-get-account-history",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "optional comma separated list of filter",
+                        "description": "Account ID",
+                        "name": "accountId",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional filter expression, e.g. changeTime \u003e= 2019-10-01",
                         "name": "filters",
                         "in": "query"
                     },
@@ -268,63 +400,63 @@ var doc = `{
                         "description": "optional order",
                         "name": "order",
                         "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "optional page size, default 100 and at most 1000",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional nextPageToken from the previous page",
+                        "name": "cursor",
+                        "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/persistence.Contact"
-                            }
+                            "type": "object",
+                            "$ref": "#/definitions/web.HistoryPage"
                         }
                     },
-                    "500": {
-                        "description": "Error",
+                    "400": {
+                        "description": "Invalid filters, order, limit or cursor",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
-                    }
-                }
-            },
-            "put": {
-                "description": "Upsert a contact passing contact json",
-                "consumes": [
-                    "application/json"
-                ],
-                "produces": [
-                    "application/json"
-                ],
-                "summary": "Upsert a contact",
-                "operationId": "cloud-bill-saas-subscription-service-upsert-contact",
-                "responses": {
-                    "204": {
-                        "description": "Upserted",
+                    },
+                    "404": {
+                        "description": "No history found",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     },
                     "500": {
                         "description": "Error",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     }
                 }
             }
         },
-        "/contacts/{accountId}": {
-            "get": {
-                "description": "Retrieves an contact by account ID",
+        "/admin/accounts/{accountId}/restore": {
+            "post": {
+                "description": "Restores a soft deleted account",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Get an contact",
-                "operationId": "cloud-bill-saas-subscription-service-get-contact",
+                "summary": "Restore an account",
+                "operationId": "cloud-bill-saas-subscription-service-restore-account",
                 "parameters": [
                     {
                         "type": "string",
@@ -335,82 +467,102 @@ var doc = `{
                     }
                 ],
                 "responses": {
-                    "200": {
-                        "description": "OK",
+                    "204": {
+                        "description": "Restored",
                         "schema": {
-                            "$ref": "#/definitions/persistence.Contact"
+                            "type": "string"
                         }
                     },
                     "400": {
                         "description": "Missing account ID in path",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Account not found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     },
                     "500": {
-                        "description": "Error",
+                        "description": "Internal server error",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     }
                 }
-            },
-            "delete": {
-                "description": "Delete an contact",
+            }
+        },
+        "/admin/entitlements/{entitlementId}/restore": {
+            "post": {
+                "description": "Restores a soft deleted entitlement",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Delete an contact",
-                "operationId": "cloud-bill-saas-subscription-service-delete-contact",
+                "summary": "Restore an entitlement",
+                "operationId": "cloud-bill-saas-subscription-service-restore-entitlement",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Account ID",
-                        "name": "accountId",
+                        "description": "Entitlement ID",
+                        "name": "entitlementId",
                         "in": "path",
                         "required": true
                     }
                 ],
                 "responses": {
                     "204": {
-                        "description": "Deleted",
+                        "description": "Restored",
                         "schema": {
                             "type": "string"
                         }
                     },
                     "400": {
-                        "description": "Missing account ID in path",
+                        "description": "Missing entitlement ID in path",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Entitlement not found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     },
                     "500": {
                         "description": "Error",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     }
                 }
             }
         },
-        "/entitlements": {
+        "/contacts": {
             "get": {
-                "description": "Gets an array of entitlements",
+                "description": "Gets an array of contacts",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "GetEntitlements",
-                "operationId": "cloud-bill-saas-subscription-service-get-entitlements",
+                "summary": "GetContacts",
+                "operationId": "cloud-bill-saas-subscription-service-get-contacts",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "optional comma separated list of filter",
+                        "description": "optional filter expression, e.g. state IN (ENTITLEMENT_ACTIVE, ENTITLEMENT_PENDING_CANCELLATION) AND updateTime \u003e= 2019-10-01",
                         "name": "filters",
                         "in": "query"
                     },
@@ -419,68 +571,132 @@ var doc = `{
                         "description": "optional order",
                         "name": "order",
                         "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "optional page size, default 100 and at most 1000",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional nextPageToken from the previous page",
+                        "name": "cursor",
+                        "in": "query"
                     }
                 ],
                 "responses": {
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "array",
-                            "items": {
-                                "$ref": "#/definitions/persistence.Entitlement"
-                            }
+                            "type": "object",
+                            "$ref": "#/definitions/web.ContactsPage"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filters, order, limit or cursor",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "No contacts found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     },
                     "500": {
                         "description": "Error",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     }
                 }
             },
             "put": {
-                "description": "Upsert an entitlement passing entitlement json",
+                "description": "Upsert a contact passing contact json",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Upsert an entitlement",
-                "operationId": "cloud-bill-saas-subscription-service-upsert-entitlement",
+                "summary": "Upsert a contact",
+                "operationId": "cloud-bill-saas-subscription-service-upsert-contact",
+                "parameters": [
+                    {
+                        "description": "Contact",
+                        "name": "contact",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.Contact"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional ETag from a previous get, the upsert fails with 412 if the contact has changed since",
+                        "name": "If-Match",
+                        "in": "header"
+                    }
+                ],
                 "responses": {
                     "204": {
                         "description": "Upserted",
                         "schema": {
                             "type": "string"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "New contact version"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request body",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "412": {
+                        "description": "Contact version does not match If-Match",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     },
                     "500": {
                         "description": "Error",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     }
                 }
             }
         },
-        "/entitlements/{entitlementId}": {
+        "/contacts/{accountId}": {
             "get": {
-                "description": "Retrieves an entitlement by entitlement ID",
+                "description": "Retrieves an contact by account ID",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Get an entitlement",
-                "operationId": "cloud-bill-saas-subscription-service-get-entitlement",
+                "summary": "Get an contact",
+                "operationId": "cloud-bill-saas-subscription-service-get-contact",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Entitlement ID",
-                        "name": "entitlementId",
+                        "description": "Account ID",
+                        "name": "accountId",
                         "in": "path",
                         "required": true
                     }
@@ -489,38 +705,54 @@ var doc = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "$ref": "#/definitions/persistence.Entitlement"
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.Contact"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Contact version for If-Match"
+                            }
                         }
                     },
                     "400": {
-                        "description": "Missing entitlement ID in path",
+                        "description": "Missing account ID in path",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     },
-                    "500": {
+                    "404": {
+                        "description": "Contact not found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
                         "description": "Error",
                         "schema": {
-                            "type": "string"
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
                         }
                     }
                 }
             },
             "delete": {
-                "description": "Delete an entitlement",
+                "description": "Delete an contact",
                 "consumes": [
                     "application/json"
                 ],
                 "produces": [
                     "application/json"
                 ],
-                "summary": "Delete an entitlement",
-                "operationId": "cloud-bill-saas-subscription-service-delete-entitlement",
+                "summary": "Delete an contact",
+                "operationId": "cloud-bill-saas-subscription-service-delete-contact",
                 "parameters": [
                     {
                         "type": "string",
-                        "description": "Entitlement ID",
-                        "name": "entitlementId",
+                        "description": "Account ID",
+                        "name": "accountId",
                         "in": "path",
                         "required": true
                     }
@@ -533,52 +765,1802 @@ var doc = `{
                         }
                     },
                     "400": {
-                        "description": "Missing entitlement ID in path",
+                        "description": "Missing account ID in path",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/deadletters": {
+            "get": {
+                "description": "Gets an array of dead letters",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "GetDeadLetters",
+                "operationId": "cloud-bill-saas-subscription-service-get-dead-letters",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "optional filter expression, e.g. eventType = ENTITLEMENT_ACTIVE AND createTime \u003e= 2019-10-01",
+                        "name": "filters",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional order, e.g. -createTime",
+                        "name": "order",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "optional page size, default 100 and at most 1000",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional nextPageToken from the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.DeadLettersPage"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filters, order, limit or cursor",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "No dead letters found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "description": "Stores a marketplace message the pubsub service gave up on, with its raw data and last error",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Store a dead letter",
+                "operationId": "cloud-bill-saas-subscription-service-upsert-dead-letter",
+                "parameters": [
+                    {
+                        "description": "Dead letter",
+                        "name": "deadLetter",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.DeadLetter"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Upserted",
                         "schema": {
                             "type": "string"
                         }
                     },
+                    "400": {
+                        "description": "Invalid request body",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/deadletters/{deadLetterId}": {
+            "get": {
+                "description": "Retrieves a dead letter by ID",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get a dead letter",
+                "operationId": "cloud-bill-saas-subscription-service-get-dead-letter",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Dead letter ID",
+                        "name": "deadLetterId",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.DeadLetter"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing dead letter ID in path",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Dead letter not found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
                     "500": {
                         "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "Deletes a dead letter, usually after it was replayed",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Delete a dead letter",
+                "operationId": "cloud-bill-saas-subscription-service-delete-dead-letter",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Dead letter ID",
+                        "name": "deadLetterId",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Deleted",
                         "schema": {
                             "type": "string"
                         }
+                    },
+                    "400": {
+                        "description": "Missing dead letter ID in path",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/entitlements": {
+            "get": {
+                "description": "Gets an array of entitlements",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "GetEntitlements",
+                "operationId": "cloud-bill-saas-subscription-service-get-entitlements",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "optional filter expression, e.g. state IN (ENTITLEMENT_ACTIVE, ENTITLEMENT_PENDING_CANCELLATION) AND updateTime \u003e= 2019-10-01",
+                        "name": "filters",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional order",
+                        "name": "order",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "optional page size, default 100 and at most 1000",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional nextPageToken from the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "optional, also list deleted entitlements",
+                        "name": "includeDeleted",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.EntitlementsPage"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filters, order, limit, cursor or includeDeleted",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "No entitlements found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
                     }
                 }
+            },
+            "put": {
+                "description": "Upsert an entitlement passing entitlement json",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Upsert an entitlement",
+                "operationId": "cloud-bill-saas-subscription-service-upsert-entitlement",
+                "parameters": [
+                    {
+                        "description": "Entitlement",
+                        "name": "entitlement",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.Entitlement"
+                        }
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional ETag from a previous get, the upsert fails with 412 if the entitlement has changed since",
+                        "name": "If-Match",
+                        "in": "header"
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Upserted",
+                        "schema": {
+                            "type": "string"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "New entitlement version"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request body",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "412": {
+                        "description": "Entitlement version does not match If-Match",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/entitlements/{entitlementId}": {
+            "get": {
+                "description": "Retrieves an entitlement by entitlement ID",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get an entitlement",
+                "operationId": "cloud-bill-saas-subscription-service-get-entitlement",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Entitlement ID",
+                        "name": "entitlementId",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "boolean",
+                        "description": "optional, also return the entitlement if it was deleted",
+                        "name": "includeDeleted",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.Entitlement"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "Entitlement version for If-Match"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Missing entitlement ID in path or invalid includeDeleted",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Entitlement not found or deleted",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "Soft deletes an entitlement, it is hidden from gets and lists until restored or purged after the retention period",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Delete an entitlement",
+                "operationId": "cloud-bill-saas-subscription-service-delete-entitlement",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Entitlement ID",
+                        "name": "entitlementId",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Deleted",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing entitlement ID in path",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/entitlements/{entitlementId}/approvals": {
+            "post": {
+                "description": "Appends an approval attempt, e.g. a failed call to approve the entitlement with the procurement API, to the approvals of an entitlement. The approval state of the entitlement becomes the state of the attempt.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Record an approval attempt on an entitlement",
+                "operationId": "cloud-bill-saas-subscription-service-add-entitlement-approval",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Entitlement ID",
+                        "name": "entitlementId",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Approval attempt, the update time defaults to now",
+                        "name": "approval",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.Approval"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Recorded",
+                        "schema": {
+                            "type": "string"
+                        },
+                        "headers": {
+                            "ETag": {
+                                "type": "string",
+                                "description": "New entitlement version"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Missing entitlement ID, invalid request body or missing name or state",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Entitlement not found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "412": {
+                        "description": "The entitlement kept changing while the approval was recorded",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/entitlements/{entitlementId}/history": {
+            "get": {
+                "description": "Gets the state, plan and approval changes of an entitlement, oldest first",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "GetEntitlementHistory",
+                "operationId": "cloud-bill-saas-subscription-service-get-entitlement-history",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Entitlement ID",
+                        "name": "entitlementId",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional filter expression, e.g. changeTime \u003e= 2019-10-01",
+                        "name": "filters",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional order",
+                        "name": "order",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "optional page size, default 100 and at most 1000",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional nextPageToken from the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.HistoryPage"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filters, order, limit or cursor",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "No history found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/events": {
+            "get": {
+                "description": "Gets an array of the marketplace events handled by the pubsub service",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "GetEvents",
+                "operationId": "cloud-bill-saas-subscription-service-get-events",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "optional filter expression, e.g. outcome IN (FAILED, DEAD_LETTERED) AND processedTime \u003e= 2019-10-01",
+                        "name": "filters",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional order, e.g. -processedTime",
+                        "name": "order",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "optional page size, default 100 and at most 1000",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional nextPageToken from the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.EventsPage"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filters, order, limit or cursor",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "No events found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "description": "Records the outcome of a marketplace event handled by the pubsub service, replacing the outcome of an earlier delivery",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Record a marketplace event",
+                "operationId": "cloud-bill-saas-subscription-service-upsert-event",
+                "parameters": [
+                    {
+                        "description": "Event",
+                        "name": "event",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.Event"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Upserted",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request body",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/events/{eventId}": {
+            "get": {
+                "description": "Retrieves the outcome of a marketplace event by event ID",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get a marketplace event",
+                "operationId": "cloud-bill-saas-subscription-service-get-event",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Event ID",
+                        "name": "eventId",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.Event"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing event ID in path",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Event not found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/failedapprovals": {
+            "get": {
+                "description": "Gets an array of entitlements that are still waiting for approval after the last attempt to approve them failed. They need attention if the failure persists.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "GetFailedApprovals",
+                "operationId": "cloud-bill-saas-subscription-service-get-failed-approvals",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "optional filter expression on the entitlements, e.g. product = cloudbees-core",
+                        "name": "filters",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional order, e.g. -updateTime",
+                        "name": "order",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "optional page size, default 100 and at most 1000",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional nextPageToken from the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.EntitlementsPage"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filters, order, limit or cursor",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "No failed approvals found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/healthz": {
+            "get": {
+                "description": "Check the health of the subscription service",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Check the health of the subscription service",
+                "operationId": "cloud-bill-saas-subscription-service-healthz",
+                "responses": {
+                    "200": {
+                        "description": "Ok",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/pendingapprovals": {
+            "get": {
+                "description": "Gets an array of requests held for manual approval",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "GetPendingApprovals",
+                "operationId": "cloud-bill-saas-subscription-service-get-pending-approvals",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "optional filter expression, e.g. request = PLAN_CHANGE AND product = cloudbees-core",
+                        "name": "filters",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional order, e.g. -createTime",
+                        "name": "order",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "optional page size, default 100 and at most 1000",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional nextPageToken from the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.PendingApprovalsPage"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filters, order, limit or cursor",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "No pending approvals found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "put": {
+                "description": "Stores an entitlement creation or plan change request the pubsub approval policy held for manual review, replacing an earlier one for the entitlement",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Hold a request for manual approval",
+                "operationId": "cloud-bill-saas-subscription-service-upsert-pending-approval",
+                "parameters": [
+                    {
+                        "description": "Pending approval",
+                        "name": "pendingApproval",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.PendingApproval"
+                        }
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Upserted",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request body",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/pendingapprovals/{entitlementId}": {
+            "get": {
+                "description": "Retrieves the request held for manual approval of an entitlement",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get a pending approval",
+                "operationId": "cloud-bill-saas-subscription-service-get-pending-approval",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Entitlement ID",
+                        "name": "entitlementId",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.PendingApproval"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing entitlement ID in path",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Pending approval not found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "delete": {
+                "description": "Deletes the request held for manual approval of an entitlement",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Delete a pending approval",
+                "operationId": "cloud-bill-saas-subscription-service-delete-pending-approval",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Entitlement ID",
+                        "name": "entitlementId",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Deleted",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing entitlement ID in path",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/pendingapprovals/{entitlementId}/approve": {
+            "post": {
+                "description": "Approves the held entitlement creation or plan change with the procurement API, records the approval on the entitlement and removes the pending approval",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Approve a pending approval",
+                "operationId": "cloud-bill-saas-subscription-service-approve-pending-approval",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Entitlement ID",
+                        "name": "entitlementId",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Approver and optional reason",
+                        "name": "decision",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ApprovalDecision"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.Entitlement"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing entitlement ID or approver",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Pending approval or entitlement not found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "The marketplace refused the approval, e.g. the request was cancelled",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "412": {
+                        "description": "The entitlement kept changing while the approval was recorded",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "502": {
+                        "description": "Procurement API error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Procurement API is not configured",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/pendingapprovals/{entitlementId}/reject": {
+            "post": {
+                "description": "Rejects the held entitlement creation or plan change with the procurement API, records the rejection on the entitlement and removes the pending approval. The reason is shown to the customer.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Reject a pending approval",
+                "operationId": "cloud-bill-saas-subscription-service-reject-pending-approval",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Entitlement ID",
+                        "name": "entitlementId",
+                        "in": "path",
+                        "required": true
+                    },
+                    {
+                        "description": "Approver and reason",
+                        "name": "decision",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ApprovalDecision"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.Entitlement"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing entitlement ID, approver or reason",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Pending approval or entitlement not found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "The marketplace refused the rejection, e.g. the request was cancelled",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "412": {
+                        "description": "The entitlement kept changing while the rejection was recorded",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "502": {
+                        "description": "Procurement API error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "503": {
+                        "description": "Procurement API is not configured",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/usagerecords": {
+            "get": {
+                "description": "Gets an array of usage records. Records that are not reported yet have an empty report ID.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "GetUsageRecords",
+                "operationId": "cloud-bill-saas-subscription-service-get-usage-records",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "optional filter expression, e.g. entitlementId = 1234 AND startTime \u003e= 2019-10-01",
+                        "name": "filters",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional order, e.g. -startTime",
+                        "name": "order",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "optional page size, default 100 and at most 1000",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional nextPageToken from the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.UsageRecordsPage"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filters, order, limit or cursor",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "No usage records found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            },
+            "post": {
+                "description": "Records the usage of a metric by an entitlement over a time window. Records are aggregated and reported to Service Control with the usageReportingId of the entitlement. The ID is chosen by the caller, posting a record with the same ID and usage again returns the stored record and is not counted twice.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Record usage",
+                "operationId": "cloud-bill-saas-subscription-service-record-usage",
+                "parameters": [
+                    {
+                        "description": "Usage record, the report ID and create time are set by the service",
+                        "name": "usageRecord",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.UsageRecord"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "Already recorded",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.UsageRecord"
+                        }
+                    },
+                    "201": {
+                        "description": "Recorded",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.UsageRecord"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid request body, missing fields, invalid times or quantity, or an entitlement that cannot be billed for usage",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Entitlement not found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "A record with the same ID and different usage exists",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/usagerecords/{usageRecordId}": {
+            "get": {
+                "description": "Retrieves a usage record by ID",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get a usage record",
+                "operationId": "cloud-bill-saas-subscription-service-get-usage-record",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Usage record ID",
+                        "name": "usageRecordId",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.UsageRecord"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing usage record ID in path",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Usage record not found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/usagereports": {
+            "get": {
+                "description": "Gets an array of usage reports",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "GetUsageReports",
+                "operationId": "cloud-bill-saas-subscription-service-get-usage-reports",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "optional filter expression, e.g. state = FAILED AND entitlementId = 1234",
+                        "name": "filters",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional order, e.g. -createTime",
+                        "name": "order",
+                        "in": "query"
+                    },
+                    {
+                        "type": "integer",
+                        "description": "optional page size, default 100 and at most 1000",
+                        "name": "limit",
+                        "in": "query"
+                    },
+                    {
+                        "type": "string",
+                        "description": "optional nextPageToken from the previous page",
+                        "name": "cursor",
+                        "in": "query"
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.UsageReportsPage"
+                        }
+                    },
+                    "400": {
+                        "description": "Invalid filters, order, limit or cursor",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "No usage reports found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/usagereports/{usageReportId}": {
+            "get": {
+                "description": "Retrieves a usage report by ID, which is also its Service Control operation ID",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Get a usage report",
+                "operationId": "cloud-bill-saas-subscription-service-get-usage-report",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Usage report ID",
+                        "name": "usageReportId",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/persistence.UsageReport"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing usage report ID in path",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Usage report not found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        },
+        "/usagereports/{usageReportId}/retry": {
+            "post": {
+                "description": "Sends a usage report that Service Control rejected again on the next reporting run, e.g. after the cause was fixed. It is sent with the same operation ID.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "summary": "Retry a usage report",
+                "operationId": "cloud-bill-saas-subscription-service-retry-usage-report",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Usage report ID",
+                        "name": "usageReportId",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "204": {
+                        "description": "Pending",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "400": {
+                        "description": "Missing usage report ID in path",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "404": {
+                        "description": "Usage report not found",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "409": {
+                        "description": "The usage report did not fail",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    },
+                    "500": {
+                        "description": "Error",
+                        "schema": {
+                            "type": "object",
+                            "$ref": "#/definitions/web.ErrorResponse"
+                        }
+                    }
+                }
+            }
+        }
+    },
+    "definitions": {
+        "persistence.Account": {
+            "type": "object",
+            "properties": {
+                "approvals": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/persistence.Approval"
+                    }
+                },
+                "createTime": {
+                    "type": "string"
+                },
+                "deletedTime": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "provider": {
+                    "type": "string"
+                },
+                "state": {
+                    "type": "string"
+                },
+                "updateTime": {
+                    "type": "string"
+                },
+                "version": {
+                    "type": "integer"
+                }
+            }
+        },
+        "persistence.AccountDeletion": {
+            "type": "object",
+            "properties": {
+                "account": {
+                    "description": "Account is true if the account was soft deleted by this call, false if it was missing or already deleted.",
+                    "type": "boolean"
+                },
+                "accountId": {
+                    "type": "string"
+                },
+                "contact": {
+                    "description": "Contact is true if the account's contact was removed.",
+                    "type": "boolean"
+                },
+                "entitlements": {
+                    "description": "Entitlements are the ids of the account's entitlements that were soft deleted by this call.",
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                }
+            }
+        },
+        "persistence.Approval": {
+            "type": "object",
+            "properties": {
+                "approver": {
+                    "type": "string"
+                },
+                "name": {
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "state": {
+                    "type": "string"
+                },
+                "updateTime": {
+                    "type": "string"
+                }
+            }
+        },
+        "persistence.Change": {
+            "type": "object",
+            "properties": {
+                "newValue": {
+                    "type": "string"
+                },
+                "oldValue": {
+                    "type": "string"
+                },
+                "property": {
+                    "type": "string"
+                }
+            }
+        },
+        "persistence.Contact": {
+            "type": "object",
+            "properties": {
+                "accountId": {
+                    "type": "string"
+                },
+                "company": {
+                    "type": "string"
+                },
+                "emailAddress": {
+                    "type": "string"
+                },
+                "firstName": {
+                    "type": "string"
+                },
+                "lastName": {
+                    "type": "string"
+                },
+                "phone": {
+                    "type": "string"
+                },
+                "timezone": {
+                    "type": "string"
+                },
+                "version": {
+                    "type": "integer"
+                }
+            }
+        },
+        "persistence.DeadLetter": {
+            "type": "object",
+            "properties": {
+                "attempts": {
+                    "type": "integer"
+                },
+                "createTime": {
+                    "type": "string"
+                },
+                "data": {
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "eventId": {
+                    "type": "string"
+                },
+                "eventType": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                }
             }
         },
-        "/healthz": {
-            "get": {
-                "description": "Check the health of the subscription service",
-                "consumes": [
-                    "application/json"
-                ],
-                "produces": [
-                    "application/json"
-                ],
-                "summary": "Check the health of the subscription service",
-                "operationId": "cloud-bill-saas-subscription-service-healthz",
-                "responses": {
-                    "200": {
-                        "description": "Ok",
-                        "schema": {
-                            "type": "string"
-                        }
-                    },
-                    "500": {
-                        "description": "Error",
-                        "schema": {
-                            "type": "string"
-                        }
-                    }
-                }
-            }
-        }
-    },
-    "definitions": {
-        "persistence.Account": {
+        "persistence.Entitlement": {
             "type": "object",
             "properties": {
+                "account": {
+                    "type": "string"
+                },
+                "approvalState": {
+                    "description": "state of the latest approval, set by the service",
+                    "type": "string"
+                },
                 "approvals": {
                     "type": "array",
                     "items": {
@@ -588,12 +2570,27 @@ var doc = `{
                 "createTime": {
                     "type": "string"
                 },
+                "deletedTime": {
+                    "type": "string"
+                },
                 "id": {
                     "type": "string"
                 },
+                "messageToUser": {
+                    "type": "string"
+                },
                 "name": {
                     "type": "string"
                 },
+                "newPendingPlan": {
+                    "type": "string"
+                },
+                "plan": {
+                    "type": "string"
+                },
+                "product": {
+                    "type": "string"
+                },
                 "provider": {
                     "type": "string"
                 },
@@ -602,92 +2599,336 @@ var doc = `{
                 },
                 "updateTime": {
                     "type": "string"
+                },
+                "usageReportingId": {
+                    "type": "string"
+                },
+                "version": {
+                    "type": "integer"
                 }
             }
         },
-        "persistence.Approval": {
+        "persistence.Event": {
             "type": "object",
             "properties": {
-                "name": {
+                "attempts": {
+                    "type": "integer"
+                },
+                "entityId": {
                     "type": "string"
                 },
-                "reason": {
+                "error": {
                     "type": "string"
                 },
-                "state": {
+                "eventType": {
                     "type": "string"
                 },
-                "updateTime": {
+                "id": {
+                    "type": "string"
+                },
+                "outcome": {
+                    "type": "string"
+                },
+                "processedTime": {
                     "type": "string"
                 }
             }
         },
-        "persistence.Contact": {
+        "persistence.HistoryEntry": {
             "type": "object",
             "properties": {
-                "accountId": {
+                "changeTime": {
                     "type": "string"
                 },
-                "company": {
+                "changes": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/persistence.Change"
+                    }
+                },
+                "entityId": {
                     "type": "string"
                 },
-                "emailAddress": {
+                "entityKind": {
                     "type": "string"
                 },
-                "firstName": {
+                "id": {
                     "type": "string"
                 },
-                "lastName": {
+                "source": {
                     "type": "string"
                 },
-                "phone": {
+                "version": {
+                    "type": "integer"
+                }
+            }
+        },
+        "persistence.PendingApproval": {
+            "type": "object",
+            "properties": {
+                "account": {
                     "type": "string"
                 },
-                "timezone": {
+                "createTime": {
+                    "type": "string"
+                },
+                "eventId": {
+                    "type": "string"
+                },
+                "id": {
+                    "type": "string"
+                },
+                "pendingPlan": {
+                    "type": "string"
+                },
+                "plan": {
+                    "type": "string"
+                },
+                "product": {
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "request": {
                     "type": "string"
                 }
             }
         },
-        "persistence.Entitlement": {
+        "persistence.UsageMetric": {
             "type": "object",
             "properties": {
-                "account": {
+                "metric": {
                     "type": "string"
                 },
+                "quantity": {
+                    "type": "integer"
+                }
+            }
+        },
+        "persistence.UsageRecord": {
+            "type": "object",
+            "properties": {
                 "createTime": {
                     "type": "string"
                 },
+                "endTime": {
+                    "type": "string"
+                },
+                "entitlementId": {
+                    "type": "string"
+                },
                 "id": {
                     "type": "string"
                 },
-                "messageToUser": {
+                "metric": {
                     "type": "string"
                 },
-                "name": {
+                "quantity": {
+                    "type": "integer"
+                },
+                "reportId": {
                     "type": "string"
                 },
-                "newPendingPlan": {
+                "startTime": {
                     "type": "string"
+                }
+            }
+        },
+        "persistence.UsageReport": {
+            "type": "object",
+            "properties": {
+                "attempts": {
+                    "type": "integer"
                 },
-                "plan": {
+                "createTime": {
                     "type": "string"
                 },
-                "product": {
+                "endTime": {
                     "type": "string"
                 },
-                "provider": {
+                "entitlementId": {
                     "type": "string"
                 },
-                "state": {
+                "error": {
                     "type": "string"
                 },
-                "updateTime": {
+                "id": {
+                    "type": "string"
+                },
+                "metrics": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/persistence.UsageMetric"
+                    }
+                },
+                "recordIds": {
+                    "type": "array",
+                    "items": {
+                        "type": "string"
+                    }
+                },
+                "sentTime": {
+                    "type": "string"
+                },
+                "serviceName": {
+                    "type": "string"
+                },
+                "startTime": {
+                    "type": "string"
+                },
+                "state": {
                     "type": "string"
                 },
                 "usageReportingId": {
                     "type": "string"
                 }
             }
+        },
+        "web.AccountsPage": {
+            "type": "object",
+            "properties": {
+                "accounts": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/persistence.Account"
+                    }
+                },
+                "nextPageToken": {
+                    "type": "string"
+                }
+            }
+        },
+        "web.ApprovalDecision": {
+            "type": "object",
+            "properties": {
+                "approver": {
+                    "type": "string"
+                },
+                "reason": {
+                    "type": "string"
+                }
+            }
+        },
+        "web.ContactsPage": {
+            "type": "object",
+            "properties": {
+                "contacts": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/persistence.Contact"
+                    }
+                },
+                "nextPageToken": {
+                    "type": "string"
+                }
+            }
+        },
+        "web.DeadLettersPage": {
+            "type": "object",
+            "properties": {
+                "deadLetters": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/persistence.DeadLetter"
+                    }
+                },
+                "nextPageToken": {
+                    "type": "string"
+                }
+            }
+        },
+        "web.EntitlementsPage": {
+            "type": "object",
+            "properties": {
+                "entitlements": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/persistence.Entitlement"
+                    }
+                },
+                "nextPageToken": {
+                    "type": "string"
+                }
+            }
+        },
+        "web.ErrorResponse": {
+            "type": "object",
+            "properties": {
+                "error": {
+                    "type": "string"
+                }
+            }
+        },
+        "web.EventsPage": {
+            "type": "object",
+            "properties": {
+                "events": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/persistence.Event"
+                    }
+                },
+                "nextPageToken": {
+                    "type": "string"
+                }
+            }
+        },
+        "web.HistoryPage": {
+            "type": "object",
+            "properties": {
+                "history": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/persistence.HistoryEntry"
+                    }
+                },
+                "nextPageToken": {
+                    "type": "string"
+                }
+            }
+        },
+        "web.PendingApprovalsPage": {
+            "type": "object",
+            "properties": {
+                "nextPageToken": {
+                    "type": "string"
+                },
+                "pendingApprovals": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/persistence.PendingApproval"
+                    }
+                }
+            }
+        },
+        "web.UsageRecordsPage": {
+            "type": "object",
+            "properties": {
+                "nextPageToken": {
+                    "type": "string"
+                },
+                "usageRecords": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/persistence.UsageRecord"
+                    }
+                }
+            }
+        },
+        "web.UsageReportsPage": {
+            "type": "object",
+            "properties": {
+                "nextPageToken": {
+                    "type": "string"
+                },
+                "usageReports": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/persistence.UsageReport"
+                    }
+                }
+            }
         }
     }
 }`
@@ -702,23 +2943,13 @@ type swaggerInfo struct {
 }
 
 // SwaggerInfo holds exported Swagger Info so clients can modify it
-var SwaggerInfo = swaggerInfo{
-	Version:     "",
-	Host:        "localhost:8085",
-	BasePath:    "/api/v1",
-	Schemes:     []string{},
-	Title:       "",
-	Description: "",
-}
+var SwaggerInfo = swaggerInfo{ Schemes: []string{}}
 
 type s struct{}
 
 func (s *s) ReadDoc() string {
-	sInfo := SwaggerInfo
-	sInfo.Description = strings.Replace(sInfo.Description, "\n", "\\n", -1)
-
 	t, err := template.New("swagger_info").Funcs(template.FuncMap{
-		"marshal": func(v interface{}) string {
+		"marshal": func(v interface {}) string {
 			a, _ := json.Marshal(v)
 			return string(a)
 		},
@@ -728,7 +2959,7 @@ func (s *s) ReadDoc() string {
 	}
 
 	var tpl bytes.Buffer
-	if err := t.Execute(&tpl, sInfo); err != nil {
+	if err := t.Execute(&tpl, SwaggerInfo); err != nil {
 		return doc
 	}
 
@@ -3,15 +3,20 @@ module github.com/cloudbees/cloud-bill-saas/subscription-service
 go 1.12
 
 require (
+	github.com/cloudbees/cloud-bill-saas/common v0.0.0
 	cloud.google.com/go/datastore v1.0.0
 	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751
 	github.com/getsentry/sentry-go v0.3.0
 	github.com/go-chi/chi v4.0.2+incompatible // indirect
 	github.com/gorilla/mux v1.7.2
 	github.com/jefferyfry/funclog v0.0.0-20191010235000-f6a0246169e0
+	github.com/lib/pq v1.2.0
 	github.com/swaggo/files v0.0.0-20190704085106-630677cd5c14 // indirect
 	github.com/swaggo/http-swagger v0.0.0-20190614090009-c2865af9083e
 	github.com/swaggo/swag v1.6.2
+	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
 	google.golang.org/api v0.8.0
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 )
+
+replace github.com/cloudbees/cloud-bill-saas/common => ../common
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"context"
+	"github.com/cloudbees/cloud-bill-saas/common/procurement"
 	"github.com/cloudbees/cloud-bill-saas/subscription-service/config"
 	"github.com/cloudbees/cloud-bill-saas/subscription-service/dbinterface"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/metering"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/purge"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/servicecontrol"
 	"github.com/cloudbees/cloud-bill-saas/subscription-service/web"
 	"github.com/getsentry/sentry-go"
 	"github.com/jefferyfry/funclog"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
@@ -42,8 +50,59 @@ func main() {
 		sentry.Flush(time.Second * 5)
 	}
 
-	datastoreClient := dbinterface.NewPersistenceLayer(dbinterface.DATASTOREDB,config.GcpProjectId)
+	connection := config.GcpProjectId
+	if dbinterface.DBTYPE(config.DatabaseType) == dbinterface.POSTGRESDB {
+		connection = config.DatabaseUrl
+	}
+
+	dbHandler, err := dbinterface.NewPersistenceLayer(dbinterface.DBTYPE(config.DatabaseType),connection)
+
+	if err != nil {
+		LogE.Fatalf("Unable to create the persistence layer: %v", err)
+	}
+
+	requestTimeout, _ := time.ParseDuration(config.RequestTimeout)
+	shutdownTimeout, _ := time.ParseDuration(config.ShutdownTimeout)
+	ctx := shutdownContext()
+
+	//purge soft deleted accounts and entitlements after the retention period
+	if deletedRetention, _ := time.ParseDuration(config.DeletedRetention); deletedRetention > 0 {
+		go purge.Run(ctx, dbHandler, deletedRetention, time.Hour, requestTimeout)
+	}
+
+	//aggregate usage records and report them to Service Control
+	if usageReportInterval, _ := time.ParseDuration(config.UsageReportInterval); usageReportInterval > 0 {
+		serviceControlClient := servicecontrol.NewClient(config.ServiceControlUrl)
+		go metering.Run(ctx, dbHandler, serviceControlClient, config.UsageServiceDomain, usageReportInterval, requestTimeout)
+	}
+
+	//pending approvals are approved and rejected with the procurement API
+	var procurementClient procurement.Client
+	if config.PartnerId != "" {
+		procurementClient = procurement.NewClient(config.CloudCommerceProcurementUrl, "", config.PartnerId)
+	}
 
 	//start web service
-	LogE.Fatal(web.SetUpService(datastoreClient,config.SubscriptionServiceEndpoint,config.HealthCheckEndpoint))
+	err = web.SetUpService(ctx,dbHandler,procurementClient,config.SubscriptionServiceEndpoint,config.HealthCheckEndpoint,requestTimeout,shutdownTimeout)
+	if closeErr := dbHandler.Close(); closeErr != nil {
+		LogE.Printf("Error closing the persistence layer: %v", closeErr)
+	}
+	if err != nil {
+		LogE.Fatal(err)
+	}
+	LogI.Println("Cloud Bill SaaS Subscription Service stopped.")
+}
+
+//shutdownContext returns a context that is cancelled when the service receives SIGTERM, as on a Kubernetes rollout, or
+//an interrupt.
+func shutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		LogI.Printf("Received %s, shutting down... \n", sig)
+		cancel()
+	}()
+	return ctx
 }
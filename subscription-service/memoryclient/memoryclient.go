@@ -0,0 +1,673 @@
+package memoryclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/persistence"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//MemoryClient is a thread-safe, in-memory persistence layer. It is intended for local runs and tests
+//and mimics the filter and order semantics of the datastore client.
+type MemoryClient struct {
+	mutex        sync.RWMutex
+	accounts     map[string]persistence.Account
+	contacts     map[string]persistence.Contact
+	entitlements map[string]persistence.Entitlement
+	history      map[string]persistence.HistoryEntry
+	events       map[string]persistence.Event
+	deadLetters  map[string]persistence.DeadLetter
+	approvals    map[string]persistence.PendingApproval
+	usageRecords map[string]persistence.UsageRecord
+	usageReports map[string]persistence.UsageReport
+}
+
+func NewMemory() persistence.DatabaseHandler {
+	return &MemoryClient{
+		accounts:     make(map[string]persistence.Account),
+		contacts:     make(map[string]persistence.Contact),
+		entitlements: make(map[string]persistence.Entitlement),
+		history:      make(map[string]persistence.HistoryEntry),
+		events:       make(map[string]persistence.Event),
+		deadLetters:  make(map[string]persistence.DeadLetter),
+		approvals:    make(map[string]persistence.PendingApproval),
+		usageRecords: make(map[string]persistence.UsageRecord),
+		usageReports: make(map[string]persistence.UsageReport),
+	}
+}
+
+func (memoryClient *MemoryClient) UpsertAccount(ctx context.Context, account *persistence.Account, ifVersion int64) error {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	current, exists := memoryClient.accounts[account.Id]
+	if err := persistence.CheckVersion(exists, current.Version, ifVersion); err != nil {
+		return err
+	}
+	account.Version = current.Version + 1
+	account.DeletedTime = current.DeletedTime
+	memoryClient.accounts[account.Id] = copyAccount(*account)
+	if entry := persistence.NewHistoryEntry(ctx, &current, account, account.Version); entry != nil {
+		memoryClient.history[entry.Id] = *entry
+	}
+	return nil
+}
+
+func (memoryClient *MemoryClient) DeleteAccount(ctx context.Context, accountId string) error {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	if current, ok := memoryClient.accounts[accountId]; ok && current.DeletedTime == "" {
+		memoryClient.setAccountDeletedTime(ctx, current, persistence.FormatDeletedTime(time.Now()))
+	}
+	return nil
+}
+
+func (memoryClient *MemoryClient) DeleteAccountCascade(ctx context.Context, accountId string) (*persistence.AccountDeletion, error) {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	deletion := persistence.AccountDeletion{AccountId: accountId, Entitlements: []string{}}
+	deletedTime := persistence.FormatDeletedTime(time.Now())
+	if current, ok := memoryClient.accounts[accountId]; ok && current.DeletedTime == "" {
+		memoryClient.setAccountDeletedTime(ctx, current, deletedTime)
+		deletion.Account = true
+	}
+	if _, ok := memoryClient.contacts[accountId]; ok {
+		delete(memoryClient.contacts, accountId)
+		deletion.Contact = true
+	}
+	for _, current := range memoryClient.entitlements {
+		if current.Account == accountId && current.DeletedTime == "" {
+			memoryClient.setEntitlementDeletedTime(ctx, current, deletedTime)
+			deletion.Entitlements = append(deletion.Entitlements, current.Id)
+		}
+	}
+	sort.Strings(deletion.Entitlements)
+	return &deletion, nil
+}
+
+func (memoryClient *MemoryClient) RestoreAccount(ctx context.Context, accountId string) error {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	current, ok := memoryClient.accounts[accountId]
+	if !ok {
+		return persistence.ErrNotFound
+	}
+	if current.DeletedTime != "" {
+		memoryClient.setAccountDeletedTime(ctx, current, "")
+	}
+	return nil
+}
+
+//setAccountDeletedTime soft deletes or restores an account. The caller must hold the write lock.
+func (memoryClient *MemoryClient) setAccountDeletedTime(ctx context.Context, current persistence.Account, deletedTime string) {
+	account := copyAccount(current)
+	account.DeletedTime = deletedTime
+	account.Version++
+	memoryClient.accounts[account.Id] = account
+	if entry := persistence.NewHistoryEntry(ctx, &current, &account, account.Version); entry != nil {
+		memoryClient.history[entry.Id] = *entry
+	}
+}
+
+func (memoryClient *MemoryClient) GetAccount(ctx context.Context, accountId string) (*persistence.Account, error) {
+	memoryClient.mutex.RLock()
+	defer memoryClient.mutex.RUnlock()
+
+	if account, ok := memoryClient.accounts[accountId]; ok {
+		account = copyAccount(account)
+		return &account, nil
+	}
+	return nil, persistence.ErrNotFound
+}
+
+func (memoryClient *MemoryClient) UpsertContact(ctx context.Context, contact *persistence.Contact, ifVersion int64) error {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	current, exists := memoryClient.contacts[contact.AccountId]
+	if err := persistence.CheckVersion(exists, current.Version, ifVersion); err != nil {
+		return err
+	}
+	contact.Version = current.Version + 1
+	memoryClient.contacts[contact.AccountId] = *contact
+	return nil
+}
+
+func (memoryClient *MemoryClient) DeleteContact(ctx context.Context, accountId string) error {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	delete(memoryClient.contacts, accountId)
+	return nil
+}
+
+func (memoryClient *MemoryClient) GetContact(ctx context.Context, accountId string) (*persistence.Contact, error) {
+	memoryClient.mutex.RLock()
+	defer memoryClient.mutex.RUnlock()
+
+	if contact, ok := memoryClient.contacts[accountId]; ok {
+		return &contact, nil
+	}
+	return nil, persistence.ErrNotFound
+}
+
+func (memoryClient *MemoryClient) UpsertEvent(ctx context.Context, event *persistence.Event) error {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	memoryClient.events[event.Id] = *event
+	return nil
+}
+
+func (memoryClient *MemoryClient) GetEvent(ctx context.Context, eventId string) (*persistence.Event, error) {
+	memoryClient.mutex.RLock()
+	defer memoryClient.mutex.RUnlock()
+
+	if event, ok := memoryClient.events[eventId]; ok {
+		return &event, nil
+	}
+	return nil, persistence.ErrNotFound
+}
+
+func (memoryClient *MemoryClient) UpsertDeadLetter(ctx context.Context, deadLetter *persistence.DeadLetter) error {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	memoryClient.deadLetters[deadLetter.Id] = *deadLetter
+	return nil
+}
+
+func (memoryClient *MemoryClient) DeleteDeadLetter(ctx context.Context, deadLetterId string) error {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	delete(memoryClient.deadLetters, deadLetterId)
+	return nil
+}
+
+func (memoryClient *MemoryClient) GetDeadLetter(ctx context.Context, deadLetterId string) (*persistence.DeadLetter, error) {
+	memoryClient.mutex.RLock()
+	defer memoryClient.mutex.RUnlock()
+
+	if deadLetter, ok := memoryClient.deadLetters[deadLetterId]; ok {
+		return &deadLetter, nil
+	}
+	return nil, persistence.ErrNotFound
+}
+
+func (memoryClient *MemoryClient) UpsertPendingApproval(ctx context.Context, approval *persistence.PendingApproval) error {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	memoryClient.approvals[approval.Id] = *approval
+	return nil
+}
+
+func (memoryClient *MemoryClient) DeletePendingApproval(ctx context.Context, entitlementId string) error {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	delete(memoryClient.approvals, entitlementId)
+	return nil
+}
+
+func (memoryClient *MemoryClient) GetPendingApproval(ctx context.Context, entitlementId string) (*persistence.PendingApproval, error) {
+	memoryClient.mutex.RLock()
+	defer memoryClient.mutex.RUnlock()
+
+	if approval, ok := memoryClient.approvals[entitlementId]; ok {
+		return &approval, nil
+	}
+	return nil, persistence.ErrNotFound
+}
+
+func (memoryClient *MemoryClient) CreateUsageRecord(ctx context.Context, record *persistence.UsageRecord) error {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	if _, exists := memoryClient.usageRecords[record.Id]; exists {
+		return persistence.ErrConflict
+	}
+	memoryClient.usageRecords[record.Id] = *record
+	return nil
+}
+
+func (memoryClient *MemoryClient) GetUsageRecord(ctx context.Context, recordId string) (*persistence.UsageRecord, error) {
+	memoryClient.mutex.RLock()
+	defer memoryClient.mutex.RUnlock()
+
+	if record, ok := memoryClient.usageRecords[recordId]; ok {
+		return &record, nil
+	}
+	return nil, persistence.ErrNotFound
+}
+
+func (memoryClient *MemoryClient) CreateUsageReport(ctx context.Context, report *persistence.UsageReport) error {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	if _, exists := memoryClient.usageReports[report.Id]; exists {
+		return persistence.ErrConflict
+	}
+	for _, recordId := range report.RecordIds {
+		if record, ok := memoryClient.usageRecords[recordId]; !ok || record.ReportId != "" {
+			return persistence.ErrConflict
+		}
+	}
+	for _, recordId := range report.RecordIds {
+		record := memoryClient.usageRecords[recordId]
+		record.ReportId = report.Id
+		memoryClient.usageRecords[recordId] = record
+	}
+	memoryClient.usageReports[report.Id] = copyUsageReport(*report)
+	return nil
+}
+
+func (memoryClient *MemoryClient) UpsertUsageReport(ctx context.Context, report *persistence.UsageReport) error {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	memoryClient.usageReports[report.Id] = copyUsageReport(*report)
+	return nil
+}
+
+func (memoryClient *MemoryClient) GetUsageReport(ctx context.Context, reportId string) (*persistence.UsageReport, error) {
+	memoryClient.mutex.RLock()
+	defer memoryClient.mutex.RUnlock()
+
+	if report, ok := memoryClient.usageReports[reportId]; ok {
+		report = copyUsageReport(report)
+		return &report, nil
+	}
+	return nil, persistence.ErrNotFound
+}
+
+func (memoryClient *MemoryClient) UpsertEntitlement(ctx context.Context, entitlement *persistence.Entitlement, ifVersion int64) error {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	current, exists := memoryClient.entitlements[entitlement.Id]
+	if err := persistence.CheckVersion(exists, current.Version, ifVersion); err != nil {
+		return err
+	}
+	entitlement.Version = current.Version + 1
+	entitlement.DeletedTime = current.DeletedTime
+	persistence.KeepApprovals(&current, entitlement)
+	memoryClient.entitlements[entitlement.Id] = copyEntitlement(*entitlement)
+	if entry := persistence.NewHistoryEntry(ctx, &current, entitlement, entitlement.Version); entry != nil {
+		memoryClient.history[entry.Id] = *entry
+	}
+	return nil
+}
+
+func (memoryClient *MemoryClient) DeleteEntitlement(ctx context.Context, entitlementId string) error {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	if current, ok := memoryClient.entitlements[entitlementId]; ok && current.DeletedTime == "" {
+		memoryClient.setEntitlementDeletedTime(ctx, current, persistence.FormatDeletedTime(time.Now()))
+	}
+	return nil
+}
+
+func (memoryClient *MemoryClient) RestoreEntitlement(ctx context.Context, entitlementId string) error {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	current, ok := memoryClient.entitlements[entitlementId]
+	if !ok {
+		return persistence.ErrNotFound
+	}
+	if current.DeletedTime != "" {
+		memoryClient.setEntitlementDeletedTime(ctx, current, "")
+	}
+	return nil
+}
+
+//setEntitlementDeletedTime soft deletes or restores an entitlement. The caller must hold the write lock.
+func (memoryClient *MemoryClient) setEntitlementDeletedTime(ctx context.Context, current persistence.Entitlement, deletedTime string) {
+	entitlement := copyEntitlement(current)
+	entitlement.DeletedTime = deletedTime
+	entitlement.Version++
+	memoryClient.entitlements[entitlement.Id] = entitlement
+	if entry := persistence.NewHistoryEntry(ctx, &current, &entitlement, entitlement.Version); entry != nil {
+		memoryClient.history[entry.Id] = *entry
+	}
+}
+
+func (memoryClient *MemoryClient) GetEntitlement(ctx context.Context, entitlementId string) (*persistence.Entitlement, error) {
+	memoryClient.mutex.RLock()
+	defer memoryClient.mutex.RUnlock()
+
+	if entitlement, ok := memoryClient.entitlements[entitlementId]; ok {
+		entitlement = copyEntitlement(entitlement)
+		return &entitlement, nil
+	}
+	return nil, persistence.ErrNotFound
+}
+
+func (memoryClient *MemoryClient) QueryEntitlements(ctx context.Context, query persistence.Query) ([]persistence.Entitlement, string, error) {
+	memoryClient.mutex.RLock()
+	entitlements := make([]persistence.Entitlement, 0, len(memoryClient.entitlements))
+	for _, entitlement := range memoryClient.entitlements {
+		entitlements = append(entitlements, copyEntitlement(entitlement))
+	}
+	memoryClient.mutex.RUnlock()
+
+	nextCursor, err := applyQuery(&entitlements, query)
+	if err != nil || len(entitlements) == 0 {
+		return nil, "", err
+	}
+	return entitlements, nextCursor, nil
+}
+
+func (memoryClient *MemoryClient) QueryAccountEntitlements(ctx context.Context, accountId string, query persistence.Query) ([]persistence.Entitlement, string, error) {
+	if accountId == "" {
+		return nil, "", errors.New("Must specify account name.")
+	}
+	query.Filters = append([]persistence.Filter{{Property: "account", Operator: "=", Value: accountId}}, query.Filters...)
+	return memoryClient.QueryEntitlements(ctx, query)
+}
+
+func (memoryClient *MemoryClient) QueryAccounts(ctx context.Context, query persistence.Query) ([]persistence.Account, string, error) {
+	memoryClient.mutex.RLock()
+	accounts := make([]persistence.Account, 0, len(memoryClient.accounts))
+	for _, account := range memoryClient.accounts {
+		accounts = append(accounts, copyAccount(account))
+	}
+	memoryClient.mutex.RUnlock()
+
+	nextCursor, err := applyQuery(&accounts, query)
+	if err != nil || len(accounts) == 0 {
+		return nil, "", err
+	}
+	return accounts, nextCursor, nil
+}
+
+func (memoryClient *MemoryClient) QueryContacts(ctx context.Context, query persistence.Query) ([]persistence.Contact, string, error) {
+	memoryClient.mutex.RLock()
+	contacts := make([]persistence.Contact, 0, len(memoryClient.contacts))
+	for _, contact := range memoryClient.contacts {
+		contacts = append(contacts, contact)
+	}
+	memoryClient.mutex.RUnlock()
+
+	nextCursor, err := applyQuery(&contacts, query)
+	if err != nil || len(contacts) == 0 {
+		return nil, "", err
+	}
+	return contacts, nextCursor, nil
+}
+
+func (memoryClient *MemoryClient) QueryEvents(ctx context.Context, query persistence.Query) ([]persistence.Event, string, error) {
+	memoryClient.mutex.RLock()
+	events := make([]persistence.Event, 0, len(memoryClient.events))
+	for _, event := range memoryClient.events {
+		events = append(events, event)
+	}
+	memoryClient.mutex.RUnlock()
+
+	nextCursor, err := applyQuery(&events, query)
+	if err != nil || len(events) == 0 {
+		return nil, "", err
+	}
+	return events, nextCursor, nil
+}
+
+func (memoryClient *MemoryClient) QueryDeadLetters(ctx context.Context, query persistence.Query) ([]persistence.DeadLetter, string, error) {
+	memoryClient.mutex.RLock()
+	deadLetters := make([]persistence.DeadLetter, 0, len(memoryClient.deadLetters))
+	for _, deadLetter := range memoryClient.deadLetters {
+		deadLetters = append(deadLetters, deadLetter)
+	}
+	memoryClient.mutex.RUnlock()
+
+	nextCursor, err := applyQuery(&deadLetters, query)
+	if err != nil || len(deadLetters) == 0 {
+		return nil, "", err
+	}
+	return deadLetters, nextCursor, nil
+}
+
+func (memoryClient *MemoryClient) QueryPendingApprovals(ctx context.Context, query persistence.Query) ([]persistence.PendingApproval, string, error) {
+	memoryClient.mutex.RLock()
+	approvals := make([]persistence.PendingApproval, 0, len(memoryClient.approvals))
+	for _, approval := range memoryClient.approvals {
+		approvals = append(approvals, approval)
+	}
+	memoryClient.mutex.RUnlock()
+
+	nextCursor, err := applyQuery(&approvals, query)
+	if err != nil || len(approvals) == 0 {
+		return nil, "", err
+	}
+	return approvals, nextCursor, nil
+}
+
+func (memoryClient *MemoryClient) QueryUsageRecords(ctx context.Context, query persistence.Query) ([]persistence.UsageRecord, string, error) {
+	memoryClient.mutex.RLock()
+	records := make([]persistence.UsageRecord, 0, len(memoryClient.usageRecords))
+	for _, record := range memoryClient.usageRecords {
+		records = append(records, record)
+	}
+	memoryClient.mutex.RUnlock()
+
+	nextCursor, err := applyQuery(&records, query)
+	if err != nil || len(records) == 0 {
+		return nil, "", err
+	}
+	return records, nextCursor, nil
+}
+
+func (memoryClient *MemoryClient) QueryUsageReports(ctx context.Context, query persistence.Query) ([]persistence.UsageReport, string, error) {
+	memoryClient.mutex.RLock()
+	reports := make([]persistence.UsageReport, 0, len(memoryClient.usageReports))
+	for _, report := range memoryClient.usageReports {
+		reports = append(reports, copyUsageReport(report))
+	}
+	memoryClient.mutex.RUnlock()
+
+	nextCursor, err := applyQuery(&reports, query)
+	if err != nil || len(reports) == 0 {
+		return nil, "", err
+	}
+	return reports, nextCursor, nil
+}
+
+func (memoryClient *MemoryClient) QueryHistory(ctx context.Context, entityKind string, entityId string, query persistence.Query) ([]persistence.HistoryEntry, string, error) {
+	memoryClient.mutex.RLock()
+	var history []persistence.HistoryEntry
+	for _, entry := range memoryClient.history {
+		if entry.EntityKind == entityKind && entry.EntityId == entityId {
+			history = append(history, entry)
+		}
+	}
+	memoryClient.mutex.RUnlock()
+
+	nextCursor, err := applyQuery(&history, query)
+	if err != nil || len(history) == 0 {
+		return nil, "", err
+	}
+	return history, nextCursor, nil
+}
+
+func (memoryClient *MemoryClient) PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error) {
+	memoryClient.mutex.Lock()
+	defer memoryClient.mutex.Unlock()
+
+	before := persistence.FormatDeletedTime(deletedBefore)
+	purged := 0
+	for id, account := range memoryClient.accounts {
+		if account.DeletedTime != "" && account.DeletedTime < before {
+			delete(memoryClient.accounts, id)
+			delete(memoryClient.contacts, id)
+			purged++
+		}
+	}
+	for id, entitlement := range memoryClient.entitlements {
+		if entitlement.DeletedTime != "" && entitlement.DeletedTime < before {
+			delete(memoryClient.entitlements, id)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (memoryClient *MemoryClient) Healthz(ctx context.Context) error {
+	return nil
+}
+
+func (memoryClient *MemoryClient) Close() error {
+	return nil
+}
+
+func copyAccount(account persistence.Account) persistence.Account {
+	if account.Approvals != nil {
+		approvals := make([]persistence.Approval, len(account.Approvals))
+		copy(approvals, account.Approvals)
+		account.Approvals = approvals
+	}
+	return account
+}
+
+func copyEntitlement(entitlement persistence.Entitlement) persistence.Entitlement {
+	if entitlement.Approvals != nil {
+		approvals := make([]persistence.Approval, len(entitlement.Approvals))
+		copy(approvals, entitlement.Approvals)
+		entitlement.Approvals = approvals
+	}
+	return entitlement
+}
+
+func copyUsageReport(report persistence.UsageReport) persistence.UsageReport {
+	report.Metrics = append([]persistence.UsageMetric(nil), report.Metrics...)
+	report.RecordIds = append([]string(nil), report.RecordIds...)
+	return report
+}
+
+//applyQuery filters, orders and pages a slice of entities in place and returns the cursor for the next page. Like
+//datastore, entities are returned in key order by default and entities that omit a filtered or ordered property are
+//excluded. Soft-deleted entities are excluded unless the query includes them.
+func applyQuery(entitiesPtr interface{}, query persistence.Query) (string, error) {
+	entities := reflect.ValueOf(entitiesPtr).Elem()
+	order := query.Order
+
+	orderProperty := strings.TrimPrefix(order, "-")
+	descending := strings.HasPrefix(order, "-")
+
+	matched := reflect.MakeSlice(entities.Type(), 0, entities.Len())
+	for i := 0; i < entities.Len(); i++ {
+		entity := entities.Index(i)
+		include := true
+		for _, filter := range query.Filters {
+			if propertyValue, present, err := getProperty(entity, filter.Property); err != nil {
+				return "", err
+			} else if !present || !filter.Match(propertyValue) {
+				include = false
+				break
+			}
+		}
+		if include && !query.IncludeDeleted && persistence.IsDeleted(entity.Interface()) {
+			include = false
+		}
+		if include && orderProperty != "" {
+			if _, present, err := getProperty(entity, orderProperty); err != nil {
+				return "", err
+			} else if !present {
+				include = false
+			}
+		}
+		if include {
+			matched = reflect.Append(matched, entity)
+		}
+	}
+
+	keyProperty := keyPropertyName(entities.Type().Elem())
+	sort.SliceStable(matched.Interface(), func(i, j int) bool {
+		iKey, _, _ := getProperty(matched.Index(i), keyProperty)
+		jKey, _, _ := getProperty(matched.Index(j), keyProperty)
+		return iKey < jKey
+	})
+	if orderProperty != "" {
+		sort.SliceStable(matched.Interface(), func(i, j int) bool {
+			iValue, _, _ := getProperty(matched.Index(i), orderProperty)
+			jValue, _, _ := getProperty(matched.Index(j), orderProperty)
+			if descending {
+				return iValue > jValue
+			}
+			return iValue < jValue
+		})
+	}
+
+	start := 0
+	if query.Cursor != "" {
+		cursorValue, cursorKey, err := persistence.DecodeCursor(query.Cursor)
+		if err != nil {
+			return "", err
+		}
+		//skip past the last entity of the previous page
+		for ; start < matched.Len(); start++ {
+			key, _, _ := getProperty(matched.Index(start), keyProperty)
+			if orderProperty == "" {
+				if key > cursorKey {
+					break
+				}
+				continue
+			}
+			value, _, _ := getProperty(matched.Index(start), orderProperty)
+			if value == cursorValue && key > cursorKey ||
+				!descending && value > cursorValue || descending && value < cursorValue {
+				break
+			}
+		}
+	}
+	end := matched.Len()
+	nextCursor := ""
+	if query.Limit > 0 && end-start > query.Limit {
+		end = start + query.Limit
+		last := matched.Index(end - 1)
+		lastKey, _, _ := getProperty(last, keyProperty)
+		lastValue := ""
+		if orderProperty != "" {
+			lastValue, _, _ = getProperty(last, orderProperty)
+		}
+		nextCursor = persistence.EncodeCursor(lastValue, lastKey)
+	}
+
+	entities.Set(matched.Slice(start, end))
+	return nextCursor, nil
+}
+
+//getProperty returns the string value of the struct field with the given datastore property name and whether the
+//property would be present in datastore (omitempty properties with zero values are not stored).
+func getProperty(entity reflect.Value, property string) (string, bool, error) {
+	entityType := entity.Type()
+	for i := 0; i < entityType.NumField(); i++ {
+		tag := strings.Split(entityType.Field(i).Tag.Get("datastore"), ",")
+		if tag[0] != property {
+			continue
+		}
+		field := entity.Field(i)
+		if field.Kind() != reflect.String {
+			return "", false, fmt.Errorf("property %s of %s does not support filtering or ordering", property, entityType.Name())
+		}
+		omitEmpty := len(tag) > 1 && tag[1] == "omitempty"
+		return field.String(), !omitEmpty || field.String() != "", nil
+	}
+	return "", false, fmt.Errorf("unknown property %s for %s", property, entityType.Name())
+}
+
+func keyPropertyName(entityType reflect.Type) string {
+	if entityType == reflect.TypeOf(persistence.Contact{}) {
+		return "accountId"
+	}
+	return "id"
+}
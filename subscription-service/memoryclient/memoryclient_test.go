@@ -0,0 +1,55 @@
+package memoryclient
+
+import (
+	"context"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/persistence"
+	"reflect"
+	"testing"
+)
+
+func TestEntitlementApprovalsAreCopied(t *testing.T) {
+	ctx := context.Background()
+	db := NewMemory()
+	entitlement := &persistence.Entitlement{
+		Id:        "E-1",
+		Approvals: make([]persistence.Approval, 1, 4),
+	}
+	entitlement.Approvals[0] = persistence.Approval{Name: "ENTITLEMENT_CREATION", State: "PENDING"}
+	if err := db.UpsertEntitlement(ctx, entitlement, persistence.NoVersion); err != nil {
+		t.Fatal(err)
+	}
+	//the caller's slice has room to grow in place, which must not change the stored entitlement
+	entitlement.Approvals = append(entitlement.Approvals, persistence.Approval{Name: "PLAN_CHANGE", State: "PENDING"})
+	entitlement.Approvals[0].State = "CHANGED"
+
+	//two writers read the same version and append an approval, only the first one is stored
+	first, _ := db.GetEntitlement(ctx, "E-1")
+	second, _ := db.GetEntitlement(ctx, "E-1")
+	first.Approvals = append(first.Approvals, persistence.Approval{Name: "ENTITLEMENT_CREATION", State: "APPROVED"})
+	second.Approvals = append(second.Approvals, persistence.Approval{Name: "ENTITLEMENT_CREATION", State: "REJECTED"})
+	if err := db.UpsertEntitlement(ctx, first, first.Version); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.UpsertEntitlement(ctx, second, second.Version); err != persistence.ErrVersionMismatch {
+		t.Fatalf("second upsert error = %v, want %v", err, persistence.ErrVersionMismatch)
+	}
+
+	stored, _ := db.GetEntitlement(ctx, "E-1")
+	want := []persistence.Approval{
+		{Name: "ENTITLEMENT_CREATION", State: "PENDING"},
+		{Name: "ENTITLEMENT_CREATION", State: "APPROVED"},
+	}
+	if !reflect.DeepEqual(stored.Approvals, want) {
+		t.Errorf("stored approvals = %+v, want %+v", stored.Approvals, want)
+	}
+
+	//entitlements returned by queries do not share the stored approvals either
+	entitlements, _, err := db.QueryEntitlements(ctx, persistence.Query{})
+	if err != nil || len(entitlements) != 1 {
+		t.Fatalf("QueryEntitlements() = %v, %v, want 1 entitlement", entitlements, err)
+	}
+	entitlements[0].Approvals[0].State = "CHANGED"
+	if stored, _ := db.GetEntitlement(ctx, "E-1"); stored.Approvals[0].State != "PENDING" {
+		t.Errorf("changing a queried entitlement changed the stored approval to %s", stored.Approvals[0].State)
+	}
+}
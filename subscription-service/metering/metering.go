@@ -0,0 +1,282 @@
+package metering
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/persistence"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/servicecontrol"
+	"github.com/jefferyfry/funclog"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	LogI = funclog.NewInfoLogger("INFO: ")
+	LogE = funclog.NewErrorLogger("ERROR: ")
+)
+
+const (
+	//maxReportRecords is the most usage records in one report, so a report and its records fit in one datastore
+	//transaction.
+	maxReportRecords = 200
+	//pageSize is the number of records or reports read with each query.
+	pageSize = 1000
+
+	operationName = "cloud-bill-saas usage report"
+)
+
+type reporter struct {
+	dbHandler     persistence.DatabaseHandler
+	client        servicecontrol.Client
+	serviceDomain string
+	timeout       time.Duration
+}
+
+//Run reports usage to Service Control every interval. It first sends the reports that are still pending, then
+//aggregates the usage records that are not in a report yet into one report per entitlement and sends them. The service
+//of an entitlement is its product in serviceDomain. Each database call and report gets the same deadline as a request.
+//Run returns when ctx is done.
+func Run(ctx context.Context, dbHandler persistence.DatabaseHandler, client servicecontrol.Client, serviceDomain string, interval time.Duration, timeout time.Duration) {
+	LogI.Printf("Reporting usage to Service Control every %s \n", interval)
+	rep := &reporter{dbHandler, client, serviceDomain, timeout}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		rep.reportUsage(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (rep *reporter) reportUsage(ctx context.Context) {
+	pending, err := rep.pendingReports(ctx)
+	if err != nil {
+		LogE.Printf("Error getting pending usage reports: %#v \n", err)
+	}
+	for i := range pending {
+		if ctx.Err() != nil {
+			return
+		}
+		rep.send(ctx, &pending[i])
+	}
+
+	records, err := rep.unreportedRecords(ctx)
+	if err != nil {
+		LogE.Printf("Error getting unreported usage records: %#v \n", err)
+		return
+	}
+	entitlementRecords := map[string][]persistence.UsageRecord{}
+	var entitlementIds []string
+	for _, record := range records {
+		if _, ok := entitlementRecords[record.EntitlementId]; !ok {
+			entitlementIds = append(entitlementIds, record.EntitlementId)
+		}
+		entitlementRecords[record.EntitlementId] = append(entitlementRecords[record.EntitlementId], record)
+	}
+	sort.Strings(entitlementIds)
+	for _, entitlementId := range entitlementIds {
+		if ctx.Err() != nil {
+			return
+		}
+		rep.reportEntitlement(ctx, entitlementId, entitlementRecords[entitlementId])
+	}
+}
+
+//reportEntitlement creates and sends the reports for the unreported records of an entitlement. Records of an
+//entitlement that is not stored yet or has no usageReportingId are left for a later run.
+func (rep *reporter) reportEntitlement(ctx context.Context, entitlementId string, records []persistence.UsageRecord) {
+	dbCtx, cancel := context.WithTimeout(ctx, rep.timeout)
+	entitlement, err := rep.dbHandler.GetEntitlement(dbCtx, entitlementId)
+	cancel()
+	if err != nil {
+		LogE.Printf("Not reporting %d usage records of entitlement %s: %#v \n", len(records), entitlementId, err)
+		return
+	}
+	if entitlement.UsageReportingId == "" {
+		LogE.Printf("Not reporting %d usage records of entitlement %s: it has no usageReportingId \n", len(records), entitlementId)
+		return
+	}
+
+	for start := 0; start < len(records); start += maxReportRecords {
+		end := start + maxReportRecords
+		if end > len(records) {
+			end = len(records)
+		}
+		report, err := rep.newReport(entitlement, records[start:end])
+		if err != nil {
+			LogE.Printf("Error creating usage report for entitlement %s: %#v \n", entitlementId, err)
+			return
+		}
+		dbCtx, cancel := context.WithTimeout(ctx, rep.timeout)
+		err = rep.dbHandler.CreateUsageReport(dbCtx, report)
+		cancel()
+		if err == persistence.ErrConflict {
+			//another replica reported the records since they were read
+			LogI.Printf("Usage records of entitlement %s are already reported \n", entitlementId)
+			continue
+		} else if err != nil {
+			LogE.Printf("Error storing usage report for entitlement %s: %#v \n", entitlementId, err)
+			return
+		}
+		LogI.Printf("Aggregated %d usage records of entitlement %s into usage report %s \n", len(report.RecordIds), entitlementId, report.Id)
+		rep.send(ctx, report)
+	}
+}
+
+//newReport aggregates records into a pending report. The report covers the earliest start to the latest end time of
+//the records and has the total quantity of each metric.
+func (rep *reporter) newReport(entitlement *persistence.Entitlement, records []persistence.UsageRecord) (*persistence.UsageReport, error) {
+	reportId, err := newOperationId()
+	if err != nil {
+		return nil, err
+	}
+	report := &persistence.UsageReport{
+		Id:               reportId,
+		EntitlementId:    entitlement.Id,
+		UsageReportingId: entitlement.UsageReportingId,
+		ServiceName:      entitlement.Product + "." + rep.serviceDomain,
+		State:            persistence.UsageReportPending,
+		CreateTime:       persistence.FormatTimestamp(time.Now()),
+	}
+	var startTime, endTime time.Time
+	totals := map[string]int64{}
+	for i, record := range records {
+		recordStart, err := time.Parse(time.RFC3339Nano, record.StartTime)
+		if err != nil {
+			return nil, err
+		}
+		recordEnd, err := time.Parse(time.RFC3339Nano, record.EndTime)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 || recordStart.Before(startTime) {
+			startTime = recordStart
+		}
+		if i == 0 || recordEnd.After(endTime) {
+			endTime = recordEnd
+		}
+		if _, ok := totals[record.Metric]; !ok {
+			report.Metrics = append(report.Metrics, persistence.UsageMetric{Metric: record.Metric})
+		}
+		totals[record.Metric] += record.Quantity
+		report.RecordIds = append(report.RecordIds, record.Id)
+	}
+	sort.Slice(report.Metrics, func(i, j int) bool {
+		return report.Metrics[i].Metric < report.Metrics[j].Metric
+	})
+	for i := range report.Metrics {
+		report.Metrics[i].Quantity = totals[report.Metrics[i].Metric]
+	}
+	report.StartTime = persistence.FormatTimestamp(startTime)
+	report.EndTime = persistence.FormatTimestamp(endTime)
+	return report, nil
+}
+
+//send sends a report and records the outcome. A report that fails with a transient error stays pending and is sent
+//again with the same operation id on the next run, so Service Control drops it if an earlier attempt arrived.
+func (rep *reporter) send(ctx context.Context, report *persistence.UsageReport) {
+	operation := servicecontrol.Operation{
+		OperationId:   report.Id,
+		OperationName: operationName,
+		ConsumerId:    report.UsageReportingId,
+		StartTime:     report.StartTime,
+		EndTime:       report.EndTime,
+	}
+	for _, metric := range report.Metrics {
+		operation.MetricValueSets = append(operation.MetricValueSets, servicecontrol.MetricValueSet{
+			MetricName:   metricName(report.ServiceName, metric.Metric),
+			MetricValues: []servicecontrol.MetricValue{servicecontrol.Int64Value(metric.Quantity)},
+		})
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, rep.timeout)
+	err := rep.client.Report(sendCtx, report.ServiceName, []servicecontrol.Operation{operation})
+	cancel()
+	report.Attempts++
+	switch {
+	case err == nil:
+		report.State = persistence.UsageReportSent
+		report.SentTime = persistence.FormatTimestamp(time.Now())
+		report.Error = ""
+		LogI.Printf("Sent usage report %s of entitlement %s \n", report.Id, report.EntitlementId)
+	case servicecontrol.IsTransient(err):
+		report.Error = err.Error()
+		LogE.Printf("Usage report %s of entitlement %s failed on attempt %d and will be sent again: %v \n", report.Id, report.EntitlementId, report.Attempts, err)
+	default:
+		report.State = persistence.UsageReportFailed
+		report.Error = err.Error()
+		LogE.Printf("Usage report %s of entitlement %s was rejected: %v \n", report.Id, report.EntitlementId, err)
+	}
+
+	dbCtx, cancel := context.WithTimeout(ctx, rep.timeout)
+	defer cancel()
+	if err := rep.dbHandler.UpsertUsageReport(dbCtx, report); err != nil {
+		LogE.Printf("Error storing the outcome of usage report %s: %#v \n", report.Id, err)
+	}
+}
+
+func (rep *reporter) pendingReports(ctx context.Context) ([]persistence.UsageReport, error) {
+	query := persistence.Query{
+		Filters: []persistence.Filter{{Property: "state", Operator: "=", Value: persistence.UsageReportPending}},
+		Limit:   pageSize,
+	}
+	var reports []persistence.UsageReport
+	for {
+		dbCtx, cancel := context.WithTimeout(ctx, rep.timeout)
+		page, nextCursor, err := rep.dbHandler.QueryUsageReports(dbCtx, query)
+		cancel()
+		if err != nil {
+			return reports, err
+		}
+		reports = append(reports, page...)
+		if nextCursor == "" {
+			return reports, nil
+		}
+		query.Cursor = nextCursor
+	}
+}
+
+func (rep *reporter) unreportedRecords(ctx context.Context) ([]persistence.UsageRecord, error) {
+	query := persistence.Query{
+		Filters: []persistence.Filter{{Property: "reportId", Operator: "=", Value: ""}},
+		Limit:   pageSize,
+	}
+	var records []persistence.UsageRecord
+	for {
+		dbCtx, cancel := context.WithTimeout(ctx, rep.timeout)
+		page, nextCursor, err := rep.dbHandler.QueryUsageRecords(dbCtx, query)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, page...)
+		if nextCursor == "" {
+			return records, nil
+		}
+		query.Cursor = nextCursor
+	}
+}
+
+//metricName returns the Service Control name of a metric, which is qualified by the service name unless it already is.
+func metricName(serviceName string, metric string) string {
+	if strings.Contains(metric, "/") {
+		return metric
+	}
+	return serviceName + "/" + metric
+}
+
+//newOperationId returns a random UUID, the operation id format Service Control recommends.
+func newOperationId() (string, error) {
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return "", err
+	}
+	uuid[6] = uuid[6]&0x0f | 0x40
+	uuid[8] = uuid[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:]), nil
+}
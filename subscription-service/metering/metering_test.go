@@ -0,0 +1,226 @@
+package metering
+
+import (
+	"context"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/memoryclient"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/persistence"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/servicecontrol/fake"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testServiceDomain = "cloudbees.cloud.goog"
+
+//setUp returns a reporter that stores to a memory database and reports to a fake Service Control, with entitlement
+//E-1 of product-a and E-2 of product-b.
+func setUp(t *testing.T) (*reporter, persistence.DatabaseHandler, *fake.Server) {
+	db := memoryclient.NewMemory()
+	sc := fake.NewServer()
+	for _, entitlement := range []persistence.Entitlement{
+		{Id: "E-1", Product: "product-a", UsageReportingId: "project_number:1"},
+		{Id: "E-2", Product: "product-b", UsageReportingId: "project_number:2"},
+		{Id: "E-unbillable", Product: "product-a"},
+	} {
+		entitlement := entitlement
+		if err := db.UpsertEntitlement(context.Background(), &entitlement, persistence.NoVersion); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &reporter{db, sc.Client(), testServiceDomain, time.Second}, db, sc
+}
+
+//record stores a usage record of quantity over the hour starting at start minutes after a fixed time.
+func record(t *testing.T, db persistence.DatabaseHandler, id string, entitlementId string, metric string, quantity int64, start int) {
+	startTime := time.Date(2019, 10, 1, 0, start, 0, 0, time.UTC)
+	usageRecord := persistence.UsageRecord{
+		Id:            id,
+		EntitlementId: entitlementId,
+		Metric:        metric,
+		Quantity:      quantity,
+		StartTime:     persistence.FormatTimestamp(startTime),
+		EndTime:       persistence.FormatTimestamp(startTime.Add(time.Hour)),
+	}
+	if err := db.CreateUsageRecord(context.Background(), &usageRecord); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func reports(t *testing.T, db persistence.DatabaseHandler) []persistence.UsageReport {
+	reports, _, err := db.QueryUsageReports(context.Background(), persistence.Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reports
+}
+
+func reportId(t *testing.T, db persistence.DatabaseHandler, recordId string) string {
+	usageRecord, err := db.GetUsageRecord(context.Background(), recordId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return usageRecord.ReportId
+}
+
+func TestAggregation(t *testing.T) {
+	rep, db, sc := setUp(t)
+	defer sc.Close()
+	record(t, db, "r1", "E-1", "requests", 10, 0)
+	record(t, db, "r2", "E-1", "requests", 5, 30)
+	record(t, db, "r3", "E-1", "storage", 7, 15)
+	record(t, db, "r4", "E-2", "requests", 3, 0)
+	record(t, db, "r5", "E-unbillable", "requests", 1, 0)
+
+	rep.reportUsage(context.Background())
+
+	tests := []struct {
+		serviceName string
+		consumerId  string
+		metric      string
+		want        int64
+	}{
+		{"product-a." + testServiceDomain, "project_number:1", "product-a." + testServiceDomain + "/requests", 15},
+		{"product-a." + testServiceDomain, "project_number:1", "product-a." + testServiceDomain + "/storage", 7},
+		{"product-b." + testServiceDomain, "project_number:2", "product-b." + testServiceDomain + "/requests", 3},
+	}
+	for _, test := range tests {
+		if usage := sc.Usage(test.serviceName, test.consumerId, test.metric); usage != test.want {
+			t.Errorf("usage of %s by %s = %d, want %d", test.metric, test.consumerId, usage, test.want)
+		}
+	}
+
+	//one operation per entitlement, covering the earliest start to the latest end of its records
+	operations := sc.Operations("product-a." + testServiceDomain)
+	if len(operations) != 1 {
+		t.Fatalf("operations = %d, want 1", len(operations))
+	}
+	if operations[0].StartTime != "2019-10-01T00:00:00.000000000Z" || operations[0].EndTime != "2019-10-01T01:30:00.000000000Z" {
+		t.Errorf("operation covers %s to %s, want 00:00 to 01:30", operations[0].StartTime, operations[0].EndTime)
+	}
+	report, err := db.GetUsageReport(context.Background(), operations[0].OperationId)
+	if err != nil {
+		t.Fatalf("no report for operation %s: %v", operations[0].OperationId, err)
+	}
+	if report.State != persistence.UsageReportSent || report.Attempts != 1 {
+		t.Errorf("report is %s after %d attempts, want %s after 1", report.State, report.Attempts, persistence.UsageReportSent)
+	}
+	for _, recordId := range []string{"r1", "r2", "r3"} {
+		if id := reportId(t, db, recordId); id != report.Id {
+			t.Errorf("record %s is in report %q, want %s", recordId, id, report.Id)
+		}
+	}
+
+	//records of an entitlement without a usageReportingId wait for a later run
+	if id := reportId(t, db, "r5"); id != "" {
+		t.Errorf("record of an unbillable entitlement is in report %s, want none", id)
+	}
+	if len(reports(t, db)) != 2 {
+		t.Errorf("reports = %d, want 2", len(reports(t, db)))
+	}
+
+	//reported records are not reported again
+	rep.reportUsage(context.Background())
+	if sc.Requests() != 2 {
+		t.Errorf("requests = %d after a run with nothing to report, want 2", sc.Requests())
+	}
+}
+
+func TestReportRecordLimit(t *testing.T) {
+	rep, db, sc := setUp(t)
+	defer sc.Close()
+	for i := 0; i < maxReportRecords+1; i++ {
+		record(t, db, "r"+strconv.Itoa(i), "E-1", "requests", 1, 0)
+	}
+
+	rep.reportUsage(context.Background())
+
+	if operations := sc.Operations("product-a." + testServiceDomain); len(operations) != 2 {
+		t.Errorf("operations = %d, want 2", len(operations))
+	}
+	if usage := sc.Usage("product-a."+testServiceDomain, "project_number:1", "product-a."+testServiceDomain+"/requests"); usage != maxReportRecords+1 {
+		t.Errorf("usage = %d, want %d", usage, maxReportRecords+1)
+	}
+}
+
+func TestPendingReportResent(t *testing.T) {
+	rep, db, sc := setUp(t)
+	defer sc.Close()
+	record(t, db, "r1", "E-1", "requests", 10, 0)
+
+	//the first attempt fails with a transient error and the report stays pending
+	sc.FailNext(1, http.StatusServiceUnavailable)
+	rep.reportUsage(context.Background())
+	pending := reports(t, db)
+	if len(pending) != 1 || pending[0].State != persistence.UsageReportPending || pending[0].Attempts != 1 || pending[0].Error == "" {
+		t.Fatalf("reports = %+v, want one pending report with the error of 1 attempt", pending)
+	}
+
+	//the next run sends it again with the same operation id
+	rep.reportUsage(context.Background())
+	operations := sc.Operations("product-a." + testServiceDomain)
+	if len(operations) != 1 || operations[0].OperationId != pending[0].Id {
+		t.Fatalf("operations = %+v, want the operation %s", operations, pending[0].Id)
+	}
+	report, _ := db.GetUsageReport(context.Background(), pending[0].Id)
+	if report.State != persistence.UsageReportSent || report.Attempts != 2 || report.Error != "" {
+		t.Errorf("report is %s after %d attempts with error %q, want %s after 2", report.State, report.Attempts, report.Error, persistence.UsageReportSent)
+	}
+
+	//a report whose response was lost is sent again and dropped by Service Control, so the usage is counted once
+	report.State = persistence.UsageReportPending
+	if err := db.UpsertUsageReport(context.Background(), report); err != nil {
+		t.Fatal(err)
+	}
+	rep.reportUsage(context.Background())
+	if sc.Requests() != 3 {
+		t.Errorf("requests = %d, want 3", sc.Requests())
+	}
+	if usage := sc.Usage("product-a."+testServiceDomain, "project_number:1", "product-a."+testServiceDomain+"/requests"); usage != 10 {
+		t.Errorf("usage = %d, want 10", usage)
+	}
+}
+
+func TestRejectedReportFails(t *testing.T) {
+	rep, db, sc := setUp(t)
+	defer sc.Close()
+	record(t, db, "r1", "E-1", "requests", 10, 0)
+	sc.Reject("project_number:1", "consumer is not active")
+
+	rep.reportUsage(context.Background())
+	rep.reportUsage(context.Background())
+
+	failed := reports(t, db)
+	if len(failed) != 1 || failed[0].State != persistence.UsageReportFailed || failed[0].Error == "" {
+		t.Fatalf("reports = %+v, want one failed report with the error", failed)
+	}
+	if sc.Requests() != 1 {
+		t.Errorf("requests = %d, want the rejected report sent once", sc.Requests())
+	}
+}
+
+func TestRecordsAlreadyReported(t *testing.T) {
+	rep, db, sc := setUp(t)
+	defer sc.Close()
+	record(t, db, "r1", "E-1", "requests", 10, 0)
+
+	//another replica reports the records after this one read them
+	records, err := rep.unreportedRecords(context.Background())
+	if err != nil || len(records) != 1 {
+		t.Fatalf("unreported records = %v, %v, want 1", records, err)
+	}
+	other := &reporter{db, sc.Client(), testServiceDomain, time.Second}
+	other.reportUsage(context.Background())
+
+	//creating the report conflicts, so it is neither stored nor sent
+	rep.reportEntitlement(context.Background(), "E-1", records)
+	if len(reports(t, db)) != 1 {
+		t.Errorf("reports = %d, want the report of the other replica only", len(reports(t, db)))
+	}
+	if sc.Requests() != 1 {
+		t.Errorf("requests = %d, want 1", sc.Requests())
+	}
+	if usage := sc.Usage("product-a."+testServiceDomain, "project_number:1", "product-a."+testServiceDomain+"/requests"); usage != 10 {
+		t.Errorf("usage = %d, want 10", usage)
+	}
+}
@@ -0,0 +1,30 @@
+package persistence
+
+//Requests a PendingApproval holds
+const (
+	ApprovalRequestCreation   = "ENTITLEMENT_CREATION"
+	ApprovalRequestPlanChange = "PLAN_CHANGE"
+)
+
+//States of the approvals recorded on an entitlement when an approval is attempted or a pending approval is decided
+const (
+	ApprovalApproved = "APPROVED"
+	ApprovalRejected = "REJECTED"
+	//the approval policy held the request for manual review
+	ApprovalPending = "PENDING"
+	//the procurement API call to approve or reject failed, the event is redelivered to try again
+	ApprovalFailed = "FAILED"
+)
+
+//KeepApprovals keeps the stored approvals of an entitlement that is upserted without any. The procurement API does not
+//return entitlement approvals, so the pubsub service would otherwise remove them each time it syncs the entitlement.
+//ApprovalState is always set from the latest approval so entitlements can be filtered on it.
+func KeepApprovals(current *Entitlement, entitlement *Entitlement) {
+	if entitlement.Approvals == nil {
+		entitlement.Approvals = current.Approvals
+	}
+	entitlement.ApprovalState = ""
+	if len(entitlement.Approvals) > 0 {
+		entitlement.ApprovalState = entitlement.Approvals[len(entitlement.Approvals)-1].State
+	}
+}
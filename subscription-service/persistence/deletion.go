@@ -0,0 +1,27 @@
+package persistence
+
+import (
+	"time"
+)
+
+//FormatDeletedTime formats the DeletedTime of a soft-deleted entity. It sorts in time order so purges can select by
+//range.
+func FormatDeletedTime(t time.Time) string {
+	return FormatTimestamp(t)
+}
+
+//IsDeleted returns whether an account or entitlement has been soft deleted.
+func IsDeleted(entity interface{}) bool {
+	return PropertyValue(entity, "deletedTime") != ""
+}
+
+//AccountDeletion summarizes what deleting an account with its related records changed.
+type AccountDeletion struct {
+	AccountId string `json:"accountId"`
+	//Account is true if the account was soft deleted by this call, false if it was missing or already deleted.
+	Account bool `json:"account"`
+	//Contact is true if the account's contact was removed.
+	Contact bool `json:"contact"`
+	//Entitlements are the ids of the account's entitlements that were soft deleted by this call.
+	Entitlements []string `json:"entitlements"`
+}
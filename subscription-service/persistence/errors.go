@@ -0,0 +1,17 @@
+package persistence
+
+import (
+	"errors"
+)
+
+//Errors that every DatabaseHandler returns so callers do not depend on backend specific errors.
+var (
+	//ErrNotFound is returned when the requested entity does not exist.
+	ErrNotFound = errors.New("persistence: entity not found")
+	//ErrConflict is returned when a write conflicts with a concurrent write or an existing entity.
+	ErrConflict = errors.New("persistence: entity conflict")
+	//ErrVersionMismatch is returned when a conditional write does not match the stored version.
+	ErrVersionMismatch = errors.New("persistence: entity version mismatch")
+	//ErrInvalidCursor is returned when a query cursor was not returned by the same backend.
+	ErrInvalidCursor = errors.New("persistence: invalid cursor")
+)
@@ -0,0 +1,8 @@
+package persistence
+
+//Event outcomes
+const (
+	EventSucceeded    = "SUCCEEDED"
+	EventFailed       = "FAILED"
+	EventDeadLettered = "DEAD_LETTERED"
+)
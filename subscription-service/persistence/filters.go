@@ -0,0 +1,320 @@
+package persistence
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+)
+
+//Filter is one parsed condition of a filter expression. Value is used by the comparison operators and Values by IN.
+type Filter struct {
+	Property string
+	Operator string
+	Value    string
+	Values   []string
+}
+
+//timestampProperties hold RFC 3339 timestamps. They are stored in timestampLayout and filter values for them are
+//checked and normalized to it, so timestamps compare correctly as strings.
+var timestampProperties = map[string]bool{
+	"updateTime": true,
+	"createTime": true,
+	"changeTime": true,
+	"deletedTime": true,
+	"processedTime": true,
+	"startTime": true,
+	"endTime": true,
+	"sentTime": true,
+}
+
+//timestampLayout is RFC 3339 in UTC with a fixed 9 digit fraction. Unlike time.RFC3339Nano, which drops trailing
+//zeros, its strings sort in time order.
+const timestampLayout = "2006-01-02T15:04:05.000000000Z"
+
+//FormatTimestamp formats a time for a timestamp property.
+func FormatTimestamp(t time.Time) string {
+	return t.UTC().Format(timestampLayout)
+}
+
+//NormalizeTimestamps rewrites the RFC 3339 timestamp properties of entity in timestampLayout. Values that are not
+//RFC 3339 timestamps are left as they are.
+func NormalizeTimestamps(entity interface{}) {
+	entityValue := reflect.Indirect(reflect.ValueOf(entity))
+	entityType := entityValue.Type()
+	for i := 0; i < entityType.NumField(); i++ {
+		property := strings.Split(entityType.Field(i).Tag.Get("datastore"), ",")[0]
+		field := entityValue.Field(i)
+		if !timestampProperties[property] || field.Kind() != reflect.String || field.String() == "" {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339Nano, field.String()); err == nil {
+			field.SetString(FormatTimestamp(t))
+		}
+	}
+}
+
+//ParseFilters parses a filter expression such as
+//
+//	state IN (ENTITLEMENT_ACTIVE, ENTITLEMENT_PENDING_CANCELLATION) AND updateTime >= 2019-10-01T00:00:00Z
+//
+//into filters on the properties of entity. Conditions are joined with AND or a comma and use =, !=, <, <=, >, >= or
+//IN. Values that contain spaces, commas or parentheses must be quoted with single or double quotes. Timestamp
+//properties accept RFC 3339 timestamps or dates.
+func ParseFilters(expression string, entity interface{}) ([]Filter, error) {
+	p := &filterParser{expression: expression}
+	var filters []Filter
+	for {
+		p.skipSpace()
+		if p.done() {
+			if len(filters) > 0 {
+				return nil, p.errorf("expected a condition after AND")
+			}
+			return nil, nil
+		}
+		filter, err := p.parseCondition()
+		if err != nil {
+			return nil, err
+		}
+		if err := checkFilter(&filter, entity); err != nil {
+			return nil, fmt.Errorf("invalid filter %q: %v", expression, err)
+		}
+		filters = append(filters, filter)
+
+		p.skipSpace()
+		if p.done() {
+			return filters, nil
+		}
+		if !p.consume(",") && !p.consumeKeyword("AND") {
+			return nil, p.errorf("expected AND")
+		}
+	}
+}
+
+//Match returns whether a property value satisfies the filter.
+func (filter Filter) Match(value string) bool {
+	switch filter.Operator {
+	case "=":
+		return value == filter.Value
+	case "!=":
+		return value != filter.Value
+	case "<":
+		return value < filter.Value
+	case "<=":
+		return value <= filter.Value
+	case ">":
+		return value > filter.Value
+	case ">=":
+		return value >= filter.Value
+	case "IN":
+		for _, v := range filter.Values {
+			if value == v {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//MatchFilters returns whether the entity satisfies all filters.
+func MatchFilters(entity interface{}, filters []Filter) bool {
+	for _, filter := range filters {
+		if !filter.Match(PropertyValue(entity, filter.Property)) {
+			return false
+		}
+	}
+	return true
+}
+
+//CheckOrder returns an error if order is not "property" or "-property" for a property of entity.
+func CheckOrder(order string, entity interface{}) error {
+	if order == "" {
+		return nil
+	}
+	if !hasProperty(entity, strings.TrimPrefix(order, "-")) {
+		return fmt.Errorf("invalid order %q: unknown property", order)
+	}
+	return nil
+}
+
+func checkFilter(filter *Filter, entity interface{}) error {
+	if !hasProperty(entity, filter.Property) {
+		return fmt.Errorf("unknown property %s", filter.Property)
+	}
+	if !timestampProperties[filter.Property] {
+		return nil
+	}
+	var err error
+	if filter.Operator == "IN" {
+		for i := range filter.Values {
+			if filter.Values[i], err = normalizeTimestamp(filter.Values[i]); err != nil {
+				return fmt.Errorf("%s must be a timestamp: %v", filter.Property, err)
+			}
+		}
+	} else if filter.Value, err = normalizeTimestamp(filter.Value); err != nil {
+		return fmt.Errorf("%s must be a timestamp: %v", filter.Property, err)
+	}
+	return nil
+}
+
+func normalizeTimestamp(value string) (string, error) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return FormatTimestamp(t), nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return "", fmt.Errorf("%q is not an RFC 3339 timestamp or date", value)
+	}
+	return FormatTimestamp(t), nil
+}
+
+//hasProperty returns whether entity has a string field with the datastore property name.
+func hasProperty(entity interface{}, property string) bool {
+	entityType := reflect.Indirect(reflect.ValueOf(entity)).Type()
+	for i := 0; i < entityType.NumField(); i++ {
+		field := entityType.Field(i)
+		if strings.Split(field.Tag.Get("datastore"), ",")[0] == property {
+			return field.Type.Kind() == reflect.String
+		}
+	}
+	return false
+}
+
+type filterParser struct {
+	expression string
+	pos        int
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid filter %q: %s at position %d", p.expression, fmt.Sprintf(format, args...), p.pos+1)
+}
+
+func (p *filterParser) done() bool {
+	return p.pos >= len(p.expression)
+}
+
+func (p *filterParser) skipSpace() {
+	for !p.done() && unicode.IsSpace(rune(p.expression[p.pos])) {
+		p.pos++
+	}
+}
+
+func (p *filterParser) consume(token string) bool {
+	if strings.HasPrefix(p.expression[p.pos:], token) {
+		p.pos += len(token)
+		return true
+	}
+	return false
+}
+
+//consumeKeyword consumes a case insensitive keyword that is followed by a space or an opening parenthesis.
+func (p *filterParser) consumeKeyword(keyword string) bool {
+	end := p.pos + len(keyword)
+	if end > len(p.expression) || !strings.EqualFold(p.expression[p.pos:end], keyword) {
+		return false
+	}
+	if end < len(p.expression) && !unicode.IsSpace(rune(p.expression[end])) && p.expression[end] != '(' {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+func (p *filterParser) parseCondition() (Filter, error) {
+	filter := Filter{}
+	start := p.pos
+	for !p.done() && (isIdentifierChar(p.expression[p.pos])) {
+		p.pos++
+	}
+	if p.pos == start {
+		return filter, p.errorf("expected a property name")
+	}
+	filter.Property = p.expression[start:p.pos]
+
+	p.skipSpace()
+	switch {
+	case p.consume("!="):
+		filter.Operator = "!="
+	case p.consume("<="):
+		filter.Operator = "<="
+	case p.consume(">="):
+		filter.Operator = ">="
+	case p.consume("="):
+		filter.Operator = "="
+	case p.consume("<"):
+		filter.Operator = "<"
+	case p.consume(">"):
+		filter.Operator = ">"
+	case p.consumeKeyword("IN"):
+		filter.Operator = "IN"
+	default:
+		return filter, p.errorf("expected one of =, !=, <, <=, >, >= or IN after %s", filter.Property)
+	}
+
+	p.skipSpace()
+	if filter.Operator != "IN" {
+		value, err := p.parseValue()
+		filter.Value = value
+		return filter, err
+	}
+
+	if !p.consume("(") {
+		return filter, p.errorf("expected ( after IN")
+	}
+	for {
+		p.skipSpace()
+		value, err := p.parseValue()
+		if err != nil {
+			return filter, err
+		}
+		filter.Values = append(filter.Values, value)
+		p.skipSpace()
+		if p.consume(")") {
+			return filter, nil
+		}
+		if !p.consume(",") {
+			return filter, p.errorf("expected , or ) in IN list")
+		}
+	}
+}
+
+//parseValue parses a quoted string or a bare value that ends at a space, comma or parenthesis.
+func (p *filterParser) parseValue() (string, error) {
+	if p.done() {
+		return "", p.errorf("expected a value")
+	}
+	quote := p.expression[p.pos]
+	if quote != '"' && quote != '\'' {
+		start := p.pos
+		for !p.done() && !strings.ContainsRune(" \t\r\n,()", rune(p.expression[p.pos])) {
+			p.pos++
+		}
+		if p.pos == start {
+			return "", p.errorf("expected a value")
+		}
+		return p.expression[start:p.pos], nil
+	}
+
+	start := p.pos
+	p.pos++
+	var value strings.Builder
+	for !p.done() {
+		c := p.expression[p.pos]
+		p.pos++
+		if c == quote {
+			return value.String(), nil
+		}
+		if c == '\\' && !p.done() {
+			c = p.expression[p.pos]
+			p.pos++
+		}
+		value.WriteByte(c)
+	}
+	p.pos = start
+	return "", p.errorf("unterminated quoted value")
+}
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
@@ -0,0 +1,107 @@
+package persistence
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//History entity kinds
+const (
+	AccountKind     = "Account"
+	EntitlementKind = "Entitlement"
+)
+
+//HistoryEntry is an append-only record of a change to the state, plan, approvals or deletion of an account or
+//entitlement. The id orders entries by version so the history of an entity is returned in the order it changed.
+type HistoryEntry struct {
+	Id         string   `json:"id" datastore:"id"`
+	EntityKind string   `json:"entityKind" datastore:"entityKind"`
+	EntityId   string   `json:"entityId" datastore:"entityId"`
+	Version    int64    `json:"version" datastore:"version"`
+	ChangeTime string   `json:"changeTime" datastore:"changeTime"`
+	Source     string   `json:"source" datastore:"source"`
+	Changes    []Change `json:"changes" datastore:"changes"`
+}
+
+//Change is one property of a HistoryEntry. OldValue is empty when the entity was created.
+type Change struct {
+	Property string `json:"property" datastore:"property"`
+	OldValue string `json:"oldValue" datastore:"oldValue"`
+	NewValue string `json:"newValue" datastore:"newValue"`
+}
+
+type sourceKey struct{}
+
+//WithSource returns a context that records the caller, such as a pubsub event, in history entries.
+func WithSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+//SourceFromContext returns the caller set with WithSource or "unknown".
+func SourceFromContext(ctx context.Context) string {
+	if source, ok := ctx.Value(sourceKey{}).(string); ok && source != "" {
+		return source
+	}
+	return "unknown"
+}
+
+//HistoryId returns the id of the history entry for a version of an entity.
+func HistoryId(entityKind string, entityId string, version int64) string {
+	return fmt.Sprintf("%s-%s-%019d", entityKind, entityId, version)
+}
+
+//NewHistoryEntry returns the history entry for replacing current with entity at version, or nil if entity is not an
+//account or entitlement or its state, plan and approvals did not change. current points to the zero value when the
+//entity is new.
+func NewHistoryEntry(ctx context.Context, current interface{}, entity interface{}, version int64) *HistoryEntry {
+	var entityKind, entityId string
+	var changes []Change
+	switch e := entity.(type) {
+	case *Account:
+		old := current.(*Account)
+		entityKind, entityId = AccountKind, e.Id
+		changes = appendChange(changes, "state", old.State, e.State)
+		changes = appendChange(changes, "approvals", approvalsValue(old.Approvals), approvalsValue(e.Approvals))
+		changes = appendChange(changes, "deletedTime", old.DeletedTime, e.DeletedTime)
+	case *Entitlement:
+		old := current.(*Entitlement)
+		entityKind, entityId = EntitlementKind, e.Id
+		changes = appendChange(changes, "state", old.State, e.State)
+		changes = appendChange(changes, "plan", old.Plan, e.Plan)
+		changes = appendChange(changes, "newPendingPlan", old.NewPendingPlan, e.NewPendingPlan)
+		changes = appendChange(changes, "approvals", approvalsValue(old.Approvals), approvalsValue(e.Approvals))
+		changes = appendChange(changes, "deletedTime", old.DeletedTime, e.DeletedTime)
+	default:
+		return nil
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return &HistoryEntry{
+		Id:         HistoryId(entityKind, entityId, version),
+		EntityKind: entityKind,
+		EntityId:   entityId,
+		Version:    version,
+		ChangeTime: FormatTimestamp(time.Now()),
+		Source:     SourceFromContext(ctx),
+		Changes:    changes,
+	}
+}
+
+func appendChange(changes []Change, property string, oldValue string, newValue string) []Change {
+	if oldValue == newValue {
+		return changes
+	}
+	return append(changes, Change{property, oldValue, newValue})
+}
+
+//approvalsValue summarizes approvals as "name:state" pairs.
+func approvalsValue(approvals []Approval) string {
+	values := make([]string, len(approvals))
+	for i, approval := range approvals {
+		values[i] = approval.Name + ":" + approval.State
+	}
+	return strings.Join(values, ",")
+}
@@ -9,6 +9,8 @@ type Account struct {
 	Provider     	string		`json:"provider,omitempty" datastore:"provider,omitempty"`
 	State 	 		string      `json:"state,omitempty" datastore:"state,omitempty"`
 	Approvals    	[]Approval  `json:"approvals,omitempty" datastore:"approvals,omitempty"`
+	Version    	  	int64		`json:"version" datastore:"version"`
+	DeletedTime   	string    	`json:"deletedTime,omitempty" datastore:"deletedTime,omitempty"`
 }
 
 type Approval struct {
@@ -16,6 +18,7 @@ type Approval struct {
 	State  			string     	`json:"state" datastore:"state"`
 	Reason  		string     	`json:"reason" datastore:"reason"`
 	UpdateTime  	string     	`json:"updateTime" datastore:"updateTime"`
+	Approver  		string     	`json:"approver,omitempty" datastore:"approver,omitempty"`
 }
 
 //cloudbees signup fields
@@ -27,6 +30,7 @@ type Contact struct {
 	Phone			string     	`json:"phone,omitempty" datastore:"phone,omitempty"`
 	Company			string     	`json:"company,omitempty" datastore:"company,omitempty"`
 	Timezone		string     	`json:"timezone,omitempty" datastore:"timezone,omitempty"`
+	Version    	  	int64		`json:"version" datastore:"version"`
 }
 
 //google entitlement fields
@@ -43,4 +47,79 @@ type Entitlement struct {
 	CreateTime    	  	string	`json:"createTime" datastore:"createTime"`
 	UsageReportingId    string	`json:"usageReportingId" datastore:"usageReportingId"`
 	MessageToUser    	string	`json:"messageToUser" datastore:"messageToUser"`
+	Approvals    		[]Approval	`json:"approvals,omitempty" datastore:"approvals,omitempty"`
+	//state of the latest approval, set by the service
+	ApprovalState    	string	`json:"approvalState,omitempty" datastore:"approvalState,omitempty"`
+	Version    	  		int64	`json:"version" datastore:"version"`
+	DeletedTime    	  	string	`json:"deletedTime,omitempty" datastore:"deletedTime,omitempty"`
+}
+
+//marketplace event handled by the pubsub service
+type Event struct {
+	Id     				string	`json:"id" datastore:"id"`
+	EventType     		string	`json:"eventType" datastore:"eventType"`
+	EntityId     		string	`json:"entityId,omitempty" datastore:"entityId,omitempty"`
+	Outcome     		string	`json:"outcome" datastore:"outcome"`
+	Attempts     		int64	`json:"attempts" datastore:"attempts"`
+	Error     			string	`json:"error,omitempty" datastore:"error,omitempty,noindex"`
+	ProcessedTime     	string	`json:"processedTime" datastore:"processedTime"`
+}
+
+//entitlement or plan change request the approval policy held for manual review, keyed by entitlement id
+type PendingApproval struct {
+	Id     				string	`json:"id" datastore:"id"`
+	Account     		string	`json:"account" datastore:"account"`
+	Request     		string	`json:"request" datastore:"request"`
+	Product     		string	`json:"product" datastore:"product"`
+	Plan     			string	`json:"plan" datastore:"plan"`
+	PendingPlan     	string	`json:"pendingPlan,omitempty" datastore:"pendingPlan,omitempty"`
+	Reason     			string	`json:"reason,omitempty" datastore:"reason,omitempty,noindex"`
+	EventId     		string	`json:"eventId,omitempty" datastore:"eventId,omitempty"`
+	CreateTime     		string	`json:"createTime" datastore:"createTime"`
+}
+
+//marketplace message the pubsub service gave up on, kept with its raw data for replay
+type DeadLetter struct {
+	Id     				string	`json:"id" datastore:"id"`
+	EventId     		string	`json:"eventId,omitempty" datastore:"eventId,omitempty"`
+	EventType     		string	`json:"eventType,omitempty" datastore:"eventType,omitempty"`
+	Data     			string	`json:"data" datastore:"data,noindex"`
+	Error     			string	`json:"error" datastore:"error,noindex"`
+	Attempts     		int64	`json:"attempts" datastore:"attempts"`
+	CreateTime     		string	`json:"createTime" datastore:"createTime"`
+}
+
+//usage of a metric by an entitlement over a time window, posted by a service or agent. The id is chosen by the poster
+//so a record that is posted again is not counted twice. ReportId is set when the record is aggregated into a report.
+type UsageRecord struct {
+	Id     				string	`json:"id" datastore:"id"`
+	EntitlementId     	string	`json:"entitlementId" datastore:"entitlementId"`
+	Metric     			string	`json:"metric" datastore:"metric"`
+	Quantity     		int64	`json:"quantity" datastore:"quantity"`
+	StartTime     		string	`json:"startTime" datastore:"startTime"`
+	EndTime     		string	`json:"endTime" datastore:"endTime"`
+	ReportId     		string	`json:"reportId" datastore:"reportId"`
+	CreateTime     		string	`json:"createTime" datastore:"createTime"`
+}
+
+//aggregated usage of an entitlement sent to Service Control as one operation, the id is the operation id
+type UsageReport struct {
+	Id     				string	`json:"id" datastore:"id"`
+	EntitlementId     	string	`json:"entitlementId" datastore:"entitlementId"`
+	UsageReportingId    string	`json:"usageReportingId" datastore:"usageReportingId"`
+	ServiceName     	string	`json:"serviceName" datastore:"serviceName"`
+	StartTime     		string	`json:"startTime" datastore:"startTime"`
+	EndTime     		string	`json:"endTime" datastore:"endTime"`
+	Metrics     		[]UsageMetric	`json:"metrics" datastore:"metrics,noindex"`
+	RecordIds     		[]string	`json:"recordIds" datastore:"recordIds,noindex"`
+	State     			string	`json:"state" datastore:"state"`
+	Attempts     		int64	`json:"attempts" datastore:"attempts"`
+	Error     			string	`json:"error,omitempty" datastore:"error,omitempty,noindex"`
+	CreateTime     		string	`json:"createTime" datastore:"createTime"`
+	SentTime     		string	`json:"sentTime,omitempty" datastore:"sentTime,omitempty"`
+}
+
+type UsageMetric struct {
+	Metric     			string	`json:"metric" datastore:"metric"`
+	Quantity     		int64	`json:"quantity" datastore:"quantity"`
 }
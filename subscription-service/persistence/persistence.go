@@ -1,22 +1,77 @@
 package persistence
 
+import (
+	"context"
+	"time"
+)
+
+//DatabaseHandler stores accounts, contacts and entitlements. Upserts take the version the caller expects to replace,
+//or NoVersion for an unconditional write, and return ErrVersionMismatch when it does not match. On success the
+//entity's Version is set to the new version. Upserts that change the state, plan or approvals of an account or
+//entitlement also record a HistoryEntry, with the caller from WithSource, in the same transaction.
+//
+//Deleting an account or entitlement only sets its DeletedTime, upserts keep it and restoring clears it. Deleting a
+//missing or deleted entity does nothing, restoring a missing entity returns ErrNotFound. Gets return deleted
+//entities so callers can check DeletedTime.
 type DatabaseHandler interface {
-	UpsertAccount(*Account) error
-	DeleteAccount(string) error
-	GetAccount(string) (*Account, error)
+	UpsertAccount(context.Context, *Account, int64) error
+	DeleteAccount(context.Context, string) error
+	//DeleteAccountCascade soft deletes an account and the entitlements that reference it, and removes its contact, in
+	//one transaction. It also cleans up the contact and entitlements of an account that is missing or already deleted.
+	DeleteAccountCascade(context.Context, string) (*AccountDeletion, error)
+	RestoreAccount(context.Context, string) error
+	GetAccount(context.Context, string) (*Account, error)
+
+	UpsertEntitlement(context.Context, *Entitlement, int64) error
+	DeleteEntitlement(context.Context, string) error
+	RestoreEntitlement(context.Context, string) error
+	GetEntitlement(context.Context, string) (*Entitlement, error)
+
+	UpsertContact(context.Context, *Contact, int64) error
+	DeleteContact(context.Context, string) error
+	GetContact(context.Context, string) (*Contact, error)
+
+	//UpsertEvent records the outcome of a marketplace event, replacing the outcome of an earlier delivery.
+	UpsertEvent(context.Context, *Event) error
+	GetEvent(context.Context, string) (*Event, error)
+
+	UpsertDeadLetter(context.Context, *DeadLetter) error
+	DeleteDeadLetter(context.Context, string) error
+	GetDeadLetter(context.Context, string) (*DeadLetter, error)
+
+	//UpsertPendingApproval holds an entitlement's creation or plan change request, replacing an earlier one.
+	UpsertPendingApproval(context.Context, *PendingApproval) error
+	DeletePendingApproval(context.Context, string) error
+	GetPendingApproval(context.Context, string) (*PendingApproval, error)
+
+	//CreateUsageRecord stores a new usage record and returns ErrConflict if a record with the same id exists.
+	CreateUsageRecord(context.Context, *UsageRecord) error
+	GetUsageRecord(context.Context, string) (*UsageRecord, error)
 
-	UpsertEntitlement(*Entitlement) error
-	DeleteEntitlement(string) error
-	GetEntitlement(string) (*Entitlement, error)
+	//CreateUsageReport stores a new usage report and sets the ReportId of its records in one transaction. It returns
+	//ErrConflict if one of the records is missing or already in a report.
+	CreateUsageReport(context.Context, *UsageReport) error
+	//UpsertUsageReport records the outcome of sending a usage report.
+	UpsertUsageReport(context.Context, *UsageReport) error
+	GetUsageReport(context.Context, string) (*UsageReport, error)
 
-	UpsertContact(*Contact) error
-	DeleteContact(string) error
-	GetContact(string) (*Contact, error)
+	//Query methods return one page of results and the cursor for the next page, which is empty on the last page.
+	QueryEntitlements(ctx context.Context, query Query) ([]Entitlement, string, error)
+	QueryAccountEntitlements(ctx context.Context, accountId string, query Query) ([]Entitlement, string, error)
+	QueryAccounts(ctx context.Context, query Query) ([]Account, string, error)
+	QueryContacts(ctx context.Context, query Query) ([]Contact, string, error)
+	QueryEvents(ctx context.Context, query Query) ([]Event, string, error)
+	QueryDeadLetters(ctx context.Context, query Query) ([]DeadLetter, string, error)
+	QueryPendingApprovals(ctx context.Context, query Query) ([]PendingApproval, string, error)
+	QueryUsageRecords(ctx context.Context, query Query) ([]UsageRecord, string, error)
+	QueryUsageReports(ctx context.Context, query Query) ([]UsageReport, string, error)
+	//QueryHistory returns the history of an account or entitlement, oldest first unless the query sets an order.
+	QueryHistory(ctx context.Context, entityKind string, entityId string, query Query) ([]HistoryEntry, string, error)
 
-	QueryEntitlements(filters []string, order string) ([]Entitlement, error)
-	QueryAccountEntitlements(accountId string,filters []string, order string) ([]Entitlement, error)
-	QueryAccounts(filters []string, order string) ([]Account, error)
-	QueryContacts(filters []string, order string) ([]Contact, error)
+	//PurgeDeleted permanently removes accounts, with their contacts, and entitlements that were soft deleted before
+	//deletedBefore and returns how many accounts and entitlements were removed. History is kept.
+	PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error)
 
-	Healthz() error
+	Healthz(context.Context) error
+	Close() error
 }
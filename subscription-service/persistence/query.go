@@ -0,0 +1,53 @@
+package persistence
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+//Query selects one page of entities. Filters come from ParseFilters and Order is "property" or "-property". A Limit of
+//zero returns every match. Cursor is the next page cursor returned with the previous page. Soft-deleted accounts and
+//entitlements are only returned with IncludeDeleted.
+type Query struct {
+	Filters        []Filter
+	Order          string
+	Limit          int
+	Cursor         string
+	IncludeDeleted bool
+}
+
+//EncodeCursor returns an opaque keyset cursor from the order value and key of the last entity on a page. Backends
+//without native cursors use it to continue after that entity.
+func EncodeCursor(orderValue string, key string) string {
+	cursorBytes, _ := json.Marshal([]string{orderValue, key})
+	return base64.RawURLEncoding.EncodeToString(cursorBytes)
+}
+
+//DecodeCursor returns the order value and key from a cursor created by EncodeCursor.
+func DecodeCursor(cursor string) (string, string, error) {
+	cursorBytes, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", ErrInvalidCursor
+	}
+	var values []string
+	if err := json.Unmarshal(cursorBytes, &values); err != nil || len(values) != 2 {
+		return "", "", ErrInvalidCursor
+	}
+	return values[0], values[1], nil
+}
+
+//PropertyValue returns the string value of the field with the given datastore property name.
+func PropertyValue(entity interface{}, property string) string {
+	entityValue := reflect.Indirect(reflect.ValueOf(entity))
+	entityType := entityValue.Type()
+	for i := 0; i < entityType.NumField(); i++ {
+		if strings.Split(entityType.Field(i).Tag.Get("datastore"), ",")[0] == property {
+			if field := entityValue.Field(i); field.Kind() == reflect.String {
+				return field.String()
+			}
+		}
+	}
+	return ""
+}
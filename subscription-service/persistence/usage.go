@@ -0,0 +1,17 @@
+package persistence
+
+//States of a usage report
+const (
+	//the report has not been sent yet or the last attempt failed with an error that may not happen again
+	UsageReportPending = "PENDING"
+	UsageReportSent    = "SENT"
+	//Service Control rejected the report, it is not sent again unless it is retried
+	UsageReportFailed = "FAILED"
+)
+
+//SameUsage returns whether two usage records with the same id record the same usage, so posting a record again is
+//only a duplicate if it did not change.
+func SameUsage(a *UsageRecord, b *UsageRecord) bool {
+	return a.EntitlementId == b.EntitlementId && a.Metric == b.Metric && a.Quantity == b.Quantity &&
+		a.StartTime == b.StartTime && a.EndTime == b.EndTime
+}
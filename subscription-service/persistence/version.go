@@ -0,0 +1,24 @@
+package persistence
+
+const (
+	//NoVersion writes the entity whatever its stored version.
+	NoVersion int64 = -1
+	//AnyVersion writes the entity only if it already exists.
+	AnyVersion int64 = -2
+)
+
+//CheckVersion returns ErrVersionMismatch if the stored entity does not satisfy ifVersion. Versions start at 1 and
+//entities written before versioning have version 0.
+func CheckVersion(exists bool, version int64, ifVersion int64) error {
+	switch {
+	case ifVersion == NoVersion:
+		return nil
+	case ifVersion == AnyVersion:
+		if !exists {
+			return ErrVersionMismatch
+		}
+	case !exists || version != ifVersion:
+		return ErrVersionMismatch
+	}
+	return nil
+}
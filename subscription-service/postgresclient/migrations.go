@@ -0,0 +1,187 @@
+package postgresclient
+
+import (
+	"database/sql"
+)
+
+//migrations are applied in order and recorded in schema_migrations. Never edit an applied migration, append a new one.
+var migrations = []string{
+	//1 - initial schema
+	`CREATE TABLE accounts (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL DEFAULT '',
+		update_time TEXT NOT NULL DEFAULT '',
+		create_time TEXT NOT NULL DEFAULT '',
+		provider TEXT NOT NULL DEFAULT '',
+		state TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE approvals (
+		account_id TEXT NOT NULL REFERENCES accounts(id) ON DELETE CASCADE,
+		ordinal INTEGER NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		state TEXT NOT NULL DEFAULT '',
+		reason TEXT NOT NULL DEFAULT '',
+		update_time TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (account_id, ordinal)
+	);
+	CREATE TABLE contacts (
+		account_id TEXT PRIMARY KEY,
+		first_name TEXT NOT NULL DEFAULT '',
+		last_name TEXT NOT NULL DEFAULT '',
+		email_address TEXT NOT NULL DEFAULT '',
+		phone TEXT NOT NULL DEFAULT '',
+		company TEXT NOT NULL DEFAULT '',
+		timezone TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE entitlements (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL DEFAULT '',
+		account TEXT NOT NULL DEFAULT '',
+		provider TEXT NOT NULL DEFAULT '',
+		product TEXT NOT NULL DEFAULT '',
+		plan TEXT NOT NULL DEFAULT '',
+		new_pending_plan TEXT NOT NULL DEFAULT '',
+		state TEXT NOT NULL DEFAULT '',
+		update_time TEXT NOT NULL DEFAULT '',
+		create_time TEXT NOT NULL DEFAULT '',
+		usage_reporting_id TEXT NOT NULL DEFAULT '',
+		message_to_user TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX entitlements_account_idx ON entitlements (account);
+	CREATE INDEX entitlements_state_product_idx ON entitlements (state, product);`,
+	//2 - entity versions for conditional writes
+	`ALTER TABLE accounts ADD COLUMN version BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE contacts ADD COLUMN version BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE entitlements ADD COLUMN version BIGINT NOT NULL DEFAULT 0;`,
+	//3 - account and entitlement history
+	`CREATE TABLE history (
+		id TEXT PRIMARY KEY,
+		entity_kind TEXT NOT NULL,
+		entity_id TEXT NOT NULL,
+		version BIGINT NOT NULL,
+		change_time TEXT NOT NULL,
+		source TEXT NOT NULL DEFAULT '',
+		changes JSONB NOT NULL
+	);
+	CREATE INDEX history_entity_idx ON history (entity_kind, entity_id);`,
+	//4 - soft delete
+	`ALTER TABLE accounts ADD COLUMN deleted_time TEXT NOT NULL DEFAULT '';
+	ALTER TABLE entitlements ADD COLUMN deleted_time TEXT NOT NULL DEFAULT '';`,
+	//5 - processed marketplace events
+	`CREATE TABLE events (
+		id TEXT PRIMARY KEY,
+		event_type TEXT NOT NULL DEFAULT '',
+		entity_id TEXT NOT NULL DEFAULT '',
+		outcome TEXT NOT NULL DEFAULT '',
+		processed_time TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX events_processed_time_idx ON events (processed_time);`,
+	//6 - event attempts and dead letters
+	`ALTER TABLE events ADD COLUMN attempts BIGINT NOT NULL DEFAULT 0;
+	ALTER TABLE events ADD COLUMN error TEXT NOT NULL DEFAULT '';
+	CREATE TABLE dead_letters (
+		id TEXT PRIMARY KEY,
+		event_id TEXT NOT NULL DEFAULT '',
+		event_type TEXT NOT NULL DEFAULT '',
+		data TEXT NOT NULL DEFAULT '',
+		error TEXT NOT NULL DEFAULT '',
+		attempts BIGINT NOT NULL DEFAULT 0,
+		create_time TEXT NOT NULL DEFAULT ''
+	);`,
+	//7 - requests held by the approval policy
+	`CREATE TABLE pending_approvals (
+		id TEXT PRIMARY KEY,
+		account TEXT NOT NULL DEFAULT '',
+		request TEXT NOT NULL DEFAULT '',
+		product TEXT NOT NULL DEFAULT '',
+		plan TEXT NOT NULL DEFAULT '',
+		pending_plan TEXT NOT NULL DEFAULT '',
+		reason TEXT NOT NULL DEFAULT '',
+		event_id TEXT NOT NULL DEFAULT '',
+		create_time TEXT NOT NULL DEFAULT ''
+	);`,
+	//8 - approvers and entitlement approvals
+	`ALTER TABLE approvals ADD COLUMN approver TEXT NOT NULL DEFAULT '';
+	ALTER TABLE entitlements ADD COLUMN approvals JSONB NOT NULL DEFAULT '[]';`,
+	//9 - latest approval state of entitlements
+	`ALTER TABLE entitlements ADD COLUMN approval_state TEXT NOT NULL DEFAULT '';
+	UPDATE entitlements SET approval_state = approvals->-1->>'state' WHERE jsonb_array_length(approvals) > 0;
+	CREATE INDEX entitlements_approval_state_idx ON entitlements (approval_state);`,
+	//10 - usage records and the reports they are sent to Service Control in
+	`CREATE TABLE usage_records (
+		id TEXT PRIMARY KEY,
+		entitlement_id TEXT NOT NULL DEFAULT '',
+		metric TEXT NOT NULL DEFAULT '',
+		quantity BIGINT NOT NULL DEFAULT 0,
+		start_time TEXT NOT NULL DEFAULT '',
+		end_time TEXT NOT NULL DEFAULT '',
+		report_id TEXT NOT NULL DEFAULT '',
+		create_time TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX usage_records_report_id_idx ON usage_records (report_id);
+	CREATE TABLE usage_reports (
+		id TEXT PRIMARY KEY,
+		entitlement_id TEXT NOT NULL DEFAULT '',
+		usage_reporting_id TEXT NOT NULL DEFAULT '',
+		service_name TEXT NOT NULL DEFAULT '',
+		start_time TEXT NOT NULL DEFAULT '',
+		end_time TEXT NOT NULL DEFAULT '',
+		metrics JSONB NOT NULL DEFAULT '[]',
+		record_ids JSONB NOT NULL DEFAULT '[]',
+		state TEXT NOT NULL DEFAULT '',
+		attempts BIGINT NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		create_time TEXT NOT NULL DEFAULT '',
+		sent_time TEXT NOT NULL DEFAULT ''
+	);
+	CREATE INDEX usage_reports_state_idx ON usage_reports (state);`,
+}
+
+//migrate applies any migrations that have not been applied yet. An advisory lock keeps replicas that start at the
+//same time from applying the same migration twice.
+func migrate(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_time TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return err
+	}
+
+	for i, migration := range migrations {
+		version := i + 1
+		if err := applyMigration(db, version, migration); err != nil {
+			LogE.Printf("Failed to apply schema migration %d: %#v \n", version, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, version int, migration string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(8085)`); err != nil {
+		return err
+	}
+
+	var applied bool
+	if err := tx.QueryRow(`SELECT EXISTS(SELECT 1 FROM schema_migrations WHERE version = $1)`, version).Scan(&applied); err != nil {
+		return err
+	}
+	if applied {
+		return nil
+	}
+
+	if _, err := tx.Exec(migration); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+		return err
+	}
+	LogI.Printf("Applied schema migration %d \n", version)
+	return tx.Commit()
+}
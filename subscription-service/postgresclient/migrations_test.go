@@ -0,0 +1,91 @@
+package postgresclient
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var (
+	createTablePattern = regexp.MustCompile(`(?s)CREATE TABLE (\w+) \((.*?)\n\t\);`)
+	addColumnPattern   = regexp.MustCompile(`ALTER TABLE (\w+) ADD COLUMN (\w+)`)
+	selectPattern      = regexp.MustCompile(`^SELECT (.*) FROM (\w+)$`)
+)
+
+//schemaColumns returns the columns of each table once every migration is applied.
+func schemaColumns() map[string]map[string]bool {
+	tables := map[string]map[string]bool{}
+	for _, migration := range migrations {
+		for _, match := range createTablePattern.FindAllStringSubmatch(migration, -1) {
+			columns := map[string]bool{}
+			for _, definition := range strings.Split(match[2], ",\n") {
+				if column := strings.Fields(definition); len(column) > 0 && column[0] != "PRIMARY" {
+					columns[column[0]] = true
+				}
+			}
+			tables[match[1]] = columns
+		}
+		for _, match := range addColumnPattern.FindAllStringSubmatch(migration, -1) {
+			tables[match[1]][match[2]] = true
+		}
+	}
+	return tables
+}
+
+func TestMigrationsDefineQueriedColumns(t *testing.T) {
+	tables := schemaColumns()
+	tests := []struct {
+		selectClause string
+		columns      map[string]string
+	}{
+		{accountSelect, accountColumns},
+		{contactSelect, contactColumns},
+		{entitlementSelect, entitlementColumns},
+		{historySelect, historyColumns},
+		{eventSelect, eventColumns},
+		{deadLetterSelect, deadLetterColumns},
+		{approvalSelect, approvalColumns},
+		{usageRecordSelect, usageRecordColumns},
+		{usageReportSelect, usageReportColumns},
+	}
+	for _, test := range tests {
+		match := selectPattern.FindStringSubmatch(test.selectClause)
+		if match == nil {
+			t.Errorf("cannot parse %s", test.selectClause)
+			continue
+		}
+		table, ok := tables[match[2]]
+		if !ok {
+			t.Errorf("no migration creates table %s", match[2])
+			continue
+		}
+		for _, column := range strings.Split(match[1], ", ") {
+			if !table[column] {
+				t.Errorf("%s selects column %s, which no migration adds", match[2], column)
+			}
+		}
+		for property, column := range test.columns {
+			if !table[column] {
+				t.Errorf("property %s of %s maps to column %s, which no migration adds", property, match[2], column)
+			}
+		}
+	}
+}
+
+//TestMigrate applies the migrations twice, the second time there is nothing to apply.
+func TestMigrate(t *testing.T) {
+	db := openTestDatabase(t)
+	defer db.Close()
+	for i := 0; i < 2; i++ {
+		if err := migrate(db); err != nil {
+			t.Fatalf("migrate() attempt %d error = %v", i+1, err)
+		}
+	}
+	var applied, latest int
+	if err := db.QueryRow(`SELECT COUNT(*), MAX(version) FROM schema_migrations`).Scan(&applied, &latest); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(migrations) || latest != len(migrations) {
+		t.Errorf("%d migrations applied up to version %d, want %d", applied, latest, len(migrations))
+	}
+}
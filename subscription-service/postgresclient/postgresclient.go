@@ -0,0 +1,1231 @@
+package postgresclient
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/persistence"
+	"github.com/jefferyfry/funclog"
+	"github.com/lib/pq"
+	"reflect"
+	"strings"
+	"time"
+)
+
+//PostgresClient stores subscription data in PostgreSQL so it can be joined and reported on with SQL.
+type PostgresClient struct {
+	db *sql.DB
+}
+
+const (
+	accountSelect     = `SELECT id, name, update_time, create_time, provider, state, version, deleted_time FROM accounts`
+	contactSelect     = `SELECT account_id, first_name, last_name, email_address, phone, company, timezone, version FROM contacts`
+	entitlementSelect = `SELECT id, name, account, provider, product, plan, new_pending_plan, state, update_time, create_time, usage_reporting_id, message_to_user, version, deleted_time, approvals, approval_state FROM entitlements`
+	historySelect     = `SELECT id, entity_kind, entity_id, version, change_time, source, changes FROM history`
+	eventSelect       = `SELECT id, event_type, entity_id, outcome, attempts, error, processed_time FROM events`
+	deadLetterSelect  = `SELECT id, event_id, event_type, data, error, attempts, create_time FROM dead_letters`
+	approvalSelect    = `SELECT id, account, request, product, plan, pending_plan, reason, event_id, create_time FROM pending_approvals`
+	usageRecordSelect = `SELECT id, entitlement_id, metric, quantity, start_time, end_time, report_id, create_time FROM usage_records`
+	usageReportSelect = `SELECT id, entitlement_id, usage_reporting_id, service_name, start_time, end_time, metrics, record_ids, state, attempts, error, create_time, sent_time FROM usage_reports`
+)
+
+var (
+	//property to column mappings, these are also the only properties that can be filtered or ordered
+	accountColumns = map[string]string{
+		"id":          "id",
+		"name":        "name",
+		"updateTime":  "update_time",
+		"createTime":  "create_time",
+		"provider":    "provider",
+		"state":       "state",
+		"deletedTime": "deleted_time",
+	}
+	contactColumns = map[string]string{
+		"accountId":    "account_id",
+		"firstName":    "first_name",
+		"lastName":     "last_name",
+		"emailAddress": "email_address",
+		"phone":        "phone",
+		"company":      "company",
+		"timezone":     "timezone",
+	}
+	entitlementColumns = map[string]string{
+		"id":               "id",
+		"name":             "name",
+		"account":          "account",
+		"provider":         "provider",
+		"product":          "product",
+		"plan":             "plan",
+		"newPendingPlan":   "new_pending_plan",
+		"state":            "state",
+		"updateTime":       "update_time",
+		"createTime":       "create_time",
+		"usageReportingId": "usage_reporting_id",
+		"messageToUser":    "message_to_user",
+		"deletedTime":      "deleted_time",
+		"approvalState":    "approval_state",
+	}
+	historyColumns = map[string]string{
+		"id":         "id",
+		"entityKind": "entity_kind",
+		"entityId":   "entity_id",
+		"changeTime": "change_time",
+		"source":     "source",
+	}
+	eventColumns = map[string]string{
+		"id":            "id",
+		"eventType":     "event_type",
+		"entityId":      "entity_id",
+		"outcome":       "outcome",
+		"processedTime": "processed_time",
+	}
+	deadLetterColumns = map[string]string{
+		"id":         "id",
+		"eventId":    "event_id",
+		"eventType":  "event_type",
+		"createTime": "create_time",
+	}
+	approvalColumns = map[string]string{
+		"id":          "id",
+		"account":     "account",
+		"request":     "request",
+		"product":     "product",
+		"plan":        "plan",
+		"pendingPlan": "pending_plan",
+		"eventId":     "event_id",
+		"createTime":  "create_time",
+	}
+	usageRecordColumns = map[string]string{
+		"id":            "id",
+		"entitlementId": "entitlement_id",
+		"metric":        "metric",
+		"startTime":     "start_time",
+		"endTime":       "end_time",
+		"reportId":      "report_id",
+		"createTime":    "create_time",
+	}
+	usageReportColumns = map[string]string{
+		"id":               "id",
+		"entitlementId":    "entitlement_id",
+		"usageReportingId": "usage_reporting_id",
+		"serviceName":      "service_name",
+		"startTime":        "start_time",
+		"endTime":          "end_time",
+		"state":            "state",
+		"createTime":       "create_time",
+		"sentTime":         "sent_time",
+	}
+
+	//properties the datastore backend omits when they are empty, see buildQuery
+	accountOmitEmpty     = omitEmptyProperties(persistence.Account{})
+	contactOmitEmpty     = omitEmptyProperties(persistence.Contact{})
+	entitlementOmitEmpty = omitEmptyProperties(persistence.Entitlement{})
+	historyOmitEmpty     = omitEmptyProperties(persistence.HistoryEntry{})
+	eventOmitEmpty       = omitEmptyProperties(persistence.Event{})
+	deadLetterOmitEmpty  = omitEmptyProperties(persistence.DeadLetter{})
+	approvalOmitEmpty    = omitEmptyProperties(persistence.PendingApproval{})
+	usageRecordOmitEmpty = omitEmptyProperties(persistence.UsageRecord{})
+	usageReportOmitEmpty = omitEmptyProperties(persistence.UsageReport{})
+
+	LogI = funclog.NewInfoLogger("INFO: ")
+	LogE = funclog.NewErrorLogger("ERROR: ")
+)
+
+//NewPostgres connects to the database at the connection url and applies any pending schema migrations.
+func NewPostgres(connection string) (persistence.DatabaseHandler, error) {
+	db, err := sql.Open("postgres", connection)
+	if err != nil {
+		LogE.Printf("Failed to open postgres database: %v", err)
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &PostgresClient{
+		db,
+	}, nil
+}
+
+func (postgresClient *PostgresClient) UpsertAccount(ctx context.Context, account *persistence.Account, ifVersion int64) error {
+	tx, err := postgresClient.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current := persistence.Account{}
+	row := tx.QueryRowContext(ctx, accountSelect+` WHERE id = $1 FOR UPDATE`, account.Id)
+	exists, err := checkLocked(scanAccount(row, &current), current.Version, ifVersion)
+	if err != nil {
+		return err
+	}
+	if exists {
+		accounts := []persistence.Account{current}
+		if err := loadApprovals(ctx, tx, accounts); err != nil {
+			return err
+		}
+		current = accounts[0]
+	}
+	version := current.Version
+	//only delete and restore change the deleted time
+	account.DeletedTime = current.DeletedTime
+	statement := `INSERT INTO accounts (id, name, update_time, create_time, provider, state, version)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	if exists {
+		statement = `UPDATE accounts SET name = $2, update_time = $3, create_time = $4, provider = $5, state = $6,
+			version = $7 WHERE id = $1`
+	}
+	if _, err := tx.ExecContext(ctx, statement,
+		account.Id, account.Name, account.UpdateTime, account.CreateTime, account.Provider, account.State, version+1); err != nil {
+		return toPersistenceError(err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM approvals WHERE account_id = $1`, account.Id); err != nil {
+		return err
+	}
+	for i, approval := range account.Approvals {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO approvals (account_id, ordinal, name, state, reason, update_time, approver)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			account.Id, i, approval.Name, approval.State, approval.Reason, approval.UpdateTime, approval.Approver); err != nil {
+			return toPersistenceError(err)
+		}
+	}
+	if err := insertHistory(ctx, tx, persistence.NewHistoryEntry(ctx, &current, account, version+1)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return toPersistenceError(err)
+	}
+	account.Version = version + 1
+	return nil
+}
+
+func (postgresClient *PostgresClient) DeleteAccount(ctx context.Context, accountId string) error {
+	return postgresClient.setAccountDeletedTime(ctx, accountId, persistence.FormatDeletedTime(time.Now()))
+}
+
+func (postgresClient *PostgresClient) DeleteAccountCascade(ctx context.Context, accountId string) (*persistence.AccountDeletion, error) {
+	tx, err := postgresClient.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	deletion := persistence.AccountDeletion{AccountId: accountId, Entitlements: []string{}}
+	deletedTime := persistence.FormatDeletedTime(time.Now())
+	if deletion.Account, err = setAccountDeletedTimeInTx(ctx, tx, accountId, deletedTime); err != nil {
+		return nil, err
+	}
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM contacts WHERE account_id = $1`, accountId)
+	if err != nil {
+		return nil, toPersistenceError(err)
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else {
+		deletion.Contact = count > 0
+	}
+
+	rows, err := tx.QueryContext(ctx, `SELECT id FROM entitlements WHERE account = $1 AND deleted_time = '' ORDER BY id`, accountId)
+	if err != nil {
+		return nil, err
+	}
+	var entitlementIds []string
+	for rows.Next() {
+		var entitlementId string
+		if err := rows.Scan(&entitlementId); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		entitlementIds = append(entitlementIds, entitlementId)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, entitlementId := range entitlementIds {
+		deleted, err := setEntitlementDeletedTimeInTx(ctx, tx, entitlementId, deletedTime)
+		if err != nil {
+			return nil, err
+		}
+		if deleted {
+			deletion.Entitlements = append(deletion.Entitlements, entitlementId)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, toPersistenceError(err)
+	}
+	return &deletion, nil
+}
+
+func (postgresClient *PostgresClient) RestoreAccount(ctx context.Context, accountId string) error {
+	return postgresClient.setAccountDeletedTime(ctx, accountId, "")
+}
+
+func (postgresClient *PostgresClient) GetAccount(ctx context.Context, accountId string) (*persistence.Account, error) {
+	account := persistence.Account{}
+	row := postgresClient.db.QueryRowContext(ctx, accountSelect+` WHERE id = $1`, accountId)
+	if err := scanAccount(row, &account); err != nil {
+		return nil, toPersistenceError(err)
+	}
+
+	accounts := []persistence.Account{account}
+	if err := loadApprovals(ctx, postgresClient.db, accounts); err != nil {
+		return nil, err
+	}
+	return &accounts[0], nil
+}
+
+func (postgresClient *PostgresClient) UpsertContact(ctx context.Context, contact *persistence.Contact, ifVersion int64) error {
+	tx, err := postgresClient.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current := persistence.Contact{}
+	row := tx.QueryRowContext(ctx, contactSelect+` WHERE account_id = $1 FOR UPDATE`, contact.AccountId)
+	exists, err := checkLocked(scanContact(row, &current), current.Version, ifVersion)
+	if err != nil {
+		return err
+	}
+	version := current.Version
+	statement := `INSERT INTO contacts (account_id, first_name, last_name, email_address, phone, company, timezone, version)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
+	if exists {
+		statement = `UPDATE contacts SET first_name = $2, last_name = $3, email_address = $4, phone = $5, company = $6,
+			timezone = $7, version = $8 WHERE account_id = $1`
+	}
+	if _, err := tx.ExecContext(ctx, statement,
+		contact.AccountId, contact.FirstName, contact.LastName, contact.EmailAddress, contact.Phone, contact.Company,
+		contact.Timezone, version+1); err != nil {
+		return toPersistenceError(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return toPersistenceError(err)
+	}
+	contact.Version = version + 1
+	return nil
+}
+
+func (postgresClient *PostgresClient) DeleteContact(ctx context.Context, accountId string) error {
+	_, err := postgresClient.db.ExecContext(ctx, `DELETE FROM contacts WHERE account_id = $1`, accountId)
+	return err
+}
+
+func (postgresClient *PostgresClient) GetContact(ctx context.Context, accountId string) (*persistence.Contact, error) {
+	contact := persistence.Contact{}
+	row := postgresClient.db.QueryRowContext(ctx, contactSelect+` WHERE account_id = $1`, accountId)
+	if err := scanContact(row, &contact); err != nil {
+		return nil, toPersistenceError(err)
+	}
+	return &contact, nil
+}
+
+func (postgresClient *PostgresClient) UpsertEvent(ctx context.Context, event *persistence.Event) error {
+	_, err := postgresClient.db.ExecContext(ctx, `INSERT INTO events (id, event_type, entity_id, outcome, attempts, error,
+			processed_time)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (id) DO UPDATE SET event_type = $2, entity_id = $3, outcome = $4, attempts = $5, error = $6,
+			processed_time = $7`,
+		event.Id, event.EventType, event.EntityId, event.Outcome, event.Attempts, event.Error, event.ProcessedTime)
+	return toPersistenceError(err)
+}
+
+func (postgresClient *PostgresClient) GetEvent(ctx context.Context, eventId string) (*persistence.Event, error) {
+	event := persistence.Event{}
+	row := postgresClient.db.QueryRowContext(ctx, eventSelect+` WHERE id = $1`, eventId)
+	if err := scanEvent(row, &event); err != nil {
+		return nil, toPersistenceError(err)
+	}
+	return &event, nil
+}
+
+func (postgresClient *PostgresClient) UpsertDeadLetter(ctx context.Context, deadLetter *persistence.DeadLetter) error {
+	_, err := postgresClient.db.ExecContext(ctx, `INSERT INTO dead_letters (id, event_id, event_type, data, error, attempts,
+			create_time)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (id) DO UPDATE SET event_id = $2, event_type = $3, data = $4, error = $5, attempts = $6,
+			create_time = $7`,
+		deadLetter.Id, deadLetter.EventId, deadLetter.EventType, deadLetter.Data, deadLetter.Error, deadLetter.Attempts,
+		deadLetter.CreateTime)
+	return toPersistenceError(err)
+}
+
+func (postgresClient *PostgresClient) DeleteDeadLetter(ctx context.Context, deadLetterId string) error {
+	_, err := postgresClient.db.ExecContext(ctx, `DELETE FROM dead_letters WHERE id = $1`, deadLetterId)
+	return err
+}
+
+func (postgresClient *PostgresClient) GetDeadLetter(ctx context.Context, deadLetterId string) (*persistence.DeadLetter, error) {
+	deadLetter := persistence.DeadLetter{}
+	row := postgresClient.db.QueryRowContext(ctx, deadLetterSelect+` WHERE id = $1`, deadLetterId)
+	if err := scanDeadLetter(row, &deadLetter); err != nil {
+		return nil, toPersistenceError(err)
+	}
+	return &deadLetter, nil
+}
+
+func (postgresClient *PostgresClient) UpsertPendingApproval(ctx context.Context, approval *persistence.PendingApproval) error {
+	_, err := postgresClient.db.ExecContext(ctx, `INSERT INTO pending_approvals (id, account, request, product, plan,
+			pending_plan, reason, event_id, create_time)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (id) DO UPDATE SET account = $2, request = $3, product = $4, plan = $5, pending_plan = $6,
+			reason = $7, event_id = $8, create_time = $9`,
+		approval.Id, approval.Account, approval.Request, approval.Product, approval.Plan, approval.PendingPlan,
+		approval.Reason, approval.EventId, approval.CreateTime)
+	return toPersistenceError(err)
+}
+
+func (postgresClient *PostgresClient) DeletePendingApproval(ctx context.Context, entitlementId string) error {
+	_, err := postgresClient.db.ExecContext(ctx, `DELETE FROM pending_approvals WHERE id = $1`, entitlementId)
+	return err
+}
+
+func (postgresClient *PostgresClient) GetPendingApproval(ctx context.Context, entitlementId string) (*persistence.PendingApproval, error) {
+	approval := persistence.PendingApproval{}
+	row := postgresClient.db.QueryRowContext(ctx, approvalSelect+` WHERE id = $1`, entitlementId)
+	if err := scanPendingApproval(row, &approval); err != nil {
+		return nil, toPersistenceError(err)
+	}
+	return &approval, nil
+}
+
+func (postgresClient *PostgresClient) CreateUsageRecord(ctx context.Context, record *persistence.UsageRecord) error {
+	_, err := postgresClient.db.ExecContext(ctx, `INSERT INTO usage_records (id, entitlement_id, metric, quantity,
+			start_time, end_time, report_id, create_time)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+		record.Id, record.EntitlementId, record.Metric, record.Quantity, record.StartTime, record.EndTime, record.ReportId,
+		record.CreateTime)
+	return toPersistenceError(err)
+}
+
+func (postgresClient *PostgresClient) GetUsageRecord(ctx context.Context, recordId string) (*persistence.UsageRecord, error) {
+	record := persistence.UsageRecord{}
+	row := postgresClient.db.QueryRowContext(ctx, usageRecordSelect+` WHERE id = $1`, recordId)
+	if err := scanUsageRecord(row, &record); err != nil {
+		return nil, toPersistenceError(err)
+	}
+	return &record, nil
+}
+
+func (postgresClient *PostgresClient) CreateUsageReport(ctx context.Context, report *persistence.UsageReport) error {
+	tx, err := postgresClient.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := upsertUsageReport(ctx, tx, report, false); err != nil {
+		return toPersistenceError(err)
+	}
+	result, err := tx.ExecContext(ctx, `UPDATE usage_records SET report_id = $1 WHERE id = ANY($2) AND report_id = ''`,
+		report.Id, pq.Array(report.RecordIds))
+	if err != nil {
+		return toPersistenceError(err)
+	}
+	//a record that is missing or already in another report is not updated
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated != int64(len(report.RecordIds)) {
+		return persistence.ErrConflict
+	}
+	return toPersistenceError(tx.Commit())
+}
+
+func (postgresClient *PostgresClient) UpsertUsageReport(ctx context.Context, report *persistence.UsageReport) error {
+	return toPersistenceError(upsertUsageReport(ctx, postgresClient.db, report, true))
+}
+
+func (postgresClient *PostgresClient) GetUsageReport(ctx context.Context, reportId string) (*persistence.UsageReport, error) {
+	report := persistence.UsageReport{}
+	row := postgresClient.db.QueryRowContext(ctx, usageReportSelect+` WHERE id = $1`, reportId)
+	if err := scanUsageReport(row, &report); err != nil {
+		return nil, toPersistenceError(err)
+	}
+	return &report, nil
+}
+
+func (postgresClient *PostgresClient) UpsertEntitlement(ctx context.Context, entitlement *persistence.Entitlement, ifVersion int64) error {
+	tx, err := postgresClient.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	current := persistence.Entitlement{}
+	row := tx.QueryRowContext(ctx, entitlementSelect+` WHERE id = $1 FOR UPDATE`, entitlement.Id)
+	exists, err := checkLocked(scanEntitlement(row, &current), current.Version, ifVersion)
+	if err != nil {
+		return err
+	}
+	version := current.Version
+	//only delete and restore change the deleted time
+	entitlement.DeletedTime = current.DeletedTime
+	persistence.KeepApprovals(&current, entitlement)
+	approvals, err := approvalsJSON(entitlement.Approvals)
+	if err != nil {
+		return err
+	}
+	statement := `INSERT INTO entitlements (id, name, account, provider, product, plan, new_pending_plan,
+			state, update_time, create_time, usage_reporting_id, message_to_user, version, approvals, approval_state)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)`
+	if exists {
+		statement = `UPDATE entitlements SET name = $2, account = $3, provider = $4, product = $5, plan = $6,
+			new_pending_plan = $7, state = $8, update_time = $9, create_time = $10, usage_reporting_id = $11,
+			message_to_user = $12, version = $13, approvals = $14, approval_state = $15 WHERE id = $1`
+	}
+	if _, err := tx.ExecContext(ctx, statement,
+		entitlement.Id, entitlement.Name, entitlement.Account, entitlement.Provider, entitlement.Product, entitlement.Plan,
+		entitlement.NewPendingPlan, entitlement.State, entitlement.UpdateTime, entitlement.CreateTime,
+		entitlement.UsageReportingId, entitlement.MessageToUser, version+1, approvals, entitlement.ApprovalState); err != nil {
+		return toPersistenceError(err)
+	}
+	if err := insertHistory(ctx, tx, persistence.NewHistoryEntry(ctx, &current, entitlement, version+1)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return toPersistenceError(err)
+	}
+	entitlement.Version = version + 1
+	return nil
+}
+
+func (postgresClient *PostgresClient) DeleteEntitlement(ctx context.Context, entitlementId string) error {
+	return postgresClient.setEntitlementDeletedTime(ctx, entitlementId, persistence.FormatDeletedTime(time.Now()))
+}
+
+func (postgresClient *PostgresClient) RestoreEntitlement(ctx context.Context, entitlementId string) error {
+	return postgresClient.setEntitlementDeletedTime(ctx, entitlementId, "")
+}
+
+func (postgresClient *PostgresClient) GetEntitlement(ctx context.Context, entitlementId string) (*persistence.Entitlement, error) {
+	entitlement := persistence.Entitlement{}
+	row := postgresClient.db.QueryRowContext(ctx, entitlementSelect+` WHERE id = $1`, entitlementId)
+	if err := scanEntitlement(row, &entitlement); err != nil {
+		return nil, toPersistenceError(err)
+	}
+	return &entitlement, nil
+}
+
+func (postgresClient *PostgresClient) QueryEntitlements(ctx context.Context, query persistence.Query) ([]persistence.Entitlement, string, error) {
+	sqlQuery, args, err := buildQuery(entitlementSelect, entitlementColumns, entitlementOmitEmpty, "id", query)
+	if err != nil {
+		return nil, "", err
+	}
+	return postgresClient.queryEntitlements(ctx, sqlQuery, args, query)
+}
+
+func (postgresClient *PostgresClient) QueryAccountEntitlements(ctx context.Context, accountId string, query persistence.Query) ([]persistence.Entitlement, string, error) {
+	if accountId == "" {
+		return nil, "", errors.New("Must specify account name.")
+	}
+	query.Filters = append([]persistence.Filter{{Property: "account", Operator: "=", Value: accountId}}, query.Filters...)
+	sqlQuery, args, err := buildQuery(entitlementSelect, entitlementColumns, entitlementOmitEmpty, "id", query)
+	if err != nil {
+		return nil, "", err
+	}
+	return postgresClient.queryEntitlements(ctx, sqlQuery, args, query)
+}
+
+func (postgresClient *PostgresClient) QueryAccounts(ctx context.Context, query persistence.Query) ([]persistence.Account, string, error) {
+	sqlQuery, args, err := buildQuery(accountSelect, accountColumns, accountOmitEmpty, "id", query)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rows, err := postgresClient.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var accounts []persistence.Account
+	for rows.Next() {
+		account := persistence.Account{}
+		if err := scanAccount(rows, &account); err != nil {
+			return nil, "", err
+		}
+		accounts = append(accounts, account)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if query.Limit > 0 && len(accounts) > query.Limit {
+		accounts = accounts[:query.Limit]
+		nextCursor = pageCursor(query, &accounts[query.Limit-1], "id")
+	}
+	if err := loadApprovals(ctx, postgresClient.db, accounts); err != nil {
+		return nil, "", err
+	}
+	return accounts, nextCursor, nil
+}
+
+func (postgresClient *PostgresClient) QueryContacts(ctx context.Context, query persistence.Query) ([]persistence.Contact, string, error) {
+	sqlQuery, args, err := buildQuery(contactSelect, contactColumns, contactOmitEmpty, "account_id", query)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rows, err := postgresClient.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var contacts []persistence.Contact
+	for rows.Next() {
+		contact := persistence.Contact{}
+		if err := scanContact(rows, &contact); err != nil {
+			return nil, "", err
+		}
+		contacts = append(contacts, contact)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if query.Limit > 0 && len(contacts) > query.Limit {
+		contacts = contacts[:query.Limit]
+		nextCursor = pageCursor(query, &contacts[query.Limit-1], "accountId")
+	}
+	return contacts, nextCursor, nil
+}
+
+func (postgresClient *PostgresClient) QueryEvents(ctx context.Context, query persistence.Query) ([]persistence.Event, string, error) {
+	sqlQuery, args, err := buildQuery(eventSelect, eventColumns, eventOmitEmpty, "id", query)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rows, err := postgresClient.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var events []persistence.Event
+	for rows.Next() {
+		event := persistence.Event{}
+		if err := scanEvent(rows, &event); err != nil {
+			return nil, "", err
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if query.Limit > 0 && len(events) > query.Limit {
+		events = events[:query.Limit]
+		nextCursor = pageCursor(query, &events[query.Limit-1], "id")
+	}
+	return events, nextCursor, nil
+}
+
+func (postgresClient *PostgresClient) QueryDeadLetters(ctx context.Context, query persistence.Query) ([]persistence.DeadLetter, string, error) {
+	sqlQuery, args, err := buildQuery(deadLetterSelect, deadLetterColumns, deadLetterOmitEmpty, "id", query)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rows, err := postgresClient.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var deadLetters []persistence.DeadLetter
+	for rows.Next() {
+		deadLetter := persistence.DeadLetter{}
+		if err := scanDeadLetter(rows, &deadLetter); err != nil {
+			return nil, "", err
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if query.Limit > 0 && len(deadLetters) > query.Limit {
+		deadLetters = deadLetters[:query.Limit]
+		nextCursor = pageCursor(query, &deadLetters[query.Limit-1], "id")
+	}
+	return deadLetters, nextCursor, nil
+}
+
+func (postgresClient *PostgresClient) QueryPendingApprovals(ctx context.Context, query persistence.Query) ([]persistence.PendingApproval, string, error) {
+	sqlQuery, args, err := buildQuery(approvalSelect, approvalColumns, approvalOmitEmpty, "id", query)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rows, err := postgresClient.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var approvals []persistence.PendingApproval
+	for rows.Next() {
+		approval := persistence.PendingApproval{}
+		if err := scanPendingApproval(rows, &approval); err != nil {
+			return nil, "", err
+		}
+		approvals = append(approvals, approval)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if query.Limit > 0 && len(approvals) > query.Limit {
+		approvals = approvals[:query.Limit]
+		nextCursor = pageCursor(query, &approvals[query.Limit-1], "id")
+	}
+	return approvals, nextCursor, nil
+}
+
+func (postgresClient *PostgresClient) QueryUsageRecords(ctx context.Context, query persistence.Query) ([]persistence.UsageRecord, string, error) {
+	sqlQuery, args, err := buildQuery(usageRecordSelect, usageRecordColumns, usageRecordOmitEmpty, "id", query)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rows, err := postgresClient.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var records []persistence.UsageRecord
+	for rows.Next() {
+		record := persistence.UsageRecord{}
+		if err := scanUsageRecord(rows, &record); err != nil {
+			return nil, "", err
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if query.Limit > 0 && len(records) > query.Limit {
+		records = records[:query.Limit]
+		nextCursor = pageCursor(query, &records[query.Limit-1], "id")
+	}
+	return records, nextCursor, nil
+}
+
+func (postgresClient *PostgresClient) QueryUsageReports(ctx context.Context, query persistence.Query) ([]persistence.UsageReport, string, error) {
+	sqlQuery, args, err := buildQuery(usageReportSelect, usageReportColumns, usageReportOmitEmpty, "id", query)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rows, err := postgresClient.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var reports []persistence.UsageReport
+	for rows.Next() {
+		report := persistence.UsageReport{}
+		if err := scanUsageReport(rows, &report); err != nil {
+			return nil, "", err
+		}
+		reports = append(reports, report)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if query.Limit > 0 && len(reports) > query.Limit {
+		reports = reports[:query.Limit]
+		nextCursor = pageCursor(query, &reports[query.Limit-1], "id")
+	}
+	return reports, nextCursor, nil
+}
+
+func (postgresClient *PostgresClient) QueryHistory(ctx context.Context, entityKind string, entityId string, query persistence.Query) ([]persistence.HistoryEntry, string, error) {
+	query.Filters = append([]persistence.Filter{
+		{Property: "entityKind", Operator: "=", Value: entityKind},
+		{Property: "entityId", Operator: "=", Value: entityId},
+	}, query.Filters...)
+	sqlQuery, args, err := buildQuery(historySelect, historyColumns, historyOmitEmpty, "id", query)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rows, err := postgresClient.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var history []persistence.HistoryEntry
+	for rows.Next() {
+		entry := persistence.HistoryEntry{}
+		var changes []byte
+		if err := rows.Scan(&entry.Id, &entry.EntityKind, &entry.EntityId, &entry.Version, &entry.ChangeTime, &entry.Source, &changes); err != nil {
+			return nil, "", err
+		}
+		if err := json.Unmarshal(changes, &entry.Changes); err != nil {
+			return nil, "", err
+		}
+		history = append(history, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if query.Limit > 0 && len(history) > query.Limit {
+		history = history[:query.Limit]
+		nextCursor = pageCursor(query, &history[query.Limit-1], "id")
+	}
+	return history, nextCursor, nil
+}
+
+func (postgresClient *PostgresClient) PurgeDeleted(ctx context.Context, deletedBefore time.Time) (int, error) {
+	tx, err := postgresClient.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	before := persistence.FormatDeletedTime(deletedBefore)
+	//approvals are removed with their account by the foreign key
+	if _, err := tx.ExecContext(ctx, `DELETE FROM contacts WHERE account_id IN
+		(SELECT id FROM accounts WHERE deleted_time <> '' AND deleted_time < $1)`, before); err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, statement := range []string{
+		`DELETE FROM accounts WHERE deleted_time <> '' AND deleted_time < $1`,
+		`DELETE FROM entitlements WHERE deleted_time <> '' AND deleted_time < $1`,
+	} {
+		result, err := tx.ExecContext(ctx, statement, before)
+		if err != nil {
+			return 0, err
+		}
+		count, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		purged += int(count)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, toPersistenceError(err)
+	}
+	return purged, nil
+}
+
+func (postgresClient *PostgresClient) Healthz(ctx context.Context) error {
+	return postgresClient.db.PingContext(ctx)
+}
+
+func (postgresClient *PostgresClient) Close() error {
+	return postgresClient.db.Close()
+}
+
+func (postgresClient *PostgresClient) queryEntitlements(ctx context.Context, sqlQuery string, args []interface{}, query persistence.Query) ([]persistence.Entitlement, string, error) {
+	rows, err := postgresClient.db.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var entitlements []persistence.Entitlement
+	for rows.Next() {
+		entitlement := persistence.Entitlement{}
+		if err := scanEntitlement(rows, &entitlement); err != nil {
+			return nil, "", err
+		}
+		entitlements = append(entitlements, entitlement)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	nextCursor := ""
+	if query.Limit > 0 && len(entitlements) > query.Limit {
+		entitlements = entitlements[:query.Limit]
+		nextCursor = pageCursor(query, &entitlements[query.Limit-1], "id")
+	}
+	return entitlements, nextCursor, nil
+}
+
+//setAccountDeletedTime soft deletes an account, or restores it when deletedTime is empty, incrementing its version
+//and recording the change in its history.
+func (postgresClient *PostgresClient) setAccountDeletedTime(ctx context.Context, accountId string, deletedTime string) error {
+	tx, err := postgresClient.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := setAccountDeletedTimeInTx(ctx, tx, accountId, deletedTime); err != nil {
+		return err
+	}
+	return toPersistenceError(tx.Commit())
+}
+
+//setAccountDeletedTimeInTx is setAccountDeletedTime within a caller's transaction. It returns whether the account
+//was changed.
+func setAccountDeletedTimeInTx(ctx context.Context, tx *sql.Tx, accountId string, deletedTime string) (bool, error) {
+	current := persistence.Account{}
+	row := tx.QueryRowContext(ctx, accountSelect+` WHERE id = $1 FOR UPDATE`, accountId)
+	if err := scanAccount(row, &current); err == sql.ErrNoRows && deletedTime != "" {
+		return false, nil
+	} else if err != nil {
+		return false, toPersistenceError(err)
+	}
+	if (current.DeletedTime != "") == (deletedTime != "") {
+		return false, nil
+	}
+
+	account := current
+	account.DeletedTime = deletedTime
+	account.Version = current.Version + 1
+	if _, err := tx.ExecContext(ctx, `UPDATE accounts SET deleted_time = $2, version = $3 WHERE id = $1`,
+		accountId, account.DeletedTime, account.Version); err != nil {
+		return false, toPersistenceError(err)
+	}
+	if err := insertHistory(ctx, tx, persistence.NewHistoryEntry(ctx, &current, &account, account.Version)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//setEntitlementDeletedTime soft deletes an entitlement, or restores it when deletedTime is empty, incrementing its
+//version and recording the change in its history.
+func (postgresClient *PostgresClient) setEntitlementDeletedTime(ctx context.Context, entitlementId string, deletedTime string) error {
+	tx, err := postgresClient.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := setEntitlementDeletedTimeInTx(ctx, tx, entitlementId, deletedTime); err != nil {
+		return err
+	}
+	return toPersistenceError(tx.Commit())
+}
+
+//setEntitlementDeletedTimeInTx is setEntitlementDeletedTime within a caller's transaction. It returns whether the
+//entitlement was changed.
+func setEntitlementDeletedTimeInTx(ctx context.Context, tx *sql.Tx, entitlementId string, deletedTime string) (bool, error) {
+	current := persistence.Entitlement{}
+	row := tx.QueryRowContext(ctx, entitlementSelect+` WHERE id = $1 FOR UPDATE`, entitlementId)
+	if err := scanEntitlement(row, &current); err == sql.ErrNoRows && deletedTime != "" {
+		return false, nil
+	} else if err != nil {
+		return false, toPersistenceError(err)
+	}
+	if (current.DeletedTime != "") == (deletedTime != "") {
+		return false, nil
+	}
+
+	entitlement := current
+	entitlement.DeletedTime = deletedTime
+	entitlement.Version = current.Version + 1
+	if _, err := tx.ExecContext(ctx, `UPDATE entitlements SET deleted_time = $2, version = $3 WHERE id = $1`,
+		entitlementId, entitlement.DeletedTime, entitlement.Version); err != nil {
+		return false, toPersistenceError(err)
+	}
+	if err := insertHistory(ctx, tx, persistence.NewHistoryEntry(ctx, &current, &entitlement, entitlement.Version)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//pageCursor returns the cursor that continues after the last entity of a page.
+func pageCursor(query persistence.Query, last interface{}, keyProperty string) string {
+	orderValue := ""
+	if query.Order != "" {
+		orderValue = persistence.PropertyValue(last, strings.TrimPrefix(query.Order, "-"))
+	}
+	return persistence.EncodeCursor(orderValue, persistence.PropertyValue(last, keyProperty))
+}
+
+//loadApprovals fills in the approvals for the accounts with a single query.
+func loadApprovals(ctx context.Context, db queryer, accounts []persistence.Account) error {
+	if len(accounts) == 0 {
+		return nil
+	}
+	accountIds := make([]string, len(accounts))
+	accountIndex := make(map[string]int, len(accounts))
+	for i, account := range accounts {
+		accountIds[i] = account.Id
+		accountIndex[account.Id] = i
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT account_id, name, state, reason, update_time, approver FROM approvals
+		WHERE account_id = ANY($1) ORDER BY account_id, ordinal`, pq.Array(accountIds))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var accountId string
+		approval := persistence.Approval{}
+		if err := rows.Scan(&accountId, &approval.Name, &approval.State, &approval.Reason, &approval.UpdateTime, &approval.Approver); err != nil {
+			return err
+		}
+		i := accountIndex[accountId]
+		accounts[i].Approvals = append(accounts[i].Approvals, approval)
+	}
+	return rows.Err()
+}
+
+//checkLocked checks the version of a row selected FOR UPDATE, err is the error from scanning it. Two writers creating
+//the same row at once both see no row, the second insert fails with a unique violation and is reported as a conflict.
+func checkLocked(err error, version int64, ifVersion int64) (bool, error) {
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+	exists := err == nil
+	return exists, persistence.CheckVersion(exists, version, ifVersion)
+}
+
+//insertHistory records a history entry, if there is one, in the upsert transaction.
+func insertHistory(ctx context.Context, tx *sql.Tx, entry *persistence.HistoryEntry) error {
+	if entry == nil {
+		return nil
+	}
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO history (id, entity_kind, entity_id, version, change_time, source, changes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		entry.Id, entry.EntityKind, entry.EntityId, entry.Version, entry.ChangeTime, entry.Source, string(changes))
+	return toPersistenceError(err)
+}
+
+//toPersistenceError maps missing rows and constraint or serialization failures to the persistence errors.
+func toPersistenceError(err error) error {
+	if err == sql.ErrNoRows {
+		return persistence.ErrNotFound
+	}
+	if pqErr, ok := err.(*pq.Error); ok {
+		switch pqErr.Code {
+		case "23505", "40001":
+			return persistence.ErrConflict
+		}
+	}
+	return err
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+//execer is a *sql.DB or *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+//queryer is a *sql.DB or *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func scanAccount(row scanner, account *persistence.Account) error {
+	return row.Scan(&account.Id, &account.Name, &account.UpdateTime, &account.CreateTime, &account.Provider, &account.State,
+		&account.Version, &account.DeletedTime)
+}
+
+func scanContact(row scanner, contact *persistence.Contact) error {
+	return row.Scan(&contact.AccountId, &contact.FirstName, &contact.LastName, &contact.EmailAddress, &contact.Phone,
+		&contact.Company, &contact.Timezone, &contact.Version)
+}
+
+func scanEntitlement(row scanner, entitlement *persistence.Entitlement) error {
+	var approvals []byte
+	if err := row.Scan(&entitlement.Id, &entitlement.Name, &entitlement.Account, &entitlement.Provider, &entitlement.Product,
+		&entitlement.Plan, &entitlement.NewPendingPlan, &entitlement.State, &entitlement.UpdateTime, &entitlement.CreateTime,
+		&entitlement.UsageReportingId, &entitlement.MessageToUser, &entitlement.Version, &entitlement.DeletedTime,
+		&approvals, &entitlement.ApprovalState); err != nil {
+		return err
+	}
+	entitlement.Approvals = nil
+	return json.Unmarshal(approvals, &entitlement.Approvals)
+}
+
+//approvalsJSON returns the approvals of an entitlement for its JSONB column, an empty array if there are none.
+func approvalsJSON(approvals []persistence.Approval) (string, error) {
+	if len(approvals) == 0 {
+		return "[]", nil
+	}
+	approvalsBytes, err := json.Marshal(approvals)
+	return string(approvalsBytes), err
+}
+
+//buildQuery maps the parsed filters and "[-]property" order to a WHERE and ORDER BY clause. Only known properties are accepted so user input never reaches the SQL text. Rows are always ordered by
+//key last so results are stable, which lets the cursor continue from the last row of the previous page. One row more
+//than the limit is selected so callers can tell whether there is a next page. Filtering or ordering on an omitEmpty
+//property skips rows where its column is empty, as datastore and the memory backend skip entities without it.
+func buildQuery(selectClause string, columns map[string]string, omitEmpty map[string]bool, keyColumn string, query persistence.Query) (string, []interface{}, error) {
+	sqlQuery := selectClause
+	var conditions []string
+	var args []interface{}
+	if _, ok := columns["deletedTime"]; ok && !query.IncludeDeleted {
+		conditions = append(conditions, "deleted_time = ''")
+	}
+	guarded := map[string]bool{}
+	guardEmpty := func(property string, column string) {
+		if omitEmpty[property] && !guarded[column] {
+			guarded[column] = true
+			conditions = append(conditions, column+" <> ''")
+		}
+	}
+	for _, filter := range query.Filters {
+		column, ok := columns[filter.Property]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown property %s", filter.Property)
+		}
+		guardEmpty(filter.Property, column)
+		if filter.Operator == "IN" {
+			args = append(args, pq.Array(filter.Values))
+			conditions = append(conditions, fmt.Sprintf("%s = ANY($%d)", column, len(args)))
+		} else {
+			args = append(args, filter.Value)
+			conditions = append(conditions, fmt.Sprintf("%s %s $%d", column, filter.Operator, len(args)))
+		}
+	}
+
+	orderColumn := keyColumn
+	descending := strings.HasPrefix(query.Order, "-")
+	if query.Order != "" {
+		property := strings.TrimPrefix(query.Order, "-")
+		column, ok := columns[property]
+		if !ok {
+			return "", nil, fmt.Errorf("unknown order property %s", query.Order)
+		}
+		guardEmpty(property, column)
+		orderColumn = column
+	}
+	comparison := ">"
+	direction := ""
+	if descending {
+		comparison = "<"
+		direction = " DESC"
+	}
+
+	if query.Cursor != "" {
+		orderValue, key, err := persistence.DecodeCursor(query.Cursor)
+		if err != nil {
+			return "", nil, err
+		}
+		if orderColumn == keyColumn {
+			args = append(args, key)
+			conditions = append(conditions, fmt.Sprintf("%s %s $%d", keyColumn, comparison, len(args)))
+		} else {
+			args = append(args, orderValue, key)
+			conditions = append(conditions, fmt.Sprintf("(%s %s $%d OR (%s = $%d AND %s > $%d))",
+				orderColumn, comparison, len(args)-1, orderColumn, len(args)-1, keyColumn, len(args)))
+		}
+	}
+	if len(conditions) > 0 {
+		sqlQuery += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	orderBy := orderColumn + direction
+	if orderColumn != keyColumn {
+		orderBy += ", " + keyColumn
+	}
+	sqlQuery += " ORDER BY " + orderBy
+	if query.Limit > 0 {
+		sqlQuery += fmt.Sprintf(" LIMIT %d", query.Limit+1)
+	}
+	return sqlQuery, args, nil
+}
+
+//omitEmptyProperties returns the datastore properties of a model that are tagged omitempty.
+func omitEmptyProperties(model interface{}) map[string]bool {
+	properties := map[string]bool{}
+	modelType := reflect.TypeOf(model)
+	for i := 0; i < modelType.NumField(); i++ {
+		tag := strings.Split(modelType.Field(i).Tag.Get("datastore"), ",")
+		for _, option := range tag[1:] {
+			if option == "omitempty" {
+				properties[tag[0]] = true
+			}
+		}
+	}
+	return properties
+}
+
+func scanEvent(row scanner, event *persistence.Event) error {
+	return row.Scan(&event.Id, &event.EventType, &event.EntityId, &event.Outcome, &event.Attempts, &event.Error,
+		&event.ProcessedTime)
+}
+
+func scanDeadLetter(row scanner, deadLetter *persistence.DeadLetter) error {
+	return row.Scan(&deadLetter.Id, &deadLetter.EventId, &deadLetter.EventType, &deadLetter.Data, &deadLetter.Error,
+		&deadLetter.Attempts, &deadLetter.CreateTime)
+}
+
+func scanPendingApproval(row scanner, approval *persistence.PendingApproval) error {
+	return row.Scan(&approval.Id, &approval.Account, &approval.Request, &approval.Product, &approval.Plan,
+		&approval.PendingPlan, &approval.Reason, &approval.EventId, &approval.CreateTime)
+}
+
+func scanUsageRecord(row scanner, record *persistence.UsageRecord) error {
+	return row.Scan(&record.Id, &record.EntitlementId, &record.Metric, &record.Quantity, &record.StartTime, &record.EndTime,
+		&record.ReportId, &record.CreateTime)
+}
+
+func scanUsageReport(row scanner, report *persistence.UsageReport) error {
+	var metrics, recordIds []byte
+	if err := row.Scan(&report.Id, &report.EntitlementId, &report.UsageReportingId, &report.ServiceName, &report.StartTime,
+		&report.EndTime, &metrics, &recordIds, &report.State, &report.Attempts, &report.Error, &report.CreateTime,
+		&report.SentTime); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(metrics, &report.Metrics); err != nil {
+		return err
+	}
+	return json.Unmarshal(recordIds, &report.RecordIds)
+}
+
+//upsertUsageReport inserts a usage report, or also replaces an existing one if replace is set.
+func upsertUsageReport(ctx context.Context, db execer, report *persistence.UsageReport, replace bool) error {
+	metrics, err := json.Marshal(report.Metrics)
+	if err != nil {
+		return err
+	}
+	recordIds, err := json.Marshal(report.RecordIds)
+	if err != nil {
+		return err
+	}
+	statement := `INSERT INTO usage_reports (id, entitlement_id, usage_reporting_id, service_name, start_time, end_time,
+			metrics, record_ids, state, attempts, error, create_time, sent_time)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
+	if replace {
+		statement += `
+		ON CONFLICT (id) DO UPDATE SET entitlement_id = $2, usage_reporting_id = $3, service_name = $4, start_time = $5,
+			end_time = $6, metrics = $7, record_ids = $8, state = $9, attempts = $10, error = $11, create_time = $12,
+			sent_time = $13`
+	}
+	_, err = db.ExecContext(ctx, statement, report.Id, report.EntitlementId, report.UsageReportingId, report.ServiceName,
+		report.StartTime, report.EndTime, string(metrics), string(recordIds), report.State, report.Attempts, report.Error,
+		report.CreateTime, report.SentTime)
+	return err
+}
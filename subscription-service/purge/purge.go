@@ -0,0 +1,41 @@
+package purge
+
+import (
+	"context"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/persistence"
+	"github.com/jefferyfry/funclog"
+	"time"
+)
+
+var (
+	LogI = funclog.NewInfoLogger("INFO: ")
+	LogE = funclog.NewErrorLogger("ERROR: ")
+)
+
+//Run permanently removes accounts and entitlements that have been soft deleted for longer than retention, checking
+//every interval. Each purge gets the same deadline as a request. Run returns when ctx is done.
+func Run(ctx context.Context, dbHandler persistence.DatabaseHandler, retention time.Duration, interval time.Duration, timeout time.Duration) {
+	LogI.Printf("Purging accounts and entitlements deleted more than %s ago every %s \n", retention, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purgeDeleted(dbHandler, retention, timeout)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func purgeDeleted(dbHandler persistence.DatabaseHandler, retention time.Duration, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(persistence.WithSource(context.Background(), "subscription-service purge"), timeout)
+	defer cancel()
+
+	deletedBefore := time.Now().Add(-retention)
+	if purged, err := dbHandler.PurgeDeleted(ctx, deletedBefore); err != nil {
+		LogE.Printf("Error purging records deleted before %s: %#v \n", deletedBefore.Format(time.RFC3339), err)
+	} else if purged > 0 {
+		LogI.Printf("Purged %d accounts and entitlements deleted before %s \n", purged, deletedBefore.Format(time.RFC3339))
+	}
+}
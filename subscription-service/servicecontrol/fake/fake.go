@@ -0,0 +1,175 @@
+//Package fake is an in-memory Service Control API for running usage reporting without GCP. It serves the report
+//method from an httptest server, drops operations it already received as the real API does, and can fail requests
+//and reject consumers to exercise retries.
+package fake
+
+import (
+	"encoding/json"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/servicecontrol"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Server is a fake Service Control API. Its methods are safe for concurrent use with the requests it serves.
+type Server struct {
+	*httptest.Server
+
+	mutex        sync.Mutex
+	operations   map[string][]servicecontrol.Operation
+	operationIds map[string]bool
+	requests     int
+	failures     int
+	failStatus   int
+	rejected     map[string]string
+}
+
+//NewServer starts a fake Service Control API. Close it when done.
+func NewServer() *Server {
+	srv := &Server{
+		operations:   map[string][]servicecontrol.Operation{},
+		operationIds: map[string]bool{},
+		rejected:     map[string]string{},
+	}
+	srv.Server = httptest.NewServer(http.HandlerFunc(srv.serveHTTP))
+	return srv
+}
+
+//Client returns a Service Control client for the server. The server URL is also the root url of the API for services
+//configured with it.
+func (srv *Server) Client() servicecontrol.Client {
+	return servicecontrol.NewClientWithHTTPClient(srv.URL, srv.Server.Client())
+}
+
+//FailNext makes the next count report requests fail with the HTTP status, such as 503, before they are recorded.
+func (srv *Server) FailNext(count int, status int) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.failures = count
+	srv.failStatus = status
+}
+
+//Reject makes the operations of consumerId fail with INVALID_ARGUMENT and the message, as for an entitlement that is
+//no longer active.
+func (srv *Server) Reject(consumerId string, message string) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	srv.rejected[consumerId] = message
+}
+
+//Operations returns the operations received for serviceName, without duplicates, in the order they were received.
+func (srv *Server) Operations(serviceName string) []servicecontrol.Operation {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return append([]servicecontrol.Operation{}, srv.operations[serviceName]...)
+}
+
+//Usage returns the total of a metric reported for consumerId to serviceName.
+func (srv *Server) Usage(serviceName string, consumerId string, metricName string) int64 {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	total := int64(0)
+	for _, operation := range srv.operations[serviceName] {
+		if operation.ConsumerId != consumerId {
+			continue
+		}
+		for _, metricValueSet := range operation.MetricValueSets {
+			if metricValueSet.MetricName != metricName {
+				continue
+			}
+			for _, metricValue := range metricValueSet.MetricValues {
+				value, _ := strconv.ParseInt(metricValue.Int64Value, 10, 64)
+				total += value
+			}
+		}
+	}
+	return total
+}
+
+//Requests returns the number of report requests received, including failed ones.
+func (srv *Server) Requests() int {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.requests
+}
+
+func (srv *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+
+	//services/{serviceName}:report
+	path := strings.TrimPrefix(r.URL.Path, "/v1/services/")
+	if r.Method != http.MethodPost || path == r.URL.Path || !strings.HasSuffix(path, ":report") {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "unknown resource "+r.URL.Path)
+		return
+	}
+	serviceName := strings.TrimSuffix(path, ":report")
+
+	srv.requests++
+	if srv.failures > 0 {
+		srv.failures--
+		writeError(w, srv.failStatus, http.StatusText(srv.failStatus), "fake failure")
+		return
+	}
+
+	request := struct {
+		Operations []servicecontrol.Operation `json:"operations"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", err.Error())
+		return
+	}
+
+	response := servicecontrol.ReportResponse{ServiceConfigId: "fake"}
+	for _, operation := range request.Operations {
+		if message := checkOperation(operation, srv.rejected); message != "" {
+			response.ReportErrors = append(response.ReportErrors, servicecontrol.ReportError{
+				OperationId: operation.OperationId,
+				Status:      servicecontrol.Status{Code: 3, Message: message},
+			})
+			continue
+		}
+		if srv.operationIds[operation.OperationId] {
+			continue
+		}
+		srv.operationIds[operation.OperationId] = true
+		srv.operations[serviceName] = append(srv.operations[serviceName], operation)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+//checkOperation returns why an operation is rejected, or "" if it is valid.
+func checkOperation(operation servicecontrol.Operation, rejected map[string]string) string {
+	if operation.OperationId == "" || operation.ConsumerId == "" {
+		return "operationId and consumerId are required"
+	}
+	if message, ok := rejected[operation.ConsumerId]; ok {
+		return message
+	}
+	startTime, startErr := time.Parse(time.RFC3339Nano, operation.StartTime)
+	endTime, endErr := time.Parse(time.RFC3339Nano, operation.EndTime)
+	if startErr != nil || endErr != nil || endTime.Before(startTime) {
+		return "startTime and endTime must be timestamps and startTime must not be after endTime"
+	}
+	for _, metricValueSet := range operation.MetricValueSets {
+		for _, metricValue := range metricValueSet.MetricValues {
+			if _, err := strconv.ParseInt(metricValue.Int64Value, 10, 64); err != nil {
+				return "invalid int64Value for " + metricValueSet.MetricName
+			}
+		}
+	}
+	return ""
+}
+
+//writeError writes an error in the format of the Google APIs.
+func writeError(w http.ResponseWriter, code int, status string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "message": message, "status": status},
+	})
+}
@@ -0,0 +1,185 @@
+//Package servicecontrol is a client for the Service Control API, which the marketplace bills the usage of usage-based
+//plans from.
+package servicecontrol
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/jefferyfry/funclog"
+	"golang.org/x/oauth2/google"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+)
+
+var (
+	LogI = funclog.NewInfoLogger("INFO: ")
+	LogE = funclog.NewErrorLogger("ERROR: ")
+)
+
+//Client sends usage reports to Service Control.
+type Client interface {
+	//Report sends operations to the service of a product. Service Control drops an operation whose id it already
+	//received, so an operation can be sent again when it is not known whether it arrived.
+	Report(ctx context.Context, serviceName string, operations []Operation) error
+}
+
+//Operation is the usage of a consumer, the usageReportingId of an entitlement, between StartTime and EndTime.
+type Operation struct {
+	OperationId     string           `json:"operationId"`
+	OperationName   string           `json:"operationName"`
+	ConsumerId      string           `json:"consumerId"`
+	StartTime       string           `json:"startTime"`
+	EndTime         string           `json:"endTime"`
+	MetricValueSets []MetricValueSet `json:"metricValueSets"`
+}
+
+type MetricValueSet struct {
+	MetricName   string        `json:"metricName"`
+	MetricValues []MetricValue `json:"metricValues"`
+}
+
+//MetricValue is an int64 value, which the API encodes as a string.
+type MetricValue struct {
+	Int64Value string `json:"int64Value"`
+}
+
+//Int64Value returns a metric value for value.
+func Int64Value(value int64) MetricValue {
+	return MetricValue{strconv.FormatInt(value, 10)}
+}
+
+//ReportResponse is the response to a report. ReportErrors are the operations that were rejected.
+type ReportResponse struct {
+	ReportErrors    []ReportError `json:"reportErrors,omitempty"`
+	ServiceConfigId string        `json:"serviceConfigId,omitempty"`
+}
+
+type ReportError struct {
+	OperationId string `json:"operationId"`
+	Status      Status `json:"status"`
+}
+
+//Status is a google.rpc.Status.
+type Status struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+//Error is an error response from Service Control, or an operation it rejected in a successful response.
+type Error struct {
+	StatusCode  int
+	Status      string
+	OperationId string
+	//Code is the google.rpc code of a rejected operation
+	Code int
+}
+
+func (err *Error) Error() string {
+	if err.OperationId != "" {
+		return "Service Control rejected operation " + err.OperationId + ": " + err.Status
+	}
+	return "Service Control report received error response: " + err.Status
+}
+
+//google.rpc codes that may not happen again
+const (
+	codeDeadlineExceeded  = 4
+	codeResourceExhausted = 8
+	codeAborted           = 10
+	codeInternal          = 13
+	codeUnavailable       = 14
+)
+
+//IsTransient returns whether a report that failed with err may succeed if it is sent again: it could not be sent or
+//its response read, the response was 429 or 5xx, or the operation was rejected as unavailable, aborted, exhausted or
+//internal.
+func IsTransient(err error) bool {
+	apiErr, ok := err.(*Error)
+	if !ok {
+		return true
+	}
+	if apiErr.OperationId != "" {
+		switch apiErr.Code {
+		case codeDeadlineExceeded, codeResourceExhausted, codeAborted, codeInternal, codeUnavailable:
+			return true
+		}
+		return false
+	}
+	return apiErr.StatusCode == http.StatusTooManyRequests || apiErr.StatusCode >= 500
+}
+
+type client struct {
+	serviceControlUrl string
+	httpClient        *http.Client
+}
+
+//NewClient returns a client for the Service Control API at serviceControlUrl that authenticates with the Google
+//application default credentials.
+func NewClient(serviceControlUrl string) Client {
+	return NewClientWithHTTPClient(serviceControlUrl, nil)
+}
+
+//NewClientWithHTTPClient returns a client that sends requests with httpClient, or with the Google application default
+//credentials if httpClient is nil.
+func NewClientWithHTTPClient(serviceControlUrl string, httpClient *http.Client) Client {
+	return &client{
+		serviceControlUrl: strings.TrimSuffix(serviceControlUrl, "/"),
+		httpClient:        httpClient,
+	}
+}
+
+func (c *client) Report(ctx context.Context, serviceName string, operations []Operation) error {
+	httpClient := c.httpClient
+	if httpClient == nil {
+		var err error
+		if httpClient, err = google.DefaultClient(ctx, "https://www.googleapis.com/auth/servicecontrol"); err != nil {
+			LogE.Printf("Failed to create oath2 client for the Service Control API %#v \n", err)
+			return err
+		}
+	}
+
+	reportUrl := c.serviceControlUrl + "/v1/services/" + serviceName + ":report"
+	body, err := json.Marshal(map[string]interface{}{"operations": operations})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, reportUrl, bytes.NewBuffer(body))
+	if err != nil {
+		LogE.Printf("Failed creating usage report request %s %#v \n", reportUrl, err)
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req = req.WithContext(ctx)
+
+	LogI.Printf("Usage report: POST %s \n", reportUrl)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		LogE.Printf("Failed sending usage report request %s %#v \n", reportUrl, err)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		LogE.Println("Usage report received error response: ", resp.StatusCode)
+		responseDump, _ := httputil.DumpResponse(resp, true)
+		LogE.Println(string(responseDump))
+		return &Error{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	response := ReportResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		LogE.Printf("Error decoding usage report response %s %#v \n", reportUrl, err)
+		return err
+	}
+	for _, reportError := range response.ReportErrors {
+		LogE.Printf("Service Control rejected operation %s: %d %s \n", reportError.OperationId, reportError.Status.Code, reportError.Status.Message)
+	}
+	if len(response.ReportErrors) > 0 {
+		reportError := response.ReportErrors[0]
+		return &Error{resp.StatusCode, reportError.Status.Message, reportError.OperationId, reportError.Status.Code}
+	}
+	LogI.Printf("Usage report %s %s", reportUrl, resp.Status)
+	return nil
+}
@@ -0,0 +1,157 @@
+package servicecontrol_test
+
+import (
+	"context"
+	"errors"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/servicecontrol"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/servicecontrol/fake"
+	"net/http"
+	"testing"
+)
+
+const (
+	testServiceName = "product-a.cloudbees.cloud.goog"
+	testConsumerId  = "project_number:1"
+	testMetricName  = testServiceName + "/requests"
+)
+
+func operation(operationId string, quantity int64) servicecontrol.Operation {
+	return servicecontrol.Operation{
+		OperationId:   operationId,
+		OperationName: "test",
+		ConsumerId:    testConsumerId,
+		StartTime:     "2019-10-01T00:00:00.000000000Z",
+		EndTime:       "2019-10-01T01:00:00.000000000Z",
+		MetricValueSets: []servicecontrol.MetricValueSet{{
+			MetricName:   testMetricName,
+			MetricValues: []servicecontrol.MetricValue{servicecontrol.Int64Value(quantity)},
+		}},
+	}
+}
+
+func TestReport(t *testing.T) {
+	srv := fake.NewServer()
+	defer srv.Close()
+	client := srv.Client()
+
+	operations := []servicecontrol.Operation{operation("op-1", 10), operation("op-2", 5)}
+	if err := client.Report(context.Background(), testServiceName, operations); err != nil {
+		t.Fatal(err)
+	}
+	if usage := srv.Usage(testServiceName, testConsumerId, testMetricName); usage != 15 {
+		t.Errorf("usage = %d, want 15", usage)
+	}
+}
+
+func TestReportSameOperationId(t *testing.T) {
+	srv := fake.NewServer()
+	defer srv.Close()
+	client := srv.Client()
+
+	//an operation sent again, when it is not known whether it arrived, is dropped
+	for i := 0; i < 2; i++ {
+		if err := client.Report(context.Background(), testServiceName, []servicecontrol.Operation{operation("op-1", 10)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if srv.Requests() != 2 || len(srv.Operations(testServiceName)) != 1 {
+		t.Errorf("%d operations received in %d requests, want 1 in 2", len(srv.Operations(testServiceName)), srv.Requests())
+	}
+	if usage := srv.Usage(testServiceName, testConsumerId, testMetricName); usage != 10 {
+		t.Errorf("usage = %d, want 10", usage)
+	}
+}
+
+func TestReportErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		setup         func(srv *fake.Server)
+		operation     servicecontrol.Operation
+		wantStatus    int
+		wantOperation string
+		wantTransient bool
+	}{
+		{
+			name:          "unavailable",
+			setup:         func(srv *fake.Server) { srv.FailNext(1, http.StatusServiceUnavailable) },
+			operation:     operation("op-1", 1),
+			wantStatus:    http.StatusServiceUnavailable,
+			wantTransient: true,
+		},
+		{
+			name:          "too many requests",
+			setup:         func(srv *fake.Server) { srv.FailNext(1, http.StatusTooManyRequests) },
+			operation:     operation("op-1", 1),
+			wantStatus:    http.StatusTooManyRequests,
+			wantTransient: true,
+		},
+		{
+			name:       "forbidden",
+			setup:      func(srv *fake.Server) { srv.FailNext(1, http.StatusForbidden) },
+			operation:  operation("op-1", 1),
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:          "consumer rejected",
+			setup:         func(srv *fake.Server) { srv.Reject(testConsumerId, "consumer is not active") },
+			operation:     operation("op-1", 1),
+			wantStatus:    http.StatusOK,
+			wantOperation: "op-1",
+		},
+		{
+			name:  "invalid times rejected",
+			setup: func(srv *fake.Server) {},
+			operation: func() servicecontrol.Operation {
+				invalid := operation("op-1", 1)
+				invalid.EndTime = "2019-09-30T00:00:00Z"
+				return invalid
+			}(),
+			wantStatus:    http.StatusOK,
+			wantOperation: "op-1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := fake.NewServer()
+			defer srv.Close()
+			test.setup(srv)
+
+			err := srv.Client().Report(context.Background(), testServiceName, []servicecontrol.Operation{test.operation})
+			apiErr, ok := err.(*servicecontrol.Error)
+			if !ok {
+				t.Fatalf("Report() error = %v, want a *servicecontrol.Error", err)
+			}
+			if apiErr.StatusCode != test.wantStatus || apiErr.OperationId != test.wantOperation {
+				t.Errorf("error status = %d for operation %q, want %d for %q", apiErr.StatusCode, apiErr.OperationId, test.wantStatus, test.wantOperation)
+			}
+			if transient := servicecontrol.IsTransient(err); transient != test.wantTransient {
+				t.Errorf("IsTransient() = %t, want %t", transient, test.wantTransient)
+			}
+			if len(srv.Operations(testServiceName)) != 0 {
+				t.Errorf("operations = %d, want none recorded", len(srv.Operations(testServiceName)))
+			}
+		})
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"not sent", errors.New("connection refused"), true},
+		{"500", &servicecontrol.Error{StatusCode: http.StatusInternalServerError}, true},
+		{"429", &servicecontrol.Error{StatusCode: http.StatusTooManyRequests}, true},
+		{"400", &servicecontrol.Error{StatusCode: http.StatusBadRequest}, false},
+		{"operation unavailable", &servicecontrol.Error{StatusCode: http.StatusOK, OperationId: "op-1", Code: 14}, true},
+		{"operation exhausted", &servicecontrol.Error{StatusCode: http.StatusOK, OperationId: "op-1", Code: 8}, true},
+		{"operation invalid", &servicecontrol.Error{StatusCode: http.StatusOK, OperationId: "op-1", Code: 3}, false},
+		{"operation permission denied", &servicecontrol.Error{StatusCode: http.StatusOK, OperationId: "op-1", Code: 7}, false},
+	}
+	for _, test := range tests {
+		if got := servicecontrol.IsTransient(test.err); got != test.want {
+			t.Errorf("IsTransient(%s) = %t, want %t", test.name, got, test.want)
+		}
+	}
+}
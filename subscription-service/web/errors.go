@@ -0,0 +1,60 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/cloudbees/cloud-bill-saas/common/procurement"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/persistence"
+	"net/http"
+)
+
+//ErrorResponse is the JSON body returned with every error status.
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{message})
+}
+
+//writeDbError maps persistence errors to status codes. Unexpected errors are logged and returned as 500.
+func writeDbError(w http.ResponseWriter, dbErr error, message string) {
+	switch dbErr {
+	case persistence.ErrNotFound:
+		writeError(w, http.StatusNotFound, message+": "+dbErr.Error())
+	case persistence.ErrConflict:
+		writeError(w, http.StatusConflict, message+": "+dbErr.Error())
+	case persistence.ErrVersionMismatch:
+		writeError(w, http.StatusPreconditionFailed, message+": "+dbErr.Error())
+	case persistence.ErrInvalidCursor:
+		writeError(w, http.StatusBadRequest, message+": "+dbErr.Error())
+	case context.DeadlineExceeded:
+		LogE.Printf("%s: %#v \n", message, dbErr)
+		writeError(w, http.StatusGatewayTimeout, message+": "+dbErr.Error())
+	case context.Canceled:
+		LogI.Printf("%s: request was cancelled \n", message)
+		writeError(w, http.StatusServiceUnavailable, message+": "+dbErr.Error())
+	default:
+		LogE.Printf("%s: %#v \n", message, dbErr)
+		writeError(w, http.StatusInternalServerError, message+": "+dbErr.Error())
+	}
+}
+
+//writeProcurementError maps procurement API errors to status codes. A request the marketplace refused, such as
+//approving a plan change the customer already cancelled, is a conflict. Other failures are a bad gateway.
+func writeProcurementError(w http.ResponseWriter, err error, message string) {
+	LogE.Printf("%s: %#v \n", message, err)
+	if apiErr, ok := err.(*procurement.Error); ok {
+		switch {
+		case apiErr.StatusCode == http.StatusNotFound:
+			writeError(w, http.StatusNotFound, message+": "+err.Error())
+			return
+		case apiErr.StatusCode >= 400 && apiErr.StatusCode < 500:
+			writeError(w, http.StatusConflict, message+": "+err.Error())
+			return
+		}
+	}
+	writeError(w, http.StatusBadGateway, message+": "+err.Error())
+}
@@ -0,0 +1,57 @@
+package web
+
+import (
+	"context"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/persistence"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//setETag sets the ETag header to the quoted entity version.
+func setETag(w http.ResponseWriter, version int64) {
+	w.Header().Set("ETag", strconv.Quote(strconv.FormatInt(version, 10)))
+}
+
+//ifMatchVersion returns the version from the If-Match header, NoVersion when there is no header and AnyVersion for *.
+//It returns false for an ETag this service did not create, which can never match.
+func ifMatchVersion(r *http.Request) (int64, bool) {
+	ifMatch := strings.TrimSpace(r.Header.Get("If-Match"))
+	switch ifMatch {
+	case "":
+		return persistence.NoVersion, true
+	case "*":
+		return persistence.AnyVersion, true
+	}
+	etag, err := strconv.Unquote(strings.TrimPrefix(ifMatch, "W/"))
+	if err != nil {
+		return 0, false
+	}
+	version, err := strconv.ParseInt(etag, 10, 64)
+	if err != nil || version < 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+//maxUpdateAttempts is how many times updateEntitlement reads and writes an entitlement that keeps changing.
+const maxUpdateAttempts = 5
+
+//updateEntitlement reads an entitlement, applies update and writes it back only if it still has the version that was
+//read, so a concurrent sync from the pubsub service, entitlement check or reconciler is not overwritten. It starts
+//over when the entitlement changed in between and returns ErrVersionMismatch after maxUpdateAttempts.
+func updateEntitlement(ctx context.Context, dbHandler persistence.DatabaseHandler, entitlementId string, update func(*persistence.Entitlement)) (*persistence.Entitlement, error) {
+	for attempt := 1; ; attempt++ {
+		entitlement, err := dbHandler.GetEntitlement(ctx, entitlementId)
+		if err != nil {
+			return nil, err
+		}
+		update(entitlement)
+		persistence.NormalizeTimestamps(entitlement)
+		err = dbHandler.UpsertEntitlement(ctx, entitlement, entitlement.Version)
+		if err != persistence.ErrVersionMismatch || attempt >= maxUpdateAttempts {
+			return entitlement, err
+		}
+		LogI.Printf("Entitlement %s changed while it was updated, trying again \n", entitlementId)
+	}
+}
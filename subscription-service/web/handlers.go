@@ -1,17 +1,23 @@
 package web
 
 import (
+	"context"
 	"encoding/json"
-	"fmt"
+	"github.com/cloudbees/cloud-bill-saas/common/procurement"
 	"github.com/cloudbees/cloud-bill-saas/subscription-service/persistence"
 	"github.com/gorilla/mux"
 	"github.com/jefferyfry/funclog"
 	"net/http"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type SubscriptionServiceHandler struct {
 	dbHandler             persistence.DatabaseHandler
+	procurementClient     procurement.Client
+	requestTimeout        time.Duration
 }
 
 var (
@@ -19,43 +25,68 @@ var (
 	LogE = funclog.NewErrorLogger("ERROR: ")
 )
 
-func GetSubscriptionServiceHandler(dbHandler persistence.DatabaseHandler) *SubscriptionServiceHandler {
+func GetSubscriptionServiceHandler(dbHandler persistence.DatabaseHandler, procurementClient procurement.Client, requestTimeout time.Duration) *SubscriptionServiceHandler {
 	return &SubscriptionServiceHandler {
 		dbHandler,
+		procurementClient,
+		requestTimeout,
 	}
 }
 
+//awaitingApprovalStates are the states of entitlements waiting for an entitlement creation or plan change approval.
+var awaitingApprovalStates = []string{"ENTITLEMENT_ACTIVATION_REQUESTED", "ENTITLEMENT_PENDING_PLAN_CHANGE_APPROVAL"}
+
+//SourceHeader identifies the caller, such as "pubsub-service event 1234", in the history of the entities it changes.
+const SourceHeader = "X-Cloud-Bill-Source"
+
+//requestContext bounds the request context with the configured request timeout. The database call is cancelled when
+//the client disconnects or the deadline passes. The caller from SourceHeader is added for history entries.
+func (hdlr *SubscriptionServiceHandler) requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx := persistence.WithSource(r.Context(), r.Header.Get(SourceHeader))
+	if hdlr.requestTimeout > 0 {
+		return context.WithTimeout(ctx, hdlr.requestTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
 // @Summary Get an account
 // @Description Retrieves an account by account ID
 // @ID cloud-bill-saas-subscription-service-get-account
 // @Accept  json
 // @Produce  json
 // @Param accountId path string true "Account ID"
+// @Param includeDeleted query bool false "optional, also return the account if it was deleted"
 // @Success 200 {object} persistence.Account
-// @Failure 400 {string} string "Missing account ID in path"
-// @Failure 500 {string} string "Internal server error"
+// @Header 200 {string} ETag "Account version for If-Match"
+// @Failure 400 {object} web.ErrorResponse "Missing account ID in path or invalid includeDeleted"
+// @Failure 404 {object} web.ErrorResponse "Account not found or deleted"
+// @Failure 500 {object} web.ErrorResponse "Internal server error"
 // @Router /accounts/{accountId} [get]
 func (hdlr *SubscriptionServiceHandler) GetAccount(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
 	vars := mux.Vars(r)
 	accountId := vars["accountId"]
 
 	if accountId == "" {
-		http.Error(w,`{"error": "missing account ID"}`,400)
+		writeError(w, http.StatusBadRequest, "missing account ID")
 		return
 	}
 
-	if account, dbErr := hdlr.dbHandler.GetAccount(accountId); nil != dbErr {
-		if dbErr.Error() == "datastore: no such entity" {
-			w.WriteHeader(404)
-		} else {
-			w.WriteHeader(500)
-			LogE.Printf("Error occured while getting account %#v \n", dbErr)
-			fmt.Fprintf(w, "Error occured while getting account %#v \n", dbErr)
-		}
+	withDeleted, err := includeDeleted(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if account, dbErr := hdlr.dbHandler.GetAccount(ctx, accountId); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting account")
 	} else {
-		if account == nil {
-			w.WriteHeader(404)
+		if account == nil || account.DeletedTime != "" && !withDeleted {
+			writeError(w, http.StatusNotFound, "account not found")
 		} else {
+			setETag(w, account.Version)
 			w.WriteHeader(200)
 			json.NewEncoder(w).Encode(&account)
 		}
@@ -67,34 +98,34 @@ func (hdlr *SubscriptionServiceHandler) GetAccount(w http.ResponseWriter, r *htt
 // @ID cloud-bill-saas-subscription-service-get-accounts
 // @Accept  json
 // @Produce  json
-// @Param filters query string false "optional comma separated list of filter"
+// @Param filters query string false "optional filter expression, e.g. state IN (ENTITLEMENT_ACTIVE, ENTITLEMENT_PENDING_CANCELLATION) AND updateTime >= 2019-10-01"
 // @Param order query string false "optional order"
-// @Success 200 {array} persistence.Account
-// @Failure 500 {string} string "Error"
+// @Param limit query int false "optional page size, default 100 and at most 1000"
+// @Param cursor query string false "optional nextPageToken from the previous page"
+// @Param includeDeleted query bool false "optional, also list deleted accounts"
+// @Success 200 {object} web.AccountsPage
+// @Failure 400 {object} web.ErrorResponse "Invalid filters, order, limit, cursor or includeDeleted"
+// @Failure 404 {object} web.ErrorResponse "No accounts found"
+// @Failure 500 {object} web.ErrorResponse "Error"
 // @Router /accounts [get]
 func (hdlr *SubscriptionServiceHandler) GetAccounts(w http.ResponseWriter, r *http.Request){
-	filtersParam, ok := r.URL.Query()["filters"]
-	var filters []string = nil
-	if ok || len(filtersParam) > 0 {
-		filters = strings.Split(filtersParam[0],",")
-	}
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
 
-	ordersParam, ok := r.URL.Query()["order"]
-	var order = ""
-	if ok || len(ordersParam) > 0 {
-		order = ordersParam[0]
+	query, err := parseQuery(r, persistence.Account{})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	if accounts, dbErr := hdlr.dbHandler.QueryAccounts(filters,order); nil != dbErr {
-		w.WriteHeader(500)
-		LogE.Printf("Error occured while getting accounts %#v \n", dbErr)
-		fmt.Fprintf(w, "Error occured while getting accounts %#v \n", dbErr)
+	if accounts, nextPageToken, dbErr := hdlr.dbHandler.QueryAccounts(ctx, query); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting accounts")
 	} else {
 		if accounts == nil {
-			w.WriteHeader(404)
+			writeError(w, http.StatusNotFound, "no accounts found")
 		} else {
 			w.WriteHeader(200)
-			json.NewEncoder(w).Encode(&accounts)
+			json.NewEncoder(w).Encode(&AccountsPage{accounts, nextPageToken})
 		}
 	}
 }
@@ -105,49 +136,114 @@ func (hdlr *SubscriptionServiceHandler) GetAccounts(w http.ResponseWriter, r *ht
 // @Accept  json
 // @Produce  json
 // @Param account body persistence.Account true "Account"
+// @Param If-Match header string false "optional ETag from a previous get, the upsert fails with 412 if the account has changed since"
 // @Success 204 {string} string "Upserted"
-// @Failure 500 {string} string "Error"
+// @Header 204 {string} ETag "New account version"
+// @Failure 400 {object} web.ErrorResponse "Invalid request body"
+// @Failure 412 {object} web.ErrorResponse "Account version does not match If-Match"
+// @Failure 500 {object} web.ErrorResponse "Error"
 // @Router /accounts [put]
 func (hdlr *SubscriptionServiceHandler) UpsertAccount(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	ifVersion, ok := ifMatchVersion(r)
+	if !ok {
+		writeError(w, http.StatusPreconditionFailed, "If-Match does not match the account version")
+		return
+	}
+
 	account := persistence.Account{}
 	if dbErr := json.NewDecoder(r.Body).Decode(&account); nil != dbErr {
-		w.WriteHeader(500)
 		LogE.Printf("Error occured while decoding account data %#v \n", dbErr)
-		fmt.Fprintf(w, "Error occured while decoding account data %#v \n", dbErr)
+		writeError(w, http.StatusBadRequest, "Error occured while decoding account data: "+dbErr.Error())
 		return
 	}
-	if dbErr := hdlr.dbHandler.UpsertAccount(&account); nil != dbErr {
-		w.WriteHeader(500)
-		LogE.Printf("Error occured while persisting account %#v \n", dbErr)
-		fmt.Fprintf(w, "Error occured while persisting account %#v \n", dbErr)
+	persistence.NormalizeTimestamps(&account)
+	if dbErr := hdlr.dbHandler.UpsertAccount(ctx, &account, ifVersion); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while persisting account")
 	} else {
+		setETag(w, account.Version)
 		w.WriteHeader(204)
 	}
 }
 
 // @Summary Delete an account
-// @Description Delete an account
+// @Description Soft deletes an account, it is hidden from gets and lists until restored or purged after the retention period.
+// @Description With cascade=true the account's entitlements are also soft deleted and its contact removed in one
+// @Description transaction, and a summary of the changes is returned.
 // @ID cloud-bill-saas-subscription-service-delete-account
 // @Accept  json
 // @Produce  json
 // @Param accountId path string true "Account ID"
+// @Param cascade query bool false "optional, also delete the account's contact and entitlements"
+// @Success 200 {object} persistence.AccountDeletion "Deleted with cascade"
 // @Success 204 {string} string "Deleted"
-// @Failure 400 {string} string "Missing account ID in path"
-// @Failure 500 {string} string "Internal server error"
+// @Failure 400 {object} web.ErrorResponse "Missing account ID in path or invalid cascade"
+// @Failure 500 {object} web.ErrorResponse "Internal server error"
 // @Router /accounts/{accountId} [delete]
 func (hdlr *SubscriptionServiceHandler) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	vars := mux.Vars(r)
+	accountId := vars["accountId"]
+
+	if accountId == "" {
+		writeError(w, http.StatusBadRequest, "missing account ID")
+		return
+	}
+
+	cascade := false
+	if value := r.URL.Query().Get("cascade"); value != "" {
+		var err error
+		if cascade, err = strconv.ParseBool(value); err != nil {
+			writeError(w, http.StatusBadRequest, "cascade must be true or false")
+			return
+		}
+	}
+
+	if cascade {
+		if deletion, dbErr := hdlr.dbHandler.DeleteAccountCascade(ctx, accountId); nil != dbErr {
+			writeDbError(w, dbErr, "Error occured while deleting account")
+		} else {
+			LogI.Printf("Deleted account %s: account %t, contact %t, entitlements %v \n", accountId, deletion.Account,
+				deletion.Contact, deletion.Entitlements)
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(deletion)
+		}
+	} else if dbErr := hdlr.dbHandler.DeleteAccount(ctx, accountId); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while deleting account")
+	} else {
+		w.WriteHeader(204)
+	}
+}
+
+// @Summary Restore an account
+// @Description Restores a soft deleted account
+// @ID cloud-bill-saas-subscription-service-restore-account
+// @Accept  json
+// @Produce  json
+// @Param accountId path string true "Account ID"
+// @Success 204 {string} string "Restored"
+// @Failure 400 {object} web.ErrorResponse "Missing account ID in path"
+// @Failure 404 {object} web.ErrorResponse "Account not found"
+// @Failure 500 {object} web.ErrorResponse "Internal server error"
+// @Router /admin/accounts/{accountId}/restore [post]
+func (hdlr *SubscriptionServiceHandler) RestoreAccount(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
 	vars := mux.Vars(r)
 	accountId := vars["accountId"]
 
 	if accountId == "" {
-		http.Error(w,`{"error": "missing account ID"}`,400)
+		writeError(w, http.StatusBadRequest, "missing account ID")
 		return
 	}
 
-	if dbErr := hdlr.dbHandler.DeleteAccount(accountId); nil != dbErr {
-		w.WriteHeader(500)
-		LogE.Printf("Error occured while deleting account %#v \n", dbErr)
-		fmt.Fprintf(w, "Error occured while deleting account %#v \n", dbErr)
+	if dbErr := hdlr.dbHandler.RestoreAccount(ctx, accountId); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while restoring account")
 	} else {
 		w.WriteHeader(204)
 	}
@@ -160,30 +256,30 @@ func (hdlr *SubscriptionServiceHandler) DeleteAccount(w http.ResponseWriter, r *
 // @Produce  json
 // @Param accountId path string true "Account ID"
 // @Success 200 {object} persistence.Contact
-// @Failure 400 {string} string "Missing account ID in path"
-// @Failure 500 {string} string "Error"
+// @Header 200 {string} ETag "Contact version for If-Match"
+// @Failure 400 {object} web.ErrorResponse "Missing account ID in path"
+// @Failure 404 {object} web.ErrorResponse "Contact not found"
+// @Failure 500 {object} web.ErrorResponse "Error"
 // @Router /contacts/{accountId} [get]
 func (hdlr *SubscriptionServiceHandler) GetContact(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
 	vars := mux.Vars(r)
 	accountId := vars["accountId"]
 
 	if accountId == "" {
-		http.Error(w,`{"error": "missing account ID in path"}`,400)
+		writeError(w, http.StatusBadRequest, "missing account ID in path")
 		return
 	}
 
-	if contact, dbErr := hdlr.dbHandler.GetContact(accountId); nil != dbErr {
-		if dbErr.Error() == "datastore: no such entity" {
-			w.WriteHeader(404)
-		} else {
-			w.WriteHeader(500)
-			LogE.Printf("Error occured while getting contact %#v \n", dbErr)
-			fmt.Fprintf(w, "Error occured while getting contact %#v \n", dbErr)
-		}
+	if contact, dbErr := hdlr.dbHandler.GetContact(ctx, accountId); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting contact")
 	} else {
 		if contact == nil {
-			w.WriteHeader(404)
+			writeError(w, http.StatusNotFound, "contact not found")
 		} else {
+			setETag(w, contact.Version)
 			w.WriteHeader(200)
 			json.NewEncoder(w).Encode(&contact)
 		}
@@ -195,23 +291,35 @@ func (hdlr *SubscriptionServiceHandler) GetContact(w http.ResponseWriter, r *htt
 // @ID cloud-bill-saas-subscription-service-upsert-contact
 // @Accept  json
 // @Produce  json
+// @Param contact body persistence.Contact true "Contact"
+// @Param If-Match header string false "optional ETag from a previous get, the upsert fails with 412 if the contact has changed since"
 // @Success 204 {string} string "Upserted"
-// @Failure 500 {string} string "Error"
+// @Header 204 {string} ETag "New contact version"
+// @Failure 400 {object} web.ErrorResponse "Invalid request body"
+// @Failure 412 {object} web.ErrorResponse "Contact version does not match If-Match"
+// @Failure 500 {object} web.ErrorResponse "Error"
 // @Router /contacts [put]
 func (hdlr *SubscriptionServiceHandler) UpsertContact(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	ifVersion, ok := ifMatchVersion(r)
+	if !ok {
+		writeError(w, http.StatusPreconditionFailed, "If-Match does not match the contact version")
+		return
+	}
+
 	contact := persistence.Contact{}
 	if dbErr := json.NewDecoder(r.Body).Decode(&contact); nil != dbErr {
-		w.WriteHeader(500)
 		LogE.Printf("Error occured while decoding contact data %#v \n", dbErr)
-		fmt.Fprintf(w, "Error occured while decodning contact data %#v \n", dbErr)
+		writeError(w, http.StatusBadRequest, "Error occured while decoding contact data: "+dbErr.Error())
 		return
 	}
 
-	if dbErr := hdlr.dbHandler.UpsertContact(&contact); nil != dbErr {
-		w.WriteHeader(500)
-		LogE.Printf("Error occured while persisting contact %#v \n", dbErr)
-		fmt.Fprintf(w, "Error occured while persisting contact %#v \n", dbErr)
+	if dbErr := hdlr.dbHandler.UpsertContact(ctx, &contact, ifVersion); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while persisting contact")
 	} else {
+		setETag(w, contact.Version)
 		w.WriteHeader(204)
 	}
 }
@@ -223,22 +331,23 @@ func (hdlr *SubscriptionServiceHandler) UpsertContact(w http.ResponseWriter, r *
 // @Produce  json
 // @Param accountId path string true "Account ID"
 // @Success 204 {string} string "Deleted"
-// @Failure 400 {string} string "Missing account ID in path"
-// @Failure 500 {string} string "Error"
+// @Failure 400 {object} web.ErrorResponse "Missing account ID in path"
+// @Failure 500 {object} web.ErrorResponse "Error"
 // @Router /contacts/{accountId} [delete]
 func (hdlr *SubscriptionServiceHandler) DeleteContact(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
 	vars := mux.Vars(r)
 	accountId := vars["accountId"]
 
 	if accountId == "" {
-		http.Error(w,`{"error": "missing contact name in path"}`,400)
+		writeError(w, http.StatusBadRequest, "missing contact name in path")
 		return
 	}
 
-	if dbErr := hdlr.dbHandler.DeleteContact(accountId); nil != dbErr {
-		w.WriteHeader(500)
-		LogE.Printf("Error occured while deleting contact %#v \n", dbErr)
-		fmt.Fprintf(w, "Error occured while deleting contact %#v \n", dbErr)
+	if dbErr := hdlr.dbHandler.DeleteContact(ctx, accountId); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while deleting contact")
 	} else {
 		w.WriteHeader(204)
 	}
@@ -249,34 +358,33 @@ func (hdlr *SubscriptionServiceHandler) DeleteContact(w http.ResponseWriter, r *
 // @ID cloud-bill-saas-subscription-service-get-contacts
 // @Accept  json
 // @Produce  json
-// @Param filters query string false "optional comma separated list of filter"
+// @Param filters query string false "optional filter expression, e.g. state IN (ENTITLEMENT_ACTIVE, ENTITLEMENT_PENDING_CANCELLATION) AND updateTime >= 2019-10-01"
 // @Param order query string false "optional order"
-// @Success 200 {array} persistence.Contact
-// @Failure 500 {string} string "Error"
+// @Param limit query int false "optional page size, default 100 and at most 1000"
+// @Param cursor query string false "optional nextPageToken from the previous page"
+// @Success 200 {object} web.ContactsPage
+// @Failure 400 {object} web.ErrorResponse "Invalid filters, order, limit or cursor"
+// @Failure 404 {object} web.ErrorResponse "No contacts found"
+// @Failure 500 {object} web.ErrorResponse "Error"
 // @Router /contacts [get]
 func (hdlr *SubscriptionServiceHandler) GetContacts(w http.ResponseWriter, r *http.Request){
-	filtersParam, ok := r.URL.Query()["filters"]
-	var filters []string = nil
-	if ok || len(filtersParam) > 0 {
-		filters = strings.Split(filtersParam[0],",")
-	}
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
 
-	ordersParam, ok := r.URL.Query()["order"]
-	var order = ""
-	if ok || len(ordersParam) > 0 {
-		order = ordersParam[0]
+	query, err := parseQuery(r, persistence.Contact{})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	if contacts, dbErr := hdlr.dbHandler.QueryContacts(filters,order); nil != dbErr {
-		w.WriteHeader(500)
-		LogE.Printf("Error occured while getting contacts %#v \n", dbErr)
-		fmt.Fprintf(w, "Error occured while getting contacts %#v \n", dbErr)
+	if contacts, nextPageToken, dbErr := hdlr.dbHandler.QueryContacts(ctx, query); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting contacts")
 	} else {
 		if contacts == nil {
-			w.WriteHeader(404)
+			writeError(w, http.StatusNotFound, "no contacts found")
 		} else {
 			w.WriteHeader(200)
-			json.NewEncoder(w).Encode(&contacts)
+			json.NewEncoder(w).Encode(&ContactsPage{contacts, nextPageToken})
 		}
 	}
 }
@@ -287,31 +395,38 @@ func (hdlr *SubscriptionServiceHandler) GetContacts(w http.ResponseWriter, r *ht
 // @Accept  json
 // @Produce  json
 // @Param entitlementId path string true "Entitlement ID"
+// @Param includeDeleted query bool false "optional, also return the entitlement if it was deleted"
 // @Success 200 {object} persistence.Entitlement
-// @Failure 400 {string} string "Missing entitlement ID in path"
-// @Failure 500 {string} string "Error"
+// @Header 200 {string} ETag "Entitlement version for If-Match"
+// @Failure 400 {object} web.ErrorResponse "Missing entitlement ID in path or invalid includeDeleted"
+// @Failure 404 {object} web.ErrorResponse "Entitlement not found or deleted"
+// @Failure 500 {object} web.ErrorResponse "Error"
 // @Router /entitlements/{entitlementId} [get]
 func (hdlr *SubscriptionServiceHandler) GetEntitlement(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
 	vars := mux.Vars(r)
 	entitlementId := vars["entitlementId"]
 
 	if entitlementId == "" {
-		http.Error(w,`{"error": "missing entitlement ID in path"}`,400)
+		writeError(w, http.StatusBadRequest, "missing entitlement ID in path")
 		return
 	}
 
-	if entitlement, dbErr := hdlr.dbHandler.GetEntitlement(entitlementId); nil != dbErr {
-		if dbErr.Error() == "datastore: no such entity" {
-			w.WriteHeader(404)
-		} else {
-			w.WriteHeader(500)
-			LogE.Printf("Error occured while getting entitlement %#v \n", dbErr)
-			fmt.Fprintf(w, "Error occured while getting entitlement %#v \n", dbErr)
-		}
+	withDeleted, err := includeDeleted(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if entitlement, dbErr := hdlr.dbHandler.GetEntitlement(ctx, entitlementId); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting entitlement")
 	} else {
-		if entitlement == nil {
-			w.WriteHeader(404)
+		if entitlement == nil || entitlement.DeletedTime != "" && !withDeleted {
+			writeError(w, http.StatusNotFound, "entitlement not found")
 		} else {
+			setETag(w, entitlement.Version)
 			w.WriteHeader(200)
 			json.NewEncoder(w).Encode(&entitlement)
 		}
@@ -323,34 +438,34 @@ func (hdlr *SubscriptionServiceHandler) GetEntitlement(w http.ResponseWriter, r
 // @ID cloud-bill-saas-subscription-service-get-entitlements
 // @Accept  json
 // @Produce  json
-// @Param filters query string false "optional comma separated list of filter"
+// @Param filters query string false "optional filter expression, e.g. state IN (ENTITLEMENT_ACTIVE, ENTITLEMENT_PENDING_CANCELLATION) AND updateTime >= 2019-10-01"
 // @Param order query string false "optional order"
-// @Success 200 {array} persistence.Entitlement
-// @Failure 500 {string} string "Error"
+// @Param limit query int false "optional page size, default 100 and at most 1000"
+// @Param cursor query string false "optional nextPageToken from the previous page"
+// @Param includeDeleted query bool false "optional, also list deleted entitlements"
+// @Success 200 {object} web.EntitlementsPage
+// @Failure 400 {object} web.ErrorResponse "Invalid filters, order, limit, cursor or includeDeleted"
+// @Failure 404 {object} web.ErrorResponse "No entitlements found"
+// @Failure 500 {object} web.ErrorResponse "Error"
 // @Router /entitlements [get]
 func (hdlr *SubscriptionServiceHandler) GetEntitlements(w http.ResponseWriter, r *http.Request){
-	filtersParam, ok := r.URL.Query()["filters"]
-	var filters []string = nil
-	if ok || len(filtersParam) > 0 {
-		filters = strings.Split(filtersParam[0],",")
-	}
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
 
-	ordersParam, ok := r.URL.Query()["order"]
-	var order = ""
-	if ok || len(ordersParam) > 0 {
-		order = ordersParam[0]
+	query, err := parseQuery(r, persistence.Entitlement{})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	if entitlements, dbErr := hdlr.dbHandler.QueryEntitlements(filters,order); nil != dbErr {
-		w.WriteHeader(500)
-		LogE.Printf("Error occured while getting entitlements %#v \n", dbErr)
-		fmt.Fprintf(w, "Error occured while getting entitlements %#v \n", dbErr)
+	if entitlements, nextPageToken, dbErr := hdlr.dbHandler.QueryEntitlements(ctx, query); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting entitlements")
 	} else {
 		if entitlements == nil {
-			w.WriteHeader(404)
+			writeError(w, http.StatusNotFound, "no entitlements found")
 		} else {
 			w.WriteHeader(200)
-			json.NewEncoder(w).Encode(&entitlements)
+			json.NewEncoder(w).Encode(&EntitlementsPage{entitlements, nextPageToken})
 		}
 	}
 }
@@ -361,42 +476,107 @@ func (hdlr *SubscriptionServiceHandler) GetEntitlements(w http.ResponseWriter, r
 // @Accept  json
 // @Produce  json
 // @Param acct path string true "account"
-// @Param filters query string false "optional comma separated list of filter"
+// @Param filters query string false "optional filter expression, e.g. state IN (ENTITLEMENT_ACTIVE, ENTITLEMENT_PENDING_CANCELLATION) AND updateTime >= 2019-10-01"
 // @Param order query string false "optional order"
-// @Success 200 {array} persistence.Entitlement
-// @Failure 500 {string} string "Error"
+// @Param limit query int false "optional page size, default 100 and at most 1000"
+// @Param cursor query string false "optional nextPageToken from the previous page"
+// @Param includeDeleted query bool false "optional, also list deleted entitlements"
+// @Success 200 {object} web.EntitlementsPage
+// @Failure 400 {object} web.ErrorResponse "Invalid filters, order, limit, cursor or includeDeleted"
+// @Failure 404 {object} web.ErrorResponse "No entitlements found"
+// @Failure 500 {object} web.ErrorResponse "Error"
 // @Router /accounts/{accountId}/entitlements [get]
 func (hdlr *SubscriptionServiceHandler) GetAccountEntitlements(w http.ResponseWriter, r *http.Request){
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
 	vars := mux.Vars(r)
 	accountId := vars["accountId"]
 
 	if accountId == "" {
-		http.Error(w,`{"error": "missing account ID"}`,400)
+		writeError(w, http.StatusBadRequest, "missing account ID")
 		return
 	}
 
-	filtersParam, ok := r.URL.Query()["filters"]
-	var filters []string = nil
-	if ok || len(filtersParam) > 0 {
-		filters = strings.Split(filtersParam[0],",")
+	query, err := parseQuery(r, persistence.Entitlement{})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if entitlements, nextPageToken, dbErr := hdlr.dbHandler.QueryAccountEntitlements(ctx, accountId, query); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting account entitlements")
+	} else {
+		if entitlements == nil {
+			writeError(w, http.StatusNotFound, "no entitlements found")
+		} else {
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(&EntitlementsPage{entitlements, nextPageToken})
+		}
 	}
+}
+
+// @Summary GetEntitlementHistory
+// @Description Gets the state, plan and approval changes of an entitlement, oldest first
+// @ID cloud-bill-saas-subscription-service-get-entitlement-history
+// @Accept  json
+// @Produce  json
+// @Param entitlementId path string true "Entitlement ID"
+// @Param filters query string false "optional filter expression, e.g. changeTime >= 2019-10-01"
+// @Param order query string false "optional order"
+// @Param limit query int false "optional page size, default 100 and at most 1000"
+// @Param cursor query string false "optional nextPageToken from the previous page"
+// @Success 200 {object} web.HistoryPage
+// @Failure 400 {object} web.ErrorResponse "Invalid filters, order, limit or cursor"
+// @Failure 404 {object} web.ErrorResponse "No history found"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /entitlements/{entitlementId}/history [get]
+func (hdlr *SubscriptionServiceHandler) GetEntitlementHistory(w http.ResponseWriter, r *http.Request){
+	hdlr.getHistory(w, r, persistence.EntitlementKind, mux.Vars(r)["entitlementId"])
+}
+
+// @Summary GetAccountHistory
+// @Description Gets the state and approval changes of an account, oldest first
+// @ID cloud-bill-saas-subscription-service-get-account-history
+// @Accept  json
+// @Produce  json
+// @Param accountId path string true "Account ID"
+// @Param filters query string false "optional filter expression, e.g. changeTime >= 2019-10-01"
+// @Param order query string false "optional order"
+// @Param limit query int false "optional page size, default 100 and at most 1000"
+// @Param cursor query string false "optional nextPageToken from the previous page"
+// @Success 200 {object} web.HistoryPage
+// @Failure 400 {object} web.ErrorResponse "Invalid filters, order, limit or cursor"
+// @Failure 404 {object} web.ErrorResponse "No history found"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /accounts/{accountId}/history [get]
+func (hdlr *SubscriptionServiceHandler) GetAccountHistory(w http.ResponseWriter, r *http.Request){
+	hdlr.getHistory(w, r, persistence.AccountKind, mux.Vars(r)["accountId"])
+}
+
+func (hdlr *SubscriptionServiceHandler) getHistory(w http.ResponseWriter, r *http.Request, entityKind string, entityId string) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
 
-	ordersParam, ok := r.URL.Query()["order"]
-	var order = ""
-	if ok || len(ordersParam) > 0 {
-		order = ordersParam[0]
+	if entityId == "" {
+		writeError(w, http.StatusBadRequest, "missing "+strings.ToLower(entityKind)+" ID")
+		return
 	}
 
-	if entitlements, dbErr := hdlr.dbHandler.QueryAccountEntitlements(accountId,filters,order); nil != dbErr {
-		w.WriteHeader(500)
-		LogE.Printf("Error occured while getting account entitlements %#v \n", dbErr)
-		fmt.Fprintf(w, "Error occured while getting account entitlements %#v \n", dbErr)
+	query, err := parseQuery(r, persistence.HistoryEntry{})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if history, nextPageToken, dbErr := hdlr.dbHandler.QueryHistory(ctx, entityKind, entityId, query); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting history")
 	} else {
-		if entitlements == nil {
-			w.WriteHeader(404)
+		if history == nil {
+			writeError(w, http.StatusNotFound, "no history found")
 		} else {
 			w.WriteHeader(200)
-			json.NewEncoder(w).Encode(&entitlements)
+			json.NewEncoder(w).Encode(&HistoryPage{history, nextPageToken})
 		}
 	}
 }
@@ -406,66 +586,980 @@ func (hdlr *SubscriptionServiceHandler) GetAccountEntitlements(w http.ResponseWr
 // @ID cloud-bill-saas-subscription-service-upsert-entitlement
 // @Accept  json
 // @Produce  json
+// @Param entitlement body persistence.Entitlement true "Entitlement"
+// @Param If-Match header string false "optional ETag from a previous get, the upsert fails with 412 if the entitlement has changed since"
 // @Success 204 {string} string "Upserted"
-// @Failure 500 {string} string "Error"
+// @Header 204 {string} ETag "New entitlement version"
+// @Failure 400 {object} web.ErrorResponse "Invalid request body"
+// @Failure 412 {object} web.ErrorResponse "Entitlement version does not match If-Match"
+// @Failure 500 {object} web.ErrorResponse "Error"
 // @Router /entitlements [put]
 func (hdlr *SubscriptionServiceHandler) UpsertEntitlement(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	ifVersion, ok := ifMatchVersion(r)
+	if !ok {
+		writeError(w, http.StatusPreconditionFailed, "If-Match does not match the entitlement version")
+		return
+	}
+
 	entitlement := persistence.Entitlement{}
 	if dbErr := json.NewDecoder(r.Body).Decode(&entitlement); nil != dbErr {
-		w.WriteHeader(500)
 		LogE.Printf("Error occured while decoding entitlement data %#v \n", dbErr)
-		fmt.Fprintf(w, "Error occured while decoding entitlement data %#v \n", dbErr)
+		writeError(w, http.StatusBadRequest, "Error occured while decoding entitlement data: "+dbErr.Error())
 		return
 	}
-	if dbErr := hdlr.dbHandler.UpsertEntitlement(&entitlement); nil != dbErr {
-		w.WriteHeader(500)
-		LogE.Printf("Error occured while persisting entitlement %#v \n", dbErr)
-		fmt.Fprintf(w, "Error occured while persisting entitlement %#v \n", dbErr)
+	persistence.NormalizeTimestamps(&entitlement)
+	if dbErr := hdlr.dbHandler.UpsertEntitlement(ctx, &entitlement, ifVersion); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while persisting entitlement")
 	} else {
+		setETag(w, entitlement.Version)
 		w.WriteHeader(204)
 	}
 }
 
+// @Summary Record an approval attempt on an entitlement
+// @Description Appends an approval attempt, e.g. a failed call to approve the entitlement with the procurement API, to the approvals of an entitlement. The approval state of the entitlement becomes the state of the attempt.
+// @ID cloud-bill-saas-subscription-service-add-entitlement-approval
+// @Accept  json
+// @Produce  json
+// @Param entitlementId path string true "Entitlement ID"
+// @Param approval body persistence.Approval true "Approval attempt, the update time defaults to now"
+// @Success 204 {string} string "Recorded"
+// @Header 204 {string} ETag "New entitlement version"
+// @Failure 400 {object} web.ErrorResponse "Missing entitlement ID, invalid request body or missing name or state"
+// @Failure 404 {object} web.ErrorResponse "Entitlement not found"
+// @Failure 412 {object} web.ErrorResponse "The entitlement kept changing while the approval was recorded"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /entitlements/{entitlementId}/approvals [post]
+func (hdlr *SubscriptionServiceHandler) AddEntitlementApproval(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	vars := mux.Vars(r)
+	entitlementId := vars["entitlementId"]
+
+	if entitlementId == "" {
+		writeError(w, http.StatusBadRequest, "missing entitlement ID in path")
+		return
+	}
+
+	approval := persistence.Approval{}
+	if err := json.NewDecoder(r.Body).Decode(&approval); nil != err {
+		writeError(w, http.StatusBadRequest, "Error occured while decoding approval: "+err.Error())
+		return
+	}
+	if approval.Name == "" || approval.State == "" {
+		writeError(w, http.StatusBadRequest, "missing approval name or state")
+		return
+	}
+	if approval.UpdateTime == "" {
+		approval.UpdateTime = persistence.FormatTimestamp(time.Now())
+	}
+
+	entitlement, dbErr := updateEntitlement(ctx, hdlr.dbHandler, entitlementId, func(entitlement *persistence.Entitlement) {
+		entitlement.Approvals = append(entitlement.Approvals, approval)
+	})
+	if dbErr != nil {
+		writeDbError(w, dbErr, "Error occured while recording approval")
+		return
+	}
+	if approval.State == persistence.ApprovalFailed {
+		LogE.Printf("Approval of entitlement %s %s failed: %s \n", entitlementId, approval.Name, approval.Reason)
+	}
+	setETag(w, entitlement.Version)
+	w.WriteHeader(204)
+}
+
+// @Summary GetFailedApprovals
+// @Description Gets an array of entitlements that are still waiting for approval after the last attempt to approve them failed. They need attention if the failure persists.
+// @ID cloud-bill-saas-subscription-service-get-failed-approvals
+// @Accept  json
+// @Produce  json
+// @Param filters query string false "optional filter expression on the entitlements, e.g. product = cloudbees-core"
+// @Param order query string false "optional order, e.g. -updateTime"
+// @Param limit query int false "optional page size, default 100 and at most 1000"
+// @Param cursor query string false "optional nextPageToken from the previous page"
+// @Success 200 {object} web.EntitlementsPage
+// @Failure 400 {object} web.ErrorResponse "Invalid filters, order, limit or cursor"
+// @Failure 404 {object} web.ErrorResponse "No failed approvals found"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /failedapprovals [get]
+func (hdlr *SubscriptionServiceHandler) GetFailedApprovals(w http.ResponseWriter, r *http.Request){
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	query, err := parseQuery(r, persistence.Entitlement{})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query.Filters = append([]persistence.Filter{
+		{Property: "state", Operator: "IN", Values: awaitingApprovalStates},
+		{Property: "approvalState", Operator: "=", Value: persistence.ApprovalFailed},
+	}, query.Filters...)
+
+	if entitlements, nextPageToken, dbErr := hdlr.dbHandler.QueryEntitlements(ctx, query); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting failed approvals")
+	} else {
+		if entitlements == nil {
+			writeError(w, http.StatusNotFound, "no failed approvals found")
+		} else {
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(&EntitlementsPage{entitlements, nextPageToken})
+		}
+	}
+}
+
 // @Summary Delete an entitlement
-// @Description Delete an entitlement
+// @Description Soft deletes an entitlement, it is hidden from gets and lists until restored or purged after the retention period
 // @ID cloud-bill-saas-subscription-service-delete-entitlement
 // @Accept  json
 // @Produce  json
 // @Param entitlementId path string true "Entitlement ID"
 // @Success 204 {string} string "Deleted"
-// @Failure 400 {string} string "Missing entitlement ID in path"
-// @Failure 500 {string} string "Error"
+// @Failure 400 {object} web.ErrorResponse "Missing entitlement ID in path"
+// @Failure 500 {object} web.ErrorResponse "Error"
 // @Router /entitlements/{entitlementId} [delete]
 func (hdlr *SubscriptionServiceHandler) DeleteEntitlement(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	vars := mux.Vars(r)
+	entitlementId := vars["entitlementId"]
+
+	if entitlementId == "" {
+		writeError(w, http.StatusBadRequest, "missing entitlement ID in path")
+		return
+	}
+
+	if dbErr := hdlr.dbHandler.DeleteEntitlement(ctx, entitlementId); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while deleting entitlement")
+	} else {
+		w.WriteHeader(204)
+	}
+}
+
+// @Summary Restore an entitlement
+// @Description Restores a soft deleted entitlement
+// @ID cloud-bill-saas-subscription-service-restore-entitlement
+// @Accept  json
+// @Produce  json
+// @Param entitlementId path string true "Entitlement ID"
+// @Success 204 {string} string "Restored"
+// @Failure 400 {object} web.ErrorResponse "Missing entitlement ID in path"
+// @Failure 404 {object} web.ErrorResponse "Entitlement not found"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /admin/entitlements/{entitlementId}/restore [post]
+func (hdlr *SubscriptionServiceHandler) RestoreEntitlement(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	vars := mux.Vars(r)
+	entitlementId := vars["entitlementId"]
+
+	if entitlementId == "" {
+		writeError(w, http.StatusBadRequest, "missing entitlement ID in path")
+		return
+	}
+
+	if dbErr := hdlr.dbHandler.RestoreEntitlement(ctx, entitlementId); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while restoring entitlement")
+	} else {
+		w.WriteHeader(204)
+	}
+}
+
+// @Summary Record a marketplace event
+// @Description Records the outcome of a marketplace event handled by the pubsub service, replacing the outcome of an earlier delivery
+// @ID cloud-bill-saas-subscription-service-upsert-event
+// @Accept  json
+// @Produce  json
+// @Param event body persistence.Event true "Event"
+// @Success 204 {string} string "Upserted"
+// @Failure 400 {object} web.ErrorResponse "Invalid request body"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /events [put]
+func (hdlr *SubscriptionServiceHandler) UpsertEvent(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	event := persistence.Event{}
+	if dbErr := json.NewDecoder(r.Body).Decode(&event); nil != dbErr {
+		LogE.Printf("Error occured while decoding event data %#v \n", dbErr)
+		writeError(w, http.StatusBadRequest, "Error occured while decoding event data: "+dbErr.Error())
+		return
+	}
+	if event.Id == "" {
+		writeError(w, http.StatusBadRequest, "missing event ID")
+		return
+	}
+	switch event.Outcome {
+	case persistence.EventSucceeded, persistence.EventFailed, persistence.EventDeadLettered:
+	default:
+		writeError(w, http.StatusBadRequest, "outcome must be "+persistence.EventSucceeded+", "+persistence.EventFailed+
+			" or "+persistence.EventDeadLettered)
+		return
+	}
+	if event.ProcessedTime == "" {
+		event.ProcessedTime = persistence.FormatTimestamp(time.Now())
+	}
+	persistence.NormalizeTimestamps(&event)
+	if dbErr := hdlr.dbHandler.UpsertEvent(ctx, &event); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while persisting event")
+	} else {
+		w.WriteHeader(204)
+	}
+}
+
+// @Summary Get a marketplace event
+// @Description Retrieves the outcome of a marketplace event by event ID
+// @ID cloud-bill-saas-subscription-service-get-event
+// @Accept  json
+// @Produce  json
+// @Param eventId path string true "Event ID"
+// @Success 200 {object} persistence.Event
+// @Failure 400 {object} web.ErrorResponse "Missing event ID in path"
+// @Failure 404 {object} web.ErrorResponse "Event not found"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /events/{eventId} [get]
+func (hdlr *SubscriptionServiceHandler) GetEvent(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	vars := mux.Vars(r)
+	eventId := vars["eventId"]
+
+	if eventId == "" {
+		writeError(w, http.StatusBadRequest, "missing event ID in path")
+		return
+	}
+
+	if event, dbErr := hdlr.dbHandler.GetEvent(ctx, eventId); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting event")
+	} else {
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(&event)
+	}
+}
+
+// @Summary GetEvents
+// @Description Gets an array of the marketplace events handled by the pubsub service
+// @ID cloud-bill-saas-subscription-service-get-events
+// @Accept  json
+// @Produce  json
+// @Param filters query string false "optional filter expression, e.g. outcome IN (FAILED, DEAD_LETTERED) AND processedTime >= 2019-10-01"
+// @Param order query string false "optional order, e.g. -processedTime"
+// @Param limit query int false "optional page size, default 100 and at most 1000"
+// @Param cursor query string false "optional nextPageToken from the previous page"
+// @Success 200 {object} web.EventsPage
+// @Failure 400 {object} web.ErrorResponse "Invalid filters, order, limit or cursor"
+// @Failure 404 {object} web.ErrorResponse "No events found"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /events [get]
+func (hdlr *SubscriptionServiceHandler) GetEvents(w http.ResponseWriter, r *http.Request){
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	query, err := parseQuery(r, persistence.Event{})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if events, nextPageToken, dbErr := hdlr.dbHandler.QueryEvents(ctx, query); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting events")
+	} else {
+		if events == nil {
+			writeError(w, http.StatusNotFound, "no events found")
+		} else {
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(&EventsPage{events, nextPageToken})
+		}
+	}
+}
+
+// @Summary Store a dead letter
+// @Description Stores a marketplace message the pubsub service gave up on, with its raw data and last error
+// @ID cloud-bill-saas-subscription-service-upsert-dead-letter
+// @Accept  json
+// @Produce  json
+// @Param deadLetter body persistence.DeadLetter true "Dead letter"
+// @Success 204 {string} string "Upserted"
+// @Failure 400 {object} web.ErrorResponse "Invalid request body"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /deadletters [put]
+func (hdlr *SubscriptionServiceHandler) UpsertDeadLetter(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	deadLetter := persistence.DeadLetter{}
+	if dbErr := json.NewDecoder(r.Body).Decode(&deadLetter); nil != dbErr {
+		LogE.Printf("Error occured while decoding dead letter data %#v \n", dbErr)
+		writeError(w, http.StatusBadRequest, "Error occured while decoding dead letter data: "+dbErr.Error())
+		return
+	}
+	if deadLetter.Id == "" {
+		writeError(w, http.StatusBadRequest, "missing dead letter ID")
+		return
+	}
+	if deadLetter.CreateTime == "" {
+		deadLetter.CreateTime = persistence.FormatTimestamp(time.Now())
+	}
+	persistence.NormalizeTimestamps(&deadLetter)
+	if dbErr := hdlr.dbHandler.UpsertDeadLetter(ctx, &deadLetter); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while persisting dead letter")
+	} else {
+		w.WriteHeader(204)
+	}
+}
+
+// @Summary Get a dead letter
+// @Description Retrieves a dead letter by ID
+// @ID cloud-bill-saas-subscription-service-get-dead-letter
+// @Accept  json
+// @Produce  json
+// @Param deadLetterId path string true "Dead letter ID"
+// @Success 200 {object} persistence.DeadLetter
+// @Failure 400 {object} web.ErrorResponse "Missing dead letter ID in path"
+// @Failure 404 {object} web.ErrorResponse "Dead letter not found"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /deadletters/{deadLetterId} [get]
+func (hdlr *SubscriptionServiceHandler) GetDeadLetter(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	vars := mux.Vars(r)
+	deadLetterId := vars["deadLetterId"]
+
+	if deadLetterId == "" {
+		writeError(w, http.StatusBadRequest, "missing dead letter ID in path")
+		return
+	}
+
+	if deadLetter, dbErr := hdlr.dbHandler.GetDeadLetter(ctx, deadLetterId); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting dead letter")
+	} else {
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(&deadLetter)
+	}
+}
+
+// @Summary Delete a dead letter
+// @Description Deletes a dead letter, usually after it was replayed
+// @ID cloud-bill-saas-subscription-service-delete-dead-letter
+// @Accept  json
+// @Produce  json
+// @Param deadLetterId path string true "Dead letter ID"
+// @Success 204 {string} string "Deleted"
+// @Failure 400 {object} web.ErrorResponse "Missing dead letter ID in path"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /deadletters/{deadLetterId} [delete]
+func (hdlr *SubscriptionServiceHandler) DeleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	vars := mux.Vars(r)
+	deadLetterId := vars["deadLetterId"]
+
+	if deadLetterId == "" {
+		writeError(w, http.StatusBadRequest, "missing dead letter ID in path")
+		return
+	}
+
+	if dbErr := hdlr.dbHandler.DeleteDeadLetter(ctx, deadLetterId); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while deleting dead letter")
+	} else {
+		w.WriteHeader(204)
+	}
+}
+
+// @Summary GetDeadLetters
+// @Description Gets an array of dead letters
+// @ID cloud-bill-saas-subscription-service-get-dead-letters
+// @Accept  json
+// @Produce  json
+// @Param filters query string false "optional filter expression, e.g. eventType = ENTITLEMENT_ACTIVE AND createTime >= 2019-10-01"
+// @Param order query string false "optional order, e.g. -createTime"
+// @Param limit query int false "optional page size, default 100 and at most 1000"
+// @Param cursor query string false "optional nextPageToken from the previous page"
+// @Success 200 {object} web.DeadLettersPage
+// @Failure 400 {object} web.ErrorResponse "Invalid filters, order, limit or cursor"
+// @Failure 404 {object} web.ErrorResponse "No dead letters found"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /deadletters [get]
+func (hdlr *SubscriptionServiceHandler) GetDeadLetters(w http.ResponseWriter, r *http.Request){
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	query, err := parseQuery(r, persistence.DeadLetter{})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if deadLetters, nextPageToken, dbErr := hdlr.dbHandler.QueryDeadLetters(ctx, query); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting dead letters")
+	} else {
+		if deadLetters == nil {
+			writeError(w, http.StatusNotFound, "no dead letters found")
+		} else {
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(&DeadLettersPage{deadLetters, nextPageToken})
+		}
+	}
+}
+
+// @Summary Hold a request for manual approval
+// @Description Stores an entitlement creation or plan change request the pubsub approval policy held for manual review, replacing an earlier one for the entitlement
+// @ID cloud-bill-saas-subscription-service-upsert-pending-approval
+// @Accept  json
+// @Produce  json
+// @Param pendingApproval body persistence.PendingApproval true "Pending approval"
+// @Success 204 {string} string "Upserted"
+// @Failure 400 {object} web.ErrorResponse "Invalid request body"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /pendingapprovals [put]
+func (hdlr *SubscriptionServiceHandler) UpsertPendingApproval(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	approval := persistence.PendingApproval{}
+	if dbErr := json.NewDecoder(r.Body).Decode(&approval); nil != dbErr {
+		LogE.Printf("Error occured while decoding pending approval data %#v \n", dbErr)
+		writeError(w, http.StatusBadRequest, "Error occured while decoding pending approval data: "+dbErr.Error())
+		return
+	}
+	if approval.Id == "" {
+		writeError(w, http.StatusBadRequest, "missing entitlement ID")
+		return
+	}
+	switch approval.Request {
+	case persistence.ApprovalRequestCreation, persistence.ApprovalRequestPlanChange:
+	default:
+		writeError(w, http.StatusBadRequest, "request must be "+persistence.ApprovalRequestCreation+" or "+
+			persistence.ApprovalRequestPlanChange)
+		return
+	}
+	if approval.CreateTime == "" {
+		approval.CreateTime = persistence.FormatTimestamp(time.Now())
+	}
+	persistence.NormalizeTimestamps(&approval)
+	if dbErr := hdlr.dbHandler.UpsertPendingApproval(ctx, &approval); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while persisting pending approval")
+	} else {
+		w.WriteHeader(204)
+	}
+}
+
+// @Summary Get a pending approval
+// @Description Retrieves the request held for manual approval of an entitlement
+// @ID cloud-bill-saas-subscription-service-get-pending-approval
+// @Accept  json
+// @Produce  json
+// @Param entitlementId path string true "Entitlement ID"
+// @Success 200 {object} persistence.PendingApproval
+// @Failure 400 {object} web.ErrorResponse "Missing entitlement ID in path"
+// @Failure 404 {object} web.ErrorResponse "Pending approval not found"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /pendingapprovals/{entitlementId} [get]
+func (hdlr *SubscriptionServiceHandler) GetPendingApproval(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
 	vars := mux.Vars(r)
 	entitlementId := vars["entitlementId"]
 
 	if entitlementId == "" {
-		http.Error(w,`{"error": "missing entitlement ID in path"}`,400)
+		writeError(w, http.StatusBadRequest, "missing entitlement ID in path")
 		return
 	}
 
-	if dbErr := hdlr.dbHandler.DeleteEntitlement(entitlementId); nil != dbErr {
-		w.WriteHeader(500)
-		LogE.Printf("Error occured while deleting entitlement %#v \n", dbErr)
-		fmt.Fprintf(w, "Error occured while deleting entitlement %#v \n", dbErr)
+	if approval, dbErr := hdlr.dbHandler.GetPendingApproval(ctx, entitlementId); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting pending approval")
+	} else {
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(&approval)
+	}
+}
+
+// @Summary Delete a pending approval
+// @Description Deletes the request held for manual approval of an entitlement
+// @ID cloud-bill-saas-subscription-service-delete-pending-approval
+// @Accept  json
+// @Produce  json
+// @Param entitlementId path string true "Entitlement ID"
+// @Success 204 {string} string "Deleted"
+// @Failure 400 {object} web.ErrorResponse "Missing entitlement ID in path"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /pendingapprovals/{entitlementId} [delete]
+func (hdlr *SubscriptionServiceHandler) DeletePendingApproval(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	vars := mux.Vars(r)
+	entitlementId := vars["entitlementId"]
+
+	if entitlementId == "" {
+		writeError(w, http.StatusBadRequest, "missing entitlement ID in path")
+		return
+	}
+
+	if dbErr := hdlr.dbHandler.DeletePendingApproval(ctx, entitlementId); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while deleting pending approval")
 	} else {
 		w.WriteHeader(204)
 	}
 }
 
+// @Summary GetPendingApprovals
+// @Description Gets an array of requests held for manual approval
+// @ID cloud-bill-saas-subscription-service-get-pending-approvals
+// @Accept  json
+// @Produce  json
+// @Param filters query string false "optional filter expression, e.g. request = PLAN_CHANGE AND product = cloudbees-core"
+// @Param order query string false "optional order, e.g. -createTime"
+// @Param limit query int false "optional page size, default 100 and at most 1000"
+// @Param cursor query string false "optional nextPageToken from the previous page"
+// @Success 200 {object} web.PendingApprovalsPage
+// @Failure 400 {object} web.ErrorResponse "Invalid filters, order, limit or cursor"
+// @Failure 404 {object} web.ErrorResponse "No pending approvals found"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /pendingapprovals [get]
+func (hdlr *SubscriptionServiceHandler) GetPendingApprovals(w http.ResponseWriter, r *http.Request){
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	query, err := parseQuery(r, persistence.PendingApproval{})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if approvals, nextPageToken, dbErr := hdlr.dbHandler.QueryPendingApprovals(ctx, query); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting pending approvals")
+	} else {
+		if approvals == nil {
+			writeError(w, http.StatusNotFound, "no pending approvals found")
+		} else {
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(&PendingApprovalsPage{approvals, nextPageToken})
+		}
+	}
+}
+
+//ApprovalDecision is the body of the approve and reject pending approval requests. Approver identifies who decided.
+type ApprovalDecision struct {
+	Approver string `json:"approver"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// @Summary Approve a pending approval
+// @Description Approves the held entitlement creation or plan change with the procurement API, records the approval on the entitlement and removes the pending approval
+// @ID cloud-bill-saas-subscription-service-approve-pending-approval
+// @Accept  json
+// @Produce  json
+// @Param entitlementId path string true "Entitlement ID"
+// @Param decision body web.ApprovalDecision true "Approver and optional reason"
+// @Success 200 {object} persistence.Entitlement
+// @Failure 400 {object} web.ErrorResponse "Missing entitlement ID or approver"
+// @Failure 404 {object} web.ErrorResponse "Pending approval or entitlement not found"
+// @Failure 409 {object} web.ErrorResponse "The marketplace refused the approval, e.g. the request was cancelled"
+// @Failure 412 {object} web.ErrorResponse "The entitlement kept changing while the approval was recorded"
+// @Failure 502 {object} web.ErrorResponse "Procurement API error"
+// @Failure 503 {object} web.ErrorResponse "Procurement API is not configured"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /pendingapprovals/{entitlementId}/approve [post]
+func (hdlr *SubscriptionServiceHandler) ApprovePendingApproval(w http.ResponseWriter, r *http.Request) {
+	hdlr.decidePendingApproval(w, r, persistence.ApprovalApproved)
+}
+
+// @Summary Reject a pending approval
+// @Description Rejects the held entitlement creation or plan change with the procurement API, records the rejection on the entitlement and removes the pending approval. The reason is shown to the customer.
+// @ID cloud-bill-saas-subscription-service-reject-pending-approval
+// @Accept  json
+// @Produce  json
+// @Param entitlementId path string true "Entitlement ID"
+// @Param decision body web.ApprovalDecision true "Approver and reason"
+// @Success 200 {object} persistence.Entitlement
+// @Failure 400 {object} web.ErrorResponse "Missing entitlement ID, approver or reason"
+// @Failure 404 {object} web.ErrorResponse "Pending approval or entitlement not found"
+// @Failure 409 {object} web.ErrorResponse "The marketplace refused the rejection, e.g. the request was cancelled"
+// @Failure 412 {object} web.ErrorResponse "The entitlement kept changing while the rejection was recorded"
+// @Failure 502 {object} web.ErrorResponse "Procurement API error"
+// @Failure 503 {object} web.ErrorResponse "Procurement API is not configured"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /pendingapprovals/{entitlementId}/reject [post]
+func (hdlr *SubscriptionServiceHandler) RejectPendingApproval(w http.ResponseWriter, r *http.Request) {
+	hdlr.decidePendingApproval(w, r, persistence.ApprovalRejected)
+}
+
+//decidePendingApproval approves or rejects a pending approval with the procurement API. Once the procurement API accepts
+//the decision the pending approval is deleted, and the stored entitlement is updated from the procurement API, when it
+//can be read, and the decision is appended to its approvals. The update is
+//made on the version read, so a sync by the pubsub service for the same decision is not overwritten.
+func (hdlr *SubscriptionServiceHandler) decidePendingApproval(w http.ResponseWriter, r *http.Request, state string) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	vars := mux.Vars(r)
+	entitlementId := vars["entitlementId"]
+
+	if entitlementId == "" {
+		writeError(w, http.StatusBadRequest, "missing entitlement ID in path")
+		return
+	}
+
+	if hdlr.procurementClient == nil {
+		writeError(w, http.StatusServiceUnavailable, "the procurement API is not configured, set the partner ID")
+		return
+	}
+
+	decision := ApprovalDecision{}
+	if err := json.NewDecoder(r.Body).Decode(&decision); nil != err {
+		writeError(w, http.StatusBadRequest, "Error occured while decoding approval decision: "+err.Error())
+		return
+	}
+	if decision.Approver == "" {
+		writeError(w, http.StatusBadRequest, "missing approver")
+		return
+	}
+	if state == persistence.ApprovalRejected && decision.Reason == "" {
+		writeError(w, http.StatusBadRequest, "missing reason, it is shown to the customer")
+		return
+	}
+	if r.Header.Get(SourceHeader) == "" {
+		ctx = persistence.WithSource(ctx, decision.Approver)
+	}
+
+	pending, dbErr := hdlr.dbHandler.GetPendingApproval(ctx, entitlementId)
+	if dbErr != nil {
+		writeDbError(w, dbErr, "Error occured while getting pending approval")
+		return
+	}
+
+	var err error
+	switch {
+	case pending.Request == persistence.ApprovalRequestPlanChange && state == persistence.ApprovalApproved:
+		err = hdlr.procurementClient.ApprovePlanChange(ctx, entitlementId, pending.PendingPlan)
+	case pending.Request == persistence.ApprovalRequestPlanChange:
+		err = hdlr.procurementClient.RejectPlanChange(ctx, entitlementId, pending.PendingPlan, decision.Reason)
+	case state == persistence.ApprovalApproved:
+		err = hdlr.procurementClient.ApproveEntitlement(ctx, entitlementId)
+	default:
+		err = hdlr.procurementClient.RejectEntitlement(ctx, entitlementId, decision.Reason)
+	}
+	if err != nil {
+		writeProcurementError(w, err, "Error occured while deciding pending approval")
+		return
+	}
+	LogI.Printf("Pending approval %s %s was %s by %s \n", entitlementId, pending.Request, state, decision.Approver)
+
+	//the decision is made, so the pending approval is deleted even if recording it on the entitlement fails below
+	if dbErr := hdlr.dbHandler.DeletePendingApproval(ctx, entitlementId); dbErr != nil {
+		LogE.Printf("Unable to delete pending approval %s after it was %s: %#v \n", entitlementId, state, dbErr)
+	}
+
+	//the procurement API is read once, the stored entitlement is read again on each attempt to update it
+	updated, err := hdlr.procurementClient.GetEntitlement(ctx, entitlementId)
+	if err != nil {
+		LogE.Printf("Unable to read entitlement %s after it was %s, the pubsub service will sync it: %#v \n", entitlementId, state, err)
+	}
+	approval := persistence.Approval{
+		Name:       pending.Request,
+		State:      state,
+		Reason:     decision.Reason,
+		UpdateTime: persistence.FormatTimestamp(time.Now()),
+		Approver:   decision.Approver,
+	}
+	entitlement, dbErr := updateEntitlement(ctx, hdlr.dbHandler, entitlementId, func(entitlement *persistence.Entitlement) {
+		if updated != nil {
+			entitlement.Name = updated.Name
+			entitlement.Account = path.Base(updated.Account)
+			entitlement.Provider = updated.Provider
+			entitlement.Product = updated.Product
+			entitlement.Plan = updated.Plan
+			entitlement.NewPendingPlan = updated.NewPendingPlan
+			entitlement.State = updated.State
+			entitlement.UpdateTime = updated.UpdateTime
+			entitlement.CreateTime = updated.CreateTime
+			entitlement.UsageReportingId = updated.UsageReportingId
+			entitlement.MessageToUser = updated.MessageToUser
+		}
+		entitlement.Approvals = append(entitlement.Approvals, approval)
+	})
+	if dbErr != nil {
+		writeDbError(w, dbErr, "Error occured while recording the decision on entitlement")
+		return
+	}
+
+	setETag(w, entitlement.Version)
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(entitlement)
+}
+
+// @Summary Record usage
+// @Description Records the usage of a metric by an entitlement over a time window. Records are aggregated and reported to Service Control with the usageReportingId of the entitlement. The ID is chosen by the caller, posting a record with the same ID and usage again returns the stored record and is not counted twice.
+// @ID cloud-bill-saas-subscription-service-record-usage
+// @Accept  json
+// @Produce  json
+// @Param usageRecord body persistence.UsageRecord true "Usage record, the report ID and create time are set by the service"
+// @Success 201 {object} persistence.UsageRecord "Recorded"
+// @Success 200 {object} persistence.UsageRecord "Already recorded"
+// @Failure 400 {object} web.ErrorResponse "Invalid request body, missing fields, invalid times or quantity, or an entitlement that cannot be billed for usage"
+// @Failure 404 {object} web.ErrorResponse "Entitlement not found"
+// @Failure 409 {object} web.ErrorResponse "A record with the same ID and different usage exists"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /usagerecords [post]
+func (hdlr *SubscriptionServiceHandler) RecordUsage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	record := persistence.UsageRecord{}
+	if err := json.NewDecoder(r.Body).Decode(&record); nil != err {
+		writeError(w, http.StatusBadRequest, "Error occured while decoding usage record: "+err.Error())
+		return
+	}
+	if record.Id == "" || record.EntitlementId == "" || record.Metric == "" {
+		writeError(w, http.StatusBadRequest, "missing usage record ID, entitlement ID or metric")
+		return
+	}
+	if record.Quantity < 0 {
+		writeError(w, http.StatusBadRequest, "quantity must not be negative")
+		return
+	}
+	startTime, startErr := time.Parse(time.RFC3339Nano, record.StartTime)
+	endTime, endErr := time.Parse(time.RFC3339Nano, record.EndTime)
+	if startErr != nil || endErr != nil || endTime.Before(startTime) {
+		writeError(w, http.StatusBadRequest, "startTime and endTime must be RFC 3339 timestamps and startTime must not be after endTime")
+		return
+	}
+	record.StartTime = persistence.FormatTimestamp(startTime)
+	record.EndTime = persistence.FormatTimestamp(endTime)
+	record.ReportId = ""
+	record.CreateTime = persistence.FormatTimestamp(time.Now())
+
+	entitlement, dbErr := hdlr.dbHandler.GetEntitlement(ctx, record.EntitlementId)
+	if dbErr != nil {
+		writeDbError(w, dbErr, "Error occured while getting entitlement")
+		return
+	}
+	if entitlement.UsageReportingId == "" {
+		writeError(w, http.StatusBadRequest, "entitlement "+record.EntitlementId+" has no usageReportingId")
+		return
+	}
+
+	if dbErr := hdlr.dbHandler.CreateUsageRecord(ctx, &record); dbErr == persistence.ErrConflict {
+		//the record was posted before, it is only a duplicate if the usage is the same
+		current, dbErr := hdlr.dbHandler.GetUsageRecord(ctx, record.Id)
+		if dbErr != nil {
+			writeDbError(w, dbErr, "Error occured while getting usage record")
+		} else if !persistence.SameUsage(current, &record) {
+			writeError(w, http.StatusConflict, "usage record "+record.Id+" was already recorded with different usage")
+		} else {
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(current)
+		}
+	} else if dbErr != nil {
+		writeDbError(w, dbErr, "Error occured while persisting usage record")
+	} else {
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(&record)
+	}
+}
+
+// @Summary Get a usage record
+// @Description Retrieves a usage record by ID
+// @ID cloud-bill-saas-subscription-service-get-usage-record
+// @Accept  json
+// @Produce  json
+// @Param usageRecordId path string true "Usage record ID"
+// @Success 200 {object} persistence.UsageRecord
+// @Failure 400 {object} web.ErrorResponse "Missing usage record ID in path"
+// @Failure 404 {object} web.ErrorResponse "Usage record not found"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /usagerecords/{usageRecordId} [get]
+func (hdlr *SubscriptionServiceHandler) GetUsageRecord(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	vars := mux.Vars(r)
+	usageRecordId := vars["usageRecordId"]
+
+	if usageRecordId == "" {
+		writeError(w, http.StatusBadRequest, "missing usage record ID in path")
+		return
+	}
+
+	if record, dbErr := hdlr.dbHandler.GetUsageRecord(ctx, usageRecordId); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting usage record")
+	} else {
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(&record)
+	}
+}
+
+// @Summary GetUsageRecords
+// @Description Gets an array of usage records. Records that are not reported yet have an empty report ID.
+// @ID cloud-bill-saas-subscription-service-get-usage-records
+// @Accept  json
+// @Produce  json
+// @Param filters query string false "optional filter expression, e.g. entitlementId = 1234 AND startTime >= 2019-10-01"
+// @Param order query string false "optional order, e.g. -startTime"
+// @Param limit query int false "optional page size, default 100 and at most 1000"
+// @Param cursor query string false "optional nextPageToken from the previous page"
+// @Success 200 {object} web.UsageRecordsPage
+// @Failure 400 {object} web.ErrorResponse "Invalid filters, order, limit or cursor"
+// @Failure 404 {object} web.ErrorResponse "No usage records found"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /usagerecords [get]
+func (hdlr *SubscriptionServiceHandler) GetUsageRecords(w http.ResponseWriter, r *http.Request){
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	query, err := parseQuery(r, persistence.UsageRecord{})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if records, nextPageToken, dbErr := hdlr.dbHandler.QueryUsageRecords(ctx, query); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting usage records")
+	} else {
+		if records == nil {
+			writeError(w, http.StatusNotFound, "no usage records found")
+		} else {
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(&UsageRecordsPage{records, nextPageToken})
+		}
+	}
+}
+
+// @Summary Get a usage report
+// @Description Retrieves a usage report by ID, which is also its Service Control operation ID
+// @ID cloud-bill-saas-subscription-service-get-usage-report
+// @Accept  json
+// @Produce  json
+// @Param usageReportId path string true "Usage report ID"
+// @Success 200 {object} persistence.UsageReport
+// @Failure 400 {object} web.ErrorResponse "Missing usage report ID in path"
+// @Failure 404 {object} web.ErrorResponse "Usage report not found"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /usagereports/{usageReportId} [get]
+func (hdlr *SubscriptionServiceHandler) GetUsageReport(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	vars := mux.Vars(r)
+	usageReportId := vars["usageReportId"]
+
+	if usageReportId == "" {
+		writeError(w, http.StatusBadRequest, "missing usage report ID in path")
+		return
+	}
+
+	if report, dbErr := hdlr.dbHandler.GetUsageReport(ctx, usageReportId); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting usage report")
+	} else {
+		w.WriteHeader(200)
+		json.NewEncoder(w).Encode(&report)
+	}
+}
+
+// @Summary GetUsageReports
+// @Description Gets an array of usage reports
+// @ID cloud-bill-saas-subscription-service-get-usage-reports
+// @Accept  json
+// @Produce  json
+// @Param filters query string false "optional filter expression, e.g. state = FAILED AND entitlementId = 1234"
+// @Param order query string false "optional order, e.g. -createTime"
+// @Param limit query int false "optional page size, default 100 and at most 1000"
+// @Param cursor query string false "optional nextPageToken from the previous page"
+// @Success 200 {object} web.UsageReportsPage
+// @Failure 400 {object} web.ErrorResponse "Invalid filters, order, limit or cursor"
+// @Failure 404 {object} web.ErrorResponse "No usage reports found"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /usagereports [get]
+func (hdlr *SubscriptionServiceHandler) GetUsageReports(w http.ResponseWriter, r *http.Request){
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	query, err := parseQuery(r, persistence.UsageReport{})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if reports, nextPageToken, dbErr := hdlr.dbHandler.QueryUsageReports(ctx, query); nil != dbErr {
+		writeDbError(w, dbErr, "Error occured while getting usage reports")
+	} else {
+		if reports == nil {
+			writeError(w, http.StatusNotFound, "no usage reports found")
+		} else {
+			w.WriteHeader(200)
+			json.NewEncoder(w).Encode(&UsageReportsPage{reports, nextPageToken})
+		}
+	}
+}
+
+// @Summary Retry a usage report
+// @Description Sends a usage report that Service Control rejected again on the next reporting run, e.g. after the cause was fixed. It is sent with the same operation ID.
+// @ID cloud-bill-saas-subscription-service-retry-usage-report
+// @Accept  json
+// @Produce  json
+// @Param usageReportId path string true "Usage report ID"
+// @Success 204 {string} string "Pending"
+// @Failure 400 {object} web.ErrorResponse "Missing usage report ID in path"
+// @Failure 404 {object} web.ErrorResponse "Usage report not found"
+// @Failure 409 {object} web.ErrorResponse "The usage report did not fail"
+// @Failure 500 {object} web.ErrorResponse "Error"
+// @Router /usagereports/{usageReportId}/retry [post]
+func (hdlr *SubscriptionServiceHandler) RetryUsageReport(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	vars := mux.Vars(r)
+	usageReportId := vars["usageReportId"]
+
+	if usageReportId == "" {
+		writeError(w, http.StatusBadRequest, "missing usage report ID in path")
+		return
+	}
+
+	report, dbErr := hdlr.dbHandler.GetUsageReport(ctx, usageReportId)
+	if dbErr != nil {
+		writeDbError(w, dbErr, "Error occured while getting usage report")
+		return
+	}
+	if report.State != persistence.UsageReportFailed {
+		writeError(w, http.StatusConflict, "usage report "+usageReportId+" is "+report.State+", only FAILED reports can be retried")
+		return
+	}
+	report.State = persistence.UsageReportPending
+	if dbErr := hdlr.dbHandler.UpsertUsageReport(ctx, report); dbErr != nil {
+		writeDbError(w, dbErr, "Error occured while persisting usage report")
+		return
+	}
+	LogI.Printf("Usage report %s of entitlement %s will be sent again \n", report.Id, report.EntitlementId)
+	w.WriteHeader(204)
+}
+
 // @Summary Check the health of the subscription service
 // @Description Check the health of the subscription service
 // @ID cloud-bill-saas-subscription-service-healthz
 // @Accept  json
 // @Produce  json
 // @Success 200 {string} string "Ok"
-// @Failure 500 {string} string "Error"
+// @Failure 500 {object} web.ErrorResponse "Error"
 // @Router /healthz [get]
 func (hdlr *SubscriptionServiceHandler) Healthz(w http.ResponseWriter, r *http.Request) {
-	if dbErr := hdlr.dbHandler.Healthz(); nil != dbErr {
-		LogE.Printf("Healthz failed. Datastore check failed: %#v \n", dbErr)
-		http.Error(w,dbErr.Error(),http.StatusInternalServerError)
+	ctx, cancel := hdlr.requestContext(r)
+	defer cancel()
+
+	if dbErr := hdlr.dbHandler.Healthz(ctx); nil != dbErr {
+		LogE.Printf("Healthz failed. Database check failed: %#v \n", dbErr)
+		writeError(w, http.StatusInternalServerError, dbErr.Error())
 	} else {
 		w.WriteHeader(200)
 	}
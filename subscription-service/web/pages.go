@@ -0,0 +1,111 @@
+package web
+
+import (
+	"fmt"
+	"github.com/cloudbees/cloud-bill-saas/subscription-service/persistence"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+//AccountsPage is one page of accounts. NextPageToken is passed as the cursor to get the next page and is empty on the
+//last page.
+type AccountsPage struct {
+	Accounts      []persistence.Account `json:"accounts"`
+	NextPageToken string                `json:"nextPageToken,omitempty"`
+}
+
+//ContactsPage is one page of contacts.
+type ContactsPage struct {
+	Contacts      []persistence.Contact `json:"contacts"`
+	NextPageToken string                `json:"nextPageToken,omitempty"`
+}
+
+//EntitlementsPage is one page of entitlements.
+type EntitlementsPage struct {
+	Entitlements  []persistence.Entitlement `json:"entitlements"`
+	NextPageToken string                    `json:"nextPageToken,omitempty"`
+}
+
+//HistoryPage is one page of history entries.
+type HistoryPage struct {
+	History       []persistence.HistoryEntry `json:"history"`
+	NextPageToken string                     `json:"nextPageToken,omitempty"`
+}
+
+//EventsPage is one page of marketplace events.
+type EventsPage struct {
+	Events        []persistence.Event `json:"events"`
+	NextPageToken string              `json:"nextPageToken,omitempty"`
+}
+
+//DeadLettersPage is one page of dead letters.
+type DeadLettersPage struct {
+	DeadLetters   []persistence.DeadLetter `json:"deadLetters"`
+	NextPageToken string                   `json:"nextPageToken,omitempty"`
+}
+
+//PendingApprovalsPage is one page of requests held for manual approval.
+type PendingApprovalsPage struct {
+	PendingApprovals []persistence.PendingApproval `json:"pendingApprovals"`
+	NextPageToken    string                        `json:"nextPageToken,omitempty"`
+}
+
+//UsageRecordsPage is one page of usage records.
+type UsageRecordsPage struct {
+	UsageRecords  []persistence.UsageRecord `json:"usageRecords"`
+	NextPageToken string                    `json:"nextPageToken,omitempty"`
+}
+
+//UsageReportsPage is one page of usage reports.
+type UsageReportsPage struct {
+	UsageReports  []persistence.UsageReport `json:"usageReports"`
+	NextPageToken string                    `json:"nextPageToken,omitempty"`
+}
+
+//parseQuery reads and validates the filters, order, limit, cursor and includeDeleted query parameters for a list of
+//entity. The limit defaults to defaultPageSize and cannot exceed maxPageSize so a list request never scans a whole kind.
+func parseQuery(r *http.Request, entity interface{}) (persistence.Query, error) {
+	params := r.URL.Query()
+	query := persistence.Query{
+		Order:  params.Get("order"),
+		Limit:  defaultPageSize,
+		Cursor: params.Get("cursor"),
+	}
+	filters, err := persistence.ParseFilters(params.Get("filters"), entity)
+	if err != nil {
+		return query, err
+	}
+	query.Filters = filters
+	if query.IncludeDeleted, err = includeDeleted(r); err != nil {
+		return query, err
+	}
+	if err := persistence.CheckOrder(query.Order, entity); err != nil {
+		return query, err
+	}
+	if limit := params.Get("limit"); limit != "" {
+		if l, err := strconv.Atoi(limit); err != nil || l < 1 || l > maxPageSize {
+			return query, fmt.Errorf("limit must be a number from 1 to %d", maxPageSize)
+		} else {
+			query.Limit = l
+		}
+	}
+	return query, nil
+}
+
+//includeDeleted reads the includeDeleted query parameter, soft deleted accounts and entitlements are hidden without it.
+func includeDeleted(r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("includeDeleted")
+	if value == "" {
+		return false, nil
+	}
+	include, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("includeDeleted must be true or false")
+	}
+	return include, nil
+}
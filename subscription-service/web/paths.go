@@ -1,19 +1,24 @@
 package web
 
 import (
+	"context"
+	"github.com/cloudbees/cloud-bill-saas/common/procurement"
 	_ "github.com/cloudbees/cloud-bill-saas/subscription-service/docs"
 	"github.com/cloudbees/cloud-bill-saas/subscription-service/persistence"
 	"github.com/gorilla/mux"
 	"github.com/swaggo/http-swagger"
 	"net/http"
+	"time"
 )
 
-//SetUpService sets up the subscription service.
-func SetUpService(dbHandler persistence.DatabaseHandler,webServiceEndpoint string, healthCheckEndpoint string) error {
-	handler := GetSubscriptionServiceHandler(dbHandler)
+//SetUpService sets up the subscription service and serves it until ctx is done. Requests in flight then have up to
+//shutdownTimeout to finish. Pending approvals cannot be approved or rejected if procurementClient is nil.
+func SetUpService(ctx context.Context, dbHandler persistence.DatabaseHandler,procurementClient procurement.Client,webServiceEndpoint string, healthCheckEndpoint string, requestTimeout time.Duration, shutdownTimeout time.Duration) error {
+	handler := GetSubscriptionServiceHandler(dbHandler,procurementClient,requestTimeout)
 	healthCheck := mux.NewRouter()
 	healthCheck.Methods(http.MethodGet).Path("/healthz").HandlerFunc(handler.Healthz)
-	go http.ListenAndServe(":"+healthCheckEndpoint, healthCheck)
+	healthCheckServer := &http.Server{Addr: ":"+healthCheckEndpoint, Handler: healthCheck}
+	go healthCheckServer.ListenAndServe()
 
 	webService := mux.NewRouter()
 	apiV1 := webService.PathPrefix("/api/v1").Subrouter()
@@ -24,6 +29,7 @@ func SetUpService(dbHandler persistence.DatabaseHandler,webServiceEndpoint strin
 	apiV1.Methods(http.MethodPut).Path("/accounts").HandlerFunc(handler.UpsertAccount)
 	apiV1.Methods(http.MethodDelete).Path("/accounts/{accountId}").HandlerFunc(handler.DeleteAccount)
 	apiV1.Methods(http.MethodGet).Path("/accounts").HandlerFunc(handler.GetAccounts)
+	apiV1.Methods(http.MethodGet).Path("/accounts/{accountId}/history").HandlerFunc(handler.GetAccountHistory)
 
 	//contacts
 	apiV1.Methods(http.MethodPost).Path("/contacts").HandlerFunc(handler.UpsertContact)
@@ -39,6 +45,43 @@ func SetUpService(dbHandler persistence.DatabaseHandler,webServiceEndpoint strin
 	apiV1.Methods(http.MethodDelete).Path("/entitlements/{entitlementId}").HandlerFunc(handler.DeleteEntitlement)
 	apiV1.Methods(http.MethodGet).Path("/entitlements").HandlerFunc(handler.GetEntitlements)
 	apiV1.Methods(http.MethodGet).Path("/accounts/{accountId}/entitlements").HandlerFunc(handler.GetAccountEntitlements)
+	apiV1.Methods(http.MethodGet).Path("/entitlements/{entitlementId}/history").HandlerFunc(handler.GetEntitlementHistory)
+	apiV1.Methods(http.MethodPost).Path("/entitlements/{entitlementId}/approvals").HandlerFunc(handler.AddEntitlementApproval)
+
+	//marketplace events
+	apiV1.Methods(http.MethodPost).Path("/events").HandlerFunc(handler.UpsertEvent)
+	apiV1.Methods(http.MethodGet).Path("/events/{eventId}").HandlerFunc(handler.GetEvent)
+	apiV1.Methods(http.MethodPut).Path("/events").HandlerFunc(handler.UpsertEvent)
+	apiV1.Methods(http.MethodGet).Path("/events").HandlerFunc(handler.GetEvents)
+
+	//dead letters
+	apiV1.Methods(http.MethodGet).Path("/deadletters/{deadLetterId}").HandlerFunc(handler.GetDeadLetter)
+	apiV1.Methods(http.MethodPut).Path("/deadletters").HandlerFunc(handler.UpsertDeadLetter)
+	apiV1.Methods(http.MethodDelete).Path("/deadletters/{deadLetterId}").HandlerFunc(handler.DeleteDeadLetter)
+	apiV1.Methods(http.MethodGet).Path("/deadletters").HandlerFunc(handler.GetDeadLetters)
+
+	//requests held for manual approval
+	apiV1.Methods(http.MethodGet).Path("/pendingapprovals/{entitlementId}").HandlerFunc(handler.GetPendingApproval)
+	apiV1.Methods(http.MethodPut).Path("/pendingapprovals").HandlerFunc(handler.UpsertPendingApproval)
+	apiV1.Methods(http.MethodDelete).Path("/pendingapprovals/{entitlementId}").HandlerFunc(handler.DeletePendingApproval)
+	apiV1.Methods(http.MethodGet).Path("/pendingapprovals").HandlerFunc(handler.GetPendingApprovals)
+	apiV1.Methods(http.MethodPost).Path("/pendingapprovals/{entitlementId}/approve").HandlerFunc(handler.ApprovePendingApproval)
+	apiV1.Methods(http.MethodPost).Path("/pendingapprovals/{entitlementId}/reject").HandlerFunc(handler.RejectPendingApproval)
+
+	//entitlements whose last approval attempt failed
+	apiV1.Methods(http.MethodGet).Path("/failedapprovals").HandlerFunc(handler.GetFailedApprovals)
+
+	//usage metering
+	apiV1.Methods(http.MethodPost).Path("/usagerecords").HandlerFunc(handler.RecordUsage)
+	apiV1.Methods(http.MethodGet).Path("/usagerecords/{usageRecordId}").HandlerFunc(handler.GetUsageRecord)
+	apiV1.Methods(http.MethodGet).Path("/usagerecords").HandlerFunc(handler.GetUsageRecords)
+	apiV1.Methods(http.MethodGet).Path("/usagereports/{usageReportId}").HandlerFunc(handler.GetUsageReport)
+	apiV1.Methods(http.MethodGet).Path("/usagereports").HandlerFunc(handler.GetUsageReports)
+	apiV1.Methods(http.MethodPost).Path("/usagereports/{usageReportId}/retry").HandlerFunc(handler.RetryUsageReport)
+
+	//admin
+	apiV1.Methods(http.MethodPost).Path("/admin/accounts/{accountId}/restore").HandlerFunc(handler.RestoreAccount)
+	apiV1.Methods(http.MethodPost).Path("/admin/entitlements/{entitlementId}/restore").HandlerFunc(handler.RestoreEntitlement)
 
 	apiV1.Methods(http.MethodGet).Path("/healthz").HandlerFunc(handler.Healthz)
 
@@ -47,5 +90,31 @@ func SetUpService(dbHandler persistence.DatabaseHandler,webServiceEndpoint strin
 		httpSwagger.URL("http://localhost:"+webServiceEndpoint+"/swagger/doc.json"), //The url pointing to API definition"
 	))
 
-	return http.ListenAndServe(":"+webServiceEndpoint, webService)
+	webServiceServer := &http.Server{Addr: ":"+webServiceEndpoint, Handler: webService}
+	return serve(ctx, shutdownTimeout, webServiceServer, healthCheckServer)
+}
+
+//serve runs server until ctx is done, then shuts it down and the other servers after it, waiting up to shutdownTimeout
+//for their requests in flight. The health check keeps answering until the service has drained.
+func serve(ctx context.Context, shutdownTimeout time.Duration, server *http.Server, others ...*http.Server) error {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	LogI.Printf("Shutting down, waiting up to %s for requests in flight \n", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	for _, other := range others {
+		if otherErr := other.Shutdown(shutdownCtx); err == nil {
+			err = otherErr
+		}
+	}
+	return err
 }
\ No newline at end of file